@@ -2,28 +2,88 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"xraytool/internal/auth"
 	"xraytool/internal/config"
 	"xraytool/internal/db"
+	"xraytool/internal/service"
 	"xraytool/internal/store"
 )
 
 func main() {
-	mode := flag.String("mode", "reset-admin", "operation mode")
+	mode := flag.String("mode", "reset-admin", "operation mode: reset-admin or mock-payment")
 	username := flag.String("username", "", "admin username")
 	password := flag.String("password", "", "admin password")
+	webhookURL := flag.String("url", "http://127.0.0.1:18080/api/webhooks/payment", "mock-payment: webhook url")
+	secret := flag.String("secret", "", "mock-payment: webhook secret")
+	paymentID := flag.String("payment-id", "", "mock-payment: payment id, generated when empty")
+	orderNo := flag.String("order-no", "", "mock-payment: order number")
+	customerCode := flag.String("customer-code", "", "mock-payment: customer code")
+	amount := flag.Float64("amount", 0, "mock-payment: paid amount")
+	days := flag.Int("days", 30, "mock-payment: days to renew")
 	flag.Parse()
 
-	if *mode != "reset-admin" {
-		fmt.Println("supported mode: reset-admin")
+	switch *mode {
+	case "reset-admin":
+		resetAdmin(*username, *password)
+	case "mock-payment":
+		sendMockPayment(*webhookURL, *secret, service.PaymentWebhookEvent{
+			PaymentID:    *paymentID,
+			OrderNo:      *orderNo,
+			CustomerCode: *customerCode,
+			Amount:       *amount,
+			Days:         *days,
+			Note:         "xtoolctl mock payment",
+		})
+	default:
+		fmt.Println("supported mode: reset-admin, mock-payment")
 		os.Exit(1)
 	}
+}
+
+func sendMockPayment(webhookURL, secret string, event service.PaymentWebhookEvent) {
+	if strings.TrimSpace(secret) == "" {
+		fmt.Println("secret is required")
+		os.Exit(1)
+	}
+	if strings.TrimSpace(event.PaymentID) == "" {
+		event.PaymentID = fmt.Sprintf("mock-%d", time.Now().UnixNano())
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		fmt.Println("encode payment failed:", err)
+		os.Exit(1)
+	}
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		fmt.Println("build request failed:", err)
+		os.Exit(1)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(service.PaymentSignatureHeader, service.SignPaymentWebhook(secret, body))
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		fmt.Println("send payment failed:", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(resp.Body)
+	fmt.Printf("payment %s -> %s\n%s\n", event.PaymentID, resp.Status, strings.TrimSpace(string(out)))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		os.Exit(1)
+	}
+}
 
+func resetAdmin(username, password string) {
 	cfg := config.Load()
 	if err := config.EnsurePaths(cfg); err != nil {
 		fmt.Println("ensure path failed:", err)
@@ -37,8 +97,8 @@ func main() {
 	st := store.New(database)
 
 	reader := bufio.NewReader(os.Stdin)
-	name := strings.TrimSpace(*username)
-	pass := strings.TrimSpace(*password)
+	name := strings.TrimSpace(username)
+	pass := strings.TrimSpace(password)
 
 	if name == "" {
 		fmt.Print("Admin username: ")
@@ -3,8 +3,17 @@ export interface Customer {
   name: string
   code: string
   contact: string
+  email: string
+  telegram_chat_id: string
   notes: string
+  tags: string
   status: string
+  balance: number
+  auto_renew: boolean
+  trial_limit: number
+  grace_hours?: number | null
+  trials_used: number
+  version: number
 }
 
 export interface HostIP {
@@ -13,6 +22,9 @@ export interface HostIP {
   is_public: boolean
   is_local: boolean
   enabled: boolean
+  tier: 'shared' | 'exclusive'
+  max_customers: number
+  max_items: number
 }
 
 export interface OrderItem {
@@ -99,6 +111,303 @@ export interface DedicatedIngress {
   notes: string
 }
 
+export interface Product {
+  id: number
+  name: string
+  sku: string
+  mode: string
+  quantity: number
+  duration_day: number
+  dedicated_protocol?: string
+  dedicated_inbound_id?: number
+  dedicated_ingress_id?: number
+  price: number
+  country_codes: string
+  grace_hours?: number | null
+  enabled: boolean
+  notes: string
+  created_at: string
+  updated_at: string
+}
+
+export interface LedgerEntry {
+  id: number
+  customer_id: number
+  order_id?: number
+  type: 'charge' | 'payment' | 'adjustment'
+  amount: number
+  balance: number
+  unit_price: number
+  days: number
+  period_start?: string
+  period_end?: string
+  source: string
+  reference: string
+  note: string
+  created_at: string
+}
+
+export interface PaymentEvent {
+  id: number
+  payment_id: string
+  order_no: string
+  customer_code: string
+  customer_id?: number
+  order_id?: number
+  child_order_ids: string
+  amount: number
+  days: number
+  status: 'processing' | 'applied' | 'credited' | 'failed'
+  error: string
+  ledger_entry_id?: number
+  payload: string
+  created_at: string
+  updated_at: string
+}
+
+export interface ScheduledAction {
+  id: number
+  order_id: number
+  action: 'activate' | 'deactivate' | 'renew' | 'switch_protocol' | 'rotate_credentials' | 'delete'
+  params: string
+  run_at: string
+  next_run_at: string
+  status: 'pending' | 'running' | 'done' | 'failed' | 'cancelled'
+  attempts: number
+  max_attempts: number
+  last_error: string
+  note: string
+  finished_at?: string
+  created_at: string
+  updated_at: string
+}
+
+export interface OrderTransfer {
+  id: number
+  order_id: number
+  order_no: string
+  order_count: number
+  from_customer_id: number
+  to_customer_id: number
+  operator: string
+  note: string
+  created_at: string
+}
+
+export interface OrderItemIPHistory {
+  id: number
+  order_item_id: number
+  order_id: number
+  customer_id: number
+  old_host_ip_id?: number
+  old_ip: string
+  new_host_ip_id?: number
+  new_ip: string
+  reason: string
+  operator: string
+  created_at: string
+}
+
+export interface DedicatedEgress {
+  id: number
+  order_id: number
+  order_item_id: number
+  address: string
+  port: number
+  username: string
+  password: string
+  exit_ip?: string
+  country_code?: string
+  region?: string
+  probe_status?: string
+  probe_error?: string
+  last_probed_at?: string
+  created_at: string
+  updated_at: string
+}
+
+export interface OrderVersion {
+  id: number
+  order_id: number
+  version: number
+  source: string
+  order_count: number
+  item_count: number
+  created_at: string
+}
+
+export interface OrderVersionDetail extends OrderVersion {
+  orders: Order[]
+  items: OrderItem[]
+  egresses: DedicatedEgress[]
+}
+
+export interface OrderVersionDiff {
+  order_id: number
+  from: number
+  to: number
+  changes: {
+    kind: 'order' | 'item' | 'egress'
+    id: number
+    order_id: number
+    action: 'added' | 'removed' | 'changed'
+    fields?: { field: string; from: unknown; to: unknown }[]
+  }[]
+}
+
+export type IntegritySeverity = 'info' | 'warning' | 'error'
+
+export interface IntegrityCheckInfo {
+  name: string
+  severity: IntegritySeverity
+  description: string
+  repairable: boolean
+}
+
+export interface IntegrityFinding {
+  check: string
+  severity: IntegritySeverity
+  entity: 'order' | 'order_item' | 'xray_resource'
+  entity_id: number
+  order_id?: number
+  message: string
+  repairable: boolean
+}
+
+export interface IntegrityReport {
+  run_id: number
+  trigger: 'manual' | 'scheduled'
+  repair: boolean
+  started_at: string
+  errors: number
+  warnings: number
+  infos: number
+  repaired: number
+  checks: {
+    name: string
+    severity: IntegritySeverity
+    findings: IntegrityFinding[]
+    repairs?: { id: number; success: boolean; error?: string }[]
+    error?: string
+  }[]
+}
+
+export interface IntegrityRun {
+  id: number
+  trigger: 'manual' | 'scheduled'
+  repair: boolean
+  errors: number
+  warnings: number
+  infos: number
+  repaired: number
+  created_at: string
+}
+
+export interface HostIPLineageEntry {
+  customer_id: number
+  customer_name: string
+  customer_code: string
+  order_id: number
+  order_no: string
+  order_item_id: number
+  assigned_at: string
+  released_at?: string
+  release_reason: '' | 'expired' | 'rotated' | 'deleted' | 'disabled'
+}
+
+export interface HostIPLineage {
+  host_ip_id: number
+  ip: string
+  enabled: boolean
+  active_items: number
+  last_released_at?: string
+  cooldown_until?: string
+  entries: HostIPLineageEntry[]
+}
+
+export interface ReservationItem {
+  id: number
+  reservation_id: number
+  host_ip_id?: number
+  socks_outbound_id?: number
+  label: string
+}
+
+export interface Reservation {
+  id: number
+  customer_id: number
+  status: 'active' | 'converted' | 'released' | 'expired'
+  expires_at: string
+  order_id?: number
+  operator: string
+  note: string
+  released_at?: string
+  created_at: string
+  updated_at: string
+  customer?: Customer
+  items: ReservationItem[]
+}
+
+export interface RecycleBinEntry {
+  id: number
+  kind: 'order' | 'customer'
+  entity_id: number
+  customer_id: number
+  label: string
+  order_count: number
+  item_count: number
+  deleted_at: string
+}
+
+export interface SavedFilter {
+  id: number
+  owner: string
+  name: string
+  keyword: string
+  mode: string
+  status: string
+  customer_id: number
+  tags: string
+  expires_from?: string
+  expires_to?: string
+  created_at: string
+  updated_at: string
+}
+
+export interface ReminderLog {
+  id: number
+  order_id: number
+  offset: string
+  expires_at: string
+  channel: 'email' | 'telegram' | 'bark'
+  customer_id: number
+  target: string
+  status: 'sent' | 'failed'
+  attempts: number
+  last_error: string
+  created_at: string
+  updated_at: string
+}
+
+export interface InvoiceLine extends LedgerEntry {
+  order_no: string
+  order_name: string
+}
+
+export interface Invoice {
+  number: string
+  customer: Customer
+  from: string
+  to: string
+  opening_balance: number
+  charges: number
+  payments: number
+  adjustments: number
+  closing_balance: number
+  lines: InvoiceLine[]
+  generated_at: string
+}
+
 export interface Order {
   id: number
   order_no?: string
@@ -111,6 +420,9 @@ export interface Order {
   dedicated_inbound_id?: number
   dedicated_ingress_id?: number
   dedicated_protocol?: string
+  product_id?: number
+  ip_tier?: '' | 'shared' | 'exclusive'
+  product?: Product
   dedicated_entry?: DedicatedEntry
   dedicated_inbound?: DedicatedInbound
   dedicated_ingress?: DedicatedIngress
@@ -122,6 +434,13 @@ export interface Order {
   port: number
   starts_at: string
   expires_at: string
+  price: number
+  is_trial: boolean
+  trial_cap_bytes: number
+  expiry_stage?: '' | 'grace' | 'final'
+  tags: string
+  notes: string
+  version: number
   items: OrderItem[]
 }
 
@@ -162,10 +481,26 @@ export interface OversellRow {
   is_local: boolean
 }
 
+export interface HostIPCapacity {
+  host_ip_id: number
+  ip: string
+  tier: 'shared' | 'exclusive'
+  customers: number
+  max_customers: number
+  items: number
+  max_items: number
+  full: boolean
+  reason?: string
+}
+
 export interface AllocationPreview {
   pool_size: number
   used_by_customer: number
+  cooling_down: number
+  reserved: number
+  at_capacity: number
   available: number
+  full_ips: HostIPCapacity[]
 }
 
 export interface CustomerRuntimeStat {
@@ -265,6 +600,42 @@ export interface ImportPreviewRow {
   error?: string
 }
 
+export interface BulkOrderRow {
+  row: number
+  customer: string
+  customer_name?: string
+  input: {
+    customer_id: number
+    name: string
+    mode: string
+    quantity: number
+    duration_day: number
+    expires_at: string
+    port: number
+    ip_tier: string
+    price: number
+    product_id: number
+    dedicated_protocol: string
+    dedicated_inbound_id: number
+    dedicated_ingress_id: number
+  }
+  egress_pool_id?: number
+  available?: number
+  warnings?: string[]
+  error?: string
+  order_id?: number
+  order_no?: string
+}
+
+export interface BulkOrderResult {
+  dry_run: boolean
+  total: number
+  valid: number
+  created: number
+  failed: number
+  rows: BulkOrderRow[]
+}
+
 export interface SingboxScanFile {
   path: string
   entry_count: number
@@ -326,20 +697,199 @@ export interface SocksMigrationPreviewResult {
   reachable_node_size: number
 }
 
+export type ForwardOutboundType = 'socks5' | 'http' | 'shadowsocks' | 'vmess'
+
 export interface ForwardOutbound {
   id: number
   name: string
+  type: ForwardOutboundType
   address: string
   port: number
   username: string
   password: string
+  method: string
+  uuid: string
+  security: string
+  network: string
+  path: string
+  host: string
+  tls: boolean
+  sni: string
   route_user: string
   exit_ip: string
   country_code: string
+  asn: number
+  as_org: string
   enabled: boolean
   probe_status: string
   probe_error: string
+  latency_ms: number
+  fail_streak: number
   last_probed_at?: string
+  bench_connect_ms: number
+  bench_ttfb_ms: number
+  bench_throughput_kbps: number
+  benched_at?: string
+  max_items: number
+  max_customers: number
+  supplier: string
+  cost: number
+  cost_period_days: number
+  supplier_expires_at?: string
+}
+
+export interface ForwardMarginOrder {
+  order_id: number
+  order_no: string
+  customer_id: number
+  customer_name: string
+  items: number
+  order_items: number
+  price: number
+  revenue: number
+  expires_at: string
+}
+
+export interface ForwardMarginRow {
+  outbound_id: number
+  name: string
+  address: string
+  port: number
+  supplier: string
+  cost: number
+  cost_period_days: number
+  monthly_cost: number
+  monthly_revenue: number
+  monthly_margin: number
+  max_items: number
+  max_customers: number
+  active_items: number
+  active_customers: number
+  supplier_expires_at?: string
+  supplier_expired: boolean
+  supplier_expiring: boolean
+  orders: ForwardMarginOrder[]
+}
+
+export interface ForwardMarginReport {
+  generated_at: string
+  period_days: number
+  total_monthly_cost: number
+  total_monthly_revenue: number
+  total_monthly_margin: number
+  rows: ForwardMarginRow[]
+}
+
+export type UpstreamBenchmarkTarget = 'socks_outbound' | 'dedicated_egress'
+
+export interface UpstreamBenchmark {
+  id: number
+  target_type: UpstreamBenchmarkTarget
+  target_id: number
+  status: string
+  target_url: string
+  connect_ms: number
+  ttfb_ms: number
+  bytes: number
+  throughput_kbps: number
+  error: string
+  created_at: string
+}
+
+export interface ForwardOutboundProbe {
+  id: number
+  socks_outbound_id: number
+  status: string
+  latency_ms: number
+  exit_ip: string
+  country_code: string
+  region: string
+  asn: number
+  as_org: string
+  error: string
+  created_at: string
+}
+
+export interface ForwardRehomeResult {
+  order_id: number
+  order_item_id: number
+  username: string
+  from_outbound_id: number
+  to_outbound_id?: number
+  warnings?: string[]
+  error?: string
+}
+
+export interface GeoIPDatabaseStatus {
+  kind: 'country' | 'asn'
+  path: string
+  loaded: boolean
+  database_type?: string
+  build_at?: string
+  error?: string
+}
+
+export interface GeoIPStatus {
+  online_fallback: boolean
+  databases: GeoIPDatabaseStatus[]
+}
+
+export interface IPGeoInfo {
+  ip: string
+  country_code: string
+  country_name: string
+  region: string
+  asn: number
+  as_org: string
+  source: 'local' | 'online'
+}
+
+export type EgressPoolStrategy = 'primary' | 'random' | 'leastPing'
+
+export interface EgressPoolMember {
+  id: number
+  pool_id: number
+  socks_outbound_id: number
+  priority: number
+  socks_outbound?: ForwardOutbound
+}
+
+export interface EgressPool {
+  id: number
+  name: string
+  strategy: EgressPoolStrategy
+  enabled: boolean
+  notes: string
+  members?: EgressPoolMember[]
+}
+
+export interface EgressPoolMemberStatus {
+  socks_outbound_id: number
+  name: string
+  type: ForwardOutboundType
+  address: string
+  port: number
+  country_code: string
+  priority: number
+  tag: string
+  alive: boolean
+  delay_ms: number
+  last_error?: string
+  probe_status: string
+  active: boolean
+}
+
+export interface EgressPoolItemStatus {
+  order_item_id: number
+  username: string
+  pool_id: number
+  pool_name: string
+  strategy: EgressPoolStrategy
+  healthy: number
+  total: number
+  active_outbound_id?: number
+  members: EgressPoolMemberStatus[]
+  runtime_error?: string
 }
 
 export interface TaskLog {
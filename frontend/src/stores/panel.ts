@@ -245,6 +245,22 @@ export const usePanelStore = defineStore('panel', {
         this.setError(`部分数据加载失败: ${failures.join(' / ')}`)
       }
     },
+    // Writes carry the version the admin was looking at; the API answers 409
+    // when someone else changed the row in the meantime.
+    customerVersionHeaders(id: number): Record<string, string> {
+      const version = this.customers.find((c) => c.id === id)?.version
+      return version ? { 'If-Match': String(version) } : {}
+    },
+    // Dialogs pass the version they were opened with; otherwise the listed
+    // row's version is used. Fetching it right before the write would defeat
+    // the check, so an unknown version fails instead.
+    orderVersionHeaders(orderID: number, version = 0): Record<string, string> {
+      const known = version || this.orders.find((o) => o.id === orderID)?.version
+      if (!known) {
+        throw new Error('订单版本未知，请刷新列表后重试')
+      }
+      return { 'If-Match': String(known) }
+    },
     async loadCustomers() {
       const res = await http.get('/api/customers')
       this.customers = res.data
@@ -255,7 +271,7 @@ export const usePanelStore = defineStore('panel', {
       this.setNotice('客户已创建')
     },
     async updateCustomer(id: number, payload: { name: string; code?: string; contact: string; notes: string; status: string }) {
-      await http.put(`/api/customers/${id}`, payload)
+      await http.put(`/api/customers/${id}`, payload, { headers: this.customerVersionHeaders(id) })
       await this.loadCustomers()
       this.setNotice('客户已更新')
     },
@@ -631,8 +647,8 @@ export const usePanelStore = defineStore('panel', {
 		const order = body.order || body
 		return { order, warnings } as OrderSubmitResult
     },
-    async updateOrder(orderID: number, payload: Record<string, unknown>) {
-      const res = await http.put(`/api/orders/${orderID}`, payload, { timeout: 120000 })
+    async updateOrder(orderID: number, payload: Record<string, unknown>, version = 0) {
+      const res = await http.put(`/api/orders/${orderID}`, payload, { timeout: 120000, headers: this.orderVersionHeaders(orderID, version) })
       await this.loadOrders()
       await this.loadOversell(this.oversellCustomerID)
       const customerID = this.orders.find((o) => o.id === orderID)?.customer_id
@@ -651,26 +667,26 @@ export const usePanelStore = defineStore('panel', {
 			return res.data?.children || []
 		},
 		async updateOrderGroupSocks5(orderID: number, lines: string) {
-			await http.post(`/api/orders/${orderID}/group/update-socks5`, { lines })
+			await http.post(`/api/orders/${orderID}/group/update-socks5`, { lines }, { headers: this.orderVersionHeaders(orderID) })
 			await this.loadOrders()
 		},
 		async updateOrderGroupSocks5Selected(orderID: number, childOrderIDs: number[], lines: string) {
 			await http.post(`/api/orders/${orderID}/group/update-socks5-selected`, {
 				child_order_ids: childOrderIDs,
 				lines
-			})
+			}, { headers: this.orderVersionHeaders(orderID) })
 			await this.loadOrders()
 		},
 		async updateOrderGroupSocks5XLSX(orderID: number, file: File) {
 			const form = new FormData()
 			form.append('file', file)
 			await http.post(`/api/orders/${orderID}/group/update-socks5/xlsx`, form, {
-				headers: { 'Content-Type': 'multipart/form-data' }
+				headers: { 'Content-Type': 'multipart/form-data', ...this.orderVersionHeaders(orderID) }
 			})
 			await this.loadOrders()
 		},
 		async updateOrderGroupCredentials(orderID: number, payload: { lines?: string; regenerate?: boolean }) {
-			await http.post(`/api/orders/${orderID}/group/update-credentials`, payload)
+			await http.post(`/api/orders/${orderID}/group/update-credentials`, payload, { headers: this.orderVersionHeaders(orderID) })
 			await this.loadOrders()
 		},
 		async updateOrderGroupCredentialsSelected(orderID: number, childOrderIDs: number[], payload: { lines?: string; regenerate?: boolean }) {
@@ -678,7 +694,7 @@ export const usePanelStore = defineStore('panel', {
 				child_order_ids: childOrderIDs,
 				lines: payload.lines,
 				regenerate: payload.regenerate
-			})
+			}, { headers: this.orderVersionHeaders(orderID) })
 			await this.loadOrders()
 		},
 		async updateOrderGroupEgressGeo(orderID: number, childOrderIDs: number[], countryCode: string, region = '') {
@@ -686,7 +702,7 @@ export const usePanelStore = defineStore('panel', {
 				child_order_ids: childOrderIDs,
 				country_code: countryCode,
 				region: region
-			})
+			}, { headers: this.orderVersionHeaders(orderID) })
 			await this.loadOrders()
 		},
 		async updateOrderGroupEgressGeoByMapping(orderID: number, lines: string, defaultCountryCode = '', defaultRegion = '') {
@@ -694,14 +710,14 @@ export const usePanelStore = defineStore('panel', {
 				lines,
 				default_country_code: defaultCountryCode,
 				default_region: defaultRegion
-			})
+			}, { headers: this.orderVersionHeaders(orderID) })
 			await this.loadOrders()
 		},
 		async updateOrderGroupCredentialsXLSX(orderID: number, file: File) {
 			const form = new FormData()
 			form.append('file', file)
 			await http.post(`/api/orders/${orderID}/group/update-credentials/xlsx`, form, {
-				headers: { 'Content-Type': 'multipart/form-data' }
+				headers: { 'Content-Type': 'multipart/form-data', ...this.orderVersionHeaders(orderID) }
 			})
 			await this.loadOrders()
 		},
@@ -710,7 +726,7 @@ export const usePanelStore = defineStore('panel', {
 				child_order_ids: childOrderIDs,
 				more_days: moreDays,
 				expires_at: expiresAt
-			})
+			}, { headers: this.orderVersionHeaders(orderID) })
 			await this.loadOrders()
 			this.setNotice('组内选中子订单续期完成')
 		},
@@ -36,12 +36,20 @@ type API struct {
 	singbox   *service.SingboxImportService
 	nodes     *service.NodeService
 	forward   *service.ForwardOutboundService
+	pools     *service.EgressPoolService
 	dedicated *service.DedicatedEntryService
 	ingress   *service.DedicatedIngressService
 	hostIPs   *service.HostIPService
 	backups   *service.BackupService
 	bark      *service.BarkService
 	runtime   *service.RuntimeStatsService
+	geoip     *service.GeoIPService
+	benchmark *service.UpstreamBenchmarkService
+	products  *service.ProductService
+	billing   *service.BillingService
+	actions   *service.ScheduledActionService
+	reminders *service.ReminderService
+	integrity *service.IntegrityService
 	cfg       config.Config
 	logger    *zap.Logger
 }
@@ -49,8 +57,8 @@ type API struct {
 var dedicatedProtocolProbe = service.ProbeDedicatedWithXrayCore
 var dedicatedUUIDRegexCompat = regexp.MustCompile(`(?i)^[0-9a-f]{8}-[0-9a-f]{4}-[1-5][0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
 
-func New(db *gorm.DB, st *store.Store, orders *service.OrderService, singbox *service.SingboxImportService, nodes *service.NodeService, forward *service.ForwardOutboundService, hostIPs *service.HostIPService, backups *service.BackupService, bark *service.BarkService, runtime *service.RuntimeStatsService, cfg config.Config, logger *zap.Logger) *API {
-	return &API{db: db, store: st, orders: orders, singbox: singbox, nodes: nodes, forward: forward, dedicated: service.NewDedicatedEntryService(db), ingress: service.NewDedicatedIngressService(db), hostIPs: hostIPs, backups: backups, bark: bark, runtime: runtime, cfg: cfg, logger: logger}
+func New(db *gorm.DB, st *store.Store, orders *service.OrderService, singbox *service.SingboxImportService, nodes *service.NodeService, forward *service.ForwardOutboundService, pools *service.EgressPoolService, hostIPs *service.HostIPService, backups *service.BackupService, bark *service.BarkService, runtime *service.RuntimeStatsService, geoip *service.GeoIPService, benchmark *service.UpstreamBenchmarkService, billing *service.BillingService, actions *service.ScheduledActionService, reminders *service.ReminderService, integrity *service.IntegrityService, cfg config.Config, logger *zap.Logger) *API {
+	return &API{db: db, store: st, orders: orders, singbox: singbox, nodes: nodes, forward: forward, pools: pools, dedicated: service.NewDedicatedEntryService(db), ingress: service.NewDedicatedIngressService(db), hostIPs: hostIPs, backups: backups, bark: bark, runtime: runtime, geoip: geoip, benchmark: benchmark, products: service.NewProductService(db), billing: billing, actions: actions, reminders: reminders, integrity: integrity, cfg: cfg, logger: logger}
 }
 
 func (a *API) Router() *gin.Engine {
@@ -74,6 +82,7 @@ func (a *API) Router() *gin.Engine {
 	api := r.Group("/api")
 	api.POST("/auth/login", a.handleLogin)
 	api.GET("/version", a.handleVersion)
+	api.POST("/webhooks/payment", a.paymentWebhook)
 
 	secure := api.Group("/")
 	secure.Use(a.authMiddleware())
@@ -84,12 +93,21 @@ func (a *API) Router() *gin.Engine {
 	secure.POST("/customers", a.createCustomer)
 	secure.PUT("/customers/:id", a.updateCustomer)
 	secure.DELETE("/customers/:id", a.deleteCustomer)
+	secure.POST("/customers/:id/suspend", a.suspendCustomer)
+	secure.POST("/customers/:id/unsuspend", a.unsuspendCustomer)
+
+	secure.GET("/products", a.listProducts)
+	secure.POST("/products", a.createProduct)
+	secure.PUT("/products/:id", a.updateProduct)
+	secure.DELETE("/products/:id", a.deleteProduct)
 
 	secure.GET("/host-ips", a.listHostIPs)
 	secure.POST("/host-ips/scan", a.scanHostIPs)
 	secure.POST("/host-ips/probe", a.probeHostPort)
 	secure.POST("/host-ips/:id/toggle", a.toggleHostIP)
+	secure.PUT("/host-ips/:id/policy", a.updateHostIPPolicy)
 	secure.GET("/oversell", a.oversellView)
+	secure.GET("/oversell/capacity", a.hostIPCapacityReport)
 
 	secure.GET("/nodes", a.listNodes)
 	secure.POST("/nodes", a.createNode)
@@ -106,6 +124,15 @@ func (a *API) Router() *gin.Engine {
 	secure.POST("/forward-outbounds/import", a.importForwardOutbounds)
 	secure.POST("/forward-outbounds/:id/probe", a.probeForwardOutbound)
 	secure.POST("/forward-outbounds/probe-all", a.probeAllForwardOutbounds)
+	secure.GET("/forward-outbounds/:id/probes", a.forwardOutboundProbeHistory)
+	secure.POST("/forward-outbounds/:id/rehome", a.rehomeForwardOutbound)
+	secure.GET("/reports/forward-margin", a.forwardMarginReport)
+	secure.GET("/reports/host-ip-lineage", a.hostIPLineageReport)
+	secure.GET("/billing/ledger", a.listLedgerEntries)
+	secure.POST("/billing/ledger", a.createLedgerEntry)
+	secure.GET("/billing/balances", a.customerBalances)
+	secure.GET("/billing/invoice", a.customerInvoice)
+	secure.GET("/billing/payments", a.listPaymentEvents)
 	secure.GET("/orders/forward-outbounds", a.listForwardOutbounds)
 	secure.POST("/orders/forward-outbounds", a.createForwardOutbound)
 	secure.PUT("/orders/forward-outbounds/:id", a.updateForwardOutbound)
@@ -114,6 +141,10 @@ func (a *API) Router() *gin.Engine {
 	secure.POST("/orders/forward-outbounds/import", a.importForwardOutbounds)
 	secure.POST("/orders/forward-outbounds/:id/probe", a.probeForwardOutbound)
 	secure.POST("/orders/forward-outbounds/probe-all", a.probeAllForwardOutbounds)
+	secure.GET("/egress-pools", a.listEgressPools)
+	secure.POST("/egress-pools", a.createEgressPool)
+	secure.PUT("/egress-pools/:id", a.updateEgressPool)
+	secure.DELETE("/egress-pools/:id", a.deleteEgressPool)
 	secure.GET("/orders/dedicated-entries", a.listDedicatedEntries)
 	secure.POST("/orders/dedicated-entries", a.createDedicatedEntry)
 	secure.PUT("/orders/dedicated-entries/:id", a.updateDedicatedEntry)
@@ -148,6 +179,8 @@ func (a *API) Router() *gin.Engine {
 	secure.POST("/orders/residential-credential-conflicts/repair", a.repairResidentialCredentialConflicts)
 	secure.POST("/orders/dedicated/egress/probe-stream", a.probeDedicatedEgressStream)
 	secure.POST("/orders/:id/split", a.splitOrder)
+	secure.POST("/orders/:id/egress-pool", a.setOrderEgressPool)
+	secure.GET("/orders/:id/egress-pool/status", a.orderEgressPoolStatus)
 	secure.GET("/orders/:id/group/template/socks5.xlsx", a.downloadOrderGroupSocks5Template)
 	secure.GET("/orders/:id/group/template/credentials.xlsx", a.downloadOrderGroupCredentialsTemplate)
 	secure.POST("/orders/:id/group/update-socks5", a.updateOrderGroupSocks5)
@@ -162,21 +195,64 @@ func (a *API) Router() *gin.Engine {
 	secure.POST("/orders/:id/deactivate", a.deactivateOrder)
 	secure.POST("/orders/:id/activate", a.activateOrder)
 	secure.POST("/orders/:id/renew", a.renewOrder)
+	secure.GET("/orders/:id/scheduled-actions", a.listOrderScheduledActions)
+	secure.POST("/orders/:id/scheduled-actions", a.createOrderScheduledAction)
+	secure.GET("/scheduled-actions", a.listScheduledActions)
+	secure.POST("/scheduled-actions/:id/cancel", a.cancelScheduledAction)
+	secure.GET("/reminders", a.listReminders)
+	secure.POST("/reminders/run", a.runReminders)
+	secure.GET("/integrity/checks", a.listIntegrityChecks)
+	secure.GET("/integrity/report", a.integrityReport)
+	secure.POST("/integrity/repair", a.repairIntegrity)
+	secure.GET("/integrity/runs", a.listIntegrityRuns)
+	secure.GET("/integrity/runs/:id", a.getIntegrityRun)
+	secure.POST("/orders/:id/transfer", a.transferOrder)
+	secure.GET("/orders/:id/transfers", a.listOrderTransfers)
+	secure.POST("/orders/:id/rotate-ip", a.rotateOrderIPs)
+	secure.POST("/orders/:id/convert-trial", a.convertTrialOrder)
+	secure.GET("/orders/:id/ip-history", a.listOrderIPHistory)
+	secure.GET("/orders/:id/versions", a.listOrderVersions)
+	secure.GET("/orders/:id/versions/diff", a.diffOrderVersions)
+	secure.GET("/orders/:id/versions/:version", a.getOrderVersion)
+	secure.POST("/orders/:id/versions/:version/revert", a.revertOrderVersion)
+	secure.GET("/reservations", a.listReservations)
+	secure.POST("/reservations", a.createReservation)
+	secure.POST("/reservations/:id/release", a.releaseReservation)
+	secure.POST("/reservations/:id/convert", a.convertReservation)
 	secure.POST("/orders/batch/deactivate", a.batchDeactivateOrders)
 	secure.POST("/orders/batch/activate", a.batchActivateOrders)
 	secure.POST("/orders/batch/renew", a.batchRenewOrders)
 	secure.POST("/orders/batch/resync", a.batchResyncOrders)
 	secure.POST("/orders/batch/test", a.batchTestOrders)
 	secure.POST("/orders/batch/export", a.batchExportOrders)
+	secure.POST("/orders/batch/tags", a.batchTagOrders)
+	secure.PUT("/orders/:id/labels", a.setOrderLabels)
+	secure.GET("/saved-filters", a.listSavedFilters)
+	secure.POST("/saved-filters", a.createSavedFilter)
+	secure.PUT("/saved-filters/:id", a.updateSavedFilter)
+	secure.DELETE("/saved-filters/:id", a.deleteSavedFilter)
 	secure.GET("/orders/:id/export", a.exportOrder)
 	secure.GET("/orders/:id/copy-links", a.copyOrderLinks)
 	secure.POST("/orders/:id/test", a.testOrder)
 	secure.POST("/orders/:id/test/stream", a.testOrderStream)
 	secure.POST("/orders/import/preview", a.previewImport)
 	secure.POST("/orders/import/confirm", a.confirmImport)
+	secure.GET("/orders/bulk/template.xlsx", a.downloadBulkOrderTemplate)
+	secure.POST("/orders/bulk/preview", a.previewBulkOrders)
+	secure.POST("/orders/bulk/confirm", a.confirmBulkOrders)
+	secure.GET("/recycle-bin", a.listRecycleBin)
+	secure.POST("/recycle-bin/:id/restore", a.restoreRecycleEntry)
+	secure.DELETE("/recycle-bin/:id", a.purgeRecycleEntry)
 
 	secure.GET("/settings", a.getSettings)
 	secure.PUT("/settings", a.updateSettings)
+	secure.GET("/geoip", a.getGeoIPStatus)
+	secure.POST("/geoip/upload", a.uploadGeoIPDatabase)
+	secure.GET("/geoip/lookup", a.lookupGeoIP)
+	secure.GET("/benchmarks", a.listBenchmarks)
+	secure.POST("/benchmarks/run", a.runBenchmarks)
+	secure.POST("/benchmarks/forward-outbounds/:id", a.benchmarkForwardOutbound)
+	secure.POST("/benchmarks/dedicated-egress/:id", a.benchmarkDedicatedEgress)
 	secure.POST("/settings/bark/test", a.testBark)
 	secure.GET("/runtime/customers", a.customerRuntimeStats)
 	secure.GET("/runtime/overview", a.runtimeOverview)
@@ -274,7 +350,8 @@ func (a *API) handleResetPassword(c *gin.Context) {
 
 func (a *API) listCustomers(c *gin.Context) {
 	var rows []model.Customer
-	if err := a.db.Order("id desc").Find(&rows).Error; err != nil {
+	q := service.ApplyCustomerTagFilter(a.db.Order("id desc"), service.SplitTags(c.Query("tags")))
+	if err := q.Find(&rows).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -293,6 +370,12 @@ func (a *API) createCustomer(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "name required"})
 		return
 	}
+	tags, err := service.NormalizeTags(row.Tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	row.Tags = tags
 	if row.Code != "" {
 		var cnt int64
 		if err := a.db.Model(&model.Customer{}).Where("code = ?", row.Code).Count(&cnt).Error; err != nil {
@@ -305,8 +388,11 @@ func (a *API) createCustomer(c *gin.Context) {
 		}
 	}
 	if row.Status == "" {
-		row.Status = "active"
+		row.Status = model.CustomerStatusActive
 	}
+	// Balances only move through ledger entries.
+	row.Balance = 0
+	row.TrialsUsed = 0
 	if err := a.db.Create(&row).Error; err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -319,19 +405,77 @@ func (a *API) updateCustomer(c *gin.Context) {
 	if !ok {
 		return
 	}
-	var req model.Customer
+	var req struct {
+		Name       string  `json:"name"`
+		Code       string  `json:"code"`
+		Contact    string  `json:"contact"`
+		Notes      string  `json:"notes"`
+		Status     string  `json:"status"`
+		AutoRenew  *bool   `json:"auto_renew"`
+		TrialLimit *int    `json:"trial_limit"`
+		GraceHours *int    `json:"grace_hours"`
+		Email      string  `json:"email"`
+		TgChatID   string  `json:"telegram_chat_id"`
+		Tags       *string `json:"tags"`
+		Version    int     `json:"version"`
+	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	version, ok := requireVersion(c, req.Version)
+	if !ok {
+		return
+	}
 	updates := map[string]interface{}{
 		"name":       strings.TrimSpace(req.Name),
 		"code":       strings.TrimSpace(req.Code),
 		"contact":    req.Contact,
 		"notes":      req.Notes,
+		"email":      strings.TrimSpace(req.Email),
+		"tg_chat_id": strings.TrimSpace(req.TgChatID),
 		"status":     req.Status,
 		"updated_at": time.Now(),
 	}
+	if req.AutoRenew != nil {
+		updates["auto_renew"] = *req.AutoRenew
+	}
+	if req.TrialLimit != nil {
+		if *req.TrialLimit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "trial_limit must be >= 0"})
+			return
+		}
+		updates["trial_limit"] = *req.TrialLimit
+	}
+	if req.Tags != nil {
+		tags, err := service.NormalizeTags(*req.Tags)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updates["tags"] = tags
+	}
+	if req.GraceHours != nil {
+		// A negative value drops the override back to product/global grace.
+		if *req.GraceHours < 0 {
+			updates["grace_hours"] = nil
+		} else {
+			updates["grace_hours"] = *req.GraceHours
+		}
+	}
+	current := model.Customer{}
+	if err := a.db.First(&current, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "customer not found"})
+		return
+	}
+	if current.Version != version {
+		c.JSON(http.StatusConflict, gin.H{"error": service.ErrVersionConflict.Error(), "current": current})
+		return
+	}
+	if (current.Status == model.CustomerStatusSuspended) != (req.Status == model.CustomerStatusSuspended) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "use the suspend/unsuspend endpoints to change suspension"})
+		return
+	}
 	if code, ok := updates["code"].(string); ok && code != "" {
 		var cnt int64
 		if err := a.db.Model(&model.Customer{}).Where("code = ? and id <> ?", code, id).Count(&cnt).Error; err != nil {
@@ -343,32 +487,59 @@ func (a *API) updateCustomer(c *gin.Context) {
 			return
 		}
 	}
-	if err := a.db.Model(&model.Customer{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+	updates["version"] = gorm.Expr("version + 1")
+	res := a.db.Model(&model.Customer{}).Where("id = ? and version = ?", id, version).Updates(updates)
+	if res.Error != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": res.Error.Error()})
+		return
+	}
+	if res.RowsAffected == 0 {
+		_ = a.db.First(&current, id).Error
+		c.JSON(http.StatusConflict, gin.H{"error": service.ErrVersionConflict.Error(), "current": current})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "version": version + 1})
+}
+
+func (a *API) deleteCustomer(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	if err := a.orders.DeleteCustomer(id); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	a.store.AddTaskLog("info", "customer deleted", fmt.Sprintf("customer=%d moved to recycle bin by %s", id, c.GetString("username")))
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
-func (a *API) deleteCustomer(c *gin.Context) {
+func (a *API) suspendCustomer(c *gin.Context) {
 	id, ok := parseUintParam(c, "id")
 	if !ok {
 		return
 	}
-	var orderCount int64
-	if err := a.db.Model(&model.Order{}).Where("customer_id = ?", id).Count(&orderCount).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	results, err := a.orders.SuspendCustomer(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if orderCount > 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "customer has orders, cannot delete"})
+	a.store.AddTaskLog("info", "customer suspended", fmt.Sprintf("customer=%d orders=%d by %s", id, len(results), c.GetString("username")))
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+func (a *API) unsuspendCustomer(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
 		return
 	}
-	if err := a.db.Delete(&model.Customer{}, id).Error; err != nil {
+	results, err := a.orders.UnsuspendCustomer(c.Request.Context(), id)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"ok": true})
+	a.store.AddTaskLog("info", "customer unsuspended", fmt.Sprintf("customer=%d orders=%d by %s", id, len(results), c.GetString("username")))
+	c.JSON(http.StatusOK, gin.H{"results": results})
 }
 
 func (a *API) listNodes(c *gin.Context) {
@@ -576,6 +747,203 @@ func (a *API) probeForwardOutbound(c *gin.Context) {
 	c.JSON(http.StatusOK, row)
 }
 
+func (a *API) forwardOutboundProbeHistory(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	limit, _ := strconv.Atoi(strings.TrimSpace(c.Query("limit")))
+	rows, err := a.forward.ProbeHistory(id, limit)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) forwardMarginReport(c *gin.Context) {
+	report, err := a.forward.MarginReport(time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+func (a *API) hostIPLineageReport(c *gin.Context) {
+	rows, err := a.orders.HostIPLineage(c.Query("ip"), time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) listLedgerEntries(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "200"))
+	customerID, _ := strconv.ParseUint(strings.TrimSpace(c.Query("customer_id")), 10, 64)
+	q := service.LedgerQuery{CustomerID: uint(customerID), Limit: limit}
+	if from := strings.TrimSpace(c.Query("from")); from != "" {
+		if t, err := time.Parse(time.RFC3339, from); err == nil {
+			q.From = t
+		}
+	}
+	if to := strings.TrimSpace(c.Query("to")); to != "" {
+		if t, err := time.Parse(time.RFC3339, to); err == nil {
+			q.To = t
+		}
+	}
+	rows, err := a.billing.ListEntries(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) createLedgerEntry(c *gin.Context) {
+	var req service.LedgerEntryInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	row, err := a.billing.AddEntry(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, row)
+}
+
+func (a *API) customerBalances(c *gin.Context) {
+	var rows []model.Customer
+	if err := a.db.Select("id", "name", "code", "status", "balance", "auto_renew").Order("balance asc, id asc").Find(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
+// customerInvoice defaults to the current calendar month; from/to accept
+// RFC3339 or YYYY-MM-DD with an exclusive end.
+func (a *API) customerInvoice(c *gin.Context) {
+	customerID, err := strconv.ParseUint(strings.TrimSpace(c.Query("customer_id")), 10, 64)
+	if err != nil || customerID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid customer_id"})
+		return
+	}
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	to := from.AddDate(0, 1, 0)
+	if raw := strings.TrimSpace(c.Query("from")); raw != "" {
+		if from, err = parseInvoiceTime(raw); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from"})
+			return
+		}
+		to = from.AddDate(0, 1, 0)
+	}
+	if raw := strings.TrimSpace(c.Query("to")); raw != "" {
+		if to, err = parseInvoiceTime(raw); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to"})
+			return
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(c.DefaultQuery("format", "json"))) {
+	case "xlsx":
+		body, filename, err := a.billing.InvoiceXLSX(uint(customerID), from, to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		setAttachmentFilename(c, filename)
+		c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", body)
+	case "pdf":
+		body, filename, err := a.billing.InvoicePDF(uint(customerID), from, to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		setAttachmentFilename(c, filename)
+		c.Data(http.StatusOK, "application/pdf", body)
+	default:
+		invoice, err := a.billing.Invoice(uint(customerID), from, to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, invoice)
+	}
+}
+
+func (a *API) listPaymentEvents(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	rows, err := a.billing.ListPaymentEvents(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
+// paymentWebhook is unauthenticated; the HMAC over the raw body is the only
+// credential, so the body is verified before it is parsed.
+func (a *API) paymentWebhook(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := a.billing.VerifyPaymentSignature(body, c.GetHeader(service.PaymentSignatureHeader)); err != nil {
+		switch {
+		case errors.Is(err, service.ErrPaymentWebhookDisabled):
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		case errors.Is(err, service.ErrPaymentSignature):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	var req service.PaymentWebhookEvent
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	event, duplicate, err := a.billing.ApplyPayment(c.Request.Context(), req, body)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrPaymentInProgress):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case event == nil:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "event": event})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "duplicate": duplicate, "event": event})
+}
+
+func parseInvoiceTime(raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", raw, time.Local)
+}
+
+func (a *API) rehomeForwardOutbound(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	results, err := a.orders.RehomeForwardOutboundItems(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "results": results})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
 func (a *API) probeAllForwardOutbounds(c *gin.Context) {
 	var req struct {
 		EnabledOnly *bool `json:"enabled_only"`
@@ -596,6 +964,92 @@ func (a *API) probeAllForwardOutbounds(c *gin.Context) {
 	c.JSON(http.StatusOK, rows)
 }
 
+func (a *API) listEgressPools(c *gin.Context) {
+	rows, err := a.pools.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) createEgressPool(c *gin.Context) {
+	var req service.EgressPoolInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	row, err := a.pools.Create(c.Request.Context(), req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, row)
+}
+
+func (a *API) updateEgressPool(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	var req service.EgressPoolInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	row, err := a.pools.Update(c.Request.Context(), id, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, row)
+}
+
+func (a *API) deleteEgressPool(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	if err := a.pools.Delete(id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (a *API) setOrderEgressPool(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		PoolID  uint   `json:"pool_id"`
+		ItemIDs []uint `json:"item_ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := a.orders.SetOrderEgressPool(c.Request.Context(), id, req.PoolID, req.ItemIDs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (a *API) orderEgressPoolStatus(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	rows, err := a.orders.EgressPoolStatus(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
 func (a *API) forwardReuseWarnings(c *gin.Context) {
 	var req struct {
 		CustomerID         uint   `json:"customer_id"`
@@ -838,23 +1292,76 @@ func (a *API) deleteDedicatedIngress(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
-func (a *API) toggleDedicatedIngress(c *gin.Context) {
-	id, ok := parseUintParam(c, "id")
-	if !ok {
+func (a *API) listProducts(c *gin.Context) {
+	rows, err := a.products.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	var req struct {
-		Enabled bool `json:"enabled"`
-	}
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) createProduct(c *gin.Context) {
+	var req service.ProductInput
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := a.ingress.ToggleIngress(id, req.Enabled); err != nil {
+	row, err := a.products.Create(req)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"ok": true})
+	c.JSON(http.StatusOK, row)
+}
+
+func (a *API) updateProduct(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	var req service.ProductInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	row, err := a.products.Update(id, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, row)
+}
+
+func (a *API) deleteProduct(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	if err := a.products.Delete(id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (a *API) toggleDedicatedIngress(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := a.ingress.ToggleIngress(id, req.Enabled); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
 type dedicatedIngressLineResponse struct {
@@ -985,6 +1492,10 @@ func (a *API) checkDedicated(c *gin.Context) {
 	if strings.TrimSpace(probe.Region) != "" {
 		response["region"] = strings.TrimSpace(probe.Region)
 	}
+	if probe.ASN > 0 {
+		response["asn"] = probe.ASN
+		response["asOrg"] = probe.ASOrg
+	}
 	if strings.TrimSpace(probe.Message) != "" {
 		response["message"] = probe.Message
 	}
@@ -1311,6 +1822,37 @@ func (a *API) toggleHostIP(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
+func (a *API) updateHostIPPolicy(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Tier         string `json:"tier"`
+		MaxCustomers int    `json:"max_customers"`
+		MaxItems     int    `json:"max_items"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	row, err := a.hostIPs.UpdatePolicy(id, req.Tier, req.MaxCustomers, req.MaxItems)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, row)
+}
+
+func (a *API) hostIPCapacityReport(c *gin.Context) {
+	rows, err := a.orders.HostIPCapacityReport()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
 func (a *API) oversellView(c *gin.Context) {
 	type ipRow struct {
 		IP       string `json:"ip"`
@@ -1337,7 +1879,7 @@ func (a *API) oversellView(c *gin.Context) {
 	if err := a.db.Table("order_items oi").
 		Select("oi.ip as ip, count(1) as count").
 		Joins("join orders o on o.id = oi.order_id").
-		Where("o.status = ? and o.expires_at > ? and oi.status = ?", model.OrderStatusActive, time.Now(), model.OrderItemStatusActive).
+		Where("o.status = ? and (o.expires_at > ? or o.expiry_stage <> '') and oi.status = ?", model.OrderStatusActive, time.Now(), model.OrderItemStatusActive).
 		Group("oi.ip").Scan(&totalRows).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -1351,7 +1893,7 @@ func (a *API) oversellView(c *gin.Context) {
 		if err := a.db.Table("order_items oi").
 			Select("oi.ip as ip, count(1) as count").
 			Joins("join orders o on o.id = oi.order_id").
-			Where("o.customer_id = ? and o.status = ? and o.expires_at > ? and oi.status = ?", uint(customerID), model.OrderStatusActive, time.Now(), model.OrderItemStatusActive).
+			Where("o.customer_id = ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '') and oi.status = ?", uint(customerID), model.OrderStatusActive, time.Now(), model.OrderItemStatusActive).
 			Group("oi.ip").Scan(&customerRows).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -1368,7 +1910,7 @@ func (a *API) oversellView(c *gin.Context) {
 	if err := a.db.Table("order_items oi").
 		Select("oi.ip as ip, count(distinct o.customer_id) as count").
 		Joins("join orders o on o.id = oi.order_id").
-		Where("o.status = ? and o.expires_at > ? and oi.status = ?", model.OrderStatusActive, time.Now(), model.OrderItemStatusActive).
+		Where("o.status = ? and (o.expires_at > ? or o.expiry_stage <> '') and oi.status = ?", model.OrderStatusActive, time.Now(), model.OrderItemStatusActive).
 		Group("oi.ip").Scan(&customerCountRows).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -1422,14 +1964,34 @@ func (a *API) listOrders(c *gin.Context) {
 	page, _ := strconv.Atoi(strings.TrimSpace(c.DefaultQuery("page", "1")))
 	pageSize, _ := strconv.Atoi(strings.TrimSpace(c.DefaultQuery("page_size", "12")))
 	customerID, _ := strconv.ParseUint(strings.TrimSpace(c.DefaultQuery("customer_id", "0")), 10, 64)
-	result, err := a.orders.ListOrders(service.ListOrdersInput{
+	in := service.ListOrdersInput{
 		Page:       page,
 		PageSize:   pageSize,
 		Keyword:    strings.TrimSpace(c.Query("keyword")),
 		Mode:       strings.TrimSpace(c.Query("mode")),
 		Status:     strings.TrimSpace(c.Query("status")),
 		CustomerID: uint(customerID),
-	})
+		Tags:       service.SplitTags(c.Query("tags")),
+	}
+	for key, target := range map[string]*time.Time{"expires_from": &in.ExpiresFrom, "expires_to": &in.ExpiresTo} {
+		if raw := strings.TrimSpace(c.Query(key)); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + key + ", expect RFC3339"})
+				return
+			}
+			*target = t
+		}
+	}
+	if filterID, _ := strconv.ParseUint(strings.TrimSpace(c.DefaultQuery("saved_filter_id", "0")), 10, 64); filterID > 0 {
+		filter, err := a.orders.GetSavedFilter(c.GetString("username"), uint(filterID))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		in = service.ApplySavedFilter(in, *filter)
+	}
+	result, err := a.orders.ListOrders(in)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -1444,7 +2006,7 @@ func (a *API) orderAllocationPreview(c *gin.Context) {
 		return
 	}
 	excludeID, _ := strconv.ParseUint(strings.TrimSpace(c.DefaultQuery("exclude_order_id", "0")), 10, 64)
-	preview, err := a.orders.AllocationPreview(uint(customerID), uint(excludeID))
+	preview, err := a.orders.AllocationPreview(uint(customerID), uint(excludeID), c.Query("ip_tier"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -1462,28 +2024,34 @@ func (a *API) getOrder(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	c.Header("ETag", strconv.Quote(strconv.Itoa(order.Version)))
 	c.JSON(http.StatusOK, order)
 }
 
 func (a *API) createOrder(c *gin.Context) {
 	var req struct {
-		CustomerID                    uint   `json:"customer_id"`
-		Name                          string `json:"name"`
-		Quantity                      int    `json:"quantity"`
-		DurationDay                   int    `json:"duration_day"`
-		ExpiresAt                     string `json:"expires_at"`
-		Mode                          string `json:"mode"`
-		Port                          int    `json:"port"`
-		ManualIPIDs                   []uint `json:"manual_ip_ids"`
-		ResidentialCredentialMode     string `json:"residential_credential_mode"`
-		ResidentialCredentialStrategy string `json:"residential_credential_strategy"`
-		ResidentialCredentialLines    string `json:"residential_credential_lines"`
-		ForwardOutboundIDs            []uint `json:"forward_outbound_ids"`
-		DedicatedEntryID              uint   `json:"dedicated_entry_id"`
-		DedicatedInboundID            uint   `json:"dedicated_inbound_id"`
-		DedicatedIngressID            uint   `json:"dedicated_ingress_id"`
-		DedicatedProtocol             string `json:"dedicated_protocol"`
-		DedicatedEgressLines          string `json:"dedicated_egress_lines"`
+		CustomerID                    uint     `json:"customer_id"`
+		Name                          string   `json:"name"`
+		Quantity                      int      `json:"quantity"`
+		DurationDay                   int      `json:"duration_day"`
+		ExpiresAt                     string   `json:"expires_at"`
+		Mode                          string   `json:"mode"`
+		Port                          int      `json:"port"`
+		ManualIPIDs                   []uint   `json:"manual_ip_ids"`
+		ResidentialCredentialMode     string   `json:"residential_credential_mode"`
+		ResidentialCredentialStrategy string   `json:"residential_credential_strategy"`
+		ResidentialCredentialLines    string   `json:"residential_credential_lines"`
+		ForwardOutboundIDs            []uint   `json:"forward_outbound_ids"`
+		DedicatedEntryID              uint     `json:"dedicated_entry_id"`
+		DedicatedInboundID            uint     `json:"dedicated_inbound_id"`
+		DedicatedIngressID            uint     `json:"dedicated_ingress_id"`
+		DedicatedProtocol             string   `json:"dedicated_protocol"`
+		DedicatedEgressLines          string   `json:"dedicated_egress_lines"`
+		Price                         *float64 `json:"price"`
+		ProductID                     uint     `json:"product_id"`
+		IPTier                        string   `json:"ip_tier"`
+		IsTrial                       bool     `json:"is_trial"`
+		TrialCapBytes                 int64    `json:"trial_cap_bytes"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -1506,6 +2074,14 @@ func (a *API) createOrder(c *gin.Context) {
 		DedicatedIngressID:            req.DedicatedIngressID,
 		DedicatedProtocol:             req.DedicatedProtocol,
 		DedicatedEgressLines:          req.DedicatedEgressLines,
+		ProductID:                     req.ProductID,
+		IPTier:                        req.IPTier,
+		IsTrial:                       req.IsTrial,
+		TrialCapBytes:                 req.TrialCapBytes,
+	}
+	if req.Price != nil {
+		input.Price = *req.Price
+		input.HasPrice = true
 	}
 	if strings.TrimSpace(req.ExpiresAt) != "" {
 		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
@@ -1545,6 +2121,43 @@ func (a *API) deleteOrder(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	a.store.AddTaskLog("info", "order deleted", fmt.Sprintf("order=%d moved to recycle bin by %s", id, c.GetString("username")))
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (a *API) listRecycleBin(c *gin.Context) {
+	rows, err := a.orders.ListRecycleBin(c.Query("kind"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) restoreRecycleEntry(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	entry, err := a.orders.RestoreRecycleEntry(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a.store.AddTaskLog("info", "recycle bin restored", fmt.Sprintf("%s=%d %s by %s", entry.Kind, entry.EntityID, entry.Label, c.GetString("username")))
+	c.JSON(http.StatusOK, entry)
+}
+
+func (a *API) purgeRecycleEntry(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	if err := a.orders.PurgeRecycleEntry(id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a.store.AddTaskLog("info", "recycle bin purged", fmt.Sprintf("entry=%d by %s", id, c.GetString("username")))
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
@@ -1622,27 +2235,33 @@ func (a *API) updateOrder(c *gin.Context) {
 		return
 	}
 	var req struct {
-		Name                           string `json:"name"`
-		Quantity                       int    `json:"quantity"`
-		Port                           int    `json:"port"`
-		ExpiresAt                      string `json:"expires_at"`
-		ManualIPIDs                    []uint `json:"manual_ip_ids"`
-		ResidentialCredentialMode      string `json:"residential_credential_mode"`
-		ResidentialCredentialStrategy  string `json:"residential_credential_strategy"`
-		ResidentialCredentialLines     string `json:"residential_credential_lines"`
-		ForwardOutboundIDs             []uint `json:"forward_outbound_ids"`
-		DedicatedEntryID               uint   `json:"dedicated_entry_id"`
-		DedicatedInboundID             uint   `json:"dedicated_inbound_id"`
-		DedicatedIngressID             uint   `json:"dedicated_ingress_id"`
-		DedicatedProtocol              string `json:"dedicated_protocol"`
-		DedicatedEgressLines           string `json:"dedicated_egress_lines"`
-		DedicatedCredentialLines       string `json:"dedicated_credential_lines"`
-		RegenerateDedicatedCredentials bool   `json:"regenerate_dedicated_credentials"`
+		Name                           string   `json:"name"`
+		Quantity                       int      `json:"quantity"`
+		Port                           int      `json:"port"`
+		ExpiresAt                      string   `json:"expires_at"`
+		ManualIPIDs                    []uint   `json:"manual_ip_ids"`
+		ResidentialCredentialMode      string   `json:"residential_credential_mode"`
+		ResidentialCredentialStrategy  string   `json:"residential_credential_strategy"`
+		ResidentialCredentialLines     string   `json:"residential_credential_lines"`
+		ForwardOutboundIDs             []uint   `json:"forward_outbound_ids"`
+		DedicatedEntryID               uint     `json:"dedicated_entry_id"`
+		DedicatedInboundID             uint     `json:"dedicated_inbound_id"`
+		DedicatedIngressID             uint     `json:"dedicated_ingress_id"`
+		DedicatedProtocol              string   `json:"dedicated_protocol"`
+		DedicatedEgressLines           string   `json:"dedicated_egress_lines"`
+		DedicatedCredentialLines       string   `json:"dedicated_credential_lines"`
+		RegenerateDedicatedCredentials bool     `json:"regenerate_dedicated_credentials"`
+		Price                          *float64 `json:"price"`
+		Version                        int      `json:"version"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	version, ok := requireVersion(c, req.Version)
+	if !ok {
+		return
+	}
 	input := service.UpdateOrderInput{
 		Name:                           req.Name,
 		Quantity:                       req.Quantity,
@@ -1659,6 +2278,7 @@ func (a *API) updateOrder(c *gin.Context) {
 		DedicatedEgressLines:           req.DedicatedEgressLines,
 		DedicatedCredentialLines:       req.DedicatedCredentialLines,
 		RegenerateDedicatedCredentials: req.RegenerateDedicatedCredentials,
+		Price:                          req.Price,
 	}
 	if strings.TrimSpace(req.ExpiresAt) != "" {
 		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
@@ -1681,12 +2301,13 @@ func (a *API) updateOrder(c *gin.Context) {
 			return
 		}
 	}
-	order, err := a.orders.UpdateOrder(c.Request.Context(), id, input)
+	ctx, capacity := service.WithCapacityWarnings(service.WithExpectedVersion(c.Request.Context(), version))
+	order, err := a.orders.UpdateOrder(ctx, id, input)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		a.respondOrderWriteError(c, id, err)
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"order": order, "warnings": warnings})
+	c.JSON(http.StatusOK, gin.H{"order": order, "warnings": appendNewWarnings(warnings, capacity())})
 }
 
 func (a *API) splitOrder(c *gin.Context) {
@@ -1736,14 +2357,19 @@ func (a *API) updateOrderGroupSocks5(c *gin.Context) {
 		return
 	}
 	var req struct {
-		Lines string `json:"lines"`
+		Lines   string `json:"lines"`
+		Version int    `json:"version"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := a.orders.UpdateGroupSocks5(c.Request.Context(), id, req.Lines); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	version, ok := requireVersion(c, req.Version)
+	if !ok {
+		return
+	}
+	if err := a.orders.UpdateGroupSocks5(service.WithExpectedVersion(c.Request.Context(), version), id, req.Lines); err != nil {
+		a.respondOrderWriteError(c, id, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"ok": true})
@@ -1757,17 +2383,22 @@ func (a *API) updateOrderGroupSocks5Selected(c *gin.Context) {
 	var req struct {
 		Lines         string `json:"lines"`
 		ChildOrderIDs []uint `json:"child_order_ids"`
+		Version       int    `json:"version"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	version, ok := requireVersion(c, req.Version)
+	if !ok {
+		return
+	}
 	if len(req.ChildOrderIDs) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "child_order_ids is empty"})
 		return
 	}
-	if err := a.orders.UpdateGroupSocks5Selected(c.Request.Context(), id, req.ChildOrderIDs, req.Lines); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := a.orders.UpdateGroupSocks5Selected(service.WithExpectedVersion(c.Request.Context(), version), id, req.ChildOrderIDs, req.Lines); err != nil {
+		a.respondOrderWriteError(c, id, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"ok": true})
@@ -1778,6 +2409,10 @@ func (a *API) updateOrderGroupSocks5ByXLSX(c *gin.Context) {
 	if !ok {
 		return
 	}
+	version, ok := requireVersion(c, formVersion(c))
+	if !ok {
+		return
+	}
 	file, err := c.FormFile("file")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
@@ -1794,8 +2429,8 @@ func (a *API) updateOrderGroupSocks5ByXLSX(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := a.orders.UpdateGroupSocks5FromXLSX(c.Request.Context(), id, body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := a.orders.UpdateGroupSocks5FromXLSX(service.WithExpectedVersion(c.Request.Context(), version), id, body); err != nil {
+		a.respondOrderWriteError(c, id, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"ok": true})
@@ -1809,13 +2444,18 @@ func (a *API) updateOrderGroupCredentials(c *gin.Context) {
 	var req struct {
 		Lines      string `json:"lines"`
 		Regenerate bool   `json:"regenerate"`
+		Version    int    `json:"version"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := a.orders.UpdateGroupCredentials(c.Request.Context(), id, req.Lines, req.Regenerate); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	version, ok := requireVersion(c, req.Version)
+	if !ok {
+		return
+	}
+	if err := a.orders.UpdateGroupCredentials(service.WithExpectedVersion(c.Request.Context(), version), id, req.Lines, req.Regenerate); err != nil {
+		a.respondOrderWriteError(c, id, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"ok": true})
@@ -1830,17 +2470,22 @@ func (a *API) updateOrderGroupCredentialsSelected(c *gin.Context) {
 		Lines         string `json:"lines"`
 		Regenerate    bool   `json:"regenerate"`
 		ChildOrderIDs []uint `json:"child_order_ids"`
+		Version       int    `json:"version"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	version, ok := requireVersion(c, req.Version)
+	if !ok {
+		return
+	}
 	if len(req.ChildOrderIDs) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "child_order_ids is empty"})
 		return
 	}
-	if err := a.orders.UpdateGroupCredentialsSelected(c.Request.Context(), id, req.ChildOrderIDs, req.Lines, req.Regenerate); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := a.orders.UpdateGroupCredentialsSelected(service.WithExpectedVersion(c.Request.Context(), version), id, req.ChildOrderIDs, req.Lines, req.Regenerate); err != nil {
+		a.respondOrderWriteError(c, id, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"ok": true})
@@ -1855,13 +2500,18 @@ func (a *API) updateOrderGroupEgressGeo(c *gin.Context) {
 		ChildOrderIDs []uint `json:"child_order_ids"`
 		CountryCode   string `json:"country_code"`
 		Region        string `json:"region"`
+		Version       int    `json:"version"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := a.orders.UpdateGroupEgressGeo(c.Request.Context(), id, req.ChildOrderIDs, req.CountryCode, req.Region); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	version, ok := requireVersion(c, req.Version)
+	if !ok {
+		return
+	}
+	if err := a.orders.UpdateGroupEgressGeo(service.WithExpectedVersion(c.Request.Context(), version), id, req.ChildOrderIDs, req.CountryCode, req.Region); err != nil {
+		a.respondOrderWriteError(c, id, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"ok": true})
@@ -1876,13 +2526,18 @@ func (a *API) updateOrderGroupEgressGeoByMapping(c *gin.Context) {
 		Lines              string `json:"lines"`
 		DefaultCountryCode string `json:"default_country_code"`
 		DefaultRegion      string `json:"default_region"`
+		Version            int    `json:"version"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := a.orders.UpdateGroupEgressGeoByMapping(c.Request.Context(), id, req.Lines, req.DefaultCountryCode, req.DefaultRegion); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	version, ok := requireVersion(c, req.Version)
+	if !ok {
+		return
+	}
+	if err := a.orders.UpdateGroupEgressGeoByMapping(service.WithExpectedVersion(c.Request.Context(), version), id, req.Lines, req.DefaultCountryCode, req.DefaultRegion); err != nil {
+		a.respondOrderWriteError(c, id, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"ok": true})
@@ -1893,6 +2548,10 @@ func (a *API) updateOrderGroupCredentialsByXLSX(c *gin.Context) {
 	if !ok {
 		return
 	}
+	version, ok := requireVersion(c, formVersion(c))
+	if !ok {
+		return
+	}
 	file, err := c.FormFile("file")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
@@ -1909,8 +2568,8 @@ func (a *API) updateOrderGroupCredentialsByXLSX(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := a.orders.UpdateGroupCredentialsFromXLSX(c.Request.Context(), id, body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := a.orders.UpdateGroupCredentialsFromXLSX(service.WithExpectedVersion(c.Request.Context(), version), id, body); err != nil {
+		a.respondOrderWriteError(c, id, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"ok": true})
@@ -1925,11 +2584,16 @@ func (a *API) renewOrderGroupSelected(c *gin.Context) {
 		ChildOrderIDs []uint `json:"child_order_ids"`
 		MoreDays      int    `json:"more_days"`
 		ExpiresAt     string `json:"expires_at"`
+		Version       int    `json:"version"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	version, ok := requireVersion(c, req.Version)
+	if !ok {
+		return
+	}
 	if len(req.ChildOrderIDs) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "child_order_ids is empty"})
 		return
@@ -1943,114 +2607,140 @@ func (a *API) renewOrderGroupSelected(c *gin.Context) {
 		}
 		expiresAt = t
 	}
-	if err := a.orders.RenewOrderGroupSelected(c.Request.Context(), id, req.ChildOrderIDs, req.MoreDays, expiresAt); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := a.orders.RenewOrderGroupSelected(service.WithExpectedVersion(c.Request.Context(), version), id, req.ChildOrderIDs, req.MoreDays, expiresAt); err != nil {
+		a.respondOrderWriteError(c, id, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
-func (a *API) deactivateOrder(c *gin.Context) {
+func (a *API) listOrderScheduledActions(c *gin.Context) {
 	id, ok := parseUintParam(c, "id")
 	if !ok {
 		return
 	}
-	if err := a.orders.DeactivateOrder(c.Request.Context(), id, model.OrderStatusDisabled); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	rows, err := a.actions.List(service.ScheduledActionQuery{OrderID: id, Status: c.Query("status")})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"ok": true})
+	c.JSON(http.StatusOK, rows)
 }
 
-func (a *API) activateOrder(c *gin.Context) {
-	id, ok := parseUintParam(c, "id")
-	if !ok {
-		return
-	}
-	if err := a.orders.ActivateOrder(c.Request.Context(), id); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+func (a *API) listScheduledActions(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "200"))
+	rows, err := a.actions.List(service.ScheduledActionQuery{Status: c.DefaultQuery("status", model.ScheduledActionPending), Limit: limit})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"ok": true})
+	c.JSON(http.StatusOK, rows)
 }
 
-func (a *API) renewOrder(c *gin.Context) {
-	id, ok := parseUintParam(c, "id")
-	if !ok {
+func (a *API) listReminders(c *gin.Context) {
+	customerID, _ := strconv.ParseUint(c.Query("customer_id"), 10, 64)
+	orderID, _ := strconv.ParseUint(c.Query("order_id"), 10, 64)
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "200"))
+	rows, err := a.reminders.List(service.ReminderQuery{CustomerID: uint(customerID), OrderID: uint(orderID), Status: c.Query("status"), Limit: limit})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	var req struct {
-		MoreDays  int    `json:"more_days"`
-		ExpiresAt string `json:"expires_at"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) runReminders(c *gin.Context) {
+	result, err := a.reminders.RunDue(c.Request.Context(), time.Now())
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	var expiresAt time.Time
-	if strings.TrimSpace(req.ExpiresAt) != "" {
-		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expires_at, expect RFC3339"})
-			return
-		}
-		expiresAt = t
+	a.store.AddTaskLog("info", "renewal reminders sent", fmt.Sprintf("messages=%d orders=%d failed=%d by %s", result.Messages, result.Orders, result.Failed, c.GetString("username")))
+	c.JSON(http.StatusOK, result)
+}
+
+func (a *API) listIntegrityChecks(c *gin.Context) {
+	c.JSON(http.StatusOK, a.integrity.Checks())
+}
+
+func (a *API) integrityReport(c *gin.Context) {
+	checks := []string{}
+	if raw := strings.TrimSpace(c.Query("checks")); raw != "" {
+		checks = strings.Split(raw, ",")
 	}
-	if err := a.orders.RenewOrderWithExpiresAt(c.Request.Context(), id, req.MoreDays, expiresAt); err != nil {
+	report, err := a.integrity.Run(c.Request.Context(), service.IntegrityRunInput{Checks: checks, Trigger: service.IntegrityTriggerManual})
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"ok": true})
+	c.JSON(http.StatusOK, report)
 }
 
-func (a *API) batchDeactivateOrders(c *gin.Context) {
+func (a *API) repairIntegrity(c *gin.Context) {
 	var req struct {
-		OrderIDs []uint `json:"order_ids"`
-		Status   string `json:"status"`
+		Checks []string `json:"checks"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if len(req.OrderIDs) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order_ids is empty"})
+	report, err := a.integrity.Run(c.Request.Context(), service.IntegrityRunInput{Checks: req.Checks, Repair: true, Trigger: service.IntegrityTriggerManual})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if req.Status == "" {
-		req.Status = model.OrderStatusDisabled
-	}
-	results := a.orders.BatchDeactivate(c.Request.Context(), req.OrderIDs, req.Status)
-	c.JSON(http.StatusOK, gin.H{"results": results})
+	a.store.AddTaskLog("info", "integrity repair", fmt.Sprintf("run %d: errors=%d warnings=%d repaired=%d by %s", report.RunID, report.Errors, report.Warnings, report.Repaired, c.GetString("username")))
+	c.JSON(http.StatusOK, report)
 }
 
-func (a *API) batchActivateOrders(c *gin.Context) {
-	var req struct {
-		OrderIDs []uint `json:"order_ids"`
+func (a *API) listIntegrityRuns(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	rows, err := a.integrity.ListRuns(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) getIntegrityRun(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
 		return
 	}
-	if len(req.OrderIDs) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order_ids is empty"})
+	report, err := a.integrity.GetRun(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
-	results := a.orders.BatchActivate(c.Request.Context(), req.OrderIDs)
-	c.JSON(http.StatusOK, gin.H{"results": results})
+	c.JSON(http.StatusOK, report)
 }
 
-func (a *API) batchRenewOrders(c *gin.Context) {
+func (a *API) createOrderScheduledAction(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
 	var req struct {
-		OrderIDs  []uint `json:"order_ids"`
-		MoreDays  int    `json:"more_days"`
-		ExpiresAt string `json:"expires_at"`
+		Action                string `json:"action"`
+		RunAt                 string `json:"run_at"`
+		MoreDays              int    `json:"more_days"`
+		ExpiresAt             string `json:"expires_at"`
+		ChildOrderIDs         []uint `json:"child_order_ids"`
+		Protocol              string `json:"protocol"`
+		DedicatedInboundID    uint   `json:"dedicated_inbound_id"`
+		DedicatedIngressID    uint   `json:"dedicated_ingress_id"`
+		RegenerateCredentials bool   `json:"regenerate_credentials"`
+		MaxAttempts           int    `json:"max_attempts"`
+		Note                  string `json:"note"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if len(req.OrderIDs) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order_ids is empty"})
+	runAt, err := time.Parse(time.RFC3339, strings.TrimSpace(req.RunAt))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid run_at, expect RFC3339"})
 		return
 	}
 	var expiresAt time.Time
@@ -2062,42 +2752,464 @@ func (a *API) batchRenewOrders(c *gin.Context) {
 		}
 		expiresAt = t
 	}
-	if expiresAt.IsZero() && req.MoreDays <= 0 {
-		req.MoreDays = 30
+	row, err := a.actions.Create(service.ScheduledActionInput{
+		OrderID: id,
+		Action:  req.Action,
+		RunAt:   runAt,
+		Params: service.ScheduledActionParams{
+			Days:                  req.MoreDays,
+			ExpiresAt:             expiresAt,
+			ChildOrderIDs:         req.ChildOrderIDs,
+			Protocol:              req.Protocol,
+			DedicatedInboundID:    req.DedicatedInboundID,
+			DedicatedIngressID:    req.DedicatedIngressID,
+			RegenerateCredentials: req.RegenerateCredentials,
+		},
+		MaxAttempts: req.MaxAttempts,
+		Note:        req.Note,
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	results := a.orders.BatchRenewWithExpiresAt(c.Request.Context(), req.OrderIDs, req.MoreDays, expiresAt)
-	c.JSON(http.StatusOK, gin.H{"results": results})
+	c.JSON(http.StatusOK, row)
 }
 
-func (a *API) batchResyncOrders(c *gin.Context) {
-	var req struct {
-		OrderIDs []uint `json:"order_ids"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+func (a *API) cancelScheduledAction(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
 		return
 	}
-	if len(req.OrderIDs) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order_ids is empty"})
+	if err := a.actions.Cancel(id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	results := a.orders.BatchResync(c.Request.Context(), req.OrderIDs)
-	c.JSON(http.StatusOK, gin.H{"results": results})
+	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
-func (a *API) batchTestOrders(c *gin.Context) {
+func (a *API) transferOrder(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	var req service.TransferOrderInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Operator = c.GetString("username")
+	ctx, capacity := service.WithCapacityWarnings(c.Request.Context())
+	order, err := a.orders.TransferOrder(ctx, id, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a.store.AddTaskLog("info", "order transferred", fmt.Sprintf("order=%d to customer=%d by %s", id, req.CustomerID, req.Operator))
+	c.JSON(http.StatusOK, gin.H{"order": order, "warnings": capacity()})
+}
+
+// appendNewWarnings adds the warnings a write reported that the pre-write
+// preview did not already show.
+func appendNewWarnings(warnings []string, extra []string) []string {
+	seen := make(map[string]struct{}, len(warnings))
+	for _, w := range warnings {
+		seen[w] = struct{}{}
+	}
+	for _, w := range extra {
+		if _, ok := seen[w]; ok {
+			continue
+		}
+		seen[w] = struct{}{}
+		warnings = append(warnings, w)
+	}
+	return warnings
+}
+
+func (a *API) listOrderTransfers(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	rows, err := a.orders.ListOrderTransfers(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) rotateOrderIPs(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	var req service.RotateOrderIPInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Operator = c.GetString("username")
+	rows, err := a.orders.RotateOrderIPs(c.Request.Context(), id, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a.store.AddTaskLog("info", "order ip rotated", fmt.Sprintf("order=%d items=%d by %s", id, len(rows), req.Operator))
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) convertTrialOrder(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		service.ConvertTrialInput
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input := req.ConvertTrialInput
+	if strings.TrimSpace(req.ExpiresAt) != "" {
+		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expires_at, expect RFC3339"})
+			return
+		}
+		input.ExpiresAt = t
+	}
+	order, err := a.orders.ConvertTrialOrder(c.Request.Context(), id, input)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a.store.AddTaskLog("info", "trial converted", fmt.Sprintf("order=%s expires=%s by %s", order.OrderNo, order.ExpiresAt.Format(time.RFC3339), c.GetString("username")))
+	c.JSON(http.StatusOK, order)
+}
+
+func (a *API) listOrderIPHistory(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	rows, err := a.orders.ListOrderIPHistory(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) listOrderVersions(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	rows, err := a.orders.ListOrderVersions(id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) getOrderVersion(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil || version <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		return
+	}
+	row, err := a.orders.GetOrderVersion(id, version)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, row)
+}
+
+func (a *API) diffOrderVersions(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	from, err := strconv.Atoi(strings.TrimSpace(c.Query("from")))
+	if err != nil || from <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from version"})
+		return
+	}
+	to, err := strconv.Atoi(strings.TrimSpace(c.DefaultQuery("to", "0")))
+	if err != nil || to < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to version"})
+		return
+	}
+	diff, err := a.orders.DiffOrderVersions(id, from, to)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, diff)
+}
+
+func (a *API) revertOrderVersion(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil || version <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid version"})
+		return
+	}
+	row, err := a.orders.RevertOrderVersion(c.Request.Context(), id, version)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a.store.AddTaskLog("info", "order reverted", fmt.Sprintf("order=%d to version=%d as version=%d by %s", id, version, row.Version, c.GetString("username")))
+	c.JSON(http.StatusOK, row)
+}
+
+func (a *API) listReservations(c *gin.Context) {
+	customerID, _ := strconv.ParseUint(strings.TrimSpace(c.Query("customer_id")), 10, 64)
+	rows, err := a.orders.ListReservations(uint(customerID), c.Query("status"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) createReservation(c *gin.Context) {
+	var req struct {
+		service.CreateReservationInput
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input := req.CreateReservationInput
+	if strings.TrimSpace(req.ExpiresAt) != "" {
+		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expires_at, expect RFC3339"})
+			return
+		}
+		input.ExpiresAt = t
+	}
+	input.Operator = c.GetString("username")
+	row, err := a.orders.CreateReservation(input)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a.store.AddTaskLog("info", "reservation created", fmt.Sprintf("reservation=%d customer=%d items=%d by %s", row.ID, row.CustomerID, len(row.Items), input.Operator))
+	c.JSON(http.StatusOK, row)
+}
+
+func (a *API) releaseReservation(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	if err := a.orders.ReleaseReservation(id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a.store.AddTaskLog("info", "reservation released", fmt.Sprintf("reservation=%d by %s", id, c.GetString("username")))
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (a *API) convertReservation(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		service.ConvertReservationInput
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	input := req.ConvertReservationInput
+	if strings.TrimSpace(req.ExpiresAt) != "" {
+		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expires_at, expect RFC3339"})
+			return
+		}
+		input.ExpiresAt = t
+	}
+	order, err := a.orders.ConvertReservation(c.Request.Context(), id, input)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a.store.AddTaskLog("info", "reservation converted", fmt.Sprintf("reservation=%d order=%d by %s", id, order.ID, c.GetString("username")))
+	c.JSON(http.StatusOK, order)
+}
+
+func (a *API) deactivateOrder(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	if err := a.orders.DeactivateOrder(c.Request.Context(), id, model.OrderStatusDisabled); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (a *API) activateOrder(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	if err := a.orders.ActivateOrder(c.Request.Context(), id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (a *API) renewOrder(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		MoreDays  int    `json:"more_days"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var expiresAt time.Time
+	if strings.TrimSpace(req.ExpiresAt) != "" {
+		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expires_at, expect RFC3339"})
+			return
+		}
+		expiresAt = t
+	}
+	if err := a.orders.RenewOrderWithExpiresAt(c.Request.Context(), id, req.MoreDays, expiresAt); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (a *API) batchDeactivateOrders(c *gin.Context) {
+	var req struct {
+		OrderIDs      []uint `json:"order_ids"`
+		Status        string `json:"status"`
+		SavedFilterID uint   `json:"saved_filter_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	orderIDs, ok := a.resolveBatchOrderIDs(c, req.OrderIDs, req.SavedFilterID)
+	if !ok {
+		return
+	}
+	if req.Status == "" {
+		req.Status = model.OrderStatusDisabled
+	}
+	results := a.orders.BatchDeactivate(c.Request.Context(), orderIDs, req.Status)
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+func (a *API) batchActivateOrders(c *gin.Context) {
+	var req struct {
+		OrderIDs      []uint `json:"order_ids"`
+		SavedFilterID uint   `json:"saved_filter_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	orderIDs, ok := a.resolveBatchOrderIDs(c, req.OrderIDs, req.SavedFilterID)
+	if !ok {
+		return
+	}
+	results := a.orders.BatchActivate(c.Request.Context(), orderIDs)
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+func (a *API) batchRenewOrders(c *gin.Context) {
+	var req struct {
+		OrderIDs      []uint `json:"order_ids"`
+		MoreDays      int    `json:"more_days"`
+		ExpiresAt     string `json:"expires_at"`
+		SavedFilterID uint   `json:"saved_filter_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	orderIDs, ok := a.resolveBatchOrderIDs(c, req.OrderIDs, req.SavedFilterID)
+	if !ok {
+		return
+	}
+	var expiresAt time.Time
+	if strings.TrimSpace(req.ExpiresAt) != "" {
+		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid expires_at, expect RFC3339"})
+			return
+		}
+		expiresAt = t
+	}
+	if expiresAt.IsZero() && req.MoreDays <= 0 {
+		req.MoreDays = 30
+	}
+	results := a.orders.BatchRenewWithExpiresAt(c.Request.Context(), orderIDs, req.MoreDays, expiresAt)
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+func (a *API) batchResyncOrders(c *gin.Context) {
 	var req struct {
-		OrderIDs []uint `json:"order_ids"`
+		OrderIDs      []uint `json:"order_ids"`
+		SavedFilterID uint   `json:"saved_filter_id"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if len(req.OrderIDs) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order_ids is empty"})
+	orderIDs, ok := a.resolveBatchOrderIDs(c, req.OrderIDs, req.SavedFilterID)
+	if !ok {
+		return
+	}
+	results := a.orders.BatchResync(c.Request.Context(), orderIDs)
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+func (a *API) batchTestOrders(c *gin.Context) {
+	var req struct {
+		OrderIDs      []uint `json:"order_ids"`
+		SavedFilterID uint   `json:"saved_filter_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	orderIDs, ok := a.resolveBatchOrderIDs(c, req.OrderIDs, req.SavedFilterID)
+	if !ok {
 		return
 	}
-	results := a.orders.BatchTest(req.OrderIDs)
+	results := a.orders.BatchTest(orderIDs)
 	c.JSON(http.StatusOK, gin.H{"results": results})
 }
 
@@ -2107,13 +3219,14 @@ func (a *API) batchExportOrders(c *gin.Context) {
 		Format               string `json:"format"`
 		IncludeRawSocks5     bool   `json:"include_raw_socks5"`
 		ResidentialTXTLayout string `json:"residential_txt_layout"`
+		SavedFilterID        uint   `json:"saved_filter_id"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if len(req.OrderIDs) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "order_ids is empty"})
+	orderIDs, ok := a.resolveBatchOrderIDs(c, req.OrderIDs, req.SavedFilterID)
+	if !ok {
 		return
 	}
 	format := strings.ToLower(strings.TrimSpace(req.Format))
@@ -2121,7 +3234,7 @@ func (a *API) batchExportOrders(c *gin.Context) {
 		format = "txt"
 	}
 	if format == "xlsx" {
-		data, filename, contentType, err := a.orders.BatchExportArtifact(req.OrderIDs, service.XLSXExportOptions{
+		data, filename, contentType, err := a.orders.BatchExportArtifact(orderIDs, service.XLSXExportOptions{
 			Shuffle:          false,
 			IncludeRawSocks5: req.IncludeRawSocks5,
 		})
@@ -2133,7 +3246,7 @@ func (a *API) batchExportOrders(c *gin.Context) {
 		c.Data(http.StatusOK, contentType, data)
 		return
 	}
-	text, filename, err := a.orders.BatchExport(req.OrderIDs, req.ResidentialTXTLayout, req.IncludeRawSocks5)
+	text, filename, err := a.orders.BatchExport(orderIDs, req.ResidentialTXTLayout, req.IncludeRawSocks5)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -2142,6 +3255,138 @@ func (a *API) batchExportOrders(c *gin.Context) {
 	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(text))
 }
 
+func (a *API) batchTagOrders(c *gin.Context) {
+	var req struct {
+		OrderIDs      []uint `json:"order_ids"`
+		SavedFilterID uint   `json:"saved_filter_id"`
+		Add           string `json:"add"`
+		Remove        string `json:"remove"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Add) == "" && strings.TrimSpace(req.Remove) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "add or remove is required"})
+		return
+	}
+	orderIDs, ok := a.resolveBatchOrderIDs(c, req.OrderIDs, req.SavedFilterID)
+	if !ok {
+		return
+	}
+	results := a.orders.BatchTagOrders(c.Request.Context(), orderIDs, req.Add, req.Remove)
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// resolveBatchOrderIDs lets batch endpoints target either explicit order_ids
+// or every order matching one of the caller's saved filters.
+func (a *API) resolveBatchOrderIDs(c *gin.Context, orderIDs []uint, savedFilterID uint) ([]uint, bool) {
+	if savedFilterID == 0 {
+		if len(orderIDs) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "order_ids is empty"})
+			return nil, false
+		}
+		return orderIDs, true
+	}
+	if len(orderIDs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "use either order_ids or saved_filter_id"})
+		return nil, false
+	}
+	filter, err := a.orders.GetSavedFilter(c.GetString("username"), savedFilterID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	ids, err := a.orders.MatchingOrderIDs(service.ApplySavedFilter(service.ListOrdersInput{}, *filter))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if len(ids) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "saved filter matches no orders"})
+		return nil, false
+	}
+	return ids, true
+}
+
+func (a *API) setOrderLabels(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		service.OrderLabelsInput
+		Version int `json:"version"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	version, ok := requireVersion(c, req.Version)
+	if !ok {
+		return
+	}
+	order, err := a.orders.SetOrderLabels(service.WithExpectedVersion(c.Request.Context(), version), id, req.OrderLabelsInput)
+	if err != nil {
+		a.respondOrderWriteError(c, id, err)
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+func (a *API) listSavedFilters(c *gin.Context) {
+	rows, err := a.orders.ListSavedFilters(c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) createSavedFilter(c *gin.Context) {
+	var req service.SavedFilterInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	row, err := a.orders.SaveFilter(c.GetString("username"), 0, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, row)
+}
+
+func (a *API) updateSavedFilter(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	var req service.SavedFilterInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	row, err := a.orders.SaveFilter(c.GetString("username"), id, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, row)
+}
+
+func (a *API) deleteSavedFilter(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	if err := a.orders.DeleteSavedFilter(c.GetString("username"), id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
 func (a *API) exportOrder(c *gin.Context) {
 	id, ok := parseUintParam(c, "id")
 	if !ok {
@@ -2289,6 +3534,64 @@ func (a *API) confirmImport(c *gin.Context) {
 	c.JSON(http.StatusOK, order)
 }
 
+func (a *API) downloadBulkOrderTemplate(c *gin.Context) {
+	body, filename, err := service.BulkOrderTemplateXLSX()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	setAttachmentFilename(c, filename)
+	c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", body)
+}
+
+func readUploadedFile(c *gin.Context) ([]byte, bool) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return nil, false
+	}
+	h, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	defer h.Close()
+	body, err := io.ReadAll(h)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return body, true
+}
+
+func (a *API) previewBulkOrders(c *gin.Context) {
+	body, ok := readUploadedFile(c)
+	if !ok {
+		return
+	}
+	result, err := a.orders.PreviewBulkOrders(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (a *API) confirmBulkOrders(c *gin.Context) {
+	body, ok := readUploadedFile(c)
+	if !ok {
+		return
+	}
+	skipInvalid := strings.ToLower(strings.TrimSpace(c.DefaultPostForm("skip_invalid", "false"))) == "true"
+	result, err := a.orders.CreateBulkOrders(c.Request.Context(), body, skipInvalid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "result": result})
+		return
+	}
+	a.store.AddTaskLog("info", "bulk orders created", fmt.Sprintf("created=%d failed=%d total=%d by %s", result.Created, result.Failed, result.Total, c.GetString("username")))
+	c.JSON(http.StatusOK, result)
+}
+
 func (a *API) ensureUnassignedCustomer() (uint, error) {
 	const customerName = "未分配客户"
 	const customerCode = "UNASSIGNED"
@@ -2346,9 +3649,108 @@ func (a *API) updateSettings(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if a.geoip != nil && hasGeoIPSettings(clean) {
+		if err := a.geoip.Reload(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
+func hasGeoIPSettings(values map[string]string) bool {
+	for k := range values {
+		if strings.HasPrefix(k, "geoip_") {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *API) getGeoIPStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, a.geoip.Status())
+}
+
+func (a *API) uploadGeoIPDatabase(c *gin.Context) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	h, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer h.Close()
+	status, err := a.geoip.Install(c.PostForm("kind"), h)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	a.store.AddTaskLog("info", "geoip database updated", fmt.Sprintf("%s %s", status.Kind, status.DatabaseType))
+	c.JSON(http.StatusOK, status)
+}
+
+func (a *API) listBenchmarks(c *gin.Context) {
+	targetID, _ := strconv.ParseUint(strings.TrimSpace(c.Query("target_id")), 10, 64)
+	limit, _ := strconv.Atoi(strings.TrimSpace(c.Query("limit")))
+	rows, err := a.benchmark.History(c.Query("target_type"), uint(targetID), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rows)
+}
+
+func (a *API) runBenchmarks(c *gin.Context) {
+	if a.benchmark.Running() {
+		c.JSON(http.StatusConflict, gin.H{"error": "benchmark is already running"})
+		return
+	}
+	go func() {
+		if err := a.benchmark.RunAll(context.Background()); err != nil {
+			a.logger.Warn("upstream benchmark run failed", zap.Error(err))
+		}
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"started": true})
+}
+
+func (a *API) benchmarkForwardOutbound(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	row, err := a.benchmark.BenchmarkOutbound(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, row)
+}
+
+func (a *API) benchmarkDedicatedEgress(c *gin.Context) {
+	id, ok := parseUintParam(c, "id")
+	if !ok {
+		return
+	}
+	row, err := a.benchmark.BenchmarkDedicatedEgress(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, row)
+}
+
+func (a *API) lookupGeoIP(c *gin.Context) {
+	info, err := a.geoip.Lookup(c.Query("ip"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
 func (a *API) testBark(c *gin.Context) {
 	title := "XrayTool Bark 测试通知"
 	body := fmt.Sprintf("测试时间: %s", time.Now().Format("2006-01-02 15:04:05"))
@@ -2588,13 +3990,60 @@ func sanitizeSettingsUpdate(in map[string]string) map[string]string {
 		"dedicated_vless_path":                  {},
 		"dedicated_vless_host":                  {},
 		"residential_name_prefix":               {},
+		"egress_pool_probe_url":                 {},
+		"egress_pool_probe_interval":            {},
+		"forward_probe_enabled":                 {},
+		"forward_probe_interval_seconds":        {},
+		"forward_probe_failure_threshold":       {},
+		"forward_probe_auto_rehome":             {},
+		"forward_probe_history_days":            {},
+		"geoip_db_path":                         {},
+		"geoip_asn_db_path":                     {},
+		"geoip_online_fallback":                 {},
+		"benchmark_enabled":                     {},
+		"benchmark_interval_minutes":            {},
+		"benchmark_target_url":                  {},
+		"benchmark_max_bytes":                   {},
+		"benchmark_timeout_seconds":             {},
+		"benchmark_history_days":                {},
+		"benchmark_ranking_enabled":             {},
+		"forward_capacity_policy":               {},
+		"billing_auto_renew_enabled":            {},
+		"billing_auto_renew_lead_hours":         {},
+		"billing_currency":                      {},
+		"invoice_pdf_font_path":                 {},
+		"payment_webhook_secret":                {},
+		"host_ip_cooldown_hours":                {},
+		"host_ip_max_customers":                 {},
+		"host_ip_max_items":                     {},
+		"trial_max_days":                        {},
+		"trial_max_per_customer":                {},
+		"trial_grace_hours":                     {},
+		"recycle_bin_retention_days":            {},
+		"order_history_keep":                    {},
+		"integrity_enabled":                     {},
+		"integrity_interval_minutes":            {},
+		"integrity_auto_repair":                 {},
+		"integrity_history_days":                {},
+		"expiry_grace_hours":                    {},
+		"expiry_final_hours":                    {},
+		"reminder_offsets":                      {},
+		"reminder_subject":                      {},
+		"reminder_template":                     {},
+		"reminder_admin_bark":                   {},
+		"smtp_host":                             {},
+		"smtp_port":                             {},
+		"smtp_username":                         {},
+		"smtp_password":                         {},
+		"smtp_from":                             {},
+		"telegram_bot_token":                    {},
 	}
 	for k, v := range in {
 		k = strings.TrimSpace(k)
 		if _, ok := allowed[k]; !ok {
 			continue
 		}
-		if k == "bark_enabled" || k == "gosealight_telemetry_enabled" {
+		if k == "bark_enabled" || k == "gosealight_telemetry_enabled" || k == "forward_probe_enabled" || k == "forward_probe_auto_rehome" || k == "geoip_online_fallback" || k == "benchmark_enabled" || k == "benchmark_ranking_enabled" || k == "billing_auto_renew_enabled" || k == "reminder_admin_bark" || k == "integrity_enabled" || k == "integrity_auto_repair" {
 			vv := strings.ToLower(strings.TrimSpace(v))
 			switch vv {
 			case "1", "true", "on", "yes":
@@ -2604,11 +4053,60 @@ func sanitizeSettingsUpdate(in map[string]string) map[string]string {
 			}
 			continue
 		}
+		if k == "forward_capacity_policy" {
+			if strings.ToLower(strings.TrimSpace(v)) == service.ForwardCapacityPolicyWarn {
+				out[k] = service.ForwardCapacityPolicyWarn
+			} else {
+				out[k] = service.ForwardCapacityPolicyRefuse
+			}
+			continue
+		}
 		out[k] = strings.TrimSpace(v)
 	}
 	return out
 }
 
+// requireVersion returns the version a write is based on, taken from
+// If-Match or else the request body. Writes without one are refused so that
+// concurrent edits cannot silently overwrite each other.
+func requireVersion(c *gin.Context, bodyVersion int) (int, bool) {
+	raw := strings.TrimSpace(c.GetHeader("If-Match"))
+	raw = strings.Trim(strings.TrimPrefix(raw, "W/"), `"`)
+	if raw == "" {
+		if bodyVersion > 0 {
+			return bodyVersion, true
+		}
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "version is required, send If-Match or a version field"})
+		return 0, false
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid If-Match version"})
+		return 0, false
+	}
+	return v, true
+}
+
+func formVersion(c *gin.Context) int {
+	v, _ := strconv.Atoi(strings.TrimSpace(c.PostForm("version")))
+	return v
+}
+
+// respondOrderWriteError answers a stale write with 409 and the order as it
+// is now, and anything else with 400.
+func (a *API) respondOrderWriteError(c *gin.Context, id uint, err error) {
+	if !errors.Is(err, service.ErrVersionConflict) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	current, loadErr := a.orders.GetOrder(id)
+	if loadErr != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "current": current})
+}
+
 func parseUintParam(c *gin.Context, key string) (uint, bool) {
 	v, err := strconv.ParseUint(c.Param(key), 10, 64)
 	if err != nil {
@@ -2621,7 +4119,7 @@ func parseUintParam(c *gin.Context, key string) (uint, bool) {
 func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
 		if c.Request.Method == http.MethodOptions {
 			c.AbortWithStatus(http.StatusNoContent)
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequireVersionPrefersIfMatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newContext := func(ifMatch string) (*gin.Context, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPut, "/api/orders/1", nil)
+		if ifMatch != "" {
+			c.Request.Header.Set("If-Match", ifMatch)
+		}
+		return c, w
+	}
+
+	c, _ := newContext(`W/"7"`)
+	if v, ok := requireVersion(c, 3); !ok || v != 7 {
+		t.Fatalf("expected If-Match version 7, got %d %v", v, ok)
+	}
+	c, _ = newContext("")
+	if v, ok := requireVersion(c, 3); !ok || v != 3 {
+		t.Fatalf("expected body version 3, got %d %v", v, ok)
+	}
+	c, w := newContext("")
+	if _, ok := requireVersion(c, 0); ok || w.Code != http.StatusPreconditionRequired {
+		t.Fatalf("expected 428 without a version, got %d", w.Code)
+	}
+	c, w = newContext("abc")
+	if _, ok := requireVersion(c, 3); ok || w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a malformed If-Match, got %d", w.Code)
+	}
+}
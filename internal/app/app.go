@@ -47,6 +47,8 @@ func Run() error {
 		"gosealight_node_username":              cfg.GoSeaTelemetry.Username,
 		"gosealight_node_password":              cfg.GoSeaTelemetry.Password,
 		"gosealight_telemetry_interval_seconds": strconv.Itoa(cfg.GoSeaTelemetry.IntervalSeconds),
+		"geoip_db_path":                         cfg.GeoIPDBPath,
+		"geoip_asn_db_path":                     cfg.GeoIPASNDBPath,
 	}); err != nil {
 		return err
 	}
@@ -75,17 +77,31 @@ func Run() error {
 		return fmt.Errorf("start managed xray failed: %w", err)
 	}
 
+	geoSvc := service.NewGeoIPService(st)
+	if err := geoSvc.Reload(); err != nil {
+		logger.Warn("load geoip database failed", zap.Error(err))
+		st.AddTaskLog("warn", "load geoip database failed", err.Error())
+	}
+	service.SetDefaultGeoIP(geoSvc)
+
 	orderSvc := service.NewOrderService(database, xrayManager, logger)
 	singboxSvc := service.NewSingboxImportService(database, orderSvc)
 	nodeSvc := service.NewNodeService(database, logger)
 	forwardSvc := service.NewForwardOutboundService(database)
+	poolSvc := service.NewEgressPoolService(database, xrayManager)
 	barkSvc := service.NewBarkService(database)
 	runtimeSvc := service.NewRuntimeStatsService(database, xrayManager)
 	telemetrySvc := service.NewGoSeaLightTelemetryService(st, runtimeSvc, cfg.GoSeaTelemetry, logger)
+	healthSvc := service.NewForwardHealthService(database, st, forwardSvc, orderSvc, barkSvc, logger)
+	benchmarkSvc := service.NewUpstreamBenchmarkService(database, st, logger)
+	billingSvc := service.NewBillingService(database, st, orderSvc, barkSvc, logger)
+	actionSvc := service.NewScheduledActionService(database, st, orderSvc, logger)
+	reminderSvc := service.NewReminderService(database, barkSvc, logger)
+	integritySvc := service.NewIntegrityService(database, st, orderSvc, barkSvc, logger)
 	backupSvc := service.NewBackupService(cfg, database, logger)
-	scheduler := service.NewScheduler(database, orderSvc, barkSvc, runtimeSvc, telemetrySvc, logger, cfg.SchedulerInterval)
+	scheduler := service.NewScheduler(database, orderSvc, barkSvc, runtimeSvc, telemetrySvc, healthSvc, benchmarkSvc, billingSvc, actionSvc, reminderSvc, integritySvc, logger, cfg.SchedulerInterval)
 
-	engine := api.New(database, st, orderSvc, singboxSvc, nodeSvc, forwardSvc, hostSvc, backupSvc, barkSvc, runtimeSvc, cfg, logger).Router()
+	engine := api.New(database, st, orderSvc, singboxSvc, nodeSvc, forwardSvc, poolSvc, hostSvc, backupSvc, barkSvc, runtimeSvc, geoSvc, benchmarkSvc, billingSvc, actionSvc, reminderSvc, integritySvc, cfg, logger).Router()
 	if err := ensureListenAddrAvailable(cfg.ListenAddr); err != nil {
 		return err
 	}
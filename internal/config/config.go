@@ -24,6 +24,8 @@ type Config struct {
 	XrayCommandTag      string
 	SchedulerInterval   time.Duration
 	BarkBaseURLFallback string
+	GeoIPDBPath         string
+	GeoIPASNDBPath      string
 	GoSeaTelemetry      GoSeaTelemetryConfig
 }
 
@@ -57,6 +59,8 @@ func Load() Config {
 		XrayCommandTag:      "api",
 		SchedulerInterval:   time.Duration(getEnvInt("XTOOL_SCHEDULER_SECONDS", 30)) * time.Second,
 		BarkBaseURLFallback: getEnv("XTOOL_BARK_BASE_URL", ""),
+		GeoIPDBPath:         getEnv("XTOOL_GEOIP_DB", filepath.Join(dataDir, "geoip", "GeoLite2-City.mmdb")),
+		GeoIPASNDBPath:      getEnv("XTOOL_GEOIP_ASN_DB", filepath.Join(dataDir, "geoip", "GeoLite2-ASN.mmdb")),
 		GoSeaTelemetry: GoSeaTelemetryConfig{
 			Enabled:         getEnvBool("XTOOL_GOSEALIGHT_TELEMETRY_ENABLED", false),
 			BaseURL:         getEnv("XTOOL_GOSEALIGHT_BASE_URL", ""),
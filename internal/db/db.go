@@ -31,12 +31,30 @@ func Open(path string) (*gorm.DB, error) {
 		&model.HostIP{},
 		&model.XrayNode{},
 		&model.SocksOutbound{},
+		&model.SocksOutboundProbe{},
+		&model.UpstreamBenchmark{},
+		&model.EgressPool{},
+		&model.EgressPoolMember{},
 		&model.DedicatedEntry{},
 		&model.DedicatedInbound{},
 		&model.DedicatedIngress{},
+		&model.Product{},
 		&model.Order{},
 		&model.OrderItem{},
 		&model.DedicatedEgress{},
+		&model.LedgerEntry{},
+		&model.PaymentEvent{},
+		&model.ScheduledAction{},
+		&model.OrderTransfer{},
+		&model.OrderItemIPHistory{},
+		&model.HostIPAssignment{},
+		&model.Reservation{},
+		&model.ReservationItem{},
+		&model.RecycleBinEntry{},
+		&model.ReminderLog{},
+		&model.SavedFilter{},
+		&model.OrderVersion{},
+		&model.IntegrityRun{},
 		&model.XrayResource{},
 		&model.Setting{},
 		&model.TaskLog{},
@@ -62,6 +80,9 @@ func Open(path string) (*gorm.DB, error) {
 	if err := migrateRuntimeSnapshotIndex(database); err != nil {
 		return nil, err
 	}
+	if err := migrateSocksOutboundType(database); err != nil {
+		return nil, err
+	}
 	return database, nil
 }
 
@@ -117,6 +138,12 @@ func migrateRuntimeSnapshotIndex(database *gorm.DB) error {
 	return database.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_runtime_snapshot_scope_key_bucket ON runtime_traffic_snapshots(scope, entity_key, bucket_at)").Error
 }
 
+func migrateSocksOutboundType(database *gorm.DB) error {
+	return database.Model(&model.SocksOutbound{}).
+		Where("coalesce(type, '') = ''").
+		Update("type", model.OutboundTypeSocks5).Error
+}
+
 func migrateDedicatedEntryToInboundIngress(database *gorm.DB) error {
 	return database.Transaction(func(tx *gorm.DB) error {
 		entries := []model.DedicatedEntry{}
@@ -6,6 +6,23 @@ const (
 	OrderStatusActive   = "active"
 	OrderStatusExpired  = "expired"
 	OrderStatusDisabled = "disabled"
+	// OrderStatusSuspended marks orders taken offline by a customer
+	// suspension; unsuspending brings back exactly these.
+	OrderStatusSuspended = "suspended"
+
+	CustomerStatusActive    = "active"
+	CustomerStatusSuspended = "suspended"
+
+	// Expiry stages keep an active order online past expires_at until the
+	// scheduler cuts it off; an empty stage means the order is not overdue.
+	ExpiryStageGrace = "grace"
+	ExpiryStageFinal = "final"
+
+	ReminderChannelEmail    = "email"
+	ReminderChannelTelegram = "telegram"
+	ReminderChannelBark     = "bark"
+	ReminderStatusSent      = "sent"
+	ReminderStatusFailed    = "failed"
 
 	OrderItemStatusActive   = "active"
 	OrderItemStatusExpired  = "expired"
@@ -17,8 +34,48 @@ const (
 	OrderModeForward   = "forward"
 	OrderModeDedicated = "dedicated"
 
-	OutboundTypeDirect = "direct"
-	OutboundTypeSocks5 = "socks5"
+	HostIPTierShared    = "shared"
+	HostIPTierExclusive = "exclusive"
+
+	OutboundTypeDirect      = "direct"
+	OutboundTypeSocks5      = "socks5"
+	OutboundTypeHTTP        = "http"
+	OutboundTypeShadowsocks = "shadowsocks"
+	OutboundTypeVmess       = "vmess"
+
+	EgressPoolStrategyRandom    = "random"
+	EgressPoolStrategyLeastPing = "leastPing"
+	EgressPoolStrategyPrimary   = "primary"
+
+	LedgerEntryCharge     = "charge"
+	LedgerEntryPayment    = "payment"
+	LedgerEntryAdjustment = "adjustment"
+
+	PaymentEventProcessing = "processing"
+	PaymentEventApplied    = "applied"
+	PaymentEventCredited   = "credited"
+	PaymentEventFailed     = "failed"
+
+	ScheduledActionActivate          = "activate"
+	ScheduledActionDeactivate        = "deactivate"
+	ScheduledActionRenew             = "renew"
+	ScheduledActionSwitchProtocol    = "switch_protocol"
+	ScheduledActionRotateCredentials = "rotate_credentials"
+	ScheduledActionDelete            = "delete"
+
+	ScheduledActionPending   = "pending"
+	ScheduledActionRunning   = "running"
+	ScheduledActionDone      = "done"
+	ScheduledActionFailed    = "failed"
+	ScheduledActionCancelled = "cancelled"
+
+	ReservationStatusActive    = "active"
+	ReservationStatusConverted = "converted"
+	ReservationStatusReleased  = "released"
+	ReservationStatusExpired   = "expired"
+
+	BenchmarkTargetSocksOutbound   = "socks_outbound"
+	BenchmarkTargetDedicatedEgress = "dedicated_egress"
 
 	DedicatedFeatureMixed       = "mixed"
 	DedicatedFeatureVmess       = "vmess"
@@ -35,27 +92,42 @@ type Admin struct {
 }
 
 type Customer struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	Name      string    `gorm:"size:128;not null;uniqueIndex" json:"name"`
-	Code      string    `gorm:"size:64;index" json:"code"`
-	Contact   string    `gorm:"size:255" json:"contact"`
-	Notes     string    `gorm:"size:1024" json:"notes"`
-	Status    string    `gorm:"size:32;default:active" json:"status"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	Name       string    `gorm:"size:128;not null;uniqueIndex" json:"name"`
+	Code       string    `gorm:"size:64;index" json:"code"`
+	Contact    string    `gorm:"size:255" json:"contact"`
+	Email      string    `gorm:"size:128" json:"email"`
+	TgChatID   string    `gorm:"size:64" json:"telegram_chat_id"`
+	Notes      string    `gorm:"size:1024" json:"notes"`
+	Tags       string    `gorm:"size:512" json:"tags"`
+	Status     string    `gorm:"size:32;default:active" json:"status"`
+	Balance    float64   `gorm:"not null;default:0" json:"balance"`
+	AutoRenew  bool      `gorm:"default:false" json:"auto_renew"`
+	TrialLimit int       `gorm:"default:0" json:"trial_limit"`
+	TrialsUsed int       `gorm:"default:0" json:"trials_used"`
+	GraceHours *int      `json:"grace_hours"`
+	Version    int       `gorm:"not null;default:1" json:"version"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
 
 	Orders []Order `json:"orders,omitempty"`
 }
 
+// HostIP is a local address residential items egress from. An exclusive
+// tier serves a single customer; MaxCustomers/MaxItems of 0 fall back to the
+// global host_ip_max_* settings.
 type HostIP struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	IP        string    `gorm:"size:64;uniqueIndex;not null" json:"ip"`
-	IsPublic  bool      `gorm:"default:false" json:"is_public"`
-	IsLocal   bool      `gorm:"default:true" json:"is_local"`
-	Enabled   bool      `gorm:"default:true" json:"enabled"`
-	Comment   string    `gorm:"size:255" json:"comment"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	IP           string    `gorm:"size:64;uniqueIndex;not null" json:"ip"`
+	IsPublic     bool      `gorm:"default:false" json:"is_public"`
+	IsLocal      bool      `gorm:"default:true" json:"is_local"`
+	Enabled      bool      `gorm:"default:true" json:"enabled"`
+	Comment      string    `gorm:"size:255" json:"comment"`
+	Tier         string    `gorm:"size:16;not null;default:shared" json:"tier"`
+	MaxCustomers int       `gorm:"not null;default:0" json:"max_customers"`
+	MaxItems     int       `gorm:"not null;default:0" json:"max_items"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 
 	OrderItems []OrderItem `json:"order_items,omitempty"`
 }
@@ -73,25 +145,99 @@ type XrayNode struct {
 }
 
 type SocksOutbound struct {
-	ID           uint       `gorm:"primaryKey" json:"id"`
-	Name         string     `gorm:"size:128" json:"name"`
-	Address      string     `gorm:"size:128;not null;index" json:"address"`
-	Port         int        `gorm:"not null" json:"port"`
-	Username     string     `gorm:"size:128;not null" json:"username"`
-	Password     string     `gorm:"size:128;not null" json:"password"`
-	RouteUser    string     `gorm:"size:128;index" json:"route_user"`
-	ExitIP       string     `gorm:"size:64" json:"exit_ip"`
-	CountryCode  string     `gorm:"size:8;index" json:"country_code"`
-	Enabled      bool       `gorm:"default:true;index" json:"enabled"`
-	ProbeStatus  string     `gorm:"size:32" json:"probe_status"`
-	ProbeError   string     `gorm:"size:255" json:"probe_error"`
-	LastProbedAt *time.Time `json:"last_probed_at,omitempty"`
-	CreatedAt    time.Time  `json:"created_at"`
-	UpdatedAt    time.Time  `json:"updated_at"`
+	ID                  uint       `gorm:"primaryKey" json:"id"`
+	Name                string     `gorm:"size:128" json:"name"`
+	Type                string     `gorm:"size:16;not null;default:socks5;index" json:"type"`
+	Address             string     `gorm:"size:128;not null;index" json:"address"`
+	Port                int        `gorm:"not null" json:"port"`
+	Username            string     `gorm:"size:128;not null" json:"username"`
+	Password            string     `gorm:"size:128;not null" json:"password"`
+	Method              string     `gorm:"size:64" json:"method"`
+	UUID                string     `gorm:"size:64" json:"uuid"`
+	Security            string     `gorm:"size:32" json:"security"`
+	Network             string     `gorm:"size:16" json:"network"`
+	Path                string     `gorm:"size:255" json:"path"`
+	Host                string     `gorm:"size:255" json:"host"`
+	TLS                 bool       `gorm:"default:false" json:"tls"`
+	SNI                 string     `gorm:"size:255" json:"sni"`
+	RouteUser           string     `gorm:"size:128;index" json:"route_user"`
+	ExitIP              string     `gorm:"size:64" json:"exit_ip"`
+	CountryCode         string     `gorm:"size:8;index" json:"country_code"`
+	ASN                 uint       `json:"asn"`
+	ASOrg               string     `gorm:"size:255" json:"as_org"`
+	Enabled             bool       `gorm:"default:true;index" json:"enabled"`
+	ProbeStatus         string     `gorm:"size:32" json:"probe_status"`
+	ProbeError          string     `gorm:"size:255" json:"probe_error"`
+	LatencyMS           int64      `json:"latency_ms"`
+	FailStreak          int        `gorm:"not null;default:0" json:"fail_streak"`
+	LastProbedAt        *time.Time `json:"last_probed_at,omitempty"`
+	BenchConnectMS      int64      `json:"bench_connect_ms"`
+	BenchTTFBMS         int64      `gorm:"column:bench_ttfb_ms" json:"bench_ttfb_ms"`
+	BenchThroughputKbps int64      `json:"bench_throughput_kbps"`
+	BenchedAt           *time.Time `json:"benched_at,omitempty"`
+	MaxItems            int        `gorm:"not null;default:0" json:"max_items"`
+	MaxCustomers        int        `gorm:"not null;default:0" json:"max_customers"`
+	Supplier            string     `gorm:"size:128;index" json:"supplier"`
+	Cost                float64    `gorm:"not null;default:0" json:"cost"`
+	CostPeriodDays      int        `gorm:"not null;default:30" json:"cost_period_days"`
+	SupplierExpiresAt   *time.Time `json:"supplier_expires_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
 
 	OrderItems []OrderItem `json:"order_items,omitempty"`
 }
 
+type SocksOutboundProbe struct {
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	SocksOutboundID uint      `gorm:"not null;index" json:"socks_outbound_id"`
+	Status          string    `gorm:"size:16;not null;index" json:"status"`
+	LatencyMS       int64     `json:"latency_ms"`
+	ExitIP          string    `gorm:"size:64" json:"exit_ip"`
+	CountryCode     string    `gorm:"size:8" json:"country_code"`
+	Region          string    `gorm:"size:128" json:"region"`
+	ASN             uint      `json:"asn"`
+	ASOrg           string    `gorm:"size:255" json:"as_org"`
+	Error           string    `gorm:"size:255" json:"error"`
+	CreatedAt       time.Time `gorm:"index" json:"created_at"`
+}
+
+type UpstreamBenchmark struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	TargetType     string    `gorm:"size:32;not null;index:idx_upstream_benchmark_target" json:"target_type"`
+	TargetID       uint      `gorm:"not null;index:idx_upstream_benchmark_target" json:"target_id"`
+	Status         string    `gorm:"size:16;not null;index" json:"status"`
+	TargetURL      string    `gorm:"size:255" json:"target_url"`
+	ConnectMS      int64     `json:"connect_ms"`
+	TTFBMS         int64     `gorm:"column:ttfb_ms" json:"ttfb_ms"`
+	Bytes          int64     `json:"bytes"`
+	ThroughputKbps int64     `json:"throughput_kbps"`
+	Error          string    `gorm:"size:255" json:"error"`
+	CreatedAt      time.Time `gorm:"index" json:"created_at"`
+}
+
+type EgressPool struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"size:128;not null;uniqueIndex" json:"name"`
+	Strategy  string    `gorm:"size:16;not null;default:primary" json:"strategy"`
+	Enabled   bool      `gorm:"default:true;index" json:"enabled"`
+	Notes     string    `gorm:"size:255" json:"notes"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Members []EgressPoolMember `gorm:"foreignKey:PoolID" json:"members,omitempty"`
+}
+
+type EgressPoolMember struct {
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	PoolID          uint      `gorm:"not null;uniqueIndex:idx_egress_pool_member" json:"pool_id"`
+	SocksOutboundID uint      `gorm:"not null;uniqueIndex:idx_egress_pool_member;index" json:"socks_outbound_id"`
+	Priority        int       `gorm:"not null;default:0" json:"priority"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+
+	SocksOutbound *SocksOutbound `json:"socks_outbound,omitempty"`
+}
+
 type DedicatedEntry struct {
 	ID              uint      `gorm:"primaryKey" json:"id"`
 	Name            string    `gorm:"size:128" json:"name"`
@@ -165,6 +311,25 @@ type DedicatedIngress struct {
 	Orders           []Order          `json:"orders,omitempty"`
 }
 
+type Product struct {
+	ID                 uint      `gorm:"primaryKey" json:"id"`
+	Name               string    `gorm:"size:128;not null;uniqueIndex" json:"name"`
+	SKU                string    `gorm:"size:64;not null;uniqueIndex" json:"sku"`
+	Mode               string    `gorm:"size:32;not null" json:"mode"`
+	Quantity           int       `gorm:"not null;default:0" json:"quantity"`
+	DurationDay        int       `gorm:"not null;default:30" json:"duration_day"`
+	DedicatedProtocol  string    `gorm:"size:32" json:"dedicated_protocol,omitempty"`
+	DedicatedInboundID *uint     `gorm:"index" json:"dedicated_inbound_id,omitempty"`
+	DedicatedIngressID *uint     `gorm:"index" json:"dedicated_ingress_id,omitempty"`
+	Price              float64   `gorm:"not null;default:0" json:"price"`
+	CountryCodes       string    `gorm:"size:255" json:"country_codes"`
+	GraceHours         *int      `json:"grace_hours"`
+	Enabled            bool      `gorm:"default:true;index" json:"enabled"`
+	Notes              string    `gorm:"size:255" json:"notes"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
 type Order struct {
 	ID                 uint      `gorm:"primaryKey" json:"id"`
 	OrderNo            string    `gorm:"size:32;index" json:"order_no"`
@@ -177,15 +342,23 @@ type Order struct {
 	DedicatedInboundID *uint     `gorm:"index" json:"dedicated_inbound_id,omitempty"`
 	DedicatedIngressID *uint     `gorm:"index" json:"dedicated_ingress_id,omitempty"`
 	DedicatedProtocol  string    `gorm:"size:32;index" json:"dedicated_protocol,omitempty"`
+	ProductID          *uint     `gorm:"index" json:"product_id,omitempty"`
 	Name               string    `gorm:"size:128;not null" json:"name"`
 	Mode               string    `gorm:"size:32;not null" json:"mode"`
+	IPTier             string    `gorm:"size:16" json:"ip_tier"`
 	Status             string    `gorm:"size:32;not null;index" json:"status"`
 	Quantity           int       `gorm:"not null" json:"quantity"`
 	Port               int       `gorm:"not null;index" json:"port"`
 	StartsAt           time.Time `gorm:"not null" json:"starts_at"`
 	ExpiresAt          time.Time `gorm:"not null;index" json:"expires_at"`
-	NotifyOneDaySent   bool      `gorm:"default:false" json:"notify_one_day_sent"`
-	NotifyExpiredSent  bool      `gorm:"default:false" json:"notify_expired_sent"`
+	Price              float64   `gorm:"not null;default:0" json:"price"`
+	IsTrial            bool      `gorm:"default:false;index" json:"is_trial"`
+	TrialCapBytes      int64     `gorm:"default:0" json:"trial_cap_bytes"`
+	ExpiryStage        string    `gorm:"size:16;index" json:"expiry_stage"`
+	Tags               string    `gorm:"size:512" json:"tags"`
+	Notes              string    `gorm:"size:1024" json:"notes"`
+	Version            int       `gorm:"not null;default:1" json:"version"`
+	NotifyBalanceSent  bool      `gorm:"default:false" json:"notify_balance_sent"`
 	CreatedAt          time.Time `json:"created_at"`
 	UpdatedAt          time.Time `json:"updated_at"`
 
@@ -193,14 +366,33 @@ type Order struct {
 	DedicatedEntry   *DedicatedEntry   `json:"dedicated_entry,omitempty"`
 	DedicatedInbound *DedicatedInbound `json:"dedicated_inbound,omitempty"`
 	DedicatedIngress *DedicatedIngress `json:"dedicated_ingress,omitempty"`
+	Product          *Product          `json:"product,omitempty"`
 	Items            []OrderItem       `json:"items"`
 }
 
+// SavedFilter is a named order list filter owned by one admin. Tags is a
+// comma-separated list that must all match.
+type SavedFilter struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	Owner       string     `gorm:"size:64;not null;uniqueIndex:idx_saved_filter_name" json:"owner"`
+	Name        string     `gorm:"size:128;not null;uniqueIndex:idx_saved_filter_name" json:"name"`
+	Keyword     string     `gorm:"size:255" json:"keyword"`
+	Mode        string     `gorm:"size:32" json:"mode"`
+	Status      string     `gorm:"size:32" json:"status"`
+	CustomerID  uint       `json:"customer_id"`
+	Tags        string     `gorm:"size:512" json:"tags"`
+	ExpiresFrom *time.Time `json:"expires_from,omitempty"`
+	ExpiresTo   *time.Time `json:"expires_to,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
 type OrderItem struct {
 	ID              uint  `gorm:"primaryKey" json:"id"`
 	OrderID         uint  `gorm:"index;not null" json:"order_id"`
 	HostIPID        *uint `gorm:"index" json:"host_ip_id,omitempty"`
 	SocksOutboundID *uint `gorm:"index" json:"socks_outbound_id,omitempty"`
+	EgressPoolID    *uint `gorm:"index" json:"egress_pool_id,omitempty"`
 
 	IP              string `gorm:"size:64;not null;index" json:"ip"`
 	Port            int    `gorm:"not null;index" json:"port"`
@@ -220,32 +412,228 @@ type OrderItem struct {
 
 	HostIP          *HostIP          `json:"host_ip,omitempty"`
 	SocksOutbound   *SocksOutbound   `json:"socks_outbound,omitempty"`
+	EgressPool      *EgressPool      `json:"egress_pool,omitempty"`
 	DedicatedEgress *DedicatedEgress `json:"dedicated_egress,omitempty"`
 	Order           Order            `json:"-"`
 	Resources       []XrayResource   `json:"resources,omitempty"`
 }
 
 type DedicatedEgress struct {
-	ID           uint       `gorm:"primaryKey" json:"id"`
-	OrderID      uint       `gorm:"index;not null" json:"order_id"`
-	OrderItemID  uint       `gorm:"index;uniqueIndex;not null" json:"order_item_id"`
-	Address      string     `gorm:"size:128;not null" json:"address"`
-	Port         int        `gorm:"not null" json:"port"`
-	Username     string     `gorm:"size:128;not null" json:"username"`
-	Password     string     `gorm:"size:128;not null" json:"password"`
-	ExitIP       string     `gorm:"size:64" json:"exit_ip,omitempty"`
-	CountryCode  string     `gorm:"size:8;index" json:"country_code,omitempty"`
-	Region       string     `gorm:"size:64;index" json:"region,omitempty"`
-	ProbeStatus  string     `gorm:"size:32" json:"probe_status,omitempty"`
-	ProbeError   string     `gorm:"size:255" json:"probe_error,omitempty"`
-	LastProbedAt *time.Time `json:"last_probed_at,omitempty"`
-	CreatedAt    time.Time  `json:"created_at"`
-	UpdatedAt    time.Time  `json:"updated_at"`
+	ID                  uint       `gorm:"primaryKey" json:"id"`
+	OrderID             uint       `gorm:"index;not null" json:"order_id"`
+	OrderItemID         uint       `gorm:"index;uniqueIndex;not null" json:"order_item_id"`
+	Address             string     `gorm:"size:128;not null" json:"address"`
+	Port                int        `gorm:"not null" json:"port"`
+	Username            string     `gorm:"size:128;not null" json:"username"`
+	Password            string     `gorm:"size:128;not null" json:"password"`
+	ExitIP              string     `gorm:"size:64" json:"exit_ip,omitempty"`
+	CountryCode         string     `gorm:"size:8;index" json:"country_code,omitempty"`
+	Region              string     `gorm:"size:64;index" json:"region,omitempty"`
+	ProbeStatus         string     `gorm:"size:32" json:"probe_status,omitempty"`
+	ProbeError          string     `gorm:"size:255" json:"probe_error,omitempty"`
+	LastProbedAt        *time.Time `json:"last_probed_at,omitempty"`
+	BenchConnectMS      int64      `json:"bench_connect_ms,omitempty"`
+	BenchTTFBMS         int64      `gorm:"column:bench_ttfb_ms" json:"bench_ttfb_ms,omitempty"`
+	BenchThroughputKbps int64      `json:"bench_throughput_kbps,omitempty"`
+	BenchedAt           *time.Time `json:"benched_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
 
 	Order     Order     `json:"-"`
 	OrderItem OrderItem `json:"-"`
 }
 
+// LedgerEntry amounts are signed by their effect on the customer balance:
+// charges are negative, payments positive, adjustments either way.
+type LedgerEntry struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	CustomerID  uint       `gorm:"not null;index" json:"customer_id"`
+	OrderID     *uint      `gorm:"index" json:"order_id,omitempty"`
+	Type        string     `gorm:"size:16;not null;index" json:"type"`
+	Amount      float64    `gorm:"not null" json:"amount"`
+	Balance     float64    `gorm:"not null" json:"balance"`
+	UnitPrice   float64    `json:"unit_price"`
+	Days        int        `json:"days"`
+	PeriodStart *time.Time `json:"period_start,omitempty"`
+	PeriodEnd   *time.Time `json:"period_end,omitempty"`
+	Source      string     `gorm:"size:32;index" json:"source"`
+	Reference   string     `gorm:"size:128;index" json:"reference"`
+	Note        string     `gorm:"size:255" json:"note"`
+	CreatedAt   time.Time  `gorm:"index" json:"created_at"`
+}
+
+// PaymentEvent is one inbound payment webhook delivery, unique per upstream
+// payment ID so retried deliveries are applied once.
+type PaymentEvent struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	PaymentID     string    `gorm:"size:128;not null;uniqueIndex" json:"payment_id"`
+	OrderNo       string    `gorm:"size:64;index" json:"order_no"`
+	CustomerCode  string    `gorm:"size:64;index" json:"customer_code"`
+	CustomerID    *uint     `gorm:"index" json:"customer_id,omitempty"`
+	OrderID       *uint     `gorm:"index" json:"order_id,omitempty"`
+	ChildOrderIDs string    `gorm:"size:1024" json:"child_order_ids"`
+	Amount        float64   `json:"amount"`
+	Days          int       `json:"days"`
+	Status        string    `gorm:"size:16;not null;index" json:"status"`
+	Error         string    `gorm:"size:1024" json:"error"`
+	LedgerEntryID *uint     `json:"ledger_entry_id,omitempty"`
+	Payload       string    `gorm:"type:text" json:"payload"`
+	CreatedAt     time.Time `gorm:"index" json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// ScheduledAction is an order action deferred to RunAt. Failed attempts are
+// retried at NextRunAt until MaxAttempts is reached.
+type ScheduledAction struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	OrderID     uint       `gorm:"not null;index" json:"order_id"`
+	Action      string     `gorm:"size:32;not null" json:"action"`
+	Params      string     `gorm:"type:text" json:"params"`
+	RunAt       time.Time  `gorm:"not null" json:"run_at"`
+	NextRunAt   time.Time  `gorm:"not null;index" json:"next_run_at"`
+	Status      string     `gorm:"size:16;not null;index" json:"status"`
+	Attempts    int        `gorm:"default:0" json:"attempts"`
+	MaxAttempts int        `gorm:"default:3" json:"max_attempts"`
+	LastError   string     `gorm:"size:1024" json:"last_error"`
+	Note        string     `gorm:"size:255" json:"note"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// ReminderLog records one renewal reminder per order, schedule offset,
+// expiry and channel, so a renewed order is reminded again for its new
+// expiry. Failed sends are retried until they succeed.
+type ReminderLog struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	OrderID    uint      `gorm:"not null;uniqueIndex:idx_reminder_once" json:"order_id"`
+	Offset     string    `gorm:"size:16;not null;uniqueIndex:idx_reminder_once" json:"offset"`
+	ExpiresAt  time.Time `gorm:"not null;uniqueIndex:idx_reminder_once" json:"expires_at"`
+	Channel    string    `gorm:"size:16;not null;uniqueIndex:idx_reminder_once" json:"channel"`
+	CustomerID uint      `gorm:"not null;index" json:"customer_id"`
+	Target     string    `gorm:"size:128" json:"target"`
+	Status     string    `gorm:"size:16;not null;index" json:"status"`
+	Attempts   int       `gorm:"default:0" json:"attempts"`
+	LastError  string    `gorm:"size:1024" json:"last_error"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// OrderItemIPHistory keeps the IPs an order item has been rotated away from.
+type OrderItemIPHistory struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	OrderItemID uint      `gorm:"not null;index" json:"order_item_id"`
+	OrderID     uint      `gorm:"not null;index" json:"order_id"`
+	CustomerID  uint      `gorm:"index" json:"customer_id"`
+	OldHostIPID *uint     `json:"old_host_ip_id,omitempty"`
+	OldIP       string    `gorm:"size:64;not null;index" json:"old_ip"`
+	NewHostIPID *uint     `json:"new_host_ip_id,omitempty"`
+	NewIP       string    `gorm:"size:64;not null" json:"new_ip"`
+	Reason      string    `gorm:"size:255" json:"reason"`
+	Operator    string    `gorm:"size:64" json:"operator"`
+	CreatedAt   time.Time `gorm:"index" json:"created_at"`
+}
+
+// HostIPAssignment is one stretch of a host IP serving an order item. An
+// open row (no ReleasedAt) means the IP is still held by that item.
+type HostIPAssignment struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	HostIPID      uint       `gorm:"not null;index" json:"host_ip_id"`
+	IP            string     `gorm:"size:64;not null;index" json:"ip"`
+	CustomerID    uint       `gorm:"not null;index" json:"customer_id"`
+	OrderID       uint       `gorm:"not null;index" json:"order_id"`
+	OrderNo       string     `gorm:"size:32" json:"order_no"`
+	OrderItemID   uint       `gorm:"not null;index" json:"order_item_id"`
+	AssignedAt    time.Time  `gorm:"not null" json:"assigned_at"`
+	ReleasedAt    *time.Time `gorm:"index" json:"released_at,omitempty"`
+	ReleaseReason string     `gorm:"size:32" json:"release_reason"`
+}
+
+// Reservation holds host IPs or forward upstreams for one customer until it
+// expires or is converted into an order.
+type Reservation struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	CustomerID uint       `gorm:"not null;index" json:"customer_id"`
+	Status     string     `gorm:"size:16;not null;index" json:"status"`
+	ExpiresAt  time.Time  `gorm:"not null;index" json:"expires_at"`
+	OrderID    *uint      `gorm:"index" json:"order_id,omitempty"`
+	Operator   string     `gorm:"size:64" json:"operator"`
+	Note       string     `gorm:"size:255" json:"note"`
+	ReleasedAt *time.Time `json:"released_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+
+	Customer *Customer         `json:"customer,omitempty"`
+	Items    []ReservationItem `json:"items"`
+}
+
+type ReservationItem struct {
+	ID              uint   `gorm:"primaryKey" json:"id"`
+	ReservationID   uint   `gorm:"not null;index" json:"reservation_id"`
+	HostIPID        *uint  `gorm:"index" json:"host_ip_id,omitempty"`
+	SocksOutboundID *uint  `gorm:"index" json:"socks_outbound_id,omitempty"`
+	Label           string `gorm:"size:255" json:"label"`
+}
+
+const (
+	RecycleKindOrder    = "order"
+	RecycleKindCustomer = "customer"
+)
+
+// RecycleBinEntry keeps a deleted order (with its group, items and dedicated
+// egress) or customer as a JSON snapshot until it is restored or purged.
+type RecycleBinEntry struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	Kind       string    `gorm:"size:16;not null;index" json:"kind"`
+	EntityID   uint      `gorm:"not null;index" json:"entity_id"`
+	CustomerID uint      `gorm:"index" json:"customer_id"`
+	Label      string    `gorm:"size:255" json:"label"`
+	OrderCount int       `json:"order_count"`
+	ItemCount  int       `json:"item_count"`
+	Payload    string    `gorm:"type:text" json:"-"`
+	DeletedAt  time.Time `gorm:"not null;index" json:"deleted_at"`
+}
+
+// OrderVersion is a numbered snapshot of an order (or a whole group, keyed
+// by its head) with items and dedicated egress, taken after every change.
+type OrderVersion struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	OrderID    uint      `gorm:"not null;uniqueIndex:idx_order_version" json:"order_id"`
+	Version    int       `gorm:"not null;uniqueIndex:idx_order_version" json:"version"`
+	Source     string    `gorm:"size:32" json:"source"`
+	OrderCount int       `json:"order_count"`
+	ItemCount  int       `json:"item_count"`
+	Payload    string    `gorm:"type:text" json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// IntegrityRun is one pass of the integrity checks. Report holds the full
+// findings and repair results as JSON.
+type IntegrityRun struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Trigger   string    `gorm:"size:16;index" json:"trigger"`
+	Repair    bool      `json:"repair"`
+	Errors    int       `json:"errors"`
+	Warnings  int       `json:"warnings"`
+	Infos     int       `json:"infos"`
+	Repaired  int       `json:"repaired"`
+	Report    string    `gorm:"type:text" json:"-"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// OrderTransfer records an order (or a whole group) moving between customers.
+type OrderTransfer struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	OrderID        uint      `gorm:"not null;index" json:"order_id"`
+	OrderNo        string    `gorm:"size:32" json:"order_no"`
+	OrderCount     int       `json:"order_count"`
+	FromCustomerID uint      `gorm:"not null;index" json:"from_customer_id"`
+	ToCustomerID   uint      `gorm:"not null;index" json:"to_customer_id"`
+	Operator       string    `gorm:"size:64" json:"operator"`
+	Note           string    `gorm:"size:255" json:"note"`
+	CreatedAt      time.Time `gorm:"index" json:"created_at"`
+}
+
 type XrayResource struct {
 	ID          uint      `gorm:"primaryKey" json:"id"`
 	OrderItemID uint      `gorm:"index;uniqueIndex" json:"order_item_id"`
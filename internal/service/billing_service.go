@@ -0,0 +1,496 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/xuri/excelize/v2"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var errAutoRenewBalance = errors.New("balance does not cover the renewal")
+
+type BillingService struct {
+	db     *gorm.DB
+	store  *store.Store
+	orders *OrderService
+	bark   *BarkService
+	logger *zap.Logger
+}
+
+type LedgerEntryInput struct {
+	CustomerID uint    `json:"customer_id"`
+	Type       string  `json:"type"`
+	Amount     float64 `json:"amount"`
+	Reference  string  `json:"reference"`
+	Note       string  `json:"note"`
+}
+
+type LedgerQuery struct {
+	CustomerID uint
+	From       time.Time
+	To         time.Time
+	Limit      int
+}
+
+type InvoiceLine struct {
+	model.LedgerEntry
+	OrderNo   string `json:"order_no"`
+	OrderName string `json:"order_name"`
+}
+
+type Invoice struct {
+	Number         string         `json:"number"`
+	Customer       model.Customer `json:"customer"`
+	From           time.Time      `json:"from"`
+	To             time.Time      `json:"to"`
+	OpeningBalance float64        `json:"opening_balance"`
+	Charges        float64        `json:"charges"`
+	Payments       float64        `json:"payments"`
+	Adjustments    float64        `json:"adjustments"`
+	ClosingBalance float64        `json:"closing_balance"`
+	Lines          []InvoiceLine  `json:"lines"`
+	GeneratedAt    time.Time      `json:"generated_at"`
+}
+
+type billingSettings struct {
+	AutoRenew    bool
+	LeadTime     time.Duration
+	PDFFontPath  string
+	CurrencyCode string
+}
+
+func NewBillingService(db *gorm.DB, st *store.Store, orders *OrderService, bark *BarkService, logger *zap.Logger) *BillingService {
+	return &BillingService{db: db, store: st, orders: orders, bark: bark, logger: logger}
+}
+
+// AddEntry records a manual payment or adjustment. Charges only come from
+// order creation and renewal.
+func (s *BillingService) AddEntry(in LedgerEntryInput) (*model.LedgerEntry, error) {
+	if in.CustomerID == 0 {
+		return nil, errors.New("customer_id is required")
+	}
+	entryType := strings.ToLower(strings.TrimSpace(in.Type))
+	switch entryType {
+	case model.LedgerEntryPayment:
+		if in.Amount <= 0 {
+			return nil, errors.New("payment amount must be > 0")
+		}
+	case model.LedgerEntryAdjustment:
+		if in.Amount == 0 {
+			return nil, errors.New("adjustment amount must not be 0")
+		}
+	default:
+		return nil, errors.New("type must be payment/adjustment")
+	}
+	entry := &model.LedgerEntry{
+		CustomerID: in.CustomerID,
+		Type:       entryType,
+		Amount:     in.Amount,
+		Source:     LedgerSourceManual,
+		Reference:  strings.TrimSpace(in.Reference),
+		Note:       strings.TrimSpace(in.Note),
+	}
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&model.Customer{}).Where("id = ?", in.CustomerID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return errors.New("customer not found")
+		}
+		return appendLedgerEntryTx(tx, entry)
+	}); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (s *BillingService) ListEntries(q LedgerQuery) ([]model.LedgerEntry, error) {
+	limit := q.Limit
+	if limit <= 0 || limit > 1000 {
+		limit = 200
+	}
+	query := s.db.Model(&model.LedgerEntry{})
+	if q.CustomerID > 0 {
+		query = query.Where("customer_id = ?", q.CustomerID)
+	}
+	if !q.From.IsZero() {
+		query = query.Where("created_at >= ?", q.From)
+	}
+	if !q.To.IsZero() {
+		query = query.Where("created_at < ?", q.To)
+	}
+	rows := []model.LedgerEntry{}
+	if err := query.Order("id desc").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Invoice summarizes the ledger of one customer for [from, to). The opening
+// balance is the running balance stored on the last entry before the period.
+func (s *BillingService) Invoice(customerID uint, from, to time.Time) (*Invoice, error) {
+	if customerID == 0 {
+		return nil, errors.New("customer_id is required")
+	}
+	if !to.After(from) {
+		return nil, errors.New("invoice period end must be after start")
+	}
+	customer := model.Customer{}
+	if err := s.db.First(&customer, customerID).Error; err != nil {
+		return nil, err
+	}
+	invoice := &Invoice{
+		Number:      invoiceNumber(customer, from),
+		Customer:    customer,
+		From:        from,
+		To:          to,
+		Lines:       []InvoiceLine{},
+		GeneratedAt: time.Now(),
+	}
+	previous := []model.LedgerEntry{}
+	if err := s.db.Where("customer_id = ? and created_at < ?", customerID, from).Order("id desc").Limit(1).Find(&previous).Error; err != nil {
+		return nil, err
+	}
+	if len(previous) > 0 {
+		invoice.OpeningBalance = previous[0].Balance
+	}
+	entries := []model.LedgerEntry{}
+	if err := s.db.Where("customer_id = ? and created_at >= ? and created_at < ?", customerID, from, to).Order("id asc").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	orderIDs := make([]uint, 0, len(entries))
+	for _, entry := range entries {
+		if entry.OrderID != nil {
+			orderIDs = append(orderIDs, *entry.OrderID)
+		}
+	}
+	orders := map[uint]model.Order{}
+	if len(orderIDs) > 0 {
+		rows := []model.Order{}
+		if err := s.db.Select("id", "order_no", "name").Where("id in ?", uniqueUintIDs(orderIDs)).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			orders[row.ID] = row
+		}
+	}
+	total := 0.0
+	for _, entry := range entries {
+		line := InvoiceLine{LedgerEntry: entry}
+		if entry.OrderID != nil {
+			order := orders[*entry.OrderID]
+			line.OrderNo = order.OrderNo
+			line.OrderName = order.Name
+		}
+		switch entry.Type {
+		case model.LedgerEntryCharge:
+			invoice.Charges -= entry.Amount
+		case model.LedgerEntryPayment:
+			invoice.Payments += entry.Amount
+		default:
+			invoice.Adjustments += entry.Amount
+		}
+		total += entry.Amount
+		invoice.Lines = append(invoice.Lines, line)
+	}
+	invoice.Charges = roundCurrency(invoice.Charges)
+	invoice.Payments = roundCurrency(invoice.Payments)
+	invoice.Adjustments = roundCurrency(invoice.Adjustments)
+	invoice.ClosingBalance = roundCurrency(invoice.OpeningBalance + total)
+	return invoice, nil
+}
+
+func (s *BillingService) InvoiceXLSX(customerID uint, from, to time.Time) ([]byte, string, error) {
+	invoice, err := s.Invoice(customerID, from, to)
+	if err != nil {
+		return nil, "", err
+	}
+	f := excelize.NewFile()
+	sheet := f.GetSheetName(0)
+	summary := [][]interface{}{
+		{"账单号", invoice.Number},
+		{"客户", invoice.Customer.Name},
+		{"账期", fmt.Sprintf("%s ~ %s", invoice.From.Format("2006-01-02"), invoice.To.Add(-time.Second).Format("2006-01-02"))},
+		{"期初余额", invoice.OpeningBalance},
+		{"费用合计", invoice.Charges},
+		{"充值合计", invoice.Payments},
+		{"调整合计", invoice.Adjustments},
+		{"期末余额", invoice.ClosingBalance},
+	}
+	for idx, row := range summary {
+		_ = f.SetCellValue(sheet, fmt.Sprintf("A%d", idx+1), row[0])
+		_ = f.SetCellValue(sheet, fmt.Sprintf("B%d", idx+1), row[1])
+	}
+	headerLine := len(summary) + 2
+	headers := []string{"时间", "类型", "订单号", "订单名称", "单价(30天)", "天数", "计费开始", "计费结束", "金额", "余额", "备注"}
+	for i, title := range headers {
+		cell, _ := excelize.CoordinatesToCellName(i+1, headerLine)
+		_ = f.SetCellValue(sheet, cell, title)
+	}
+	for idx, line := range invoice.Lines {
+		r := headerLine + idx + 1
+		_ = f.SetCellValue(sheet, fmt.Sprintf("A%d", r), line.CreatedAt.Format("2006-01-02 15:04:05"))
+		_ = f.SetCellValue(sheet, fmt.Sprintf("B%d", r), ledgerEntryTypeLabel(line.Type))
+		_ = f.SetCellValue(sheet, fmt.Sprintf("C%d", r), line.OrderNo)
+		_ = f.SetCellValue(sheet, fmt.Sprintf("D%d", r), line.OrderName)
+		if line.Type == model.LedgerEntryCharge {
+			_ = f.SetCellValue(sheet, fmt.Sprintf("E%d", r), line.UnitPrice)
+			_ = f.SetCellValue(sheet, fmt.Sprintf("F%d", r), line.Days)
+		}
+		if line.PeriodStart != nil && line.PeriodEnd != nil {
+			_ = f.SetCellValue(sheet, fmt.Sprintf("G%d", r), line.PeriodStart.Format("2006-01-02 15:04"))
+			_ = f.SetCellValue(sheet, fmt.Sprintf("H%d", r), line.PeriodEnd.Format("2006-01-02 15:04"))
+		}
+		_ = f.SetCellValue(sheet, fmt.Sprintf("I%d", r), line.Amount)
+		_ = f.SetCellValue(sheet, fmt.Sprintf("J%d", r), line.Balance)
+		_ = f.SetCellValue(sheet, fmt.Sprintf("K%d", r), strings.TrimSpace(strings.Join([]string{line.Reference, line.Note}, " ")))
+	}
+	_ = f.SetColWidth(sheet, "A", "A", 20)
+	_ = f.SetColWidth(sheet, "B", "B", 12)
+	_ = f.SetColWidth(sheet, "C", "D", 22)
+	_ = f.SetColWidth(sheet, "G", "H", 18)
+	_ = f.SetColWidth(sheet, "K", "K", 32)
+	body, err := f.WriteToBuffer()
+	if err != nil {
+		return nil, "", err
+	}
+	return body.Bytes(), invoice.Number + ".xlsx", nil
+}
+
+// InvoicePDF renders with the built-in Helvetica font unless a UTF-8 TTF is
+// configured; without one, characters outside Latin-1 are replaced.
+func (s *BillingService) InvoicePDF(customerID uint, from, to time.Time) ([]byte, string, error) {
+	invoice, err := s.Invoice(customerID, from, to)
+	if err != nil {
+		return nil, "", err
+	}
+	settings, err := s.loadSettings()
+	if err != nil {
+		return nil, "", err
+	}
+
+	pdf := fpdf.New("P", "mm", "A4", "")
+	family := "Helvetica"
+	text := latin1Text(pdf.UnicodeTranslatorFromDescriptor(""))
+	if settings.PDFFontPath != "" {
+		font, err := os.ReadFile(settings.PDFFontPath)
+		if err != nil {
+			return nil, "", fmt.Errorf("read invoice pdf font failed: %w", err)
+		}
+		pdf.AddUTF8FontFromBytes("invoice", "", font)
+		family = "invoice"
+		text = func(v string) string { return v }
+	}
+	pdf.SetTitle(invoice.Number, true)
+	pdf.AddPage()
+	pdf.SetFont(family, "", 16)
+	pdf.CellFormat(0, 10, "Invoice "+invoice.Number, "", 1, "L", false, 0, "")
+	pdf.SetFont(family, "", 10)
+	amount := func(v float64) string {
+		if settings.CurrencyCode == "" {
+			return fmt.Sprintf("%.2f", v)
+		}
+		return fmt.Sprintf("%.2f %s", v, settings.CurrencyCode)
+	}
+	for _, row := range [][2]string{
+		{"Customer", invoice.Customer.Name},
+		{"Period", fmt.Sprintf("%s - %s", invoice.From.Format("2006-01-02"), invoice.To.Add(-time.Second).Format("2006-01-02"))},
+		{"Opening balance", amount(invoice.OpeningBalance)},
+		{"Charges", amount(invoice.Charges)},
+		{"Payments", amount(invoice.Payments)},
+		{"Adjustments", amount(invoice.Adjustments)},
+		{"Closing balance", amount(invoice.ClosingBalance)},
+	} {
+		pdf.CellFormat(40, 6, row[0], "", 0, "L", false, 0, "")
+		pdf.CellFormat(0, 6, text(row[1]), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(4)
+
+	widths := []float64{30, 20, 36, 50, 12, 22, 20}
+	pdf.SetFont(family, "", 9)
+	for i, title := range []string{"Date", "Type", "Order", "Detail", "Days", "Amount", "Balance"} {
+		pdf.CellFormat(widths[i], 7, title, "1", 0, "C", false, 0, "")
+	}
+	pdf.Ln(-1)
+	for _, line := range invoice.Lines {
+		detail := line.OrderName
+		if line.PeriodStart != nil && line.PeriodEnd != nil {
+			detail = fmt.Sprintf("%s - %s", line.PeriodStart.Format("01-02"), line.PeriodEnd.Format("01-02"))
+		}
+		if line.Type != model.LedgerEntryCharge {
+			detail = strings.TrimSpace(strings.Join([]string{line.Reference, line.Note}, " "))
+		}
+		days := ""
+		if line.Days > 0 {
+			days = fmt.Sprintf("%d", line.Days)
+		}
+		cells := []string{
+			line.CreatedAt.Format("2006-01-02 15:04"),
+			line.Type,
+			text(line.OrderNo),
+			text(detail),
+			days,
+			fmt.Sprintf("%.2f", line.Amount),
+			fmt.Sprintf("%.2f", line.Balance),
+		}
+		for i, value := range cells {
+			align := "L"
+			if i >= 4 {
+				align = "R"
+			}
+			pdf.CellFormat(widths[i], 6, value, "1", 0, align, false, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+
+	buf := bytes.Buffer{}
+	if err := pdf.Output(&buf); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), invoice.Number + ".pdf", nil
+}
+
+// AutoRenewDue renews orders of auto-renew customers that expire within the
+// lead window while their balance covers one more period. It runs ahead of the
+// scheduler's expiry pass so covered orders never go offline.
+func (s *BillingService) AutoRenewDue(ctx context.Context, now time.Time) {
+	settings, err := s.loadSettings()
+	if err != nil {
+		s.logger.Warn("load billing settings failed", zap.Error(err))
+		return
+	}
+	if !settings.AutoRenew {
+		return
+	}
+	rows := []model.Order{}
+	if err := s.db.Preload("Product").
+		Joins("join customers on customers.id = orders.customer_id").
+		Where("customers.auto_renew = ? and customers.status = ?", true, model.CustomerStatusActive).
+		Where("orders.status = ? and orders.parent_order_id is null and orders.price > 0 and orders.expires_at <= ?", model.OrderStatusActive, now.Add(settings.LeadTime)).
+		Order("orders.expires_at asc, orders.id asc").
+		Find(&rows).Error; err != nil {
+		s.logger.Warn("load auto-renew orders failed", zap.Error(err))
+		return
+	}
+	for _, order := range rows {
+		if ctx.Err() != nil {
+			return
+		}
+		days := pricePeriodDays
+		if order.Product != nil && order.Product.DurationDay > 0 {
+			days = order.Product.DurationDay
+		}
+		cost := orderPeriodCost(order.Price, days)
+		customer := model.Customer{}
+		if err := s.db.First(&customer, order.CustomerID).Error; err != nil {
+			continue
+		}
+		if customer.Balance < cost {
+			if order.NotifyBalanceSent {
+				continue
+			}
+			detail := fmt.Sprintf("customer %s balance %.2f, order %s needs %.2f for %d days", customer.Name, customer.Balance, order.OrderNo, cost, days)
+			s.store.AddTaskLog("warn", "auto-renew balance insufficient", detail)
+			s.notify("XrayTool 余额不足", fmt.Sprintf("客户[%s] 余额 %.2f 不足以续费订单[%s] (需 %.2f), 订单将于 %s 到期", customer.Name, customer.Balance, order.Name, cost, order.ExpiresAt.Format("2006-01-02 15:04:05")))
+			_ = s.db.Model(&model.Order{}).Where("id = ?", order.ID).Update("notify_balance_sent", true).Error
+			continue
+		}
+		renewCtx := withRenewalTxHook(ctx, autoRenewBalanceGuard(order.CustomerID))
+		if err := s.orders.renewOrder(renewCtx, order.ID, days, time.Time{}, LedgerSourceAutoRenew); err != nil {
+			if errors.Is(err, errAutoRenewBalance) {
+				s.store.AddTaskLog("warn", "auto-renew balance insufficient", fmt.Sprintf("customer %s balance no longer covers order %s", customer.Name, order.OrderNo))
+				continue
+			}
+			s.logger.Warn("auto-renew order failed", zap.Error(err), zap.Uint("order_id", order.ID))
+			s.store.AddTaskLog("error", "auto-renew order failed", fmt.Sprintf("%s: %v", order.OrderNo, err))
+			continue
+		}
+		s.store.AddTaskLog("info", "order auto-renewed", fmt.Sprintf("%s renewed %d days for %.2f", order.OrderNo, days, cost))
+	}
+}
+
+// autoRenewBalanceGuard runs inside the renewal transaction after the charge
+// is booked. The conditional update only matches while the balance is still
+// covered, so a debit that landed after the pre-check rolls the renewal back
+// instead of taking the balance below zero.
+func autoRenewBalanceGuard(customerID uint) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		res := tx.Model(&model.Customer{}).Where("id = ? and balance > ?", customerID, -0.005).Update("updated_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errAutoRenewBalance
+		}
+		return nil
+	}
+}
+
+func (s *BillingService) notify(title, body string) {
+	if s.bark == nil {
+		return
+	}
+	if err := s.bark.Notify(title, body); err != nil {
+		s.logger.Warn("bark billing notify failed", zap.Error(err))
+	}
+}
+
+func (s *BillingService) loadSettings() (billingSettings, error) {
+	values, err := s.store.GetSettings()
+	if err != nil {
+		return billingSettings{}, err
+	}
+	leadHours := parseSettingInt(values["billing_auto_renew_lead_hours"], 24)
+	if leadHours < 0 {
+		leadHours = 0
+	}
+	return billingSettings{
+		AutoRenew:    parseSettingBool(values["billing_auto_renew_enabled"], false),
+		LeadTime:     time.Duration(leadHours) * time.Hour,
+		PDFFontPath:  strings.TrimSpace(values["invoice_pdf_font_path"]),
+		CurrencyCode: strings.ToUpper(strings.TrimSpace(values["billing_currency"])),
+	}, nil
+}
+
+func invoiceNumber(customer model.Customer, from time.Time) string {
+	code := strings.TrimSpace(customer.Code)
+	if code == "" {
+		code = fmt.Sprintf("C%d", customer.ID)
+	}
+	return fmt.Sprintf("INV-%s-%s", strings.ToUpper(code), from.Format("200601"))
+}
+
+func ledgerEntryTypeLabel(entryType string) string {
+	switch entryType {
+	case model.LedgerEntryCharge:
+		return "费用"
+	case model.LedgerEntryPayment:
+		return "充值"
+	default:
+		return "调整"
+	}
+}
+
+func latin1Text(translate func(string) string) func(string) string {
+	return func(v string) string {
+		runes := []rune(v)
+		for i, r := range runes {
+			if r > 0xff {
+				runes[i] = '?'
+			}
+		}
+		return translate(string(runes))
+	}
+}
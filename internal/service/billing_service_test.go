@@ -0,0 +1,208 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"xraytool/internal/config"
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+func seedBillingCustomer(t *testing.T, db *gorm.DB, name string, hostIP string) model.Customer {
+	t.Helper()
+	customer := model.Customer{Name: name, Code: name, Status: model.OrderStatusActive}
+	if err := db.Create(&customer).Error; err != nil {
+		t.Fatalf("create customer failed: %v", err)
+	}
+	host := model.HostIP{IP: hostIP, IsPublic: true, IsLocal: true, Enabled: true}
+	if err := db.Create(&host).Error; err != nil {
+		t.Fatalf("create host ip failed: %v", err)
+	}
+	return customer
+}
+
+func TestBillingLedgerChargesAndInvoices(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, NewXrayManager(config.Config{}, db, zap.NewNop()), zap.NewNop())
+	billing := NewBillingService(db, store.New(db), svc, nil, zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	customer := seedBillingCustomer(t, db, "ledger", "198.51.100.20")
+
+	order, err := svc.CreateOrder(context.Background(), CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 10, Port: residentialTestPort, Price: 30})
+	if err != nil {
+		t.Fatalf("create order failed: %v", err)
+	}
+	if err := svc.RenewOrder(context.Background(), order.ID, 30); err != nil {
+		t.Fatalf("renew order failed: %v", err)
+	}
+	if _, err := billing.AddEntry(LedgerEntryInput{CustomerID: customer.ID, Type: model.LedgerEntryCharge, Amount: 5}); err == nil {
+		t.Fatalf("expected manual charge to be rejected")
+	}
+	if _, err := billing.AddEntry(LedgerEntryInput{CustomerID: customer.ID, Type: model.LedgerEntryPayment, Amount: -5}); err == nil {
+		t.Fatalf("expected negative payment to be rejected")
+	}
+	payment, err := billing.AddEntry(LedgerEntryInput{CustomerID: customer.ID, Type: model.LedgerEntryPayment, Amount: 100, Reference: "bank-1"})
+	if err != nil {
+		t.Fatalf("add payment failed: %v", err)
+	}
+	if payment.Balance != 60 {
+		t.Fatalf("expected balance 60 after charges 10+30 and payment 100, got %.2f", payment.Balance)
+	}
+
+	entries, err := billing.ListEntries(LedgerQuery{CustomerID: customer.ID})
+	if err != nil {
+		t.Fatalf("list ledger failed: %v", err)
+	}
+	if len(entries) != 3 || entries[2].Source != LedgerSourceCreate || entries[2].Days != 10 || entries[1].Source != LedgerSourceRenew || entries[1].Amount != -30 {
+		t.Fatalf("unexpected ledger entries: %#v", entries)
+	}
+
+	now := time.Now()
+	invoice, err := billing.Invoice(customer.ID, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("build invoice failed: %v", err)
+	}
+	if invoice.OpeningBalance != 0 || invoice.Charges != 40 || invoice.Payments != 100 || invoice.ClosingBalance != 60 || len(invoice.Lines) != 3 {
+		t.Fatalf("unexpected invoice totals: %#v", invoice)
+	}
+	if invoice.Lines[0].OrderNo != order.OrderNo {
+		t.Fatalf("expected charge line to carry order no, got %#v", invoice.Lines[0])
+	}
+	later, err := billing.Invoice(customer.ID, now.Add(time.Hour), now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("build later invoice failed: %v", err)
+	}
+	if later.OpeningBalance != 60 || later.ClosingBalance != 60 || len(later.Lines) != 0 {
+		t.Fatalf("expected later invoice to carry the balance forward, got %#v", later)
+	}
+
+	body, filename, err := billing.InvoiceXLSX(customer.ID, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil || len(body) == 0 || filename != invoice.Number+".xlsx" {
+		t.Fatalf("unexpected xlsx invoice: %s %d %v", filename, len(body), err)
+	}
+	body, _, err = billing.InvoicePDF(customer.ID, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil || !bytes.HasPrefix(body, []byte("%PDF")) {
+		t.Fatalf("unexpected pdf invoice: %d %v", len(body), err)
+	}
+}
+
+func TestBillingAutoRenewDueUsesBalance(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, NewXrayManager(config.Config{}, db, zap.NewNop()), zap.NewNop())
+	st := store.New(db)
+	billing := NewBillingService(db, st, svc, nil, zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	if err := st.SetSettings(map[string]string{"billing_auto_renew_enabled": "true", "billing_auto_renew_lead_hours": "24"}); err != nil {
+		t.Fatalf("save settings failed: %v", err)
+	}
+
+	expiresAt := time.Now().Add(12 * time.Hour)
+	create := func(name, ip string) (model.Customer, *model.Order) {
+		customer := seedBillingCustomer(t, db, name, ip)
+		if err := db.Model(&model.Customer{}).Where("id = ?", customer.ID).Update("auto_renew", true).Error; err != nil {
+			t.Fatalf("enable auto renew failed: %v", err)
+		}
+		order, err := svc.CreateOrder(context.Background(), CreateOrderInput{CustomerID: customer.ID, Quantity: 1, ExpiresAt: expiresAt, Port: residentialTestPort, Price: 30})
+		if err != nil {
+			t.Fatalf("create order failed: %v", err)
+		}
+		return customer, order
+	}
+	rich, richOrder := create("rich", "198.51.100.21")
+	poor, poorOrder := create("poor", "198.51.100.22")
+	if _, err := billing.AddEntry(LedgerEntryInput{CustomerID: rich.ID, Type: model.LedgerEntryPayment, Amount: 50}); err != nil {
+		t.Fatalf("add payment failed: %v", err)
+	}
+
+	billing.AutoRenewDue(context.Background(), time.Now())
+	billing.AutoRenewDue(context.Background(), time.Now())
+
+	renewed := model.Order{}
+	if err := db.First(&renewed, richOrder.ID).Error; err != nil {
+		t.Fatalf("load renewed order failed: %v", err)
+	}
+	if !renewed.ExpiresAt.After(expiresAt.Add(29 * 24 * time.Hour)) {
+		t.Fatalf("expected covered order to be renewed once by 30 days, got %s", renewed.ExpiresAt)
+	}
+	if renewed.ExpiresAt.After(expiresAt.Add(31 * 24 * time.Hour)) {
+		t.Fatalf("expected a single auto renewal, got %s", renewed.ExpiresAt)
+	}
+	customer := model.Customer{}
+	if err := db.First(&customer, rich.ID).Error; err != nil {
+		t.Fatalf("load customer failed: %v", err)
+	}
+	if customer.Balance != 19 {
+		t.Fatalf("expected balance 50-1-30=19, got %.2f", customer.Balance)
+	}
+
+	skipped := model.Order{}
+	if err := db.First(&skipped, poorOrder.ID).Error; err != nil {
+		t.Fatalf("load skipped order failed: %v", err)
+	}
+	if !skipped.ExpiresAt.Equal(poorOrder.ExpiresAt) || !skipped.NotifyBalanceSent {
+		t.Fatalf("expected uncovered order untouched and flagged, got %#v", skipped)
+	}
+	var warnings int64
+	if err := db.Model(&model.TaskLog{}).Where("message = ? and detail like ?", "auto-renew balance insufficient", "%poor%").Count(&warnings).Error; err != nil {
+		t.Fatalf("count task logs failed: %v", err)
+	}
+	if warnings != 1 {
+		t.Fatalf("expected a single insufficient balance warning, got %d", warnings)
+	}
+	var charges int64
+	if err := db.Model(&model.LedgerEntry{}).Where("customer_id = ? and source = ?", poor.ID, LedgerSourceAutoRenew).Count(&charges).Error; err != nil {
+		t.Fatalf("count charges failed: %v", err)
+	}
+	if charges != 0 {
+		t.Fatalf("expected no auto renew charge for uncovered customer, got %d", charges)
+	}
+}
+
+func TestAutoRenewBalanceGuardRollsBackUncoveredRenewal(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, NewXrayManager(config.Config{}, db, zap.NewNop()), zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	customer := seedBillingCustomer(t, db, "guarded", "198.51.100.23")
+	expiresAt := time.Now().Add(12 * time.Hour)
+	order, err := svc.CreateOrder(context.Background(), CreateOrderInput{CustomerID: customer.ID, Quantity: 1, ExpiresAt: expiresAt, Port: residentialTestPort, Price: 30})
+	if err != nil {
+		t.Fatalf("create order failed: %v", err)
+	}
+	// Covers the 30-day charge only until a concurrent debit lands.
+	if err := db.Model(&model.Customer{}).Where("id = ?", customer.ID).Update("balance", 20).Error; err != nil {
+		t.Fatalf("set balance failed: %v", err)
+	}
+
+	ctx := withRenewalTxHook(context.Background(), autoRenewBalanceGuard(customer.ID))
+	if err := svc.renewOrder(ctx, order.ID, 30, time.Time{}, LedgerSourceAutoRenew); !errors.Is(err, errAutoRenewBalance) {
+		t.Fatalf("expected guarded renewal to be refused, got %v", err)
+	}
+	reloaded := model.Order{}
+	if err := db.First(&reloaded, order.ID).Error; err != nil {
+		t.Fatalf("load order failed: %v", err)
+	}
+	if !reloaded.ExpiresAt.Equal(order.ExpiresAt) {
+		t.Fatalf("expected expiry untouched, got %s", reloaded.ExpiresAt)
+	}
+	stored := model.Customer{}
+	if err := db.First(&stored, customer.ID).Error; err != nil || stored.Balance != 20 {
+		t.Fatalf("expected balance untouched at 20, got %.2f (%v)", stored.Balance, err)
+	}
+
+	if err := db.Model(&model.Customer{}).Where("id = ?", customer.ID).Update("balance", 30).Error; err != nil {
+		t.Fatalf("top up balance failed: %v", err)
+	}
+	if err := svc.renewOrder(ctx, order.ID, 30, time.Time{}, LedgerSourceAutoRenew); err != nil {
+		t.Fatalf("expected covered renewal to pass the guard: %v", err)
+	}
+	if err := db.First(&stored, customer.ID).Error; err != nil || stored.Balance != 0 {
+		t.Fatalf("expected balance drained to 0, got %.2f (%v)", stored.Balance, err)
+	}
+}
@@ -101,7 +101,7 @@ func (s *DedicatedEntryService) Delete(id uint) error {
 	}
 	var count int64
 	if err := s.db.Model(&model.Order{}).
-		Where("dedicated_entry_id = ? and status = ? and expires_at > ?", id, model.OrderStatusActive, time.Now()).
+		Where("dedicated_entry_id = ? and status = ? and (expires_at > ? or expiry_stage <> '')", id, model.OrderStatusActive, time.Now()).
 		Count(&count).Error; err != nil {
 		return err
 	}
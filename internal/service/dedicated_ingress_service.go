@@ -113,7 +113,7 @@ func (s *DedicatedIngressService) UpdateInbound(id uint, in DedicatedInboundInpu
 	}
 	if !strings.EqualFold(strings.TrimSpace(base.Protocol), strings.TrimSpace(row.Protocol)) || base.ListenPort != row.ListenPort {
 		var activeCount int64
-		if err := s.db.Model(&model.Order{}).Where("dedicated_inbound_id = ? and status = ? and expires_at > ?", id, model.OrderStatusActive, time.Now()).Count(&activeCount).Error; err != nil {
+		if err := s.db.Model(&model.Order{}).Where("dedicated_inbound_id = ? and status = ? and (expires_at > ? or expiry_stage <> '')", id, model.OrderStatusActive, time.Now()).Count(&activeCount).Error; err != nil {
 			return nil, err
 		}
 		if activeCount > 0 {
@@ -179,7 +179,7 @@ func (s *DedicatedIngressService) DeleteInbound(id uint) error {
 		return fmt.Errorf("inbound has %d ingresses", ingressCount)
 	}
 	var orderCount int64
-	if err := s.db.Model(&model.Order{}).Where("dedicated_inbound_id = ? and status = ? and expires_at > ?", id, model.OrderStatusActive, time.Now()).Count(&orderCount).Error; err != nil {
+	if err := s.db.Model(&model.Order{}).Where("dedicated_inbound_id = ? and status = ? and (expires_at > ? or expiry_stage <> '')", id, model.OrderStatusActive, time.Now()).Count(&orderCount).Error; err != nil {
 		return err
 	}
 	if orderCount > 0 {
@@ -238,7 +238,7 @@ func (s *DedicatedIngressService) UpdateIngress(id uint, in DedicatedIngressInpu
 	}
 	if base.DedicatedInboundID != row.DedicatedInboundID {
 		var activeCount int64
-		if err := s.db.Model(&model.Order{}).Where("dedicated_ingress_id = ? and status = ? and expires_at > ?", id, model.OrderStatusActive, time.Now()).Count(&activeCount).Error; err != nil {
+		if err := s.db.Model(&model.Order{}).Where("dedicated_ingress_id = ? and status = ? and (expires_at > ? or expiry_stage <> '')", id, model.OrderStatusActive, time.Now()).Count(&activeCount).Error; err != nil {
 			return nil, err
 		}
 		if activeCount > 0 {
@@ -280,7 +280,7 @@ func (s *DedicatedIngressService) DeleteIngress(id uint) error {
 		return errors.New("id is required")
 	}
 	var count int64
-	if err := s.db.Model(&model.Order{}).Where("dedicated_ingress_id = ? and status = ? and expires_at > ?", id, model.OrderStatusActive, time.Now()).Count(&count).Error; err != nil {
+	if err := s.db.Model(&model.Order{}).Where("dedicated_ingress_id = ? and status = ? and (expires_at > ? or expiry_stage <> '')", id, model.OrderStatusActive, time.Now()).Count(&count).Error; err != nil {
 		return err
 	}
 	if count > 0 {
@@ -32,6 +32,8 @@ type DedicatedProtocolProbeResult struct {
 	ExitIP         string
 	CountryCode    string
 	Region         string
+	ASN            uint
+	ASOrg          string
 	Message        string
 	ErrorCode      string
 }
@@ -90,6 +92,17 @@ func reserveLocalTCPPort() (int, error) {
 }
 
 func runProbeCore(ctx context.Context, localPort int, outbound map[string]any) (DedicatedProtocolProbeResult, error) {
+	instance, err := startProbeCore(ctx, localPort, outbound)
+	if err != nil {
+		return DedicatedProtocolProbeResult{}, err
+	}
+	defer instance.Close()
+	return probeExitViaLocalSocks(ctx, localPort), nil
+}
+
+// startProbeCore runs outbound behind a no-auth SOCKS inbound on localPort
+// and returns once the inbound accepts connections.
+func startProbeCore(ctx context.Context, localPort int, outbound map[string]any) (*core.Instance, error) {
 	payload := map[string]any{
 		"log": map[string]any{
 			"loglevel": "warning",
@@ -121,22 +134,25 @@ func runProbeCore(ctx context.Context, localPort int, outbound map[string]any) (
 		},
 	}
 
+	return startLocalXrayCore(ctx, payload, localPort)
+}
+
+func startLocalXrayCore(ctx context.Context, payload map[string]any, readyPort int) (*core.Instance, error) {
 	confObj, err := decodeConfig(payload)
 	if err != nil {
-		return DedicatedProtocolProbeResult{}, err
+		return nil, err
 	}
 	coreCfg, err := confObj.Build()
 	if err != nil {
-		return DedicatedProtocolProbeResult{}, err
+		return nil, err
 	}
 	instance, err := core.New(coreCfg)
 	if err != nil {
-		return DedicatedProtocolProbeResult{}, err
+		return nil, err
 	}
-	defer instance.Close()
-
 	if err := instance.Start(); err != nil {
-		return DedicatedProtocolProbeResult{}, err
+		_ = instance.Close()
+		return nil, err
 	}
 
 	probeCtx, cancel := context.WithTimeout(ctx, 6*time.Second)
@@ -145,12 +161,13 @@ func runProbeCore(ctx context.Context, localPort int, outbound map[string]any) (
 	for {
 		select {
 		case <-probeCtx.Done():
-			return DedicatedProtocolProbeResult{}, probeCtx.Err()
+			_ = instance.Close()
+			return nil, probeCtx.Err()
 		default:
-			conn, dialErr := (&net.Dialer{Timeout: 300 * time.Millisecond}).DialContext(probeCtx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)))
+			conn, dialErr := (&net.Dialer{Timeout: 300 * time.Millisecond}).DialContext(probeCtx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(readyPort)))
 			if dialErr == nil {
 				_ = conn.Close()
-				return probeExitViaLocalSocks(ctx, localPort), nil
+				return instance, nil
 			}
 			time.Sleep(80 * time.Millisecond)
 		}
@@ -323,11 +340,11 @@ func probeExitViaLocalSocks(ctx context.Context, localPort int) DedicatedProtoco
 		return DedicatedProtocolProbeResult{ConnectivityOK: false, Message: "empty exit ip", ErrorCode: "EGRESS_PROBE_EMPTY_EXIT_IP"}
 	}
 
-	country, region, lookupErr := lookupCountryRegion(exitIP)
+	geo, lookupErr := lookupIPGeo(exitIP)
 	if lookupErr != nil {
-		country = ""
-		region = ""
+		geo = IPGeoInfo{}
 	}
+	country := geo.CountryCode
 
 	message := "protocol probe succeeded"
 	if country != "" {
@@ -338,7 +355,9 @@ func probeExitViaLocalSocks(ctx context.Context, localPort int) DedicatedProtoco
 		ConnectivityOK: true,
 		ExitIP:         exitIP,
 		CountryCode:    strings.ToLower(strings.TrimSpace(country)),
-		Region:         strings.TrimSpace(region),
+		Region:         strings.TrimSpace(geo.Region),
+		ASN:            geo.ASN,
+		ASOrg:          geo.ASOrg,
 		Message:        message,
 	}
 }
@@ -0,0 +1,316 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultEgressPoolProbeURL      = "https://www.gstatic.com/generate_204"
+	defaultEgressPoolProbeInterval = "30s"
+
+	// A primary pool fails over in member order through leastLoad costs.
+	// Alive members answer the observatory probe within its 5s timeout, so a
+	// sqrt(cost) step just above 5000 per priority keeps any alive member
+	// cheaper than every member behind it. leastLoad scales the delay in ns by sqrt(cost)
+	// into an int64, and a fourth tier would overflow that within the timeout.
+	egressPoolPrimaryCostStep   = 5001.0 * 5001.0
+	egressPoolPrimaryMaxMembers = 3
+)
+
+type EgressPoolService struct {
+	db   *gorm.DB
+	xray *XrayManager
+}
+
+type EgressPoolInput struct {
+	Name        string `json:"name"`
+	Strategy    string `json:"strategy"`
+	Enabled     *bool  `json:"enabled"`
+	Notes       string `json:"notes"`
+	OutboundIDs []uint `json:"outbound_ids"`
+}
+
+type egressPoolRuntime struct {
+	pool    model.EgressPool
+	members []model.SocksOutbound
+}
+
+func NewEgressPoolService(db *gorm.DB, xray *XrayManager) *EgressPoolService {
+	return &EgressPoolService{db: db, xray: xray}
+}
+
+func EgressPoolBalancerTag(poolID uint) string {
+	return fmt.Sprintf("xtool-bal-%d", poolID)
+}
+
+func EgressPoolMemberTag(poolID uint, index int) string {
+	return fmt.Sprintf("xtool-pool-%d-%d", poolID, index)
+}
+
+func (s *EgressPoolService) List() ([]model.EgressPool, error) {
+	rows := []model.EgressPool{}
+	if err := s.db.Preload("Members", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("priority asc, id asc")
+	}).Preload("Members.SocksOutbound").Order("enabled desc, id asc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *EgressPoolService) Get(id uint) (*model.EgressPool, error) {
+	row := model.EgressPool{}
+	if err := s.db.Preload("Members", func(tx *gorm.DB) *gorm.DB {
+		return tx.Order("priority asc, id asc")
+	}).Preload("Members.SocksOutbound").First(&row, id).Error; err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
+
+func (s *EgressPoolService) Create(ctx context.Context, in EgressPoolInput) (*model.EgressPool, error) {
+	row, outboundIDs, err := normalizeEgressPoolInput(in)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&row).Error; err != nil {
+			return err
+		}
+		return replaceEgressPoolMembersTx(tx, row.ID, outboundIDs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(row.ID)
+}
+
+func (s *EgressPoolService) Update(ctx context.Context, id uint, in EgressPoolInput) (*model.EgressPool, error) {
+	if id == 0 {
+		return nil, errors.New("id is required")
+	}
+	base := model.EgressPool{}
+	if err := s.db.First(&base, id).Error; err != nil {
+		return nil, err
+	}
+	row, outboundIDs, err := normalizeEgressPoolInput(in)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&model.EgressPool{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"name":       row.Name,
+			"strategy":   row.Strategy,
+			"enabled":    row.Enabled,
+			"notes":      row.Notes,
+			"updated_at": time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		return replaceEgressPoolMembersTx(tx, id, outboundIDs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	inUse, err := s.activeItemCount(id)
+	if err != nil {
+		return nil, err
+	}
+	if inUse > 0 && s.xray != nil {
+		if err := s.xray.RebuildAndRestartManaged(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return s.Get(id)
+}
+
+func (s *EgressPoolService) Delete(id uint) error {
+	if id == 0 {
+		return errors.New("id is required")
+	}
+	var count int64
+	if err := s.db.Model(&model.OrderItem{}).Where("egress_pool_id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("egress pool is bound to %d order items", count)
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("pool_id = ?", id).Delete(&model.EgressPoolMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&model.EgressPool{}, id).Error
+	})
+}
+
+func (s *EgressPoolService) activeItemCount(poolID uint) (int64, error) {
+	var count int64
+	err := s.db.Model(&model.OrderItem{}).Joins("join orders o on o.id = order_items.order_id").
+		Where("order_items.egress_pool_id = ? and order_items.status = ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '')", poolID, model.OrderItemStatusActive, model.OrderStatusActive, time.Now()).
+		Count(&count).Error
+	return count, err
+}
+
+func normalizeEgressPoolInput(in EgressPoolInput) (model.EgressPool, []uint, error) {
+	name := strings.TrimSpace(in.Name)
+	if name == "" {
+		return model.EgressPool{}, nil, errors.New("name is required")
+	}
+	strategy, err := normalizeEgressPoolStrategy(in.Strategy)
+	if err != nil {
+		return model.EgressPool{}, nil, err
+	}
+	outboundIDs := uniqueUintIDs(in.OutboundIDs)
+	if len(outboundIDs) == 0 {
+		return model.EgressPool{}, nil, errors.New("at least one outbound is required")
+	}
+	if strategy == model.EgressPoolStrategyPrimary && len(outboundIDs) > egressPoolPrimaryMaxMembers {
+		return model.EgressPool{}, nil, fmt.Errorf("primary pools support at most %d outbounds", egressPoolPrimaryMaxMembers)
+	}
+	enabled := true
+	if in.Enabled != nil {
+		enabled = *in.Enabled
+	}
+	return model.EgressPool{
+		Name:     name,
+		Strategy: strategy,
+		Enabled:  enabled,
+		Notes:    strings.TrimSpace(in.Notes),
+	}, outboundIDs, nil
+}
+
+func normalizeEgressPoolStrategy(raw string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "", "primary", "stick-to-primary", "failover":
+		return model.EgressPoolStrategyPrimary, nil
+	case "random":
+		return model.EgressPoolStrategyRandom, nil
+	case "leastping", "least-ping", "least_ping":
+		return model.EgressPoolStrategyLeastPing, nil
+	default:
+		return "", fmt.Errorf("unsupported pool strategy %s", raw)
+	}
+}
+
+func replaceEgressPoolMembersTx(tx *gorm.DB, poolID uint, outboundIDs []uint) error {
+	var found int64
+	if err := tx.Model(&model.SocksOutbound{}).Where("id in ?", outboundIDs).Count(&found).Error; err != nil {
+		return err
+	}
+	if int(found) != len(outboundIDs) {
+		return errors.New("some outbounds do not exist")
+	}
+	if err := tx.Where("pool_id = ?", poolID).Delete(&model.EgressPoolMember{}).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	for idx, outboundID := range outboundIDs {
+		member := model.EgressPoolMember{
+			PoolID:          poolID,
+			SocksOutboundID: outboundID,
+			Priority:        idx,
+			CreatedAt:       now,
+			UpdatedAt:       now,
+		}
+		if err := tx.Create(&member).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadEgressPoolRuntimes(db *gorm.DB, poolIDs []uint) (map[uint]egressPoolRuntime, error) {
+	out := map[uint]egressPoolRuntime{}
+	poolIDs = uniqueUintIDs(poolIDs)
+	if len(poolIDs) == 0 {
+		return out, nil
+	}
+	pools := []model.EgressPool{}
+	if err := db.Where("id in ? and enabled = ?", poolIDs, true).Find(&pools).Error; err != nil {
+		return nil, err
+	}
+	for _, pool := range pools {
+		out[pool.ID] = egressPoolRuntime{pool: pool}
+	}
+	members := []model.EgressPoolMember{}
+	if err := db.Preload("SocksOutbound").Where("pool_id in ?", poolIDs).Order("pool_id asc, priority asc, id asc").Find(&members).Error; err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		runtime, ok := out[member.PoolID]
+		if !ok || member.SocksOutbound == nil || !member.SocksOutbound.Enabled {
+			continue
+		}
+		runtime.members = append(runtime.members, *member.SocksOutbound)
+		out[member.PoolID] = runtime
+	}
+	for id, runtime := range out {
+		if len(runtime.members) == 0 {
+			delete(out, id)
+		}
+	}
+	return out, nil
+}
+
+func egressPoolBalancer(poolID uint, strategy string, memberCount int) map[string]interface{} {
+	balancer := map[string]interface{}{
+		"tag":         EgressPoolBalancerTag(poolID),
+		"selector":    []string{fmt.Sprintf("xtool-pool-%d-", poolID)},
+		"strategy":    map[string]interface{}{"type": "random"},
+		"fallbackTag": EgressPoolMemberTag(poolID, 0),
+	}
+	switch strategy {
+	case model.EgressPoolStrategyLeastPing:
+		balancer["strategy"] = map[string]interface{}{"type": "leastPing"}
+	case model.EgressPoolStrategyRandom:
+	default:
+		costs := make([]map[string]interface{}, 0, memberCount)
+		cost := 1.0
+		for idx := 1; idx < memberCount; idx++ {
+			if idx < egressPoolPrimaryMaxMembers {
+				cost *= egressPoolPrimaryCostStep
+			}
+			costs = append(costs, map[string]interface{}{
+				"regexp": true,
+				"match":  fmt.Sprintf("^%s$", EgressPoolMemberTag(poolID, idx)),
+				"value":  cost,
+			})
+		}
+		balancer["strategy"] = map[string]interface{}{
+			"type":     "leastLoad",
+			"settings": map[string]interface{}{"costs": costs},
+		}
+	}
+	return balancer
+}
+
+func loadEgressPoolObservatorySettings(db *gorm.DB) (string, string) {
+	probeURL := defaultEgressPoolProbeURL
+	interval := defaultEgressPoolProbeInterval
+	rows := []model.Setting{}
+	if err := db.Where("key in ?", []string{"egress_pool_probe_url", "egress_pool_probe_interval"}).Find(&rows).Error; err != nil {
+		return probeURL, interval
+	}
+	for _, row := range rows {
+		v := strings.TrimSpace(row.Value)
+		if v == "" {
+			continue
+		}
+		switch row.Key {
+		case "egress_pool_probe_url":
+			probeURL = v
+		case "egress_pool_probe_interval":
+			if _, err := time.ParseDuration(v); err == nil {
+				interval = v
+			}
+		}
+	}
+	return probeURL, interval
+}
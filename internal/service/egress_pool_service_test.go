@@ -0,0 +1,266 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"xraytool/internal/config"
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+)
+
+func seedForwardPoolOrder(t *testing.T, svc *OrderService, outbound model.SocksOutbound) (model.Order, model.OrderItem) {
+	t.Helper()
+	now := time.Now()
+	customer := model.Customer{Name: "pool-customer", Code: "pool-customer", Status: model.OrderStatusActive}
+	if err := svc.db.Create(&customer).Error; err != nil {
+		t.Fatalf("create customer failed: %v", err)
+	}
+	order := model.Order{
+		CustomerID: customer.ID,
+		Name:       "pool-order",
+		Mode:       model.OrderModeForward,
+		Status:     model.OrderStatusActive,
+		Quantity:   1,
+		Port:       residentialTestPort,
+		StartsAt:   now,
+		ExpiresAt:  now.Add(24 * time.Hour),
+	}
+	if err := svc.db.Create(&order).Error; err != nil {
+		t.Fatalf("create order failed: %v", err)
+	}
+	item := model.OrderItem{
+		OrderID:         order.ID,
+		IP:              "203.0.113.70",
+		Port:            residentialTestPort,
+		Username:        "pool-user",
+		Password:        "pool-pass",
+		SocksOutboundID: &outbound.ID,
+		OutboundType:    forwardOutboundTypeOf(outbound),
+		ForwardAddress:  outbound.Address,
+		ForwardPort:     outbound.Port,
+		ForwardUsername: outbound.Username,
+		ForwardPassword: outbound.Password,
+		Managed:         true,
+		Status:          model.OrderItemStatusActive,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if err := svc.db.Create(&item).Error; err != nil {
+		t.Fatalf("create item failed: %v", err)
+	}
+	return order, item
+}
+
+func TestSetOrderEgressPoolRendersBalancerAndMigratesBack(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	cfgPath := filepath.Join(t.TempDir(), "managed-xray.json")
+	mgr := NewXrayManager(config.Config{XrayConfigPath: cfgPath, XrayAPIServer: "127.0.0.1:10085"}, db, zap.NewNop())
+	svc := NewOrderService(db, mgr, zap.NewNop())
+	pools := NewEgressPoolService(db, mgr)
+
+	upstreams := []model.SocksOutbound{
+		{Type: model.OutboundTypeSocks5, Address: "198.51.100.40", Port: 1080, Username: "u1", Password: "p1", Enabled: true},
+		{Type: model.OutboundTypeHTTP, Address: "198.51.100.41", Port: 3128, Username: "u2", Password: "p2", Enabled: true},
+		{Type: model.OutboundTypeSocks5, Address: "198.51.100.42", Port: 1080, Username: "u3", Password: "p3", Enabled: true},
+	}
+	for i := range upstreams {
+		if err := db.Create(&upstreams[i]).Error; err != nil {
+			t.Fatalf("create upstream failed: %v", err)
+		}
+	}
+	order, item := seedForwardPoolOrder(t, svc, upstreams[2])
+
+	pool, err := pools.Create(context.Background(), EgressPoolInput{
+		Name:        "jp-pool",
+		Strategy:    "stick-to-primary",
+		OutboundIDs: []uint{upstreams[0].ID, upstreams[1].ID},
+	})
+	if err != nil {
+		t.Fatalf("create pool failed: %v", err)
+	}
+	if pool.Strategy != model.EgressPoolStrategyPrimary || len(pool.Members) != 2 || pool.Members[0].SocksOutboundID != upstreams[0].ID {
+		t.Fatalf("unexpected pool: %#v", pool)
+	}
+
+	sibling := item
+	sibling.ID = 0
+	sibling.IP = "203.0.113.71"
+	sibling.Username = "pool-user-2"
+	if err := db.Create(&sibling).Error; err != nil {
+		t.Fatalf("create sibling item failed: %v", err)
+	}
+	if _, err := pools.Create(context.Background(), EgressPoolInput{
+		Name:        "too-big",
+		OutboundIDs: []uint{1, 2, 3, 4},
+	}); err == nil || !strings.Contains(err.Error(), "at most") {
+		t.Fatalf("expected oversized primary pool to be refused, got %v", err)
+	}
+
+	if err := svc.SetOrderEgressPool(context.Background(), order.ID, pool.ID, nil); err != nil {
+		t.Fatalf("bind pool failed: %v", err)
+	}
+	bound := model.OrderItem{}
+	if err := db.First(&bound, item.ID).Error; err != nil {
+		t.Fatalf("load item failed: %v", err)
+	}
+	if bound.EgressPoolID == nil || *bound.EgressPoolID != pool.ID {
+		t.Fatalf("expected item bound to pool, got %#v", bound.EgressPoolID)
+	}
+	if bound.SocksOutboundID == nil || *bound.SocksOutboundID != upstreams[0].ID || bound.ForwardAddress != upstreams[0].Address {
+		t.Fatalf("expected snapshot moved to pool primary, got %#v", bound)
+	}
+	if bound.Username != item.Username || bound.Password != item.Password {
+		t.Fatalf("customer credentials changed: %s/%s", bound.Username, bound.Password)
+	}
+
+	if err := mgr.RebuildConfigFile(context.Background()); err != nil {
+		t.Fatalf("rebuild config failed: %v", err)
+	}
+	body, err := os.ReadFile(cfgPath)
+	if err != nil {
+		t.Fatalf("read config failed: %v", err)
+	}
+	var payload struct {
+		Outbounds []map[string]any `json:"outbounds"`
+		Routing   struct {
+			Rules     []map[string]any `json:"rules"`
+			Balancers []map[string]any `json:"balancers"`
+		} `json:"routing"`
+		Observatory map[string]any `json:"observatory"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("unmarshal config failed: %v", err)
+	}
+	tags := map[string]string{}
+	for _, outbound := range payload.Outbounds {
+		tags[outbound["tag"].(string)] = outbound["protocol"].(string)
+	}
+	if tags[EgressPoolMemberTag(pool.ID, 0)] != "socks" || tags[EgressPoolMemberTag(pool.ID, 1)] != "http" {
+		t.Fatalf("unexpected pool member outbounds: %#v", tags)
+	}
+	if _, ok := tags[OutboundTag(item.ID)]; ok {
+		t.Fatalf("single outbound should not be rendered for pooled item")
+	}
+	memberOutbounds := 0
+	for tag := range tags {
+		if strings.HasPrefix(tag, "xtool-pool-") {
+			memberOutbounds++
+		}
+	}
+	if memberOutbounds != 2 {
+		t.Fatalf("expected pool members rendered once for both items, got %#v", tags)
+	}
+	if len(payload.Routing.Balancers) != 1 || payload.Routing.Balancers[0]["fallbackTag"] != EgressPoolMemberTag(pool.ID, 0) {
+		t.Fatalf("unexpected balancers: %#v", payload.Routing.Balancers)
+	}
+	strategy, _ := payload.Routing.Balancers[0]["strategy"].(map[string]any)
+	if strategy["type"] != "leastLoad" {
+		t.Fatalf("expected primary pool to fail over through leastLoad costs: %#v", strategy)
+	}
+	poolRules := 0
+	for _, rule := range payload.Routing.Rules {
+		if rule["balancerTag"] == EgressPoolBalancerTag(pool.ID) {
+			poolRules++
+		}
+	}
+	if poolRules != 2 {
+		t.Fatalf("expected both items routed to the pool balancer: %#v", payload.Routing.Rules)
+	}
+	if payload.Observatory == nil {
+		t.Fatalf("expected observatory config")
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(body, &raw); err != nil {
+		t.Fatalf("unmarshal raw config failed: %v", err)
+	}
+	confObj, err := decodeConfig(raw)
+	if err != nil {
+		t.Fatalf("decode config failed: %v", err)
+	}
+	if _, err := confObj.Build(); err != nil {
+		t.Fatalf("xray rejected pooled config: %v", err)
+	}
+
+	if err := pools.Delete(pool.ID); err == nil {
+		t.Fatalf("expected delete of bound pool to fail")
+	}
+	if err := svc.SetOrderEgressPool(context.Background(), order.ID, 0, []uint{item.ID}); err != nil {
+		t.Fatalf("unbind pool failed: %v", err)
+	}
+	if err := db.First(&bound, item.ID).Error; err != nil {
+		t.Fatalf("load item failed: %v", err)
+	}
+	if bound.EgressPoolID != nil || bound.ForwardAddress != upstreams[0].Address {
+		t.Fatalf("expected unbound item to keep primary snapshot, got %#v", bound)
+	}
+}
+
+func TestPrimaryEgressPoolCostsKeepMemberOrder(t *testing.T) {
+	balancer := egressPoolBalancer(1, model.EgressPoolStrategyPrimary, egressPoolPrimaryMaxMembers)
+	settings := balancer["strategy"].(map[string]interface{})["settings"].(map[string]interface{})
+	costs := []float64{1}
+	for _, row := range settings["costs"].([]map[string]interface{}) {
+		// Xray parses cost values as float32.
+		costs = append(costs, float64(float32(row["value"].(float64))))
+	}
+	if len(costs) != egressPoolPrimaryMaxMembers {
+		t.Fatalf("expected one cost per member, got %v", costs)
+	}
+	// leastLoad ranks by time.Duration(delay * sqrt(cost)).
+	rank := func(delay time.Duration, cost float64) time.Duration {
+		value := float64(delay) * math.Sqrt(cost)
+		if value >= math.MaxInt64 {
+			t.Fatalf("cost %v overflows at delay %s", cost, delay)
+		}
+		return time.Duration(value)
+	}
+	for idx := 1; idx < len(costs); idx++ {
+		slowest := rank(5*time.Second, costs[idx-1])
+		fastest := rank(time.Millisecond, costs[idx])
+		if slowest >= fastest {
+			t.Fatalf("member %d at 5s (%d) must rank before member %d at 1ms (%d)", idx-1, slowest, idx, fastest)
+		}
+	}
+}
+
+func TestMarkEgressPoolActiveMemberFollowsStrategy(t *testing.T) {
+	members := func(alive ...bool) []EgressPoolMemberStatus {
+		out := make([]EgressPoolMemberStatus, 0, len(alive))
+		for i, ok := range alive {
+			out = append(out, EgressPoolMemberStatus{SocksOutboundID: uint(i + 1), Alive: ok, DelayMS: int64(300 - i*100)})
+		}
+		return out
+	}
+
+	primary := EgressPoolItemStatus{Strategy: model.EgressPoolStrategyPrimary, Members: members(false, true, true)}
+	markEgressPoolActiveMember(&primary)
+	if primary.ActiveOutboundID == nil || *primary.ActiveOutboundID != 2 {
+		t.Fatalf("expected primary failover to second member, got %#v", primary.ActiveOutboundID)
+	}
+
+	tail := EgressPoolItemStatus{Strategy: model.EgressPoolStrategyPrimary, Members: members(false, false, true)}
+	markEgressPoolActiveMember(&tail)
+	if tail.ActiveOutboundID == nil || *tail.ActiveOutboundID != 3 {
+		t.Fatalf("expected primary failover past the second member, got %#v", tail.ActiveOutboundID)
+	}
+
+	leastPing := EgressPoolItemStatus{Strategy: model.EgressPoolStrategyLeastPing, Members: members(true, true, false)}
+	markEgressPoolActiveMember(&leastPing)
+	if leastPing.ActiveOutboundID == nil || *leastPing.ActiveOutboundID != 2 {
+		t.Fatalf("expected lowest-delay alive member, got %#v", leastPing.ActiveOutboundID)
+	}
+
+	random := EgressPoolItemStatus{Strategy: model.EgressPoolStrategyRandom, Members: members(true, false, true)}
+	markEgressPoolActiveMember(&random)
+	if random.ActiveOutboundID != nil || !random.Members[0].Active || random.Members[1].Active || !random.Members[2].Active {
+		t.Fatalf("expected all alive members active for random: %#v", random.Members)
+	}
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+type ForwardHealthService struct {
+	db      *gorm.DB
+	store   *store.Store
+	forward *ForwardOutboundService
+	orders  *OrderService
+	bark    *BarkService
+	logger  *zap.Logger
+
+	running       atomic.Bool
+	mu            sync.Mutex
+	lastAttemptAt time.Time
+}
+
+type forwardHealthSettings struct {
+	Enabled          bool
+	Interval         time.Duration
+	FailureThreshold int
+	AutoRehome       bool
+	HistoryDays      int
+}
+
+func NewForwardHealthService(db *gorm.DB, st *store.Store, forward *ForwardOutboundService, orders *OrderService, bark *BarkService, logger *zap.Logger) *ForwardHealthService {
+	return &ForwardHealthService{db: db, store: st, forward: forward, orders: orders, bark: bark, logger: logger}
+}
+
+func (s *ForwardHealthService) RunDue(ctx context.Context) {
+	settings, err := s.loadSettings()
+	if err != nil {
+		s.logger.Warn("load forward health settings failed", zap.Error(err))
+		return
+	}
+	if !settings.Enabled {
+		return
+	}
+
+	s.mu.Lock()
+	if !s.lastAttemptAt.IsZero() && time.Since(s.lastAttemptAt) < settings.Interval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastAttemptAt = time.Now()
+	s.mu.Unlock()
+
+	s.runCycle(ctx, settings)
+}
+
+// Running reports whether a probe cycle is in flight. Probes can take a
+// timeout each, so the scheduler starts cycles in the background.
+func (s *ForwardHealthService) Running() bool {
+	return s.running.Load()
+}
+
+func (s *ForwardHealthService) runCycle(ctx context.Context, settings forwardHealthSettings) {
+	if !s.running.CompareAndSwap(false, true) {
+		return
+	}
+	defer s.running.Store(false)
+
+	rows := []model.SocksOutbound{}
+	if err := s.db.Where("enabled = 1").Order("id asc").Find(&rows).Error; err != nil {
+		s.logger.Warn("load forward outbounds for health check failed", zap.Error(err))
+		return
+	}
+	for _, row := range rows {
+		if ctx.Err() != nil {
+			return
+		}
+		_, _ = s.forward.probeRow(row)
+		latest := model.SocksOutbound{}
+		if err := s.db.First(&latest, row.ID).Error; err != nil {
+			continue
+		}
+		s.handleResult(ctx, settings, row, latest)
+	}
+	if settings.HistoryDays > 0 {
+		if err := s.forward.PruneProbeHistory(time.Now().AddDate(0, 0, -settings.HistoryDays)); err != nil {
+			s.logger.Warn("prune forward probe history failed", zap.Error(err))
+		}
+	}
+}
+
+func (s *ForwardHealthService) handleResult(ctx context.Context, settings forwardHealthSettings, before model.SocksOutbound, after model.SocksOutbound) {
+	label := forwardOutboundLabel(after)
+	if after.FailStreak == 0 {
+		if before.FailStreak >= settings.FailureThreshold {
+			s.store.AddTaskLog("info", "forward upstream recovered", label)
+			s.notify("XrayTool 上游已恢复", fmt.Sprintf("上游[%s] 探测恢复正常", label))
+		}
+		return
+	}
+	if after.FailStreak < settings.FailureThreshold {
+		return
+	}
+	if before.FailStreak < settings.FailureThreshold {
+		detail := fmt.Sprintf("%s failed %d consecutive probes: %s", label, after.FailStreak, after.ProbeError)
+		s.store.AddTaskLog("warn", "forward upstream down", detail)
+		s.notify("XrayTool 上游连续探测失败", fmt.Sprintf("上游[%s] 连续 %d 次探测失败: %s", label, after.FailStreak, after.ProbeError))
+	}
+	if !settings.AutoRehome {
+		return
+	}
+	results, err := s.orders.RehomeForwardOutboundItems(ctx, after.ID)
+	if err != nil {
+		s.logger.Warn("forward rehome failed", zap.Error(err), zap.Uint("outbound_id", after.ID))
+		if len(results) == 0 {
+			return
+		}
+	}
+	moved := 0
+	failed := make([]string, 0)
+	for _, result := range results {
+		if result.Error != "" {
+			failed = append(failed, fmt.Sprintf("item %d: %s", result.OrderItemID, result.Error))
+			continue
+		}
+		moved++
+	}
+	if moved > 0 {
+		s.store.AddTaskLog("info", "forward items rehomed", fmt.Sprintf("%s: moved %d items to spare upstreams", label, moved))
+		s.notify("XrayTool 上游自动切换", fmt.Sprintf("上游[%s] 故障, 已将 %d 条线路切换到同国家备用上游", label, moved))
+	}
+	if len(failed) > 0 {
+		s.store.AddTaskLog("warn", "forward items rehome incomplete", fmt.Sprintf("%s: %s", label, strings.Join(failed, "; ")))
+	}
+}
+
+func (s *ForwardHealthService) notify(title, body string) {
+	if s.bark == nil {
+		return
+	}
+	if err := s.bark.Notify(title, body); err != nil {
+		s.logger.Warn("bark forward health notify failed", zap.Error(err))
+	}
+}
+
+func (s *ForwardHealthService) loadSettings() (forwardHealthSettings, error) {
+	values, err := s.store.GetSettings()
+	if err != nil {
+		return forwardHealthSettings{}, err
+	}
+	intervalSeconds := parseSettingInt(values["forward_probe_interval_seconds"], 300)
+	if intervalSeconds < 30 {
+		intervalSeconds = 30
+	}
+	threshold := parseSettingInt(values["forward_probe_failure_threshold"], 3)
+	if threshold <= 0 {
+		threshold = 3
+	}
+	return forwardHealthSettings{
+		Enabled:          parseSettingBool(values["forward_probe_enabled"], false),
+		Interval:         time.Duration(intervalSeconds) * time.Second,
+		FailureThreshold: threshold,
+		AutoRehome:       parseSettingBool(values["forward_probe_auto_rehome"], false),
+		HistoryDays:      parseSettingInt(values["forward_probe_history_days"], 7),
+	}, nil
+}
+
+func forwardOutboundLabel(row model.SocksOutbound) string {
+	name := strings.TrimSpace(row.Name)
+	if name == "" {
+		name = strings.TrimSpace(row.RouteUser)
+	}
+	addr := fmt.Sprintf("%s:%d", row.Address, row.Port)
+	if name == "" {
+		return addr
+	}
+	return fmt.Sprintf("%s(%s)", name, addr)
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+)
+
+func TestRehomeForwardOutboundItemsPicksSameCountrySpare(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+
+	upstreams := []model.SocksOutbound{
+		{Type: model.OutboundTypeSocks5, Address: "198.51.100.50", Port: 1080, Username: "down", Password: "down", CountryCode: "jp", ProbeStatus: "failed", FailStreak: 3, Enabled: true},
+		{Type: model.OutboundTypeSocks5, Address: "198.51.100.51", Port: 1080, Username: "us", Password: "us", CountryCode: "us", ProbeStatus: "ok", Enabled: true},
+		{Type: model.OutboundTypeSocks5, Address: "198.51.100.52", Port: 1080, Username: "flaky", Password: "flaky", CountryCode: "jp", ProbeStatus: "ok", FailStreak: 1, Enabled: true},
+		{Type: model.OutboundTypeHTTP, Address: "198.51.100.53", Port: 3128, Username: "spare", Password: "spare", CountryCode: "jp", ProbeStatus: "ok", Enabled: true},
+	}
+	for i := range upstreams {
+		if err := db.Create(&upstreams[i]).Error; err != nil {
+			t.Fatalf("create upstream failed: %v", err)
+		}
+	}
+	order, item := seedForwardPoolOrder(t, svc, upstreams[0])
+
+	pool := model.EgressPool{Name: "jp", Strategy: model.EgressPoolStrategyPrimary, Enabled: true}
+	if err := db.Create(&pool).Error; err != nil {
+		t.Fatalf("create pool failed: %v", err)
+	}
+	pooled := item
+	pooled.ID = 0
+	pooled.IP = "203.0.113.71"
+	pooled.Username = "pooled-user"
+	pooled.EgressPoolID = &pool.ID
+	if err := db.Create(&pooled).Error; err != nil {
+		t.Fatalf("create pooled item failed: %v", err)
+	}
+
+	results, err := svc.RehomeForwardOutboundItems(context.Background(), upstreams[0].ID)
+	if err != nil {
+		t.Fatalf("rehome failed: %v", err)
+	}
+	if len(results) != 1 || results[0].OrderItemID != item.ID || results[0].ToOutboundID != upstreams[3].ID {
+		t.Fatalf("unexpected rehome results: %#v", results)
+	}
+
+	moved := model.OrderItem{}
+	if err := db.First(&moved, item.ID).Error; err != nil {
+		t.Fatalf("load item failed: %v", err)
+	}
+	if moved.SocksOutboundID == nil || *moved.SocksOutboundID != upstreams[3].ID || moved.OutboundType != model.OutboundTypeHTTP || moved.ForwardAddress != upstreams[3].Address {
+		t.Fatalf("expected item moved to spare, got %#v", moved)
+	}
+	if moved.Username != item.Username || moved.Password != item.Password {
+		t.Fatalf("customer credentials changed: %s/%s", moved.Username, moved.Password)
+	}
+	bumped := model.Order{}
+	if err := db.First(&bumped, order.ID).Error; err != nil {
+		t.Fatalf("load order failed: %v", err)
+	}
+	if bumped.Version != 2 {
+		t.Fatalf("expected rehome to bump the order version, got %d", bumped.Version)
+	}
+	versions, err := svc.ListOrderVersions(order.ID)
+	if err != nil || len(versions) != 2 || versions[0].Source != OrderVersionSourceRehome || versions[1].Source != OrderVersionSourceBaseline {
+		t.Fatalf("expected baseline and rehome versions, got %+v (%v)", versions, err)
+	}
+
+	untouched := model.OrderItem{}
+	if err := db.First(&untouched, pooled.ID).Error; err != nil {
+		t.Fatalf("load pooled item failed: %v", err)
+	}
+	if untouched.SocksOutboundID == nil || *untouched.SocksOutboundID != upstreams[0].ID {
+		t.Fatalf("pooled item should be left to the balancer, got %#v", untouched.SocksOutboundID)
+	}
+}
+
+func TestForwardHealthRunDueRecordsFailuresAndAlerts(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	if err := db.AutoMigrate(&model.Setting{}, &model.TaskLog{}); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	st := store.New(db)
+	if err := st.SetSettings(map[string]string{
+		"forward_probe_enabled":           "true",
+		"forward_probe_failure_threshold": "2",
+	}); err != nil {
+		t.Fatalf("save settings failed: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	closedPort := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+
+	outbound := model.SocksOutbound{Type: model.OutboundTypeSocks5, Address: "127.0.0.1", Port: closedPort, ExitIP: "198.51.100.60", CountryCode: "jp", ProbeStatus: "ok", Enabled: true}
+	if err := db.Create(&outbound).Error; err != nil {
+		t.Fatalf("create upstream failed: %v", err)
+	}
+
+	health := NewForwardHealthService(db, st, NewForwardOutboundService(db), NewOrderService(db, &XrayManager{}, zap.NewNop()), nil, zap.NewNop())
+	settings, err := health.loadSettings()
+	if err != nil {
+		t.Fatalf("load settings failed: %v", err)
+	}
+	health.RunDue(context.Background())
+	// The interval gate must skip an immediate second run.
+	health.RunDue(context.Background())
+	health.runCycle(context.Background(), settings)
+
+	latest := model.SocksOutbound{}
+	if err := db.First(&latest, outbound.ID).Error; err != nil {
+		t.Fatalf("load upstream failed: %v", err)
+	}
+	if latest.FailStreak != 2 || latest.ProbeStatus != "failed" {
+		t.Fatalf("expected two recorded failures, got streak=%d status=%s", latest.FailStreak, latest.ProbeStatus)
+	}
+	if latest.CountryCode != "jp" || latest.ExitIP != "198.51.100.60" {
+		t.Fatalf("failed probe should keep last known geo, got %s/%s", latest.CountryCode, latest.ExitIP)
+	}
+
+	history, err := health.forward.ProbeHistory(outbound.ID, 0)
+	if err != nil {
+		t.Fatalf("load history failed: %v", err)
+	}
+	if len(history) != 2 || history[0].Status != "failed" || history[0].Error == "" {
+		t.Fatalf("unexpected probe history: %#v", history)
+	}
+
+	var alerts int64
+	if err := db.Model(&model.TaskLog{}).Where("message = ?", "forward upstream down").Count(&alerts).Error; err != nil {
+		t.Fatalf("count task logs failed: %v", err)
+	}
+	if alerts != 1 {
+		t.Fatalf("expected one down alert, got %d", alerts)
+	}
+}
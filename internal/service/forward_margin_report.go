@@ -0,0 +1,180 @@
+package service
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"xraytool/internal/model"
+)
+
+// Order prices and reported margins are per 30 days; upstream costs are
+// scaled from their own billing period.
+const pricePeriodDays = 30
+
+type ForwardMarginOrder struct {
+	OrderID      uint      `json:"order_id"`
+	OrderNo      string    `json:"order_no"`
+	CustomerID   uint      `json:"customer_id"`
+	CustomerName string    `json:"customer_name"`
+	Items        int64     `json:"items"`
+	OrderItems   int64     `json:"order_items"`
+	Price        float64   `json:"price"`
+	Revenue      float64   `json:"revenue"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+type ForwardMarginRow struct {
+	OutboundID        uint                 `json:"outbound_id"`
+	Name              string               `json:"name"`
+	Address           string               `json:"address"`
+	Port              int                  `json:"port"`
+	Supplier          string               `json:"supplier"`
+	Cost              float64              `json:"cost"`
+	CostPeriodDays    int                  `json:"cost_period_days"`
+	MonthlyCost       float64              `json:"monthly_cost"`
+	MonthlyRevenue    float64              `json:"monthly_revenue"`
+	MonthlyMargin     float64              `json:"monthly_margin"`
+	MaxItems          int                  `json:"max_items"`
+	MaxCustomers      int                  `json:"max_customers"`
+	ActiveItems       int64                `json:"active_items"`
+	ActiveCustomers   int                  `json:"active_customers"`
+	SupplierExpiresAt *time.Time           `json:"supplier_expires_at,omitempty"`
+	SupplierExpired   bool                 `json:"supplier_expired"`
+	SupplierExpiring  bool                 `json:"supplier_expiring"`
+	Orders            []ForwardMarginOrder `json:"orders"`
+}
+
+type ForwardMarginReport struct {
+	GeneratedAt         time.Time          `json:"generated_at"`
+	PeriodDays          int                `json:"period_days"`
+	TotalMonthlyCost    float64            `json:"total_monthly_cost"`
+	TotalMonthlyRevenue float64            `json:"total_monthly_revenue"`
+	TotalMonthlyMargin  float64            `json:"total_monthly_margin"`
+	Rows                []ForwardMarginRow `json:"rows"`
+}
+
+// MarginReport joins every upstream's cost with the active orders routed
+// through it. An order's price is split across its upstreams by item count.
+func (s *ForwardOutboundService) MarginReport(now time.Time) (*ForwardMarginReport, error) {
+	outbounds := []model.SocksOutbound{}
+	if err := s.db.Order("id asc").Find(&outbounds).Error; err != nil {
+		return nil, err
+	}
+
+	type usageRow struct {
+		OutboundID   uint
+		OrderID      uint
+		OrderNo      string
+		CustomerID   uint
+		CustomerName string
+		Price        float64
+		ExpiresAt    time.Time
+		Count        int64
+	}
+	usage := []usageRow{}
+	if err := s.db.Table("order_items oi").
+		Select("oi.socks_outbound_id as outbound_id, o.id as order_id, o.order_no as order_no, o.customer_id as customer_id, c.name as customer_name, o.price as price, o.expires_at as expires_at, count(1) as count").
+		Joins("join orders o on o.id = oi.order_id").
+		Joins("left join customers c on c.id = o.customer_id").
+		Where("oi.socks_outbound_id is not null and oi.status = ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '')", model.OrderItemStatusActive, model.OrderStatusActive, now).
+		Group("oi.socks_outbound_id, o.id, o.order_no, o.customer_id, c.name, o.price, o.expires_at").
+		Scan(&usage).Error; err != nil {
+		return nil, err
+	}
+
+	orderIDs := make([]uint, 0, len(usage))
+	for _, row := range usage {
+		orderIDs = append(orderIDs, row.OrderID)
+	}
+	orderItems := map[uint]int64{}
+	if len(orderIDs) > 0 {
+		counts := []struct {
+			OrderID uint
+			Count   int64
+		}{}
+		if err := s.db.Model(&model.OrderItem{}).
+			Select("order_id, count(1) as count").
+			Where("order_id in ? and status = ?", uniqueUintIDs(orderIDs), model.OrderItemStatusActive).
+			Group("order_id").
+			Scan(&counts).Error; err != nil {
+			return nil, err
+		}
+		for _, row := range counts {
+			orderItems[row.OrderID] = row.Count
+		}
+	}
+
+	byOutbound := map[uint][]usageRow{}
+	for _, row := range usage {
+		byOutbound[row.OutboundID] = append(byOutbound[row.OutboundID], row)
+	}
+
+	report := &ForwardMarginReport{GeneratedAt: now, PeriodDays: pricePeriodDays, Rows: make([]ForwardMarginRow, 0, len(outbounds))}
+	for _, outbound := range outbounds {
+		row := ForwardMarginRow{
+			OutboundID:        outbound.ID,
+			Name:              outbound.Name,
+			Address:           outbound.Address,
+			Port:              outbound.Port,
+			Supplier:          outbound.Supplier,
+			Cost:              outbound.Cost,
+			CostPeriodDays:    outbound.CostPeriodDays,
+			MonthlyCost:       monthlyForwardCost(outbound),
+			MaxItems:          outbound.MaxItems,
+			MaxCustomers:      outbound.MaxCustomers,
+			SupplierExpiresAt: outbound.SupplierExpiresAt,
+			Orders:            []ForwardMarginOrder{},
+		}
+		if outbound.SupplierExpiresAt != nil {
+			row.SupplierExpired = !outbound.SupplierExpiresAt.After(now)
+			row.SupplierExpiring = !row.SupplierExpired && outbound.SupplierExpiresAt.Before(now.Add(7*24*time.Hour))
+		}
+		customers := map[uint]struct{}{}
+		for _, use := range byOutbound[outbound.ID] {
+			total := orderItems[use.OrderID]
+			if total < use.Count {
+				total = use.Count
+			}
+			revenue := roundCurrency(use.Price * float64(use.Count) / float64(total))
+			row.Orders = append(row.Orders, ForwardMarginOrder{
+				OrderID:      use.OrderID,
+				OrderNo:      use.OrderNo,
+				CustomerID:   use.CustomerID,
+				CustomerName: use.CustomerName,
+				Items:        use.Count,
+				OrderItems:   total,
+				Price:        use.Price,
+				Revenue:      revenue,
+				ExpiresAt:    use.ExpiresAt,
+			})
+			row.ActiveItems += use.Count
+			row.MonthlyRevenue += revenue
+			customers[use.CustomerID] = struct{}{}
+		}
+		sort.Slice(row.Orders, func(i, j int) bool { return row.Orders[i].OrderID < row.Orders[j].OrderID })
+		row.ActiveCustomers = len(customers)
+		row.MonthlyRevenue = roundCurrency(row.MonthlyRevenue)
+		row.MonthlyMargin = roundCurrency(row.MonthlyRevenue - row.MonthlyCost)
+
+		report.TotalMonthlyCost += row.MonthlyCost
+		report.TotalMonthlyRevenue += row.MonthlyRevenue
+		report.Rows = append(report.Rows, row)
+	}
+	report.TotalMonthlyCost = roundCurrency(report.TotalMonthlyCost)
+	report.TotalMonthlyRevenue = roundCurrency(report.TotalMonthlyRevenue)
+	report.TotalMonthlyMargin = roundCurrency(report.TotalMonthlyRevenue - report.TotalMonthlyCost)
+	return report, nil
+}
+
+func monthlyForwardCost(outbound model.SocksOutbound) float64 {
+	days := outbound.CostPeriodDays
+	if days <= 0 {
+		days = pricePeriodDays
+	}
+	return roundCurrency(outbound.Cost * pricePeriodDays / float64(days))
+}
+
+func roundCurrency(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -24,22 +24,42 @@ type ForwardOutboundService struct {
 
 type ForwardOutboundInput struct {
 	Name      string `json:"name"`
+	Type      string `json:"type"`
 	Address   string `json:"address"`
 	Port      int    `json:"port"`
 	Username  string `json:"username"`
 	Password  string `json:"password"`
+	Method    string `json:"method"`
+	UUID      string `json:"uuid"`
+	Security  string `json:"security"`
+	Network   string `json:"network"`
+	Path      string `json:"path"`
+	Host      string `json:"host"`
+	TLS       bool   `json:"tls"`
+	SNI       string `json:"sni"`
 	RouteUser string `json:"route_user"`
 	Enabled   *bool  `json:"enabled"`
+
+	MaxItems          int        `json:"max_items"`
+	MaxCustomers      int        `json:"max_customers"`
+	Supplier          string     `json:"supplier"`
+	Cost              float64    `json:"cost"`
+	CostPeriodDays    int        `json:"cost_period_days"`
+	SupplierExpiresAt *time.Time `json:"supplier_expires_at"`
 }
 
 type ForwardOutboundImportRow struct {
 	Raw       string `json:"raw"`
+	Name      string `json:"name,omitempty"`
+	Type      string `json:"type"`
 	Address   string `json:"address"`
 	Port      int    `json:"port"`
 	Username  string `json:"username"`
 	Password  string `json:"password"`
 	RouteUser string `json:"route_user"`
 	Error     string `json:"error,omitempty"`
+
+	upstream model.SocksOutbound
 }
 
 func NewForwardOutboundService(db *gorm.DB) *ForwardOutboundService {
@@ -90,17 +110,30 @@ func (s *ForwardOutboundService) Update(id uint, in ForwardOutboundInput) (*mode
 			return nil, err
 		}
 	}
-	updates := map[string]interface{}{
-		"name":       row.Name,
-		"address":    row.Address,
-		"port":       row.Port,
-		"username":   row.Username,
-		"password":   row.Password,
-		"route_user": row.RouteUser,
-		"enabled":    row.Enabled,
-		"updated_at": time.Now(),
+	changed, err := s.ensureUpstreamEditable(base, row)
+	if err != nil {
+		return nil, err
 	}
-	if err := s.db.Model(&model.SocksOutbound{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+	updates := forwardOutboundUpstreamUpdates(row)
+	updates["name"] = row.Name
+	updates["route_user"] = row.RouteUser
+	updates["enabled"] = row.Enabled
+	updates["max_items"] = row.MaxItems
+	updates["max_customers"] = row.MaxCustomers
+	updates["supplier"] = row.Supplier
+	updates["cost"] = row.Cost
+	updates["cost_period_days"] = row.CostPeriodDays
+	updates["supplier_expires_at"] = row.SupplierExpiresAt
+	updates["updated_at"] = time.Now()
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&model.SocksOutbound{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+			return err
+		}
+		if changed {
+			return resnapshotUpstreamItemsTx(tx, id, row)
+		}
+		return nil
+	}); err != nil {
 		return nil, err
 	}
 	if err := s.db.First(&base, id).Error; err != nil {
@@ -123,16 +156,33 @@ func (s *ForwardOutboundService) Delete(id uint) error {
 	if id == 0 {
 		return errors.New("id is required")
 	}
-	var count int64
-	if err := s.db.Model(&model.OrderItem{}).Joins("join orders o on o.id = order_items.order_id").
-		Where("order_items.socks_outbound_id = ? and order_items.status = ? and o.status = ? and o.expires_at > ?", id, model.OrderItemStatusActive, model.OrderStatusActive, time.Now()).
-		Count(&count).Error; err != nil {
+	count, err := s.referencingItemCount(id)
+	if err != nil {
 		return err
 	}
 	if count > 0 {
-		return fmt.Errorf("outbound is used by %d active order items", count)
+		return fmt.Errorf("outbound is used by %d live order items", count)
+	}
+	if err := s.db.Model(&model.EgressPoolMember{}).Where("socks_outbound_id = ?", id).Count(&count).Error; err != nil {
+		return err
 	}
-	return s.db.Delete(&model.SocksOutbound{}, id).Error
+	if count > 0 {
+		return fmt.Errorf("outbound is a member of %d egress pools", count)
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("socks_outbound_id = ?", id).Delete(&model.SocksOutboundProbe{}).Error; err != nil {
+			return err
+		}
+		// Lapsed items keep their address snapshot but no longer point at
+		// the upstream.
+		if err := tx.Model(&model.OrderItem{}).Where("socks_outbound_id = ?", id).Updates(map[string]interface{}{
+			"socks_outbound_id": nil,
+			"updated_at":        time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&model.SocksOutbound{}, id).Error
+	})
 }
 
 func (s *ForwardOutboundService) ImportLines(lines string) ([]ForwardOutboundImportRow, error) {
@@ -143,10 +193,31 @@ func (s *ForwardOutboundService) ImportLines(lines string) ([]ForwardOutboundImp
 		if raw == "" {
 			continue
 		}
-		row := ForwardOutboundImportRow{Raw: raw}
+		row := ForwardOutboundImportRow{Raw: raw, Type: model.OutboundTypeSocks5}
+		if strings.Contains(raw, "://") {
+			upstream, err := parseForwardOutboundURI(raw)
+			if err == nil {
+				err = validateForwardOutbound(upstream)
+			}
+			if err != nil {
+				row.Error = err.Error()
+				rows = append(rows, row)
+				continue
+			}
+			row.Name = upstream.Name
+			row.Type = upstream.Type
+			row.Address = upstream.Address
+			row.Port = upstream.Port
+			row.Username = upstream.Username
+			row.Password = upstream.Password
+			row.RouteUser = upstream.RouteUser
+			row.upstream = upstream
+			rows = append(rows, row)
+			continue
+		}
 		parts := strings.Split(raw, ":")
 		if len(parts) != 4 && len(parts) != 5 {
-			row.Error = "format must be ip:port:user:pass[:route_user]"
+			row.Error = "format must be ip:port:user:pass[:route_user] or a socks5/http/ss/vmess uri"
 			rows = append(rows, row)
 			continue
 		}
@@ -166,6 +237,13 @@ func (s *ForwardOutboundService) ImportLines(lines string) ([]ForwardOutboundImp
 		if row.Address == "" || row.Username == "" || row.Password == "" {
 			row.Error = "address/user/pass required"
 		}
+		row.upstream = model.SocksOutbound{
+			Type:     model.OutboundTypeSocks5,
+			Address:  row.Address,
+			Port:     row.Port,
+			Username: row.Username,
+			Password: row.Password,
+		}
 		rows = append(rows, row)
 	}
 	if err := scanner.Err(); err != nil {
@@ -177,7 +255,7 @@ func (s *ForwardOutboundService) ImportLines(lines string) ([]ForwardOutboundImp
 		if rows[i].Error != "" {
 			continue
 		}
-		key := strings.ToLower(fmt.Sprintf("%s:%d:%s", rows[i].Address, rows[i].Port, rows[i].Username))
+		key := strings.ToLower(fmt.Sprintf("%s:%s:%d:%s", rows[i].Type, rows[i].Address, rows[i].Port, forwardOutboundIdentity(rows[i].upstream)))
 		if _, ok := seen[key]; ok {
 			rows[i].Error = "duplicate in import list"
 			continue
@@ -191,7 +269,7 @@ func (s *ForwardOutboundService) ImportLines(lines string) ([]ForwardOutboundImp
 		}
 		row := rows[i]
 		rec := model.SocksOutbound{}
-		err := s.db.Where("address = ? and port = ? and username = ?", row.Address, row.Port, row.Username).First(&rec).Error
+		err := s.db.Where("type = ? and address = ? and port = ? and username = ? and uuid = ?", row.Type, row.Address, row.Port, row.Username, row.upstream.UUID).First(&rec).Error
 		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 			rows[i].Error = err.Error()
 			continue
@@ -204,15 +282,10 @@ func (s *ForwardOutboundService) ImportLines(lines string) ([]ForwardOutboundImp
 					continue
 				}
 			}
-			create := model.SocksOutbound{
-				Name:      "",
-				Address:   row.Address,
-				Port:      row.Port,
-				Username:  row.Username,
-				Password:  row.Password,
-				RouteUser: routeUser,
-				Enabled:   true,
-			}
+			create := row.upstream
+			create.Name = row.Name
+			create.RouteUser = routeUser
+			create.Enabled = true
 			if createErr := s.db.Create(&create).Error; createErr != nil {
 				rows[i].Error = createErr.Error()
 			}
@@ -229,15 +302,27 @@ func (s *ForwardOutboundService) ImportLines(lines string) ([]ForwardOutboundImp
 				continue
 			}
 		}
-		updateErr := s.db.Model(&model.SocksOutbound{}).Where("id = ?", rec.ID).Updates(map[string]interface{}{
-			"address":    row.Address,
-			"port":       row.Port,
-			"username":   row.Username,
-			"password":   row.Password,
-			"route_user": routeUser,
-			"enabled":    true,
-			"updated_at": time.Now(),
-		}).Error
+		changed, editErr := s.ensureUpstreamEditable(rec, row.upstream)
+		if editErr != nil {
+			rows[i].Error = editErr.Error()
+			continue
+		}
+		updates := forwardOutboundUpstreamUpdates(row.upstream)
+		if row.Name != "" {
+			updates["name"] = row.Name
+		}
+		updates["route_user"] = routeUser
+		updates["enabled"] = true
+		updates["updated_at"] = time.Now()
+		updateErr := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&model.SocksOutbound{}).Where("id = ?", rec.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+			if changed {
+				return resnapshotUpstreamItemsTx(tx, rec.ID, row.upstream)
+			}
+			return nil
+		})
 		if updateErr != nil {
 			rows[i].Error = updateErr.Error()
 		}
@@ -299,20 +384,42 @@ func (s *ForwardOutboundService) normalizeRouteUser(id uint, fallbackCountry str
 }
 
 func (s *ForwardOutboundService) probeRow(row model.SocksOutbound) (*model.SocksOutbound, error) {
-	exitIP, country, probeErr := probeSocksOutbound(row.Address, row.Port, row.Username, row.Password)
+	started := time.Now()
+	exitIP, country, region, probeErr := probeForwardOutboundGeo(row)
 	now := time.Now()
+	latency := now.Sub(started).Milliseconds()
+	history := model.SocksOutboundProbe{
+		SocksOutboundID: row.ID,
+		LatencyMS:       latency,
+		CreatedAt:       now,
+	}
 	updates := map[string]interface{}{
-		"exit_ip":        strings.TrimSpace(exitIP),
-		"country_code":   strings.ToLower(strings.TrimSpace(country)),
+		"latency_ms":     latency,
 		"last_probed_at": &now,
 		"updated_at":     now,
 	}
 	if probeErr != nil {
+		history.Status = "failed"
+		history.Error = truncateProbeError(probeErr.Error())
 		updates["probe_status"] = "failed"
-		updates["probe_error"] = probeErr.Error()
+		updates["probe_error"] = history.Error
+		updates["fail_streak"] = gorm.Expr("fail_streak + 1")
 	} else {
+		history.Status = "ok"
+		history.ExitIP = strings.TrimSpace(exitIP)
+		history.CountryCode = strings.ToLower(strings.TrimSpace(country))
+		history.Region = strings.TrimSpace(region)
+		if geo, ok := lookupLocalIPGeo(history.ExitIP); ok {
+			history.ASN = geo.ASN
+			history.ASOrg = geo.ASOrg
+		}
+		updates["exit_ip"] = history.ExitIP
+		updates["country_code"] = history.CountryCode
+		updates["asn"] = history.ASN
+		updates["as_org"] = history.ASOrg
 		updates["probe_status"] = "ok"
 		updates["probe_error"] = ""
+		updates["fail_streak"] = 0
 		if strings.TrimSpace(row.RouteUser) == "" {
 			route, err := s.nextAvailableRouteUser(country)
 			if err != nil {
@@ -321,7 +428,13 @@ func (s *ForwardOutboundService) probeRow(row model.SocksOutbound) (*model.Socks
 			updates["route_user"] = route
 		}
 	}
-	if err := s.db.Model(&model.SocksOutbound{}).Where("id = ?", row.ID).Updates(updates).Error; err != nil {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&history).Error; err != nil {
+			return err
+		}
+		return tx.Model(&model.SocksOutbound{}).Where("id = ?", row.ID).Updates(updates).Error
+	})
+	if err != nil {
 		return nil, err
 	}
 	if probeErr != nil {
@@ -334,34 +447,158 @@ func (s *ForwardOutboundService) probeRow(row model.SocksOutbound) (*model.Socks
 	return &latest, nil
 }
 
-func normalizeForwardOutboundInput(in ForwardOutboundInput) (model.SocksOutbound, error) {
-	name := strings.TrimSpace(in.Name)
-	address := strings.TrimSpace(in.Address)
-	username := strings.TrimSpace(in.Username)
-	password := strings.TrimSpace(in.Password)
-	routeUser := strings.TrimSpace(in.RouteUser)
-	if address == "" {
-		return model.SocksOutbound{}, errors.New("address is required")
+func (s *ForwardOutboundService) ProbeHistory(id uint, limit int) ([]model.SocksOutboundProbe, error) {
+	if id == 0 {
+		return nil, errors.New("id is required")
 	}
-	if in.Port <= 0 || in.Port > 65535 {
-		return model.SocksOutbound{}, errors.New("invalid port")
+	if limit <= 0 || limit > 500 {
+		limit = 100
 	}
-	if username == "" || password == "" {
-		return model.SocksOutbound{}, errors.New("username and password are required")
+	rows := []model.SocksOutboundProbe{}
+	if err := s.db.Where("socks_outbound_id = ?", id).Order("created_at desc, id desc").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *ForwardOutboundService) PruneProbeHistory(before time.Time) error {
+	return s.db.Where("created_at < ?", before).Delete(&model.SocksOutboundProbe{}).Error
+}
+
+func truncateProbeError(msg string) string {
+	msg = strings.TrimSpace(msg)
+	if len(msg) > 255 {
+		return msg[:255]
+	}
+	return msg
+}
+
+func normalizeForwardOutboundInput(in ForwardOutboundInput) (model.SocksOutbound, error) {
+	outboundType, err := normalizeForwardOutboundType(in.Type)
+	if err != nil {
+		return model.SocksOutbound{}, err
 	}
 	enabled := true
 	if in.Enabled != nil {
 		enabled = *in.Enabled
 	}
-	return model.SocksOutbound{
-		Name:      name,
-		Address:   address,
+	row := model.SocksOutbound{
+		Name:      strings.TrimSpace(in.Name),
+		Type:      outboundType,
+		Address:   strings.TrimSpace(in.Address),
 		Port:      in.Port,
-		Username:  username,
-		Password:  password,
-		RouteUser: routeUser,
+		Username:  strings.TrimSpace(in.Username),
+		Password:  strings.TrimSpace(in.Password),
+		Method:    strings.ToLower(strings.TrimSpace(in.Method)),
+		UUID:      strings.ToLower(strings.TrimSpace(in.UUID)),
+		Security:  strings.TrimSpace(in.Security),
+		Network:   strings.ToLower(strings.TrimSpace(in.Network)),
+		Path:      strings.TrimSpace(in.Path),
+		Host:      strings.TrimSpace(in.Host),
+		TLS:       in.TLS,
+		SNI:       strings.TrimSpace(in.SNI),
+		RouteUser: strings.TrimSpace(in.RouteUser),
 		Enabled:   enabled,
-	}, nil
+
+		MaxItems:          in.MaxItems,
+		MaxCustomers:      in.MaxCustomers,
+		Supplier:          strings.TrimSpace(in.Supplier),
+		Cost:              in.Cost,
+		CostPeriodDays:    in.CostPeriodDays,
+		SupplierExpiresAt: in.SupplierExpiresAt,
+	}
+	if err := validateForwardOutbound(row); err != nil {
+		return model.SocksOutbound{}, err
+	}
+	if row.MaxItems < 0 || row.MaxCustomers < 0 {
+		return model.SocksOutbound{}, errors.New("capacity limits must be >= 0")
+	}
+	if row.Cost < 0 {
+		return model.SocksOutbound{}, errors.New("cost must be >= 0")
+	}
+	if row.CostPeriodDays < 0 {
+		return model.SocksOutbound{}, errors.New("cost_period_days must be >= 0")
+	}
+	if row.CostPeriodDays == 0 {
+		row.CostPeriodDays = 30
+	}
+	return row, nil
+}
+
+func forwardOutboundUpstreamUpdates(row model.SocksOutbound) map[string]interface{} {
+	return map[string]interface{}{
+		"type":     forwardOutboundTypeOf(row),
+		"address":  row.Address,
+		"port":     row.Port,
+		"username": row.Username,
+		"password": row.Password,
+		"method":   row.Method,
+		"uuid":     row.UUID,
+		"security": row.Security,
+		"network":  row.Network,
+		"path":     row.Path,
+		"host":     row.Host,
+		"tls":      row.TLS,
+		"sni":      row.SNI,
+	}
+}
+
+// ensureUpstreamEditable refuses connection changes to an upstream that live
+// order items still reference and reports whether the connection changes.
+// Items snapshot the address and credentials but render the typed fields from
+// the upstream, so a live edit would mix the two; such items have to be
+// re-homed first.
+func (s *ForwardOutboundService) ensureUpstreamEditable(base model.SocksOutbound, row model.SocksOutbound) (bool, error) {
+	current := forwardOutboundUpstreamUpdates(base)
+	changed := false
+	for key, value := range forwardOutboundUpstreamUpdates(row) {
+		if current[key] != value {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	count, err := s.referencingItemCount(base.ID)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, fmt.Errorf("outbound is used by %d live order items, re-home them before changing its connection", count)
+	}
+	return true, nil
+}
+
+// referencingItemCount counts the items on orders still being served or
+// suspended until their expiry, which come back on unsuspend. Items on lapsed
+// or disabled orders are re-snapshotted on edit and detached on delete.
+func (s *ForwardOutboundService) referencingItemCount(id uint) (int64, error) {
+	var count int64
+	err := s.db.Model(&model.OrderItem{}).Joins("join orders o on o.id = order_items.order_id").
+		Where("order_items.socks_outbound_id = ? and o.status in ? and (o.expires_at > ? or o.expiry_stage <> '')", id, []string{model.OrderStatusActive, model.OrderStatusSuspended}, time.Now()).
+		Count(&count).Error
+	return count, err
+}
+
+// resnapshotUpstreamItemsTx points the lapsed items of an edited upstream at
+// its new connection, so a later renewal renders it consistently.
+func resnapshotUpstreamItemsTx(tx *gorm.DB, id uint, row model.SocksOutbound) error {
+	return tx.Model(&model.OrderItem{}).Where("socks_outbound_id = ?", id).Updates(map[string]interface{}{
+		"outbound_type":    forwardOutboundTypeOf(row),
+		"forward_address":  row.Address,
+		"forward_port":     row.Port,
+		"forward_username": row.Username,
+		"forward_password": row.Password,
+		"updated_at":       time.Now(),
+	}).Error
+}
+
+func forwardOutboundIdentity(row model.SocksOutbound) string {
+	if forwardOutboundTypeOf(row) == model.OutboundTypeVmess {
+		return row.UUID
+	}
+	return row.Username
 }
 
 func (s *ForwardOutboundService) ensureRouteUserAvailable(routeUser string, excludeID uint) error {
@@ -412,11 +649,6 @@ func normalizeCountryPrefix(country string) string {
 	return "xx"
 }
 
-func probeSocksOutbound(address string, port int, username, password string) (string, string, error) {
-	exitIP, country, _, err := probeSocksOutboundGeo(address, port, username, password)
-	return exitIP, country, err
-}
-
 func probeSocksOutboundGeo(address string, port int, username, password string) (string, string, string, error) {
 	socksAddr := fmt.Sprintf("%s:%d", strings.TrimSpace(address), port)
 	dialer, err := proxy.SOCKS5("tcp", socksAddr, &proxy.Auth{User: strings.TrimSpace(username), Password: strings.TrimSpace(password)}, proxy.Direct)
@@ -433,9 +665,11 @@ func probeSocksOutboundGeo(address string, port int, username, password string)
 	if resp.StatusCode >= 300 {
 		return "", "", "", fmt.Errorf("ip probe status %d", resp.StatusCode)
 	}
-	body := make([]byte, 128)
-	n, _ := resp.Body.Read(body)
-	exitIP := strings.TrimSpace(string(body[:n]))
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 128))
+	if err != nil {
+		return "", "", "", err
+	}
+	exitIP := strings.TrimSpace(string(body))
 	if exitIP == "" {
 		return "", "", "", errors.New("empty exit ip")
 	}
@@ -453,6 +687,14 @@ func lookupCountryCode(ip string) (string, error) {
 }
 
 func lookupCountryRegion(ip string) (string, string, error) {
+	info, err := lookupIPGeo(ip)
+	if err != nil {
+		return "", "", err
+	}
+	return info.CountryCode, info.Region, nil
+}
+
+func lookupCountryRegionOnline(ip string) (string, string, error) {
 	ip = strings.TrimSpace(ip)
 	if ip == "" {
 		return "", "", errors.New("ip is empty")
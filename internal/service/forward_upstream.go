@@ -0,0 +1,463 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+)
+
+func normalizeForwardOutboundType(raw string) (string, error) {
+	v := strings.ToLower(strings.TrimSpace(raw))
+	switch v {
+	case "", "socks", model.OutboundTypeSocks5:
+		return model.OutboundTypeSocks5, nil
+	case model.OutboundTypeHTTP, "https":
+		return model.OutboundTypeHTTP, nil
+	case model.OutboundTypeShadowsocks, "ss":
+		return model.OutboundTypeShadowsocks, nil
+	case model.OutboundTypeVmess:
+		return model.OutboundTypeVmess, nil
+	default:
+		return "", fmt.Errorf("unsupported outbound type %s", raw)
+	}
+}
+
+func isForwardOutboundType(raw string) bool {
+	v := strings.ToLower(strings.TrimSpace(raw))
+	return v == model.OutboundTypeSocks5 || v == model.OutboundTypeHTTP || v == model.OutboundTypeShadowsocks || v == model.OutboundTypeVmess
+}
+
+func forwardOutboundTypeOf(row model.SocksOutbound) string {
+	v, err := normalizeForwardOutboundType(row.Type)
+	if err != nil {
+		return model.OutboundTypeSocks5
+	}
+	return v
+}
+
+func validateForwardOutbound(row model.SocksOutbound) error {
+	if strings.TrimSpace(row.Address) == "" {
+		return errors.New("address is required")
+	}
+	if row.Port <= 0 || row.Port > 65535 {
+		return errors.New("invalid port")
+	}
+	switch forwardOutboundTypeOf(row) {
+	case model.OutboundTypeSocks5:
+		if strings.TrimSpace(row.Username) == "" || strings.TrimSpace(row.Password) == "" {
+			return errors.New("username and password are required")
+		}
+	case model.OutboundTypeHTTP:
+		if (strings.TrimSpace(row.Username) == "") != (strings.TrimSpace(row.Password) == "") {
+			return errors.New("username and password must be set together")
+		}
+	case model.OutboundTypeShadowsocks:
+		if strings.TrimSpace(row.Method) == "" || strings.TrimSpace(row.Password) == "" {
+			return errors.New("method and password are required")
+		}
+	case model.OutboundTypeVmess:
+		if !uuidRegex.MatchString(strings.TrimSpace(row.UUID)) {
+			return errors.New("valid uuid is required")
+		}
+		switch strings.ToLower(strings.TrimSpace(row.Network)) {
+		case "", "tcp", "ws", "grpc", "httpupgrade":
+		default:
+			return fmt.Errorf("unsupported vmess network %s", row.Network)
+		}
+	}
+	return nil
+}
+
+func forwardUpstreamOutbound(tag string, row model.SocksOutbound) map[string]interface{} {
+	address := strings.TrimSpace(row.Address)
+	switch forwardOutboundTypeOf(row) {
+	case model.OutboundTypeHTTP:
+		server := map[string]interface{}{
+			"address": address,
+			"port":    row.Port,
+		}
+		if strings.TrimSpace(row.Username) != "" || strings.TrimSpace(row.Password) != "" {
+			server["users"] = []map[string]string{{
+				"user": row.Username,
+				"pass": row.Password,
+			}}
+		}
+		out := map[string]interface{}{
+			"tag":      tag,
+			"protocol": "http",
+			"settings": map[string]interface{}{"servers": []map[string]interface{}{server}},
+		}
+		if row.TLS {
+			out["streamSettings"] = forwardUpstreamTLSStream("tcp", row)
+		}
+		return out
+	case model.OutboundTypeShadowsocks:
+		return map[string]interface{}{
+			"tag":      tag,
+			"protocol": "shadowsocks",
+			"settings": map[string]interface{}{
+				"servers": []map[string]interface{}{{
+					"address":  address,
+					"port":     row.Port,
+					"method":   strings.TrimSpace(row.Method),
+					"password": row.Password,
+				}},
+			},
+		}
+	case model.OutboundTypeVmess:
+		security := strings.TrimSpace(row.Security)
+		if security == "" {
+			security = "auto"
+		}
+		network := strings.ToLower(strings.TrimSpace(row.Network))
+		if network == "" {
+			network = "tcp"
+		}
+		stream := map[string]interface{}{"network": network, "security": "none"}
+		if row.TLS {
+			stream = forwardUpstreamTLSStream(network, row)
+		}
+		switch network {
+		case "ws":
+			ws := map[string]interface{}{"path": defaultVlessPath(row.Path)}
+			if strings.TrimSpace(row.Host) != "" {
+				ws["headers"] = map[string]interface{}{"Host": strings.TrimSpace(row.Host)}
+			}
+			stream["wsSettings"] = ws
+		case "grpc":
+			grpc := map[string]interface{}{}
+			if strings.TrimSpace(row.Path) != "" {
+				grpc["serviceName"] = strings.TrimSpace(row.Path)
+			}
+			stream["grpcSettings"] = grpc
+		case "httpupgrade":
+			httpUpgrade := map[string]interface{}{"path": defaultVlessPath(row.Path)}
+			if strings.TrimSpace(row.Host) != "" {
+				httpUpgrade["host"] = strings.TrimSpace(row.Host)
+			}
+			stream["httpupgradeSettings"] = httpUpgrade
+		}
+		return map[string]interface{}{
+			"tag":      tag,
+			"protocol": "vmess",
+			"settings": map[string]interface{}{
+				"vnext": []map[string]interface{}{{
+					"address": address,
+					"port":    row.Port,
+					"users": []map[string]interface{}{{
+						"id":       strings.ToLower(strings.TrimSpace(row.UUID)),
+						"alterId":  0,
+						"security": security,
+					}},
+				}},
+			},
+			"streamSettings": stream,
+		}
+	default:
+		server := map[string]interface{}{
+			"address": address,
+			"port":    row.Port,
+		}
+		if strings.TrimSpace(row.Username) != "" || strings.TrimSpace(row.Password) != "" {
+			server["users"] = []map[string]string{{
+				"user": row.Username,
+				"pass": row.Password,
+			}}
+		}
+		return map[string]interface{}{
+			"tag":      tag,
+			"protocol": "socks",
+			"settings": map[string]interface{}{"servers": []map[string]interface{}{server}},
+		}
+	}
+}
+
+func forwardUpstreamTLSStream(network string, row model.SocksOutbound) map[string]interface{} {
+	tlsSettings := map[string]interface{}{}
+	serverName := strings.TrimSpace(row.SNI)
+	if serverName == "" {
+		serverName = strings.TrimSpace(row.Host)
+	}
+	if serverName != "" {
+		tlsSettings["serverName"] = serverName
+	}
+	return map[string]interface{}{
+		"network":     network,
+		"security":    "tls",
+		"tlsSettings": tlsSettings,
+	}
+}
+
+// forwardUpstreamForItem merges an item's connection snapshot with the typed
+// fields of its upstream. A failed upstream load is returned rather than
+// rendering a vmess or ss outbound without its uuid or method.
+func forwardUpstreamForItem(db *gorm.DB, item model.OrderItem) (model.SocksOutbound, bool, error) {
+	if !isForwardOutboundType(item.OutboundType) || strings.TrimSpace(item.ForwardAddress) == "" || item.ForwardPort <= 0 {
+		return model.SocksOutbound{}, false, nil
+	}
+	row := model.SocksOutbound{}
+	if item.SocksOutboundID != nil && *item.SocksOutboundID > 0 && db != nil {
+		if err := db.First(&row, *item.SocksOutboundID).Error; err != nil {
+			return model.SocksOutbound{}, false, fmt.Errorf("load upstream %d of item %d failed: %w", *item.SocksOutboundID, item.ID, err)
+		}
+	}
+	row.Type = strings.ToLower(strings.TrimSpace(item.OutboundType))
+	row.Address = item.ForwardAddress
+	row.Port = item.ForwardPort
+	row.Username = item.ForwardUsername
+	row.Password = item.ForwardPassword
+	return row, true, nil
+}
+
+func parseForwardOutboundURI(raw string) (model.SocksOutbound, error) {
+	raw = strings.TrimSpace(raw)
+	idx := strings.Index(raw, "://")
+	if idx <= 0 {
+		return model.SocksOutbound{}, errors.New("invalid uri")
+	}
+	scheme := strings.ToLower(raw[:idx])
+	switch scheme {
+	case "socks", "socks5", "http", "https":
+		return parseForwardAuthURI(scheme, raw)
+	case "ss":
+		return parseShadowsocksURI(raw)
+	case "vmess":
+		return parseVmessURI(raw)
+	default:
+		return model.SocksOutbound{}, fmt.Errorf("unsupported scheme %s", scheme)
+	}
+}
+
+func parseForwardAuthURI(scheme string, raw string) (model.SocksOutbound, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return model.SocksOutbound{}, err
+	}
+	port, err := parseURIPort(u)
+	if err != nil {
+		return model.SocksOutbound{}, err
+	}
+	row := model.SocksOutbound{
+		Name:    strings.TrimSpace(u.Fragment),
+		Type:    model.OutboundTypeSocks5,
+		Address: u.Hostname(),
+		Port:    port,
+	}
+	if scheme == "http" || scheme == "https" {
+		row.Type = model.OutboundTypeHTTP
+		row.TLS = scheme == "https"
+		row.SNI = strings.TrimSpace(u.Query().Get("sni"))
+	}
+	if u.User != nil {
+		row.Username = u.User.Username()
+		row.Password, _ = u.User.Password()
+	}
+	row.RouteUser = strings.TrimSpace(u.Query().Get("route_user"))
+	return row, nil
+}
+
+func parseShadowsocksURI(raw string) (model.SocksOutbound, error) {
+	body := strings.TrimSpace(raw[len("ss://"):])
+	name := ""
+	if i := strings.Index(body, "#"); i >= 0 {
+		name, _ = url.PathUnescape(body[i+1:])
+		body = body[:i]
+	}
+	if i := strings.Index(body, "?"); i >= 0 {
+		body = body[:i]
+	}
+	body = strings.TrimSuffix(body, "/")
+	if !strings.Contains(body, "@") {
+		decoded, err := decodeBase64Loose(body)
+		if err != nil {
+			return model.SocksOutbound{}, errors.New("invalid shadowsocks uri")
+		}
+		body = decoded
+	}
+	at := strings.LastIndex(body, "@")
+	if at <= 0 {
+		return model.SocksOutbound{}, errors.New("invalid shadowsocks uri")
+	}
+	userInfo := body[:at]
+	hostPort := body[at+1:]
+	if !strings.Contains(userInfo, ":") {
+		decoded, err := decodeBase64Loose(userInfo)
+		if err != nil {
+			return model.SocksOutbound{}, errors.New("invalid shadowsocks user info")
+		}
+		userInfo = decoded
+	} else if unescaped, err := url.PathUnescape(userInfo); err == nil {
+		userInfo = unescaped
+	}
+	method, password, ok := strings.Cut(userInfo, ":")
+	if !ok {
+		return model.SocksOutbound{}, errors.New("invalid shadowsocks user info")
+	}
+	host, portRaw, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return model.SocksOutbound{}, err
+	}
+	port, err := strconv.Atoi(portRaw)
+	if err != nil || port <= 0 || port > 65535 {
+		return model.SocksOutbound{}, errors.New("invalid port")
+	}
+	return model.SocksOutbound{
+		Name:     strings.TrimSpace(name),
+		Type:     model.OutboundTypeShadowsocks,
+		Address:  host,
+		Port:     port,
+		Method:   strings.ToLower(strings.TrimSpace(method)),
+		Password: password,
+	}, nil
+}
+
+func parseVmessURI(raw string) (model.SocksOutbound, error) {
+	decoded, err := decodeBase64Loose(strings.TrimSpace(raw[len("vmess://"):]))
+	if err != nil {
+		return model.SocksOutbound{}, errors.New("invalid vmess uri")
+	}
+	var payload struct {
+		PS   string          `json:"ps"`
+		Add  string          `json:"add"`
+		Port json.RawMessage `json:"port"`
+		ID   string          `json:"id"`
+		Scy  string          `json:"scy"`
+		Net  string          `json:"net"`
+		Host string          `json:"host"`
+		Path string          `json:"path"`
+		TLS  string          `json:"tls"`
+		SNI  string          `json:"sni"`
+	}
+	if err := json.Unmarshal([]byte(decoded), &payload); err != nil {
+		return model.SocksOutbound{}, fmt.Errorf("invalid vmess payload: %w", err)
+	}
+	port, err := strconv.Atoi(strings.Trim(strings.TrimSpace(string(payload.Port)), `"`))
+	if err != nil || port <= 0 || port > 65535 {
+		return model.SocksOutbound{}, errors.New("invalid port")
+	}
+	return model.SocksOutbound{
+		Name:     strings.TrimSpace(payload.PS),
+		Type:     model.OutboundTypeVmess,
+		Address:  strings.TrimSpace(payload.Add),
+		Port:     port,
+		UUID:     strings.ToLower(strings.TrimSpace(payload.ID)),
+		Security: strings.TrimSpace(payload.Scy),
+		Network:  strings.ToLower(strings.TrimSpace(payload.Net)),
+		Host:     strings.TrimSpace(payload.Host),
+		Path:     strings.TrimSpace(payload.Path),
+		TLS:      strings.EqualFold(strings.TrimSpace(payload.TLS), "tls"),
+		SNI:      strings.TrimSpace(payload.SNI),
+	}, nil
+}
+
+func parseURIPort(u *url.URL) (int, error) {
+	port, err := strconv.Atoi(u.Port())
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, errors.New("invalid port")
+	}
+	return port, nil
+}
+
+func decodeBase64Loose(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if unescaped, err := url.PathUnescape(raw); err == nil {
+		raw = unescaped
+	}
+	raw = strings.TrimRight(raw, "=")
+	for _, enc := range []*base64.Encoding{base64.RawStdEncoding, base64.RawURLEncoding} {
+		if out, err := enc.DecodeString(raw); err == nil {
+			return string(out), nil
+		}
+	}
+	return "", errors.New("invalid base64")
+}
+
+func probeForwardOutboundGeo(row model.SocksOutbound) (string, string, string, error) {
+	switch forwardOutboundTypeOf(row) {
+	case model.OutboundTypeHTTP:
+		return probeHTTPOutboundGeo(row)
+	case model.OutboundTypeShadowsocks, model.OutboundTypeVmess:
+		return probeOutboundViaXrayCore(row)
+	default:
+		return probeSocksOutboundGeo(row.Address, row.Port, row.Username, row.Password)
+	}
+}
+
+func forwardHTTPProxyURL(row model.SocksOutbound) *url.URL {
+	scheme := "http"
+	if row.TLS {
+		scheme = "https"
+	}
+	proxyURL := &url.URL{Scheme: scheme, Host: net.JoinHostPort(strings.TrimSpace(row.Address), strconv.Itoa(row.Port))}
+	if strings.TrimSpace(row.Username) != "" || strings.TrimSpace(row.Password) != "" {
+		proxyURL.User = url.UserPassword(strings.TrimSpace(row.Username), strings.TrimSpace(row.Password))
+	}
+	return proxyURL
+}
+
+func probeHTTPOutboundGeo(row model.SocksOutbound) (string, string, string, error) {
+	transport := &http.Transport{Proxy: http.ProxyURL(forwardHTTPProxyURL(row))}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Timeout: 8 * time.Second, Transport: transport}
+	resp, err := client.Get("https://api.ipify.org")
+	if err != nil {
+		return "", "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", "", "", fmt.Errorf("ip probe status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 128))
+	if err != nil {
+		return "", "", "", err
+	}
+	exitIP := strings.TrimSpace(string(body))
+	if exitIP == "" {
+		return "", "", "", errors.New("empty exit ip")
+	}
+	country, region, err := lookupCountryRegion(exitIP)
+	if err != nil {
+		country = "xx"
+		region = ""
+	}
+	return exitIP, country, region, nil
+}
+
+func probeOutboundViaXrayCore(row model.SocksOutbound) (string, string, string, error) {
+	if err := validateForwardOutbound(row); err != nil {
+		return "", "", "", err
+	}
+	localPort, err := reserveLocalTCPPort()
+	if err != nil {
+		return "", "", "", fmt.Errorf("reserve local probe port failed: %w", err)
+	}
+	res, err := runProbeCore(context.Background(), localPort, forwardUpstreamOutbound("probe-out", row))
+	if err != nil {
+		return "", "", "", fmt.Errorf("start probe runtime failed: %w", err)
+	}
+	if !res.ConnectivityOK || strings.TrimSpace(res.ExitIP) == "" {
+		msg := strings.TrimSpace(res.Message)
+		if msg == "" {
+			msg = "probe failed"
+		}
+		return "", "", "", errors.New(msg)
+	}
+	country := res.CountryCode
+	if country == "" {
+		country = "xx"
+	}
+	return res.ExitIP, country, res.Region, nil
+}
@@ -0,0 +1,355 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"xraytool/internal/store"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+const (
+	GeoIPKindCountry = "country"
+	GeoIPKindASN     = "asn"
+)
+
+// defaultGeoIP backs the package-level lookup helpers used by probes and
+// exports; without it every lookup goes straight to the online providers.
+var defaultGeoIP atomic.Pointer[GeoIPService]
+
+type IPGeoInfo struct {
+	IP          string `json:"ip"`
+	CountryCode string `json:"country_code"`
+	CountryName string `json:"country_name"`
+	Region      string `json:"region"`
+	ASN         uint   `json:"asn"`
+	ASOrg       string `json:"as_org"`
+	Source      string `json:"source"`
+}
+
+type GeoIPDatabaseStatus struct {
+	Kind         string     `json:"kind"`
+	Path         string     `json:"path"`
+	Loaded       bool       `json:"loaded"`
+	DatabaseType string     `json:"database_type,omitempty"`
+	BuildAt      *time.Time `json:"build_at,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+type GeoIPStatus struct {
+	OnlineFallback bool                  `json:"online_fallback"`
+	Databases      []GeoIPDatabaseStatus `json:"databases"`
+}
+
+type GeoIPService struct {
+	store *store.Store
+
+	mu             sync.RWMutex
+	country        *maxminddb.Reader
+	asn            *maxminddb.Reader
+	countryStatus  GeoIPDatabaseStatus
+	asnStatus      GeoIPDatabaseStatus
+	onlineFallback bool
+
+	namesMu sync.RWMutex
+	names   map[string]string
+}
+
+type mmdbNamedRecord struct {
+	ISOCode string            `maxminddb:"iso_code"`
+	Names   map[string]string `maxminddb:"names"`
+}
+
+type mmdbGeoRecord struct {
+	Country           mmdbNamedRecord   `maxminddb:"country"`
+	RegisteredCountry mmdbNamedRecord   `maxminddb:"registered_country"`
+	Subdivisions      []mmdbNamedRecord `maxminddb:"subdivisions"`
+	Traits            struct {
+		ASN   uint   `maxminddb:"autonomous_system_number"`
+		ASOrg string `maxminddb:"autonomous_system_organization"`
+	} `maxminddb:"traits"`
+}
+
+type mmdbASNRecord struct {
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+func NewGeoIPService(st *store.Store) *GeoIPService {
+	return &GeoIPService{store: st, names: map[string]string{}}
+}
+
+func SetDefaultGeoIP(s *GeoIPService) {
+	defaultGeoIP.Store(s)
+}
+
+func (s *GeoIPService) Reload() error {
+	values, err := s.store.GetSettings()
+	if err != nil {
+		return err
+	}
+	countryReader, countryStatus := openGeoIPDatabase(GeoIPKindCountry, values["geoip_db_path"])
+	asnReader, asnStatus := openGeoIPDatabase(GeoIPKindASN, values["geoip_asn_db_path"])
+
+	s.mu.Lock()
+	oldCountry, oldASN := s.country, s.asn
+	s.country, s.asn = countryReader, asnReader
+	s.countryStatus, s.asnStatus = countryStatus, asnStatus
+	s.onlineFallback = parseSettingBool(values["geoip_online_fallback"], false)
+	s.mu.Unlock()
+
+	if oldCountry != nil {
+		_ = oldCountry.Close()
+	}
+	if oldASN != nil {
+		_ = oldASN.Close()
+	}
+	if countryStatus.Error != "" {
+		return fmt.Errorf("load geoip database failed: %s", countryStatus.Error)
+	}
+	if asnStatus.Error != "" {
+		return fmt.Errorf("load geoip asn database failed: %s", asnStatus.Error)
+	}
+	return nil
+}
+
+func (s *GeoIPService) Status() GeoIPStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return GeoIPStatus{
+		OnlineFallback: s.onlineFallback,
+		Databases:      []GeoIPDatabaseStatus{s.countryStatus, s.asnStatus},
+	}
+}
+
+// Install validates an uploaded mmdb file and atomically replaces the
+// database configured for kind before reloading.
+func (s *GeoIPService) Install(kind string, r io.Reader) (GeoIPDatabaseStatus, error) {
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	key := ""
+	switch kind {
+	case "", GeoIPKindCountry, "city":
+		kind = GeoIPKindCountry
+		key = "geoip_db_path"
+	case GeoIPKindASN:
+		key = "geoip_asn_db_path"
+	default:
+		return GeoIPDatabaseStatus{}, fmt.Errorf("unsupported geoip database kind %s", kind)
+	}
+	target, err := s.store.GetSetting(key)
+	if err != nil {
+		return GeoIPDatabaseStatus{}, err
+	}
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return GeoIPDatabaseStatus{}, fmt.Errorf("%s is not configured", key)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return GeoIPDatabaseStatus{}, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".geoip-*.mmdb")
+	if err != nil {
+		return GeoIPDatabaseStatus{}, err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+	if _, err := io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		return GeoIPDatabaseStatus{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return GeoIPDatabaseStatus{}, err
+	}
+	reader, status := openGeoIPDatabase(kind, tmpPath)
+	if reader == nil {
+		if status.Error == "" {
+			status.Error = "empty database"
+		}
+		return GeoIPDatabaseStatus{}, fmt.Errorf("invalid mmdb file: %s", status.Error)
+	}
+	_ = reader.Close()
+	if err := os.Rename(tmpPath, target); err != nil {
+		return GeoIPDatabaseStatus{}, err
+	}
+	if err := s.Reload(); err != nil {
+		return GeoIPDatabaseStatus{}, err
+	}
+	current := s.Status()
+	if kind == GeoIPKindASN {
+		return current.Databases[1], nil
+	}
+	return current.Databases[0], nil
+}
+
+// Lookup resolves ip from the local databases and, when allowed, falls back
+// to the online providers for addresses the local data cannot place.
+func (s *GeoIPService) Lookup(ip string) (IPGeoInfo, error) {
+	info, ok, err := s.lookupLocal(ip)
+	if err != nil {
+		return IPGeoInfo{}, err
+	}
+	if ok && len(info.CountryCode) == 2 {
+		return info, nil
+	}
+	s.mu.RLock()
+	online := s.onlineFallback
+	loaded := s.country != nil
+	s.mu.RUnlock()
+	if !online {
+		if !loaded {
+			return IPGeoInfo{}, errors.New("geoip database is not loaded and online lookup is disabled")
+		}
+		return IPGeoInfo{}, errors.New("ip not found in geoip database")
+	}
+	country, region, err := lookupCountryRegionOnline(info.IP)
+	if err != nil {
+		return IPGeoInfo{}, err
+	}
+	info.CountryCode = country
+	info.Region = region
+	info.Source = "online"
+	return info, nil
+}
+
+func (s *GeoIPService) lookupLocal(ip string) (IPGeoInfo, bool, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return IPGeoInfo{}, false, fmt.Errorf("invalid ip %s", strings.TrimSpace(ip))
+	}
+	addr = addr.Unmap()
+	info := IPGeoInfo{IP: addr.String()}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	found := false
+	if s.country != nil {
+		record := mmdbGeoRecord{}
+		result := s.country.Lookup(addr)
+		if result.Found() {
+			if err := result.Decode(&record); err != nil {
+				return IPGeoInfo{}, false, err
+			}
+			named := record.Country
+			if strings.TrimSpace(named.ISOCode) == "" {
+				named = record.RegisteredCountry
+			}
+			info.CountryCode = strings.ToLower(strings.TrimSpace(named.ISOCode))
+			info.CountryName = strings.TrimSpace(named.Names["zh-CN"])
+			if len(record.Subdivisions) > 0 {
+				info.Region = strings.TrimSpace(record.Subdivisions[0].Names["en"])
+			}
+			info.ASN = record.Traits.ASN
+			info.ASOrg = strings.TrimSpace(record.Traits.ASOrg)
+			found = info.CountryCode != ""
+		}
+	}
+	if s.asn != nil {
+		record := mmdbASNRecord{}
+		result := s.asn.Lookup(addr)
+		if result.Found() {
+			if err := result.Decode(&record); err != nil {
+				return IPGeoInfo{}, false, err
+			}
+			info.ASN = record.ASN
+			info.ASOrg = strings.TrimSpace(record.ASOrg)
+			found = true
+		}
+	}
+	if !found {
+		return info, false, nil
+	}
+	info.Source = "local"
+	if info.CountryCode != "" && info.CountryName != "" {
+		s.rememberCountryName(info.CountryCode, info.CountryName)
+	}
+	return info, true, nil
+}
+
+func (s *GeoIPService) rememberCountryName(code, name string) {
+	s.namesMu.Lock()
+	s.names[code] = name
+	s.namesMu.Unlock()
+}
+
+func (s *GeoIPService) countryName(code string) string {
+	s.namesMu.RLock()
+	defer s.namesMu.RUnlock()
+	return s.names[code]
+}
+
+func openGeoIPDatabase(kind, path string) (*maxminddb.Reader, GeoIPDatabaseStatus) {
+	status := GeoIPDatabaseStatus{Kind: kind, Path: strings.TrimSpace(path)}
+	if status.Path == "" {
+		return nil, status
+	}
+	if _, err := os.Stat(status.Path); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			status.Error = err.Error()
+		}
+		return nil, status
+	}
+	reader, err := maxminddb.Open(status.Path)
+	if err != nil {
+		status.Error = err.Error()
+		return nil, status
+	}
+	dbType := strings.TrimSpace(reader.Metadata.DatabaseType)
+	isASN := strings.Contains(strings.ToUpper(dbType), "ASN")
+	if kind == GeoIPKindASN && !isASN {
+		_ = reader.Close()
+		status.Error = fmt.Sprintf("database type %s is not an ASN database", dbType)
+		return nil, status
+	}
+	if kind == GeoIPKindCountry && isASN {
+		_ = reader.Close()
+		status.Error = fmt.Sprintf("database type %s has no country data", dbType)
+		return nil, status
+	}
+	buildAt := reader.Metadata.BuildTime()
+	status.Loaded = true
+	status.DatabaseType = dbType
+	status.BuildAt = &buildAt
+	return reader, status
+}
+
+func lookupIPGeo(ip string) (IPGeoInfo, error) {
+	if resolver := defaultGeoIP.Load(); resolver != nil {
+		return resolver.Lookup(ip)
+	}
+	country, region, err := lookupCountryRegionOnline(ip)
+	if err != nil {
+		return IPGeoInfo{}, err
+	}
+	return IPGeoInfo{IP: strings.TrimSpace(ip), CountryCode: country, Region: region, Source: "online"}, nil
+}
+
+// lookupLocalIPGeo never leaves the host; exports use it to fill gaps
+// without leaking customer exit IPs.
+func lookupLocalIPGeo(ip string) (IPGeoInfo, bool) {
+	resolver := defaultGeoIP.Load()
+	if resolver == nil || strings.TrimSpace(ip) == "" {
+		return IPGeoInfo{}, false
+	}
+	info, ok, err := resolver.lookupLocal(ip)
+	if err != nil || !ok {
+		return IPGeoInfo{}, false
+	}
+	return info, true
+}
+
+func geoIPCountryName(code string) string {
+	resolver := defaultGeoIP.Load()
+	if resolver == nil {
+		return ""
+	}
+	return resolver.countryName(code)
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"xraytool/internal/store"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+func buildTestMMDB(t *testing.T, dbType string, cidr string, record mmdbtype.Map) []byte {
+	t.Helper()
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: dbType, RecordSize: 24, IncludeReservedNetworks: true})
+	if err != nil {
+		t.Fatalf("new mmdb tree failed: %v", err)
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("parse cidr failed: %v", err)
+	}
+	if err := tree.Insert(network, record); err != nil {
+		t.Fatalf("insert mmdb record failed: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := tree.WriteTo(buf); err != nil {
+		t.Fatalf("write mmdb failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestGeoIPServiceResolvesLocallyWithoutOnlineFallback(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	st := store.New(db)
+	unset := NewGeoIPService(st)
+	if err := unset.Reload(); err != nil {
+		t.Fatalf("reload with default settings failed: %v", err)
+	}
+	if unset.Status().OnlineFallback {
+		t.Fatalf("expected online fallback to be off by default")
+	}
+	dir := t.TempDir()
+	if err := st.SetSettings(map[string]string{
+		"geoip_db_path":         filepath.Join(dir, "country.mmdb"),
+		"geoip_asn_db_path":     filepath.Join(dir, "asn.mmdb"),
+		"geoip_online_fallback": "false",
+	}); err != nil {
+		t.Fatalf("save settings failed: %v", err)
+	}
+	geo := NewGeoIPService(st)
+	if err := geo.Reload(); err != nil {
+		t.Fatalf("reload without databases failed: %v", err)
+	}
+	SetDefaultGeoIP(geo)
+	t.Cleanup(func() { SetDefaultGeoIP(nil) })
+
+	if _, err := lookupIPGeo("203.0.113.9"); err == nil {
+		t.Fatalf("expected lookup to fail without database and online fallback")
+	}
+
+	countryDB := buildTestMMDB(t, "GeoLite2-City", "203.0.113.0/24", mmdbtype.Map{
+		"country": mmdbtype.Map{
+			"iso_code": mmdbtype.String("ID"),
+			"names":    mmdbtype.Map{"en": mmdbtype.String("Indonesia"), "zh-CN": mmdbtype.String("印度尼西亚")},
+		},
+		"subdivisions": mmdbtype.Slice{mmdbtype.Map{
+			"iso_code": mmdbtype.String("JK"),
+			"names":    mmdbtype.Map{"en": mmdbtype.String("Jakarta")},
+		}},
+	})
+	asnDB := buildTestMMDB(t, "GeoLite2-ASN", "203.0.113.0/24", mmdbtype.Map{
+		"autonomous_system_number":       mmdbtype.Uint32(64500),
+		"autonomous_system_organization": mmdbtype.String("Example Transit"),
+	})
+
+	if _, err := geo.Install(GeoIPKindCountry, bytes.NewReader(asnDB)); err == nil {
+		t.Fatalf("expected asn database to be rejected as country database")
+	}
+	if _, err := geo.Install(GeoIPKindCountry, bytes.NewReader([]byte("not an mmdb"))); err == nil {
+		t.Fatalf("expected garbage upload to be rejected")
+	}
+	status, err := geo.Install("city", bytes.NewReader(countryDB))
+	if err != nil {
+		t.Fatalf("install country database failed: %v", err)
+	}
+	if !status.Loaded || status.DatabaseType != "GeoLite2-City" {
+		t.Fatalf("unexpected country database status: %#v", status)
+	}
+	if _, err := geo.Install(GeoIPKindASN, bytes.NewReader(asnDB)); err != nil {
+		t.Fatalf("install asn database failed: %v", err)
+	}
+
+	info, err := lookupIPGeo("203.0.113.9")
+	if err != nil {
+		t.Fatalf("local lookup failed: %v", err)
+	}
+	if info.CountryCode != "id" || info.Region != "Jakarta" || info.ASN != 64500 || info.ASOrg != "Example Transit" || info.Source != "local" {
+		t.Fatalf("unexpected geo info: %#v", info)
+	}
+	country, region, err := lookupCountryRegion("::ffff:203.0.113.10")
+	if err != nil || country != "id" || region != "Jakarta" {
+		t.Fatalf("unexpected country/region: %s %s %v", country, region, err)
+	}
+	if _, err := lookupIPGeo("198.51.100.1"); err == nil {
+		t.Fatalf("expected miss to fail when online fallback is disabled")
+	}
+
+	if got := countryNameCN("id"); got != "印度尼西亚" {
+		t.Fatalf("expected localized country name from geoip database, got %s", got)
+	}
+	if got := exportCountryCode("", "203.0.113.11"); got != "id" {
+		t.Fatalf("expected export to fill country from local database, got %s", got)
+	}
+	if got := exportCountryCode("jp", "203.0.113.11"); got != "jp" {
+		t.Fatalf("probed country should win over local database, got %s", got)
+	}
+	if got := dedicatedLinkTag("", "203.0.113.12"); got != "印度尼西亚-203.0.113.12" {
+		t.Fatalf("unexpected link tag: %s", got)
+	}
+}
+
+func TestGeoIPServiceASNOnlyDatabase(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	st := store.New(db)
+	asnPath := filepath.Join(t.TempDir(), "asn.mmdb")
+	if err := st.SetSettings(map[string]string{"geoip_asn_db_path": asnPath}); err != nil {
+		t.Fatalf("save settings failed: %v", err)
+	}
+	geo := NewGeoIPService(st)
+	asnDB := buildTestMMDB(t, "GeoLite2-ASN", "198.51.100.0/24", mmdbtype.Map{
+		"autonomous_system_number":       mmdbtype.Uint32(64501),
+		"autonomous_system_organization": mmdbtype.String("Example Residential"),
+	})
+	if _, err := geo.Install(GeoIPKindASN, bytes.NewReader(asnDB)); err != nil {
+		t.Fatalf("install asn database failed: %v", err)
+	}
+	SetDefaultGeoIP(geo)
+	t.Cleanup(func() { SetDefaultGeoIP(nil) })
+
+	info, ok := lookupLocalIPGeo("198.51.100.7")
+	if !ok || info.ASN != 64501 || info.CountryCode != "" {
+		t.Fatalf("unexpected asn-only lookup: %#v %v", info, ok)
+	}
+	status := geo.Status()
+	if len(status.Databases) != 2 || status.Databases[0].Loaded || !status.Databases[1].Loaded {
+		t.Fatalf("unexpected geoip status: %#v", status)
+	}
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"errors"
 	"net"
 	"sort"
 	"strconv"
@@ -152,3 +153,32 @@ func isPublicIPv4(ip net.IP) bool {
 func intToString(v int) string {
 	return strconv.Itoa(v)
 }
+
+func (s *HostIPService) UpdatePolicy(id uint, tier string, maxCustomers int, maxItems int) (*model.HostIP, error) {
+	normalized, err := normalizeHostIPTier(tier)
+	if err != nil {
+		return nil, err
+	}
+	if maxCustomers < 0 || maxItems < 0 {
+		return nil, errors.New("max_customers and max_items must be >= 0")
+	}
+	row := model.HostIP{}
+	if err := s.db.First(&row, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("host ip not found")
+		}
+		return nil, err
+	}
+	if err := s.db.Model(&model.HostIP{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"tier":          normalized,
+		"max_customers": maxCustomers,
+		"max_items":     maxItems,
+		"updated_at":    time.Now(),
+	}).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.First(&row, id).Error; err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
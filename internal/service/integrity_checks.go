@@ -0,0 +1,514 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+)
+
+const (
+	IntegrityCheckOrphanXrayResources     = "orphan_xray_resources"
+	IntegrityCheckItemHostIP              = "item_host_ip"
+	IntegrityCheckDedicatedBindings       = "dedicated_bindings"
+	IntegrityCheckEmptyGroupHeads         = "empty_group_heads"
+	IntegrityCheckDedicatedMixedDuplicate = "dedicated_mixed_duplicates"
+	IntegrityCheckResidentialUsernames    = "residential_username_conflicts"
+)
+
+func (s *IntegrityService) registerDefaultChecks() {
+	s.Register(IntegrityCheck{
+		Name:        IntegrityCheckOrphanXrayResources,
+		Severity:    IntegritySeverityWarning,
+		Description: "xray resource rows whose order item is gone; repair deletes them",
+		Scan:        s.scanOrphanXrayResources,
+		Repair:      s.repairOrphanXrayResources,
+	})
+	s.Register(IntegrityCheck{
+		Name:        IntegrityCheckItemHostIP,
+		Severity:    IntegritySeverityError,
+		Description: "live items whose host ip is missing or disabled; repair relinks to an enabled host ip with the same address",
+		Rebuild:     true,
+		Scan:        s.scanItemHostIPs,
+		Repair:      s.repairItemHostIPs,
+	})
+	s.Register(IntegrityCheck{
+		Name:        IntegrityCheckDedicatedBindings,
+		Severity:    IntegritySeverityError,
+		Description: "dedicated orders pointing at a missing entry, inbound or ingress; repair rebinds when the port stays the same",
+		Rebuild:     true,
+		Scan:        s.scanDedicatedBindings,
+		Repair:      s.repairDedicatedBindings,
+	})
+	s.Register(IntegrityCheck{
+		Name:        IntegrityCheckEmptyGroupHeads,
+		Severity:    IntegritySeverityWarning,
+		Description: "group heads with no children; repair moves them to the recycle bin",
+		Scan:        s.scanEmptyGroupHeads,
+		Repair:      s.repairEmptyGroupHeads,
+	})
+	s.Register(IntegrityCheck{
+		Name:        IntegrityCheckDedicatedMixedDuplicate,
+		Severity:    IntegritySeverityError,
+		Description: "live dedicated mixed items sharing a username on one port; repair regenerates credentials for all but the oldest",
+		Rebuild:     true,
+		Scan:        s.scanDedicatedMixedDuplicates,
+		Repair:      s.repairDedicatedMixedDuplicates,
+	})
+	s.Register(IntegrityCheck{
+		Name:        IntegrityCheckResidentialUsernames,
+		Severity:    IntegritySeverityError,
+		Description: "live residential orders sharing a username; repair refreshes credentials for all but the oldest order",
+		Scan:        s.scanResidentialUsernameConflicts,
+		Repair:      s.repairResidentialUsernameConflicts,
+	})
+}
+
+// repairOrder applies one repair to an order like any other edit: baseline
+// history first, bump the group version with the change and record the
+// result.
+func (s *IntegrityService) repairOrder(orderID uint, fn func(tx *gorm.DB) error) error {
+	order := model.Order{}
+	if err := s.db.Select("id", "parent_order_id").First(&order, orderID).Error; err != nil {
+		return err
+	}
+	rootID := orderHistoryRoot(order)
+	if err := s.orders.ensureOrderBaseline(rootID); err != nil {
+		return err
+	}
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return bumpOrderVersionTx(tx, orderID)
+	}); err != nil {
+		return err
+	}
+	s.orders.recordOrderVersion(rootID, OrderVersionSourceIntegrity)
+	return nil
+}
+
+func repairEach(findings []IntegrityFinding, fn func(finding IntegrityFinding) error) []BatchActionResult {
+	results := make([]BatchActionResult, 0, len(findings))
+	for _, finding := range findings {
+		result := BatchActionResult{ID: finding.EntityID}
+		if err := fn(finding); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Success = true
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (s *IntegrityService) scanOrphanXrayResources(now time.Time) ([]IntegrityFinding, error) {
+	type row struct {
+		ID          uint
+		OrderItemID uint
+	}
+	rows := []row{}
+	if err := s.db.Table("xray_resources xr").
+		Select("xr.id as id, xr.order_item_id as order_item_id").
+		Joins("left join order_items oi on oi.id = xr.order_item_id").
+		Where("oi.id is null").
+		Order("xr.id asc").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	findings := make([]IntegrityFinding, 0, len(rows))
+	for _, r := range rows {
+		findings = append(findings, IntegrityFinding{
+			Entity:     "xray_resource",
+			EntityID:   r.ID,
+			Message:    fmt.Sprintf("xray resource %d points to missing order item %d", r.ID, r.OrderItemID),
+			Repairable: true,
+		})
+	}
+	return findings, nil
+}
+
+func (s *IntegrityService) repairOrphanXrayResources(ctx context.Context, findings []IntegrityFinding) []BatchActionResult {
+	return repairEach(findings, func(finding IntegrityFinding) error {
+		res := s.db.Where("id = ? and not exists (select 1 from order_items oi where oi.id = xray_resources.order_item_id)", finding.EntityID).Delete(&model.XrayResource{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errors.New("no longer orphaned")
+		}
+		return nil
+	})
+}
+
+func (s *IntegrityService) scanItemHostIPs(now time.Time) ([]IntegrityFinding, error) {
+	type row struct {
+		ItemID   uint
+		OrderID  uint
+		HostIPID uint
+		IP       string
+		FoundID  *uint
+	}
+	rows := []row{}
+	if err := s.db.Table("order_items oi").
+		Select("oi.id as item_id, oi.order_id as order_id, oi.host_ip_id as host_ip_id, oi.ip as ip, h.id as found_id").
+		Joins("join orders o on o.id = oi.order_id").
+		Joins("left join host_ips h on h.id = oi.host_ip_id").
+		Where("oi.host_ip_id is not null and oi.status = ?", model.OrderItemStatusActive).
+		Where("o.status = ? and (o.expires_at > ? or o.expiry_stage <> '')", model.OrderStatusActive, now).
+		Where("h.id is null or h.enabled = ?", false).
+		Order("oi.id asc").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return []IntegrityFinding{}, nil
+	}
+	ips := make([]string, 0, len(rows))
+	for _, r := range rows {
+		ips = append(ips, strings.TrimSpace(r.IP))
+	}
+	enabled := []model.HostIP{}
+	if err := s.db.Where("enabled = ? and ip in ?", true, ips).Find(&enabled).Error; err != nil {
+		return nil, err
+	}
+	byIP := make(map[string]uint, len(enabled))
+	for _, host := range enabled {
+		byIP[host.IP] = host.ID
+	}
+
+	findings := make([]IntegrityFinding, 0, len(rows))
+	for _, r := range rows {
+		finding := IntegrityFinding{Entity: "order_item", EntityID: r.ItemID, OrderID: r.OrderID}
+		if r.FoundID == nil {
+			finding.Message = fmt.Sprintf("item %d points to missing host ip %d (%s)", r.ItemID, r.HostIPID, r.IP)
+		} else {
+			finding.Severity = IntegritySeverityWarning
+			finding.Message = fmt.Sprintf("item %d uses disabled host ip %s", r.ItemID, r.IP)
+		}
+		if _, ok := byIP[strings.TrimSpace(r.IP)]; ok {
+			finding.Repairable = true
+		} else {
+			finding.Message += "; re-enable the host ip or rotate the item"
+		}
+		findings = append(findings, finding)
+	}
+	return findings, nil
+}
+
+func (s *IntegrityService) repairItemHostIPs(ctx context.Context, findings []IntegrityFinding) []BatchActionResult {
+	return repairEach(findings, func(finding IntegrityFinding) error {
+		item := model.OrderItem{}
+		if err := s.db.First(&item, finding.EntityID).Error; err != nil {
+			return err
+		}
+		host := model.HostIP{}
+		if err := s.db.Where("ip = ? and enabled = ?", strings.TrimSpace(item.IP), true).First(&host).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("no enabled host ip for %s", item.IP)
+			}
+			return err
+		}
+		return s.repairOrder(item.OrderID, func(tx *gorm.DB) error {
+			return tx.Model(&model.OrderItem{}).Where("id = ?", item.ID).Updates(map[string]interface{}{
+				"host_ip_id": host.ID,
+				"updated_at": time.Now(),
+			}).Error
+		})
+	})
+}
+
+func (s *IntegrityService) scanDedicatedBindings(now time.Time) ([]IntegrityFinding, error) {
+	orders := []model.Order{}
+	if err := s.db.Select("id", "port", "dedicated_entry_id", "dedicated_inbound_id", "dedicated_ingress_id", "dedicated_protocol").
+		Where("mode = ? and (dedicated_entry_id is not null or dedicated_inbound_id is not null or dedicated_ingress_id is not null)", model.OrderModeDedicated).
+		Order("id asc").
+		Find(&orders).Error; err != nil {
+		return nil, err
+	}
+	findings := make([]IntegrityFinding, 0)
+	for _, order := range orders {
+		problems, err := dedicatedBindingProblems(s.db, order)
+		if err != nil {
+			return nil, err
+		}
+		if len(problems) == 0 {
+			continue
+		}
+		finding := IntegrityFinding{
+			Entity:   "order",
+			EntityID: order.ID,
+			OrderID:  order.ID,
+			Message:  fmt.Sprintf("order %d: %s", order.ID, strings.Join(problems, "; ")),
+		}
+		if _, _, _, err := s.planDedicatedBinding(s.db, order); err != nil {
+			finding.Message += "; " + err.Error()
+		} else {
+			finding.Repairable = true
+		}
+		findings = append(findings, finding)
+	}
+	return findings, nil
+}
+
+func dedicatedBindingProblems(tx *gorm.DB, order model.Order) ([]string, error) {
+	problems := make([]string, 0)
+	if order.DedicatedEntryID != nil {
+		var count int64
+		if err := tx.Model(&model.DedicatedEntry{}).Where("id = ?", *order.DedicatedEntryID).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			problems = append(problems, fmt.Sprintf("dedicated entry %d missing", *order.DedicatedEntryID))
+		}
+	}
+	inboundFound := false
+	if order.DedicatedInboundID != nil {
+		var count int64
+		if err := tx.Model(&model.DedicatedInbound{}).Where("id = ?", *order.DedicatedInboundID).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		inboundFound = count > 0
+		if !inboundFound {
+			problems = append(problems, fmt.Sprintf("dedicated inbound %d missing", *order.DedicatedInboundID))
+		}
+	}
+	if order.DedicatedIngressID != nil {
+		ingress := model.DedicatedIngress{}
+		err := tx.Where("id = ?", *order.DedicatedIngressID).First(&ingress).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			problems = append(problems, fmt.Sprintf("dedicated ingress %d missing", *order.DedicatedIngressID))
+		case err != nil:
+			return nil, err
+		case inboundFound && ingress.DedicatedInboundID != *order.DedicatedInboundID:
+			problems = append(problems, fmt.Sprintf("dedicated ingress %d belongs to inbound %d, not %d", ingress.ID, ingress.DedicatedInboundID, *order.DedicatedInboundID))
+		}
+	}
+	return problems, nil
+}
+
+// planDedicatedBinding works out a binding for an order with dangling ids.
+// The ingress is trusted over the inbound, a lone enabled ingress fills a
+// missing one and a surviving legacy entry is resolved as on update. A plan
+// that would move the order to another port is not safe to apply.
+func (s *IntegrityService) planDedicatedBinding(tx *gorm.DB, order model.Order) (*uint, *uint, *uint, error) {
+	entryID := order.DedicatedEntryID
+	if entryID != nil {
+		var count int64
+		if err := tx.Model(&model.DedicatedEntry{}).Where("id = ?", *entryID).Count(&count).Error; err != nil {
+			return nil, nil, nil, err
+		}
+		if count == 0 {
+			entryID = nil
+		}
+	}
+	var inboundID, ingressID *uint
+	if order.DedicatedIngressID != nil {
+		ingress := model.DedicatedIngress{}
+		if err := tx.Where("id = ?", *order.DedicatedIngressID).First(&ingress).Error; err == nil {
+			ingressID = uintPtrOrNil(ingress.ID)
+			inboundID = uintPtrOrNil(ingress.DedicatedInboundID)
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, nil, err
+		}
+	}
+	if ingressID == nil && order.DedicatedInboundID != nil {
+		ingresses := []model.DedicatedIngress{}
+		if err := tx.Where("dedicated_inbound_id = ? and enabled = ?", *order.DedicatedInboundID, true).Limit(2).Find(&ingresses).Error; err != nil {
+			return nil, nil, nil, err
+		}
+		if len(ingresses) == 1 {
+			inboundID = order.DedicatedInboundID
+			ingressID = uintPtrOrNil(ingresses[0].ID)
+		}
+	}
+	if ingressID == nil && entryID == nil {
+		return nil, nil, nil, errors.New("no safe binding found, rebind the order manually")
+	}
+	resolvedEntryID, resolvedInboundID, resolvedIngressID, port, err := s.orders.resolveDedicatedBindingForUpdateTx(tx, order.DedicatedProtocol, entryID, inboundID, ingressID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if port != order.Port {
+		return nil, nil, nil, fmt.Errorf("rebinding would move the order from port %d to %d", order.Port, port)
+	}
+	return resolvedEntryID, resolvedInboundID, resolvedIngressID, nil
+}
+
+func (s *IntegrityService) repairDedicatedBindings(ctx context.Context, findings []IntegrityFinding) []BatchActionResult {
+	return repairEach(findings, func(finding IntegrityFinding) error {
+		order := model.Order{}
+		if err := s.db.First(&order, finding.EntityID).Error; err != nil {
+			return err
+		}
+		problems, err := dedicatedBindingProblems(s.db, order)
+		if err != nil {
+			return err
+		}
+		if len(problems) == 0 {
+			return errors.New("binding no longer dangling")
+		}
+		entryID, inboundID, ingressID, err := s.planDedicatedBinding(s.db, order)
+		if err != nil {
+			return err
+		}
+		return s.repairOrder(order.ID, func(tx *gorm.DB) error {
+			return tx.Model(&model.Order{}).Where("id = ?", order.ID).Updates(map[string]interface{}{
+				"dedicated_entry_id":   entryID,
+				"dedicated_inbound_id": inboundID,
+				"dedicated_ingress_id": ingressID,
+				"updated_at":           time.Now(),
+			}).Error
+		})
+	})
+}
+
+func (s *IntegrityService) scanEmptyGroupHeads(now time.Time) ([]IntegrityFinding, error) {
+	heads := []model.Order{}
+	if err := s.db.Select("id", "name").
+		Where("is_group_head = ?", true).
+		Where("not exists (select 1 from orders c where c.parent_order_id = orders.id)").
+		Where("not exists (select 1 from order_items oi where oi.order_id = orders.id)").
+		Order("id asc").
+		Find(&heads).Error; err != nil {
+		return nil, err
+	}
+	findings := make([]IntegrityFinding, 0, len(heads))
+	for _, head := range heads {
+		findings = append(findings, IntegrityFinding{
+			Entity:     "order",
+			EntityID:   head.ID,
+			OrderID:    head.ID,
+			Message:    fmt.Sprintf("group head %d (%s) has no children", head.ID, head.Name),
+			Repairable: true,
+		})
+	}
+	return findings, nil
+}
+
+func (s *IntegrityService) repairEmptyGroupHeads(ctx context.Context, findings []IntegrityFinding) []BatchActionResult {
+	return repairEach(findings, func(finding IntegrityFinding) error {
+		var children int64
+		if err := s.db.Model(&model.Order{}).Where("parent_order_id = ?", finding.EntityID).Count(&children).Error; err != nil {
+			return err
+		}
+		if children > 0 {
+			return errors.New("group head has children again")
+		}
+		return s.orders.DeleteOrder(ctx, finding.EntityID)
+	})
+}
+
+func (s *IntegrityService) scanDedicatedMixedDuplicates(now time.Time) ([]IntegrityFinding, error) {
+	type row struct {
+		ItemID   uint
+		OrderID  uint
+		Port     int
+		Username string
+	}
+	rows := []row{}
+	if err := s.db.Table("order_items oi").
+		Select("oi.id as item_id, oi.order_id as order_id, oi.port as port, oi.username as username").
+		Joins("join orders o on o.id = oi.order_id").
+		Where("o.mode = ? and o.dedicated_protocol = ? and oi.status = ? and oi.username <> ''", model.OrderModeDedicated, model.DedicatedFeatureMixed, model.OrderItemStatusActive).
+		Where("o.status = ? and (o.expires_at > ? or o.expiry_stage <> '')", model.OrderStatusActive, now).
+		Order("oi.port asc, oi.username asc, oi.id asc").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	findings := make([]IntegrityFinding, 0)
+	firstByKey := map[string]uint{}
+	for _, r := range rows {
+		key := fmt.Sprintf("%d|%s", r.Port, strings.TrimSpace(r.Username))
+		first, ok := firstByKey[key]
+		if !ok {
+			firstByKey[key] = r.ItemID
+			continue
+		}
+		findings = append(findings, IntegrityFinding{
+			Entity:     "order_item",
+			EntityID:   r.ItemID,
+			OrderID:    r.OrderID,
+			Message:    fmt.Sprintf("item %d reuses mixed username %s of item %d on shared port %d", r.ItemID, r.Username, first, r.Port),
+			Repairable: true,
+		})
+	}
+	return findings, nil
+}
+
+func (s *IntegrityService) repairDedicatedMixedDuplicates(ctx context.Context, findings []IntegrityFinding) []BatchActionResult {
+	return repairEach(findings, func(finding IntegrityFinding) error {
+		item := model.OrderItem{}
+		if err := s.db.First(&item, finding.EntityID).Error; err != nil {
+			return err
+		}
+		var others int64
+		if err := s.db.Table("order_items oi").
+			Joins("join orders o on o.id = oi.order_id").
+			Where("o.mode = ? and o.dedicated_protocol = ? and oi.status = ? and oi.port = ? and oi.username = ? and oi.id <> ?", model.OrderModeDedicated, model.DedicatedFeatureMixed, model.OrderItemStatusActive, item.Port, item.Username, item.ID).
+			Where("o.status = ? and (o.expires_at > ? or o.expiry_stage <> '')", model.OrderStatusActive, time.Now()).
+			Count(&others).Error; err != nil {
+			return err
+		}
+		if others == 0 {
+			return errors.New("username no longer duplicated")
+		}
+		user, pass, uuid := generateDedicatedCredentialsByProtocol(model.DedicatedFeatureMixed)
+		row := DedicatedCredentialLine{Username: user, Password: pass, UUID: uuid}
+		return s.repairOrder(item.OrderID, func(tx *gorm.DB) error {
+			owner := model.Order{Items: []model.OrderItem{item}}
+			if err := s.orders.ensureDedicatedMixedUsernamesAvailableTx(tx, item.Port, []model.Order{owner}, []DedicatedCredentialLine{row}); err != nil {
+				return err
+			}
+			return tx.Model(&model.OrderItem{}).Where("id = ?", item.ID).Updates(map[string]interface{}{
+				"username":   row.Username,
+				"password":   row.Password,
+				"vmess_uuid": row.UUID,
+				"updated_at": time.Now(),
+			}).Error
+		})
+	})
+}
+
+func (s *IntegrityService) scanResidentialUsernameConflicts(now time.Time) ([]IntegrityFinding, error) {
+	conflicts, err := s.orders.ListResidentialUsernameConflicts()
+	if err != nil {
+		return nil, err
+	}
+	findings := make([]IntegrityFinding, 0)
+	seen := map[uint]struct{}{}
+	for _, conflict := range conflicts {
+		if len(conflict.AffectedOrderIDs) < 2 {
+			continue
+		}
+		keep := conflict.AffectedOrderIDs[0]
+		for _, orderID := range conflict.AffectedOrderIDs[1:] {
+			if _, ok := seen[orderID]; ok {
+				continue
+			}
+			seen[orderID] = struct{}{}
+			findings = append(findings, IntegrityFinding{
+				Entity:     "order",
+				EntityID:   orderID,
+				OrderID:    orderID,
+				Message:    fmt.Sprintf("order %d shares residential username %s with order %d", orderID, conflict.Username, keep),
+				Repairable: true,
+			})
+		}
+	}
+	return findings, nil
+}
+
+func (s *IntegrityService) repairResidentialUsernameConflicts(ctx context.Context, findings []IntegrityFinding) []BatchActionResult {
+	ids := make([]uint, 0, len(findings))
+	for _, finding := range findings {
+		ids = append(ids, finding.EntityID)
+	}
+	return s.orders.RepairResidentialUsernameConflicts(ctx, ids)
+}
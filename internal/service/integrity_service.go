@@ -0,0 +1,362 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	IntegritySeverityInfo    = "info"
+	IntegritySeverityWarning = "warning"
+	IntegritySeverityError   = "error"
+
+	IntegrityTriggerManual    = "manual"
+	IntegrityTriggerScheduled = "scheduled"
+)
+
+// IntegrityCheck is one pluggable consistency rule. Scan only reads; Repair
+// gets the repairable findings of the same run and reports one result per
+// finding, keyed by EntityID. Rebuild asks for one runtime rebuild after a
+// run in which the repair changed anything.
+type IntegrityCheck struct {
+	Name        string
+	Severity    string
+	Description string
+	Rebuild     bool
+	Scan        func(now time.Time) ([]IntegrityFinding, error)
+	Repair      func(ctx context.Context, findings []IntegrityFinding) []BatchActionResult
+}
+
+type IntegrityCheckInfo struct {
+	Name        string `json:"name"`
+	Severity    string `json:"severity"`
+	Description string `json:"description"`
+	Repairable  bool   `json:"repairable"`
+}
+
+type IntegrityFinding struct {
+	Check      string `json:"check"`
+	Severity   string `json:"severity"`
+	Entity     string `json:"entity"`
+	EntityID   uint   `json:"entity_id"`
+	OrderID    uint   `json:"order_id,omitempty"`
+	Message    string `json:"message"`
+	Repairable bool   `json:"repairable"`
+}
+
+type IntegrityCheckReport struct {
+	Name     string              `json:"name"`
+	Severity string              `json:"severity"`
+	Findings []IntegrityFinding  `json:"findings"`
+	Repairs  []BatchActionResult `json:"repairs,omitempty"`
+	Error    string              `json:"error,omitempty"`
+}
+
+type IntegrityReport struct {
+	RunID     uint                   `json:"run_id"`
+	Trigger   string                 `json:"trigger"`
+	Repair    bool                   `json:"repair"`
+	StartedAt time.Time              `json:"started_at"`
+	Errors    int                    `json:"errors"`
+	Warnings  int                    `json:"warnings"`
+	Infos     int                    `json:"infos"`
+	Repaired  int                    `json:"repaired"`
+	Checks    []IntegrityCheckReport `json:"checks"`
+}
+
+type IntegrityRunInput struct {
+	Checks  []string
+	Repair  bool
+	Trigger string
+}
+
+type IntegrityService struct {
+	db     *gorm.DB
+	store  *store.Store
+	orders *OrderService
+	bark   *BarkService
+	logger *zap.Logger
+	checks []IntegrityCheck
+
+	// runMu keeps a manual run and a scheduled one from repairing the same
+	// rows at once.
+	runMu         sync.Mutex
+	running       atomic.Bool
+	mu            sync.Mutex
+	lastAttemptAt time.Time
+}
+
+type integritySettings struct {
+	Enabled     bool
+	Interval    time.Duration
+	AutoRepair  bool
+	HistoryDays int
+}
+
+func NewIntegrityService(db *gorm.DB, st *store.Store, orders *OrderService, bark *BarkService, logger *zap.Logger) *IntegrityService {
+	s := &IntegrityService{db: db, store: st, orders: orders, bark: bark, logger: logger}
+	s.registerDefaultChecks()
+	return s
+}
+
+// Register adds a check, replacing any registered under the same name.
+func (s *IntegrityService) Register(check IntegrityCheck) {
+	for i := range s.checks {
+		if s.checks[i].Name == check.Name {
+			s.checks[i] = check
+			return
+		}
+	}
+	s.checks = append(s.checks, check)
+}
+
+func (s *IntegrityService) Checks() []IntegrityCheckInfo {
+	rows := make([]IntegrityCheckInfo, 0, len(s.checks))
+	for _, check := range s.checks {
+		rows = append(rows, IntegrityCheckInfo{
+			Name:        check.Name,
+			Severity:    check.Severity,
+			Description: check.Description,
+			Repairable:  check.Repair != nil,
+		})
+	}
+	return rows
+}
+
+func (s *IntegrityService) selectChecks(names []string) ([]IntegrityCheck, error) {
+	if len(names) == 0 {
+		return s.checks, nil
+	}
+	selected := make([]IntegrityCheck, 0, len(names))
+	seen := map[string]struct{}{}
+	for _, raw := range names {
+		name := strings.TrimSpace(raw)
+		if name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		found := false
+		for _, check := range s.checks {
+			if check.Name == name {
+				selected = append(selected, check)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown integrity check %s", name)
+		}
+	}
+	if len(selected) == 0 {
+		return s.checks, nil
+	}
+	return selected, nil
+}
+
+// Run scans the selected checks (all when none are named), repairs what it
+// safely can when asked to and stores the report as an IntegrityRun.
+func (s *IntegrityService) Run(ctx context.Context, in IntegrityRunInput) (*IntegrityReport, error) {
+	checks, err := s.selectChecks(in.Checks)
+	if err != nil {
+		return nil, err
+	}
+	trigger := strings.TrimSpace(in.Trigger)
+	if trigger == "" {
+		trigger = IntegrityTriggerManual
+	}
+
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	now := time.Now()
+	report := &IntegrityReport{Trigger: trigger, Repair: in.Repair, StartedAt: now, Checks: make([]IntegrityCheckReport, 0, len(checks))}
+	rebuild := false
+	for _, check := range checks {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		row := IntegrityCheckReport{Name: check.Name, Severity: check.Severity, Findings: []IntegrityFinding{}}
+		findings, err := check.Scan(now)
+		if err != nil {
+			row.Error = err.Error()
+			report.Checks = append(report.Checks, row)
+			continue
+		}
+		repairable := make([]IntegrityFinding, 0)
+		for _, finding := range findings {
+			finding.Check = check.Name
+			if finding.Severity == "" {
+				finding.Severity = check.Severity
+			}
+			if check.Repair == nil {
+				finding.Repairable = false
+			}
+			switch finding.Severity {
+			case IntegritySeverityError:
+				report.Errors++
+			case IntegritySeverityWarning:
+				report.Warnings++
+			default:
+				report.Infos++
+			}
+			if finding.Repairable {
+				repairable = append(repairable, finding)
+			}
+			row.Findings = append(row.Findings, finding)
+		}
+		if in.Repair && len(repairable) > 0 {
+			row.Repairs = check.Repair(ctx, repairable)
+			for _, result := range row.Repairs {
+				if result.Success {
+					report.Repaired++
+				}
+			}
+			if check.Rebuild && hasBatchSuccess(row.Repairs) {
+				rebuild = true
+			}
+		}
+		report.Checks = append(report.Checks, row)
+	}
+	if rebuild {
+		if err := s.orders.rebuildManagedRuntime(ctx); err != nil {
+			s.logger.Warn("rebuild runtime after integrity repair failed", zap.Error(err))
+		}
+	}
+
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	run := model.IntegrityRun{
+		Trigger:   trigger,
+		Repair:    in.Repair,
+		Errors:    report.Errors,
+		Warnings:  report.Warnings,
+		Infos:     report.Infos,
+		Repaired:  report.Repaired,
+		Report:    string(payload),
+		CreatedAt: now,
+	}
+	if err := s.db.Create(&run).Error; err != nil {
+		return nil, err
+	}
+	report.RunID = run.ID
+	return report, nil
+}
+
+func (s *IntegrityService) ListRuns(limit int) ([]model.IntegrityRun, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	rows := []model.IntegrityRun{}
+	if err := s.db.Omit("report").Order("id desc").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *IntegrityService) GetRun(id uint) (*IntegrityReport, error) {
+	run := model.IntegrityRun{}
+	if err := s.db.First(&run, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("integrity run %d not found", id)
+		}
+		return nil, err
+	}
+	report := &IntegrityReport{}
+	if err := json.Unmarshal([]byte(run.Report), report); err != nil {
+		return nil, err
+	}
+	report.RunID = run.ID
+	return report, nil
+}
+
+// Running reports whether a scheduled run is in flight. With auto-repair a
+// run can rebuild the runtime, so the scheduler starts it in the background.
+func (s *IntegrityService) Running() bool {
+	return s.running.Load()
+}
+
+func (s *IntegrityService) RunDue(ctx context.Context) {
+	settings, err := s.loadSettings()
+	if err != nil {
+		s.logger.Warn("load integrity settings failed", zap.Error(err))
+		return
+	}
+	if !settings.Enabled {
+		return
+	}
+
+	s.mu.Lock()
+	if !s.lastAttemptAt.IsZero() && time.Since(s.lastAttemptAt) < settings.Interval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastAttemptAt = time.Now()
+	s.mu.Unlock()
+
+	if !s.running.CompareAndSwap(false, true) {
+		return
+	}
+	defer s.running.Store(false)
+
+	report, err := s.Run(ctx, IntegrityRunInput{Repair: settings.AutoRepair, Trigger: IntegrityTriggerScheduled})
+	if err != nil {
+		s.logger.Warn("scheduled integrity check failed", zap.Error(err))
+		return
+	}
+	if settings.HistoryDays > 0 {
+		if err := s.db.Where("created_at < ?", time.Now().AddDate(0, 0, -settings.HistoryDays)).Delete(&model.IntegrityRun{}).Error; err != nil {
+			s.logger.Warn("prune integrity runs failed", zap.Error(err))
+		}
+	}
+	if report.Repaired > 0 {
+		s.store.AddTaskLog("info", "integrity issues repaired", fmt.Sprintf("run %d: repaired %d findings", report.RunID, report.Repaired))
+	}
+	if report.Errors > 0 {
+		detail := fmt.Sprintf("run %d: errors=%d warnings=%d repaired=%d", report.RunID, report.Errors, report.Warnings, report.Repaired)
+		s.store.AddTaskLog("warn", "integrity check found errors", detail)
+		s.notify("XrayTool 数据完整性检查", fmt.Sprintf("发现 %d 个错误, %d 个警告, 已自动修复 %d 项", report.Errors, report.Warnings, report.Repaired))
+	}
+}
+
+func (s *IntegrityService) notify(title, body string) {
+	if s.bark == nil {
+		return
+	}
+	if err := s.bark.Notify(title, body); err != nil {
+		s.logger.Warn("bark integrity notify failed", zap.Error(err))
+	}
+}
+
+func (s *IntegrityService) loadSettings() (integritySettings, error) {
+	values, err := s.store.GetSettings()
+	if err != nil {
+		return integritySettings{}, err
+	}
+	intervalMinutes := parseSettingInt(values["integrity_interval_minutes"], 360)
+	if intervalMinutes < 5 {
+		intervalMinutes = 5
+	}
+	return integritySettings{
+		Enabled:     parseSettingBool(values["integrity_enabled"], false),
+		Interval:    time.Duration(intervalMinutes) * time.Minute,
+		AutoRepair:  parseSettingBool(values["integrity_auto_repair"], false),
+		HistoryDays: parseSettingInt(values["integrity_history_days"], 30),
+	}, nil
+}
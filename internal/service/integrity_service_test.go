@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+)
+
+func TestIntegrityScanAndRepair(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	orders := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	svc := NewIntegrityService(db, nil, orders, nil, zap.NewNop())
+	ctx := context.Background()
+
+	// The seeded group already reuses username "x" on port 1080.
+	headID, children := seedDedicatedGroupForGeoTest(t, db)
+	inbound := model.DedicatedInbound{Name: "mixed", Protocol: model.DedicatedFeatureMixed, ListenPort: 1080, Enabled: true}
+	if err := db.Create(&inbound).Error; err != nil {
+		t.Fatalf("create inbound failed: %v", err)
+	}
+	ingress := model.DedicatedIngress{DedicatedInboundID: inbound.ID, Domain: "edge.example.com", IngressPort: 1080, Enabled: true}
+	if err := db.Create(&ingress).Error; err != nil {
+		t.Fatalf("create ingress failed: %v", err)
+	}
+	if err := db.Model(&model.Order{}).Where("id = ?", children[0].orderID).Updates(map[string]interface{}{
+		"dedicated_inbound_id": 9999,
+		"dedicated_ingress_id": ingress.ID,
+	}).Error; err != nil {
+		t.Fatalf("break binding failed: %v", err)
+	}
+
+	if err := db.Create(&model.XrayResource{OrderItemID: 9999, InboundTag: "in-orphan"}).Error; err != nil {
+		t.Fatalf("create orphan resource failed: %v", err)
+	}
+
+	now := time.Now()
+	emptyHead := model.Order{CustomerID: 1, Name: "empty", Mode: model.OrderModeDedicated, Status: model.OrderStatusActive, Port: 1080, StartsAt: now, ExpiresAt: now.Add(time.Hour), IsGroupHead: true}
+	if err := db.Create(&emptyHead).Error; err != nil {
+		t.Fatalf("create empty head failed: %v", err)
+	}
+
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	customer := seedBillingCustomer(t, db, "integrity", "198.51.100.93")
+	order, err := orders.CreateOrder(ctx, CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create order failed: %v", err)
+	}
+	// Re-adding a host ip gives it a new id and strands the item's link.
+	if err := db.Where("ip = ?", "198.51.100.93").Delete(&model.HostIP{}).Error; err != nil {
+		t.Fatalf("delete host ip failed: %v", err)
+	}
+	if err := db.Create(&model.HostIP{IP: "198.51.100.93", IsPublic: true, IsLocal: true, Enabled: true}).Error; err != nil {
+		t.Fatalf("re-add host ip failed: %v", err)
+	}
+
+	report, err := svc.Run(ctx, IntegrityRunInput{})
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	found := map[string][]IntegrityFinding{}
+	for _, check := range report.Checks {
+		if check.Error != "" {
+			t.Fatalf("check %s failed: %s", check.Name, check.Error)
+		}
+		found[check.Name] = check.Findings
+	}
+	expect := map[string]uint{
+		IntegrityCheckOrphanXrayResources:     0,
+		IntegrityCheckItemHostIP:              order.Items[0].ID,
+		IntegrityCheckDedicatedBindings:       children[0].orderID,
+		IntegrityCheckEmptyGroupHeads:         emptyHead.ID,
+		IntegrityCheckDedicatedMixedDuplicate: children[1].itemID,
+	}
+	for name, entityID := range expect {
+		rows := found[name]
+		if len(rows) != 1 || !rows[0].Repairable {
+			t.Fatalf("expected one repairable %s finding, got %+v", name, rows)
+		}
+		if entityID > 0 && rows[0].EntityID != entityID {
+			t.Fatalf("unexpected %s finding: %+v", name, rows[0])
+		}
+	}
+	if report.Errors != 3 || report.Warnings != 2 || report.Repaired != 0 {
+		t.Fatalf("unexpected counts: %+v", report)
+	}
+
+	repaired, err := svc.Run(ctx, IntegrityRunInput{Repair: true})
+	if err != nil {
+		t.Fatalf("repair failed: %v", err)
+	}
+	if repaired.Repaired != 5 {
+		t.Fatalf("expected 5 repairs, got %+v", repaired.Checks)
+	}
+
+	after, err := svc.Run(ctx, IntegrityRunInput{})
+	if err != nil {
+		t.Fatalf("rescan failed: %v", err)
+	}
+	if after.Errors != 0 || after.Warnings != 0 {
+		t.Fatalf("expected a clean rescan, got %+v", after.Checks)
+	}
+	bound := model.Order{}
+	if err := db.First(&bound, children[0].orderID).Error; err != nil {
+		t.Fatalf("load order failed: %v", err)
+	}
+	if bound.DedicatedInboundID == nil || *bound.DedicatedInboundID != inbound.ID || bound.Version == 1 {
+		t.Fatalf("expected inbound rebound and version bumped, got %+v", bound)
+	}
+	var heads int64
+	db.Model(&model.Order{}).Where("id = ?", headID).Count(&heads)
+	if heads != 1 {
+		t.Fatalf("group head with children must stay")
+	}
+
+	runs, err := svc.ListRuns(0)
+	if err != nil || len(runs) != 3 {
+		t.Fatalf("expected 3 stored runs, got %d (%v)", len(runs), err)
+	}
+	stored, err := svc.GetRun(repaired.RunID)
+	if err != nil || stored.Repaired != 5 || !stored.Repair {
+		t.Fatalf("unexpected stored run: %+v (%v)", stored, err)
+	}
+	if _, err := svc.Run(ctx, IntegrityRunInput{Checks: []string{"nope"}}); err == nil {
+		t.Fatalf("expected unknown check to fail")
+	}
+}
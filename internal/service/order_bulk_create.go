@@ -0,0 +1,636 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"github.com/xuri/excelize/v2"
+	"go.uber.org/zap"
+)
+
+// bulkOrderColumns is the header row of the bulk order sheet. Columns are
+// matched by header name, so extra or reordered columns are fine.
+var bulkOrderColumns = []string{
+	"customer",
+	"name",
+	"mode",
+	"product_sku",
+	"quantity",
+	"duration_day",
+	"expires_at",
+	"price",
+	"ip_tier",
+	"port",
+	"manual_ips",
+	"dedicated_protocol",
+	"dedicated_inbound_id",
+	"dedicated_ingress_id",
+	"dedicated_egress_lines",
+	"egress_pool_id",
+}
+
+type BulkOrderRow struct {
+	Row          int              `json:"row"`
+	Customer     string           `json:"customer"`
+	CustomerName string           `json:"customer_name,omitempty"`
+	Input        CreateOrderInput `json:"input"`
+	EgressPoolID uint             `json:"egress_pool_id,omitempty"`
+	Available    *int             `json:"available,omitempty"`
+	Warnings     []string         `json:"warnings,omitempty"`
+	Error        string           `json:"error,omitempty"`
+	OrderID      uint             `json:"order_id,omitempty"`
+	OrderNo      string           `json:"order_no,omitempty"`
+
+	productSKU string
+	manualIPs  []string
+}
+
+type BulkOrderResult struct {
+	DryRun  bool           `json:"dry_run"`
+	Total   int            `json:"total"`
+	Valid   int            `json:"valid"`
+	Created int            `json:"created"`
+	Failed  int            `json:"failed"`
+	Rows    []BulkOrderRow `json:"rows"`
+}
+
+func BulkOrderTemplateXLSX() ([]byte, string, error) {
+	f := excelize.NewFile()
+	sheet := f.GetSheetName(0)
+	for i, title := range bulkOrderColumns {
+		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
+		_ = f.SetCellValue(sheet, cell, title)
+	}
+	_ = f.SetCellValue(sheet, "A2", "CUST01")
+	_ = f.SetCellValue(sheet, "C2", model.OrderModeAuto)
+	_ = f.SetCellValue(sheet, "E2", 10)
+	_ = f.SetCellValue(sheet, "F2", 30)
+	_ = f.SetColWidth(sheet, "A", "P", 18)
+	_ = f.SetColWidth(sheet, "O", "O", 48)
+	body, err := f.WriteToBuffer()
+	if err != nil {
+		return nil, "", err
+	}
+	return body.Bytes(), "bulk-orders-template.xlsx", nil
+}
+
+// parseBulkOrderSheet reads an XLSX workbook (first sheet) or a CSV file.
+// Cell problems are kept on the row so the preview can show every one.
+func parseBulkOrderSheet(body []byte) ([]BulkOrderRow, error) {
+	records, err := readBulkOrderRecords(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("sheet is empty")
+	}
+	index := map[string]int{}
+	for i, title := range records[0] {
+		index[strings.ToLower(strings.TrimSpace(title))] = i
+	}
+	if _, ok := index["customer"]; !ok {
+		return nil, errors.New("header row must contain a customer column")
+	}
+	cell := func(record []string, column string) string {
+		i, ok := index[column]
+		if !ok {
+			return ""
+		}
+		return trimCell(record, i)
+	}
+
+	rows := make([]BulkOrderRow, 0, len(records)-1)
+	for idx := 1; idx < len(records); idx++ {
+		record := records[idx]
+		blank := true
+		for _, value := range record {
+			if strings.TrimSpace(value) != "" {
+				blank = false
+				break
+			}
+		}
+		if blank {
+			continue
+		}
+		row := BulkOrderRow{Row: idx + 1, Customer: cell(record, "customer")}
+		row.productSKU = cell(record, "product_sku")
+		row.Input.Name = cell(record, "name")
+		row.Input.Mode = strings.ToLower(cell(record, "mode"))
+		row.Input.IPTier = cell(record, "ip_tier")
+		row.Input.DedicatedProtocol = cell(record, "dedicated_protocol")
+		row.Input.DedicatedEgressLines = strings.ReplaceAll(cell(record, "dedicated_egress_lines"), ";", "\n")
+		for _, ip := range strings.FieldsFunc(cell(record, "manual_ips"), func(r rune) bool {
+			return r == ',' || r == ';' || r == '\n' || r == ' '
+		}) {
+			row.manualIPs = append(row.manualIPs, strings.TrimSpace(ip))
+		}
+		errs := []string{}
+		parseInt := func(column string, target *int) {
+			raw := cell(record, column)
+			if raw == "" {
+				return
+			}
+			v, err := parseExcelInt(raw)
+			if err != nil || v < 0 {
+				errs = append(errs, fmt.Sprintf("invalid %s", column))
+				return
+			}
+			*target = v
+		}
+		parseID := func(column string, target *uint) {
+			v := 0
+			parseInt(column, &v)
+			*target = uint(v)
+		}
+		parseInt("quantity", &row.Input.Quantity)
+		parseInt("duration_day", &row.Input.DurationDay)
+		parseInt("port", &row.Input.Port)
+		parseID("dedicated_inbound_id", &row.Input.DedicatedInboundID)
+		parseID("dedicated_ingress_id", &row.Input.DedicatedIngressID)
+		parseID("egress_pool_id", &row.EgressPoolID)
+		if raw := cell(record, "price"); raw != "" {
+			price, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				errs = append(errs, "invalid price")
+			}
+			row.Input.Price = price
+			row.Input.HasPrice = true
+		}
+		if raw := cell(record, "expires_at"); raw != "" {
+			expiresAt, err := parseBulkOrderTime(raw)
+			if err != nil {
+				errs = append(errs, "invalid expires_at, expect RFC3339 or 2006-01-02")
+			}
+			row.Input.ExpiresAt = expiresAt
+		}
+		if row.Customer == "" {
+			errs = append(errs, "customer is required")
+		}
+		row.Error = strings.Join(errs, "; ")
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("sheet has no order rows")
+	}
+	return rows, nil
+}
+
+func readBulkOrderRecords(body []byte) ([][]string, error) {
+	if bytes.HasPrefix(body, []byte("PK")) {
+		book, err := excelize.OpenReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("read xlsx failed: %w", err)
+		}
+		sheet := book.GetSheetName(0)
+		if sheet == "" {
+			return nil, errors.New("xlsx has no sheet")
+		}
+		return book.GetRows(sheet)
+	}
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("read csv failed: %w", err)
+	}
+	return records, nil
+}
+
+func parseBulkOrderTime(raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", raw, time.Local)
+}
+
+// bulkOrderPlan tracks what earlier rows of the same sheet already claim, so
+// capacity is checked against the whole sheet rather than row by row.
+type bulkOrderPlan struct {
+	// hostIPs carries the live host IP load plus every IP earlier rows
+	// claimed, so per-IP limits see the claims of all customers and tiers.
+	hostIPs     *hostIPCapacityChecker
+	pool        []model.HostIP
+	usedIPs     map[uint]map[string]struct{}
+	customerIPs map[uint]map[uint]struct{}
+	egress      map[uint]map[string]struct{}
+	poolClaims  map[uint]int64
+	ports       map[int]error
+}
+
+// PreviewBulkOrders parses a bulk order sheet and validates every row against
+// customers, products, IP allocation, dedicated bindings and egress pools
+// without creating anything.
+func (s *OrderService) PreviewBulkOrders(body []byte) (BulkOrderResult, error) {
+	rows, err := parseBulkOrderSheet(body)
+	if err != nil {
+		return BulkOrderResult{}, err
+	}
+	if err := s.validateBulkOrderRows(rows); err != nil {
+		return BulkOrderResult{}, err
+	}
+	return summarizeBulkOrders(rows, true), nil
+}
+
+// CreateBulkOrders validates the sheet like PreviewBulkOrders and then creates
+// each valid row in order. Unless skipInvalid is set, a sheet with any invalid
+// row creates nothing.
+func (s *OrderService) CreateBulkOrders(ctx context.Context, body []byte, skipInvalid bool) (BulkOrderResult, error) {
+	rows, err := parseBulkOrderSheet(body)
+	if err != nil {
+		return BulkOrderResult{}, err
+	}
+	if err := s.validateBulkOrderRows(rows); err != nil {
+		return BulkOrderResult{}, err
+	}
+	if !skipInvalid {
+		for _, row := range rows {
+			if row.Error != "" {
+				result := summarizeBulkOrders(rows, true)
+				return result, fmt.Errorf("%d of %d rows failed validation, fix them or skip invalid rows", result.Failed, result.Total)
+			}
+		}
+	}
+	for i := range rows {
+		row := &rows[i]
+		if row.Error != "" {
+			continue
+		}
+		order, err := s.CreateOrder(ctx, row.Input)
+		if err != nil {
+			row.Error = err.Error()
+			continue
+		}
+		row.OrderID = order.ID
+		row.OrderNo = order.OrderNo
+		if row.EgressPoolID > 0 {
+			if err := s.bindGroupEgressPool(ctx, order.ID, row.EgressPoolID); err != nil {
+				row.Warnings = append(row.Warnings, fmt.Sprintf("order created but egress pool binding failed: %v", err))
+			}
+		}
+	}
+	result := summarizeBulkOrders(rows, false)
+	s.log.Info("bulk orders created", zap.Int("created", result.Created), zap.Int("failed", result.Failed))
+	return result, nil
+}
+
+func (s *OrderService) bindGroupEgressPool(ctx context.Context, headID uint, poolID uint) error {
+	children := []model.Order{}
+	if err := s.db.Select("id").Where("parent_order_id = ?", headID).Order("id asc").Find(&children).Error; err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := s.SetOrderEgressPool(ctx, child.ID, poolID, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func summarizeBulkOrders(rows []BulkOrderRow, dryRun bool) BulkOrderResult {
+	result := BulkOrderResult{DryRun: dryRun, Total: len(rows), Rows: rows}
+	for _, row := range rows {
+		switch {
+		case row.Error != "":
+			result.Failed++
+		case dryRun:
+			result.Valid++
+		default:
+			result.Valid++
+			result.Created++
+		}
+	}
+	return result
+}
+
+func (s *OrderService) validateBulkOrderRows(rows []BulkOrderRow) error {
+	customers := []model.Customer{}
+	if err := s.db.Find(&customers).Error; err != nil {
+		return err
+	}
+	products := []model.Product{}
+	if err := s.db.Find(&products).Error; err != nil {
+		return err
+	}
+	hostIPs, err := s.hostIPSet()
+	if err != nil {
+		return err
+	}
+	plan := &bulkOrderPlan{
+		usedIPs:     map[uint]map[string]struct{}{},
+		customerIPs: map[uint]map[uint]struct{}{},
+		egress:      map[uint]map[string]struct{}{},
+		poolClaims:  map[uint]int64{},
+		ports:       map[int]error{},
+	}
+	now := time.Now()
+	for i := range rows {
+		row := &rows[i]
+		if row.Error != "" {
+			continue
+		}
+		if err := s.validateBulkOrderRow(row, plan, customers, products, hostIPs, now); err != nil {
+			row.Error = err.Error()
+		}
+	}
+	return nil
+}
+
+func (s *OrderService) validateBulkOrderRow(row *BulkOrderRow, plan *bulkOrderPlan, customers []model.Customer, products []model.Product, hostIPs map[string]uint, now time.Time) error {
+	customer, err := matchBulkOrderCustomer(customers, row.Customer)
+	if err != nil {
+		return err
+	}
+	row.Input.CustomerID = customer.ID
+	row.CustomerName = customer.Name
+	if customer.Status == model.CustomerStatusSuspended {
+		return errors.New("customer is suspended")
+	}
+
+	in := row.Input
+	if row.productSKU != "" {
+		product, err := matchBulkOrderProduct(products, row.productSKU)
+		if err != nil {
+			return err
+		}
+		in.ProductID = product.ID
+		if in, err = s.applyProductToCreateInput(in); err != nil {
+			return err
+		}
+	}
+	if in.Mode == "" {
+		in.Mode = model.OrderModeAuto
+	}
+	if in.Mode != model.OrderModeAuto && in.Mode != model.OrderModeManual && in.Mode != model.OrderModeDedicated {
+		return errors.New("mode must be auto/manual/dedicated")
+	}
+	if in.Price < 0 {
+		return errors.New("price must be >= 0")
+	}
+	tier, err := normalizeOrderIPTier(in.IPTier)
+	if err != nil {
+		return err
+	}
+	in.IPTier = tier
+	if !in.ExpiresAt.IsZero() && !in.ExpiresAt.After(now) {
+		return errors.New("expires_at must be in the future")
+	}
+	if in.DurationDay <= 0 && in.ExpiresAt.IsZero() {
+		in.DurationDay = 30
+	}
+	if row.EgressPoolID > 0 && in.Mode != model.OrderModeDedicated {
+		return errors.New("egress_pool_id only applies to dedicated rows")
+	}
+
+	if in.Mode == model.OrderModeDedicated {
+		if err := s.validateBulkDedicatedRow(row, &in, plan); err != nil {
+			return err
+		}
+	} else if err := s.validateBulkResidentialRow(row, &in, plan, hostIPs); err != nil {
+		return err
+	}
+	row.Input = in
+	return nil
+}
+
+func (s *OrderService) validateBulkResidentialRow(row *BulkOrderRow, in *CreateOrderInput, plan *bulkOrderPlan, hostIPs map[string]uint) error {
+	if in.Mode == model.OrderModeManual {
+		if len(row.manualIPs) == 0 {
+			return errors.New("manual_ips is required for manual rows")
+		}
+		in.ManualIPIDs = make([]uint, 0, len(row.manualIPs))
+		for _, ip := range row.manualIPs {
+			id, ok := hostIPs[ip]
+			if !ok {
+				return fmt.Errorf("manual ip %s is not a host ip", ip)
+			}
+			in.ManualIPIDs = append(in.ManualIPIDs, id)
+		}
+		if in.Quantity <= 0 {
+			in.Quantity = len(in.ManualIPIDs)
+		}
+	}
+	if in.Quantity <= 0 {
+		return errors.New("quantity must be > 0")
+	}
+	port := in.Port
+	if port <= 0 {
+		p, err := s.defaultPort()
+		if err != nil {
+			return err
+		}
+		port = p
+	}
+	portErr, checked := plan.ports[port]
+	if !checked {
+		portErr = s.ensurePortReadyForManaged(port)
+		plan.ports[port] = portErr
+	}
+	if portErr != nil {
+		return portErr
+	}
+
+	if plan.hostIPs == nil {
+		checker, err := s.loadHostIPCapacityChecker(0)
+		if err != nil {
+			return err
+		}
+		pool, err := s.usableIPPool()
+		if err != nil {
+			return err
+		}
+		plan.hostIPs, plan.pool = checker, pool
+	}
+	claimed := plan.customerIPs[in.CustomerID]
+	if claimed == nil {
+		claimed = map[uint]struct{}{}
+		plan.customerIPs[in.CustomerID] = claimed
+	}
+	match := combineHostIPMatchers(hostIPCountryMatcher(in.countryCodes), hostIPTierMatcher(in.IPTier))
+	if in.Mode == model.OrderModeManual {
+		selected, err := s.allocateIPsMatching(in.CustomerID, in.Quantity, in.Mode, in.ManualIPIDs, 0, match)
+		if err != nil {
+			return err
+		}
+		for _, ip := range selected {
+			if _, taken := claimed[ip.ID]; taken {
+				return fmt.Errorf("ip %s is already used by an earlier row for this customer", ip.IP)
+			}
+			if reason := plan.hostIPs.reason(ip, in.CustomerID, 1); reason != "" {
+				return fmt.Errorf("ip %s is at capacity with earlier rows (%s)", ip.IP, reason)
+			}
+		}
+		for _, ip := range selected {
+			claimed[ip.ID] = struct{}{}
+			plan.hostIPs.claim(ip.IP, in.CustomerID, 1)
+		}
+		return nil
+	}
+
+	used, ok := plan.usedIPs[in.CustomerID]
+	if !ok {
+		var err error
+		if used, err = s.customerUsedIPSet(in.CustomerID, 0); err != nil {
+			return err
+		}
+		plan.usedIPs[in.CustomerID] = used
+	}
+	all := make([]model.HostIP, 0, len(plan.pool))
+	usedOrClaimed := make(map[string]struct{}, len(used)+len(claimed))
+	for ip := range used {
+		usedOrClaimed[ip] = struct{}{}
+	}
+	for _, ip := range plan.pool {
+		if match != nil && !match(ip) {
+			continue
+		}
+		if _, taken := claimed[ip.ID]; taken {
+			usedOrClaimed[ip.IP] = struct{}{}
+		}
+		all = append(all, ip)
+	}
+	if len(all) == 0 {
+		return errors.New("no host ips in the allowed countries or ip tier")
+	}
+	pool, err := s.classifyHostIPPool(in.CustomerID, 0, all, usedOrClaimed, time.Now(), plan.hostIPs)
+	if err != nil {
+		return err
+	}
+	available := len(pool.candidates) + len(pool.returned)
+	row.Available = &available
+	if in.Quantity > available {
+		return fmt.Errorf("not enough IPs, expect %d got %d", in.Quantity, available)
+	}
+	// Claim the least loaded IPs, the way auto allocation spreads items, and
+	// leave IPs the customer handed back for last.
+	picks := append([]model.HostIP{}, pool.candidates...)
+	sort.SliceStable(picks, func(i, j int) bool {
+		return plan.hostIPs.load(picks[i].IP).items < plan.hostIPs.load(picks[j].IP).items
+	})
+	picks = append(picks, pool.returned...)
+	for _, ip := range picks[:in.Quantity] {
+		claimed[ip.ID] = struct{}{}
+		plan.hostIPs.claim(ip.IP, in.CustomerID, 1)
+	}
+	return nil
+}
+
+func (s *OrderService) validateBulkDedicatedRow(row *BulkOrderRow, in *CreateOrderInput, plan *bulkOrderPlan) error {
+	protocol := strings.TrimSpace(in.DedicatedProtocol)
+	if protocol == "" {
+		protocol = model.DedicatedFeatureMixed
+	}
+	protocol, err := normalizeDedicatedProtocol(protocol)
+	if err != nil {
+		return err
+	}
+	in.DedicatedProtocol = protocol
+	inbound, ingress, _, err := s.resolveDedicatedBindingForCreate(*in, protocol)
+	if err != nil {
+		return err
+	}
+	if len(in.countryCodes) > 0 && !containsCountryCode(in.countryCodes, ingress.CountryCode) {
+		return fmt.Errorf("ingress country %s is outside the allowed countries %s", ingress.CountryCode, strings.Join(in.countryCodes, ","))
+	}
+	if inbound.ListenPort <= 0 {
+		return fmt.Errorf("dedicated inbound has no usable port for protocol %s", protocol)
+	}
+	egressRows, err := parseDedicatedEgressLines(in.DedicatedEgressLines)
+	if err != nil {
+		return err
+	}
+	if in.Quantity > 0 && in.Quantity != len(egressRows) {
+		return fmt.Errorf("quantity %d does not match %d egress lines", in.Quantity, len(egressRows))
+	}
+	in.Quantity = len(egressRows)
+	if err := s.ensureCustomerDedicatedEgressUniqueTx(s.db, in.CustomerID, egressRows, nil); err != nil {
+		return err
+	}
+	seen := plan.egress[in.CustomerID]
+	if seen == nil {
+		seen = map[string]struct{}{}
+		plan.egress[in.CustomerID] = seen
+	}
+	for _, line := range egressRows {
+		key := buildEgressMatchKey(line.Address, line.Port, line.Username, line.Password)
+		if _, dup := seen[key]; dup {
+			return fmt.Errorf("egress %s:%d:%s is already used by an earlier row for this customer", line.Address, line.Port, line.Username)
+		}
+	}
+	if row.EgressPoolID > 0 {
+		if err := s.checkBulkEgressPool(row, *in, plan); err != nil {
+			return err
+		}
+	}
+	for _, line := range egressRows {
+		seen[buildEgressMatchKey(line.Address, line.Port, line.Username, line.Password)] = struct{}{}
+	}
+	return nil
+}
+
+// checkBulkEgressPool makes sure the pool can serve the row. Items bound to a
+// pool start on its primary member, so that member's capacity is what the
+// row consumes.
+func (s *OrderService) checkBulkEgressPool(row *BulkOrderRow, in CreateOrderInput, plan *bulkOrderPlan) error {
+	runtimes, err := loadEgressPoolRuntimes(s.db, []uint{row.EgressPoolID})
+	if err != nil {
+		return err
+	}
+	pool, ok := runtimes[row.EgressPoolID]
+	if !ok {
+		return errors.New("egress pool is disabled or has no enabled members")
+	}
+	primary := pool.members[0]
+	loads, err := forwardOutboundLoadsTx(s.db, []uint{primary.ID}, 0)
+	if err != nil {
+		return err
+	}
+	adds := plan.poolClaims[primary.ID] + int64(in.Quantity)
+	if reason := forwardCapacityShortfall(primary, loads[primary.ID], in.CustomerID, adds); reason != "" {
+		message := fmt.Sprintf("egress pool %s primary %s over capacity (%s)", pool.pool.Name, forwardOutboundLabel(primary), reason)
+		if forwardCapacityPolicy(s.db) != ForwardCapacityPolicyWarn {
+			return errors.New(message)
+		}
+		row.Warnings = append(row.Warnings, message)
+	}
+	plan.poolClaims[primary.ID] = adds
+	return nil
+}
+
+func matchBulkOrderCustomer(customers []model.Customer, raw string) (model.Customer, error) {
+	for _, customer := range customers {
+		if customer.Code != "" && strings.EqualFold(customer.Code, raw) {
+			return customer, nil
+		}
+	}
+	for _, customer := range customers {
+		if customer.Name == raw {
+			return customer, nil
+		}
+	}
+	if id, err := strconv.ParseUint(raw, 10, 64); err == nil {
+		for _, customer := range customers {
+			if customer.ID == uint(id) {
+				return customer, nil
+			}
+		}
+	}
+	return model.Customer{}, fmt.Errorf("customer %s not found", raw)
+}
+
+func matchBulkOrderProduct(products []model.Product, sku string) (model.Product, error) {
+	for _, product := range products {
+		if strings.EqualFold(product.SKU, sku) {
+			return product, nil
+		}
+	}
+	return model.Product{}, fmt.Errorf("product %s not found", sku)
+}
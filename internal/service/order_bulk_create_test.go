@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+)
+
+func TestBulkOrdersPreviewAndCreate(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	customer := seedBillingCustomer(t, db, "bulk-a", "198.51.100.80")
+	if err := db.Create(&model.HostIP{IP: "198.51.100.81", IsPublic: true, IsLocal: true, Enabled: true}).Error; err != nil {
+		t.Fatalf("create host ip failed: %v", err)
+	}
+	sheet := strings.Join([]string{
+		"customer,mode,quantity,port,duration_day",
+		fmt.Sprintf("BULK-A,auto,1,%d,30", residentialTestPort),
+		fmt.Sprintf("bulk-a,,1,%d,", residentialTestPort),
+		fmt.Sprintf("bulk-a,auto,1,%d,30", residentialTestPort),
+		"nobody,auto,1,,",
+		"bulk-a,dedicated,,,",
+		"bulk-a,auto,two,,",
+	}, "\n")
+
+	preview, err := svc.PreviewBulkOrders([]byte(sheet))
+	if err != nil {
+		t.Fatalf("preview failed: %v", err)
+	}
+	if !preview.DryRun || preview.Total != 6 || preview.Valid != 2 || preview.Failed != 4 {
+		t.Fatalf("unexpected preview summary: %+v", preview)
+	}
+	expect := []string{"", "", "not enough IPs", "customer nobody not found", "dedicated_inbound_id", "invalid quantity"}
+	for i, row := range preview.Rows {
+		if row.Row != i+2 {
+			t.Fatalf("row %d numbered %d", i, row.Row)
+		}
+		if expect[i] == "" && row.Error != "" || !strings.Contains(row.Error, expect[i]) {
+			t.Fatalf("row %d expected error %q, got %q", row.Row, expect[i], row.Error)
+		}
+	}
+	if preview.Rows[1].Available == nil || *preview.Rows[1].Available != 1 || preview.Rows[1].Input.CustomerID != customer.ID {
+		t.Fatalf("expected second row to see one remaining ip, got %+v", preview.Rows[1])
+	}
+
+	ctx := context.Background()
+	var before int64
+	if err := db.Model(&model.Order{}).Count(&before).Error; err != nil {
+		t.Fatalf("count orders failed: %v", err)
+	}
+	if _, err := svc.CreateBulkOrders(ctx, []byte(sheet), false); err == nil || !strings.Contains(err.Error(), "4 of 6 rows failed") {
+		t.Fatalf("expected invalid sheet to be refused, got %v", err)
+	}
+	var count int64
+	if err := db.Model(&model.Order{}).Count(&count).Error; err != nil || count != before {
+		t.Fatalf("expected no new orders after refused sheet, got %d %v", count-before, err)
+	}
+
+	created, err := svc.CreateBulkOrders(ctx, []byte(sheet), true)
+	if err != nil {
+		t.Fatalf("create bulk orders failed: %v", err)
+	}
+	if created.DryRun || created.Created != 2 || created.Failed != 4 {
+		t.Fatalf("unexpected create summary: %+v", created)
+	}
+	ips := map[string]struct{}{}
+	for _, row := range created.Rows[:2] {
+		order, err := svc.GetOrder(row.OrderID)
+		if err != nil || order.OrderNo != row.OrderNo || len(order.Items) != 1 {
+			t.Fatalf("load created order failed: %+v %v", order, err)
+		}
+		ips[order.Items[0].IP] = struct{}{}
+	}
+	if len(ips) != 2 {
+		t.Fatalf("expected the two rows on different ips, got %v", ips)
+	}
+
+	template, _, err := BulkOrderTemplateXLSX()
+	if err != nil {
+		t.Fatalf("build template failed: %v", err)
+	}
+	fromTemplate, err := svc.PreviewBulkOrders(template)
+	if err != nil || fromTemplate.Total != 1 || !strings.Contains(fromTemplate.Rows[0].Error, "customer CUST01 not found") {
+		t.Fatalf("expected template sample row to parse, got %+v %v", fromTemplate, err)
+	}
+}
+
+func TestBulkOrdersCountHostIPClaimsAcrossCustomers(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	seedBillingCustomer(t, db, "bulk-x", "198.51.100.84")
+	seedBillingCustomer(t, db, "bulk-y", "198.51.100.85")
+	if err := store.New(db).SetSettings(map[string]string{"host_ip_max_customers": "1"}); err != nil {
+		t.Fatalf("save settings failed: %v", err)
+	}
+	sheet := strings.Join([]string{
+		"customer,mode,quantity,port,duration_day,manual_ips",
+		fmt.Sprintf("bulk-x,auto,2,%d,30,", residentialTestPort),
+		fmt.Sprintf("bulk-y,auto,1,%d,30,", residentialTestPort),
+		fmt.Sprintf("bulk-y,manual,,%d,30,198.51.100.84", residentialTestPort),
+	}, "\n")
+	preview, err := svc.PreviewBulkOrders([]byte(sheet))
+	if err != nil {
+		t.Fatalf("preview failed: %v", err)
+	}
+	if preview.Rows[0].Error != "" {
+		t.Fatalf("expected first customer to take both ips, got %q", preview.Rows[0].Error)
+	}
+	if !strings.Contains(preview.Rows[1].Error, "not enough IPs") || preview.Rows[1].Available == nil || *preview.Rows[1].Available != 0 {
+		t.Fatalf("expected second customer to see the ips claimed by the earlier row, got %+v", preview.Rows[1])
+	}
+	if !strings.Contains(preview.Rows[2].Error, "at capacity with earlier rows") {
+		t.Fatalf("expected manual row on a claimed ip to be refused, got %q", preview.Rows[2].Error)
+	}
+}
@@ -28,6 +28,7 @@ type XLSXExportOptions struct {
 type xlsxExportRow struct {
 	Protocol     string
 	Mode         string
+	SKU          string
 	OrderNo      string
 	GroupHeadID  uint
 	Customer     string
@@ -149,7 +150,7 @@ func (s *OrderService) collectXLSXRows(orderIDs []uint, opts XLSXExportOptions)
 	result := make([]xlsxExportRow, 0)
 	now := time.Now()
 	for _, order := range orders {
-		if order.Status != model.OrderStatusActive || !order.ExpiresAt.After(now) {
+		if !orderLive(order, now) {
 			continue
 		}
 		protocol := exportOrderProtocol(order)
@@ -167,7 +168,7 @@ func (s *OrderService) collectXLSXRows(orderIDs []uint, opts XLSXExportOptions)
 			if err != nil {
 				return nil, err
 			}
-			country := strings.ToLower(strings.TrimSpace(egress.CountryCode))
+			country := exportCountryCode(egress.CountryCode, egress.ExitIP)
 			if country == "" {
 				country = "xx"
 			}
@@ -190,6 +191,7 @@ func (s *OrderService) collectXLSXRows(orderIDs []uint, opts XLSXExportOptions)
 			result = append(result, xlsxExportRow{
 				Protocol:     protocol,
 				Mode:         strings.TrimSpace(order.Mode),
+				SKU:          productSKU(order),
 				OrderNo:      orderNo,
 				GroupHeadID:  groupHeadID(order),
 				Customer:     strings.TrimSpace(order.Customer.Name),
@@ -245,12 +247,12 @@ func (s *OrderService) expandOrdersForExport(orderIDs []uint) ([]model.Order, er
 	seen := map[uint]struct{}{}
 	for _, id := range ids {
 		order := model.Order{}
-		if err := s.db.Preload("Customer").Preload("DedicatedEntry").Preload("DedicatedInbound").Preload("DedicatedIngress").Preload("Items").First(&order, id).Error; err != nil {
+		if err := s.db.Preload("Customer").Preload("DedicatedEntry").Preload("DedicatedInbound").Preload("DedicatedIngress").Preload("Product").Preload("Items").First(&order, id).Error; err != nil {
 			return nil, err
 		}
 		if order.IsGroupHead {
 			children := []model.Order{}
-			if err := s.db.Preload("Customer").Preload("DedicatedEntry").Preload("DedicatedInbound").Preload("DedicatedIngress").Preload("Items").Where("parent_order_id = ?", order.ID).Order("sequence_no asc, id asc").Find(&children).Error; err != nil {
+			if err := s.db.Preload("Customer").Preload("DedicatedEntry").Preload("DedicatedInbound").Preload("DedicatedIngress").Preload("Product").Preload("Items").Where("parent_order_id = ?", order.ID).Order("sequence_no asc, id asc").Find(&children).Error; err != nil {
 				return nil, err
 			}
 			if len(children) == 0 {
@@ -329,6 +331,9 @@ func exportArtifactSKU(rows []xlsxExportRow, protocol string) string {
 	if len(rows) == 0 {
 		return "Export"
 	}
+	if sku := strings.TrimSpace(rows[0].SKU); sku != "" {
+		return sku
+	}
 	if strings.EqualFold(strings.TrimSpace(rows[0].Mode), model.OrderModeDedicated) {
 		return exportProtocolLabel(protocol)
 	}
@@ -417,9 +422,12 @@ func exportCustomerLabelFromOrders(orders []model.Order) string {
 func exportSKUCountsFromRows(rows []xlsxExportRow) map[string]int {
 	counts := map[string]int{}
 	for _, row := range rows {
-		key := exportProtocolLabel(row.Protocol)
-		if !strings.EqualFold(strings.TrimSpace(row.Mode), model.OrderModeDedicated) {
-			key = "Home"
+		key := strings.TrimSpace(row.SKU)
+		if key == "" {
+			key = exportProtocolLabel(row.Protocol)
+			if !strings.EqualFold(strings.TrimSpace(row.Mode), model.OrderModeDedicated) {
+				key = "Home"
+			}
 		}
 		counts[key]++
 	}
@@ -514,9 +522,25 @@ func countryNameCN(code string) string {
 	if name, ok := known[code]; ok {
 		return name
 	}
+	if name := geoIPCountryName(code); name != "" {
+		return name
+	}
 	return strings.ToUpper(code)
 }
 
+// exportCountryCode keeps the probed country and only consults the local
+// GeoIP database when it is missing; it also warms the zh-CN name cache.
+func exportCountryCode(code string, exitIP string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	geo, ok := lookupLocalIPGeo(exitIP)
+	if code == "" || code == "xx" {
+		if ok && geo.CountryCode != "" {
+			return geo.CountryCode
+		}
+	}
+	return code
+}
+
 func cycleTag(order model.Order, now time.Time) string {
 	days := cycleDays(order, now)
 	return fmt.Sprintf("D%d", days)
@@ -556,7 +580,7 @@ func exportOrderProtocol(order model.Order) string {
 }
 
 func dedicatedLinkTag(countryCode string, exitIP string) string {
-	country := countryNameCN(countryCode)
+	country := countryNameCN(exportCountryCode(countryCode, exitIP))
 	if strings.TrimSpace(country) == "" {
 		country = "未知"
 	}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"xraytool/internal/model"
@@ -25,6 +27,8 @@ type OrderService struct {
 	db   *gorm.DB
 	xray *XrayManager
 	log  *zap.Logger
+
+	assignMu sync.Mutex
 }
 
 type BatchActionResult struct {
@@ -40,6 +44,8 @@ type BatchTestResult struct {
 	Error   string          `json:"error,omitempty"`
 }
 
+// CreateOrderInput describes a new order. Price is per 30 days whatever
+// DurationDay is; charges are prorated by the days actually booked.
 type CreateOrderInput struct {
 	CustomerID                    uint      `json:"customer_id"`
 	Name                          string    `json:"name"`
@@ -58,6 +64,14 @@ type CreateOrderInput struct {
 	DedicatedIngressID            uint      `json:"dedicated_ingress_id"`
 	DedicatedProtocol             string    `json:"dedicated_protocol"`
 	DedicatedEgressLines          string    `json:"dedicated_egress_lines"`
+	Price                         float64   `json:"price"`
+	HasPrice                      bool      `json:"-"`
+	ProductID                     uint      `json:"product_id"`
+	IPTier                        string    `json:"ip_tier"`
+	IsTrial                       bool      `json:"is_trial"`
+	TrialCapBytes                 int64     `json:"trial_cap_bytes"`
+
+	countryCodes []string
 }
 
 type UpdateOrderInput struct {
@@ -77,21 +91,29 @@ type UpdateOrderInput struct {
 	DedicatedEgressLines           string    `json:"dedicated_egress_lines"`
 	DedicatedCredentialLines       string    `json:"dedicated_credential_lines"`
 	RegenerateDedicatedCredentials bool      `json:"regenerate_dedicated_credentials"`
+	Price                          *float64  `json:"price"`
 }
 
 type AllocationPreview struct {
-	PoolSize       int `json:"pool_size"`
-	UsedByCustomer int `json:"used_by_customer"`
-	Available      int `json:"available"`
+	PoolSize       int              `json:"pool_size"`
+	UsedByCustomer int              `json:"used_by_customer"`
+	CoolingDown    int              `json:"cooling_down"`
+	Reserved       int              `json:"reserved"`
+	AtCapacity     int              `json:"at_capacity"`
+	Available      int              `json:"available"`
+	FullIPs        []HostIPCapacity `json:"full_ips"`
 }
 
 type ListOrdersInput struct {
-	Page       int
-	PageSize   int
-	Keyword    string
-	Mode       string
-	Status     string
-	CustomerID uint
+	Page        int
+	PageSize    int
+	Keyword     string
+	Mode        string
+	Status      string
+	CustomerID  uint
+	Tags        []string
+	ExpiresFrom time.Time
+	ExpiresTo   time.Time
 }
 
 type OrderListStats struct {
@@ -232,7 +254,7 @@ func (s *OrderService) ListOrders(in ListOrdersInput) (ListOrdersResult, error)
 
 func (s *OrderService) GetOrder(orderID uint) (*model.Order, error) {
 	var order model.Order
-	err := s.db.Preload("Customer").Preload("DedicatedEntry").Preload("DedicatedInbound").Preload("DedicatedIngress").Preload("Items").Preload("Items.Resources").First(&order, orderID).Error
+	err := s.db.Preload("Customer").Preload("DedicatedEntry").Preload("DedicatedInbound").Preload("DedicatedIngress").Preload("Product").Preload("Items").Preload("Items.Resources").First(&order, orderID).Error
 	if err != nil {
 		return nil, err
 	}
@@ -281,11 +303,20 @@ func (s *OrderService) applyListOrdersFilters(db *gorm.DB, in ListOrdersInput) *
 	switch in.Status {
 	case model.OrderStatusActive, model.OrderStatusExpired, model.OrderStatusDisabled:
 		db = db.Where("orders.status = ?", in.Status)
+	case model.ExpiryStageGrace, model.ExpiryStageFinal:
+		db = db.Where("orders.status = ? and orders.expiry_stage = ?", model.OrderStatusActive, in.Status)
 	}
 	if in.Keyword != "" {
 		kw := orderListKeywordLike(in.Keyword)
 		db = db.Where(orderListKeywordFilterSQL(), keywordArgs(kw)...)
 	}
+	db = applyListOrdersTagFilter(db, in.Tags)
+	if !in.ExpiresFrom.IsZero() {
+		db = db.Where("orders.expires_at >= ?", in.ExpiresFrom)
+	}
+	if !in.ExpiresTo.IsZero() {
+		db = db.Where("orders.expires_at <= ?", in.ExpiresTo)
+	}
 	return db
 }
 
@@ -381,26 +412,43 @@ func keywordArgs(kw string) []interface{} {
 	return args
 }
 
-func (s *OrderService) AllocationPreview(customerID uint, excludeOrderID uint) (AllocationPreview, error) {
+func (s *OrderService) AllocationPreview(customerID uint, excludeOrderID uint, ipTier string) (AllocationPreview, error) {
 	if customerID == 0 {
 		return AllocationPreview{}, errors.New("customer_id is required")
 	}
-	pool, err := s.usableIPPool()
+	tier, err := normalizeOrderIPTier(ipTier)
 	if err != nil {
 		return AllocationPreview{}, err
 	}
+	all, err := s.usableIPPool()
+	if err != nil {
+		return AllocationPreview{}, err
+	}
+	if match := hostIPTierMatcher(tier); match != nil {
+		matched := make([]model.HostIP, 0, len(all))
+		for _, ip := range all {
+			if match(ip) {
+				matched = append(matched, ip)
+			}
+		}
+		all = matched
+	}
 	usedByCustomer, err := s.customerUsedIPSet(customerID, excludeOrderID)
 	if err != nil {
 		return AllocationPreview{}, err
 	}
-	available := len(pool) - len(usedByCustomer)
-	if available < 0 {
-		available = 0
+	pool, err := s.classifyHostIPPool(customerID, excludeOrderID, all, usedByCustomer, time.Now(), nil)
+	if err != nil {
+		return AllocationPreview{}, err
 	}
 	return AllocationPreview{
-		PoolSize:       len(pool),
-		UsedByCustomer: len(usedByCustomer),
-		Available:      available,
+		PoolSize:       len(all),
+		UsedByCustomer: pool.used,
+		CoolingDown:    pool.cooling,
+		Reserved:       pool.reserved,
+		AtCapacity:     len(pool.full),
+		Available:      len(pool.candidates) + len(pool.returned),
+		FullIPs:        pool.full,
 	}, nil
 }
 
@@ -409,10 +457,18 @@ func (s *OrderService) UpdateOrder(ctx context.Context, orderID uint, in UpdateO
 	if err := s.db.Preload("Items").Preload("DedicatedEntry").Preload("DedicatedInbound").Preload("DedicatedIngress").First(&order, orderID).Error; err != nil {
 		return nil, err
 	}
+	if in.Price != nil && *in.Price < 0 {
+		return nil, errors.New("price must be >= 0")
+	}
+	historyRoot := orderHistoryRoot(order)
+	if err := s.ensureOrderBaseline(historyRoot); err != nil {
+		return nil, err
+	}
 	if order.IsGroupHead {
 		if err := s.updateOrderGroup(ctx, order, in); err != nil {
 			return nil, err
 		}
+		s.recordOrderVersion(historyRoot, OrderVersionSourceUpdate)
 		updated, err := s.GetOrder(order.ID)
 		if err != nil {
 			return nil, err
@@ -522,9 +578,12 @@ func (s *OrderService) UpdateOrder(ctx context.Context, orderID uint, in UpdateO
 	}
 
 	now := time.Now()
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
+	// An overdue order in its grace stage stays up until the scheduler cuts it
+	// off.
+	inGrace := order.ExpiryStage != "" && !targetExpiresAt.After(now)
+	if err := s.versionedTx(ctx, order.ID, func(tx *gorm.DB) error {
 		if order.Mode == model.OrderModeForward {
-			if err := s.syncForwardOrderItemsTx(tx, order, targetForwardOutboundIDs, targetPort, targetExpiresAt, now); err != nil {
+			if err := s.syncForwardOrderItemsTx(ctx, tx, order, targetForwardOutboundIDs, targetPort, targetExpiresAt, now); err != nil {
 				return err
 			}
 		} else {
@@ -557,7 +616,11 @@ func (s *OrderService) UpdateOrder(ctx context.Context, orderID uint, in UpdateO
 				if ipMode != model.OrderModeAuto && ipMode != model.OrderModeManual {
 					ipMode = model.OrderModeAuto
 				}
-				selectedIPs, err := s.allocateIPs(order.CustomerID, diff, ipMode, manualIDs, order.ID)
+				match, err := s.orderHostIPMatcher(order)
+				if err != nil {
+					return err
+				}
+				selectedIPs, err := s.allocateIPsMatching(order.CustomerID, diff, ipMode, manualIDs, order.ID, match)
 				if err != nil {
 					return err
 				}
@@ -626,7 +689,7 @@ func (s *OrderService) UpdateOrder(ctx context.Context, orderID uint, in UpdateO
 		}
 
 		orderStatus := model.OrderStatusActive
-		if !targetExpiresAt.After(now) {
+		if !targetExpiresAt.After(now) && !inGrace {
 			orderStatus = model.OrderStatusExpired
 		}
 		if order.Mode == model.OrderModeDedicated && strings.TrimSpace(in.DedicatedEgressLines) != "" {
@@ -640,14 +703,18 @@ func (s *OrderService) UpdateOrder(ctx context.Context, orderID uint, in UpdateO
 			}
 		}
 		orderUpdates := map[string]interface{}{
-			"name":                targetName,
-			"quantity":            targetQuantity,
-			"port":                targetPort,
-			"expires_at":          targetExpiresAt,
-			"status":              orderStatus,
-			"notify_one_day_sent": false,
-			"notify_expired_sent": false,
-			"updated_at":          now,
+			"name":       targetName,
+			"quantity":   targetQuantity,
+			"port":       targetPort,
+			"expires_at": targetExpiresAt,
+			"status":     orderStatus,
+			"updated_at": now,
+		}
+		if in.Price != nil {
+			orderUpdates["price"] = *in.Price
+		}
+		if !inGrace {
+			orderUpdates["expiry_stage"] = ""
 		}
 		if order.Mode == model.OrderModeDedicated {
 			orderUpdates["dedicated_protocol"] = targetDedicatedProtocol
@@ -666,7 +733,7 @@ func (s *OrderService) UpdateOrder(ctx context.Context, orderID uint, in UpdateO
 		return nil, err
 	}
 
-	if !targetExpiresAt.After(now) {
+	if !targetExpiresAt.After(now) && !inGrace {
 		if err := s.DeactivateOrder(ctx, order.ID, model.OrderStatusExpired); err != nil {
 			return nil, err
 		}
@@ -675,6 +742,7 @@ func (s *OrderService) UpdateOrder(ctx context.Context, orderID uint, in UpdateO
 			s.log.Warn("sync runtime after update failed", zap.Error(err), zap.Uint("order_id", order.ID))
 		}
 	}
+	s.recordOrderVersion(historyRoot, OrderVersionSourceUpdate)
 
 	updated, err := s.GetOrder(order.ID)
 	if err != nil {
@@ -687,8 +755,20 @@ func (s *OrderService) CreateOrder(ctx context.Context, in CreateOrderInput) (*m
 	if in.CustomerID == 0 {
 		return nil, errors.New("customer_id is required")
 	}
+	if err := s.ensureCustomerNotSuspended(in.CustomerID); err != nil {
+		return nil, err
+	}
+	if in.ProductID > 0 {
+		var err error
+		if in, err = s.applyProductToCreateInput(in); err != nil {
+			return nil, err
+		}
+	}
 	if in.DurationDay <= 0 && in.ExpiresAt.IsZero() {
 		in.DurationDay = 30
+		if days := loadTrialPolicy(s.db).maxDays; in.IsTrial && days > 0 {
+			in.DurationDay = days
+		}
 	}
 	if in.Mode == "" {
 		in.Mode = model.OrderModeAuto
@@ -699,6 +779,14 @@ func (s *OrderService) CreateOrder(ctx context.Context, in CreateOrderInput) (*m
 	if in.Mode == model.OrderModeForward {
 		return nil, errors.New("forward mode is deprecated, use auto/manual for residential orders")
 	}
+	if in.Price < 0 {
+		return nil, errors.New("price must be >= 0")
+	}
+	ipTier, err := normalizeOrderIPTier(in.IPTier)
+	if err != nil {
+		return nil, err
+	}
+	in.IPTier = ipTier
 
 	now := time.Now()
 	expiresAt := now.Add(time.Duration(in.DurationDay) * 24 * time.Hour)
@@ -708,6 +796,18 @@ func (s *OrderService) CreateOrder(ctx context.Context, in CreateOrderInput) (*m
 		}
 		expiresAt = in.ExpiresAt
 	}
+	if in.IsTrial {
+		if in.TrialCapBytes < 0 {
+			return nil, errors.New("trial_cap_bytes must be >= 0")
+		}
+		if err := s.ensureTrialAllowed(in.CustomerID, now, expiresAt); err != nil {
+			return nil, err
+		}
+		// Trials are free; converting one to paid sets the price.
+		in.Price = 0
+	} else {
+		in.TrialCapBytes = 0
+	}
 
 	if in.Mode == model.OrderModeDedicated {
 		return s.createDedicatedOrder(ctx, in, now, expiresAt)
@@ -747,7 +847,7 @@ func (s *OrderService) CreateOrder(ctx context.Context, in CreateOrderInput) (*m
 	if in.Mode == model.OrderModeForward {
 		ipMode = model.OrderModeAuto
 	}
-	selectedIPs, err := s.allocateIPs(in.CustomerID, in.Quantity, ipMode, in.ManualIPIDs, 0)
+	selectedIPs, err := s.allocateIPsMatching(in.CustomerID, in.Quantity, ipMode, in.ManualIPIDs, 0, combineHostIPMatchers(hostIPCountryMatcher(in.countryCodes), hostIPTierMatcher(in.IPTier)))
 	if err != nil {
 		return nil, err
 	}
@@ -763,14 +863,19 @@ func (s *OrderService) CreateOrder(ctx context.Context, in CreateOrderInput) (*m
 		}
 	}
 	order := &model.Order{
-		CustomerID: in.CustomerID,
-		Name:       in.Name,
-		Mode:       in.Mode,
-		Status:     model.OrderStatusActive,
-		Quantity:   in.Quantity,
-		Port:       port,
-		StartsAt:   now,
-		ExpiresAt:  expiresAt,
+		CustomerID:    in.CustomerID,
+		Name:          in.Name,
+		Mode:          in.Mode,
+		Status:        model.OrderStatusActive,
+		Quantity:      in.Quantity,
+		Port:          port,
+		StartsAt:      now,
+		ExpiresAt:     expiresAt,
+		Price:         in.Price,
+		ProductID:     uintPtrOrNil(in.ProductID),
+		IPTier:        in.IPTier,
+		IsTrial:       in.IsTrial,
+		TrialCapBytes: in.TrialCapBytes,
 	}
 	if strings.TrimSpace(order.Name) == "" {
 		prefix := s.residentialNamePrefix()
@@ -795,6 +900,12 @@ func (s *OrderService) CreateOrder(ctx context.Context, in CreateOrderInput) (*m
 			return err
 		}
 		order.OrderNo = orderNo
+		if err := recordOrderChargeTx(tx, *order, order.Price, now, expiresAt, LedgerSourceCreate); err != nil {
+			return err
+		}
+		if err := countTrialTx(tx, *order); err != nil {
+			return err
+		}
 		for i, ip := range selectedIPs {
 			username := ""
 			password := randomString(12)
@@ -827,7 +938,7 @@ func (s *OrderService) CreateOrder(ctx context.Context, in CreateOrderInput) (*m
 					return userErr
 				}
 				item.Username = user
-				item.OutboundType = model.OutboundTypeSocks5
+				item.OutboundType = forwardOutboundTypeOf(outbound)
 				item.SocksOutboundID = &outbound.ID
 				item.ForwardAddress = outbound.Address
 				item.ForwardPort = outbound.Port
@@ -879,9 +990,13 @@ func (s *OrderService) DeactivateOrder(ctx context.Context, orderID uint, status
 	}
 	if order.Mode == model.OrderModeDedicated || order.ParentOrderID != nil {
 		if err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := bumpOrderVersionTx(tx, orderID); err != nil {
+				return err
+			}
 			if err := tx.Model(&model.Order{}).Where("id = ?", orderID).Updates(map[string]interface{}{
-				"status":     status,
-				"updated_at": time.Now(),
+				"status":       status,
+				"expiry_stage": "",
+				"updated_at":   time.Now(),
 			}).Error; err != nil {
 				return err
 			}
@@ -895,9 +1010,13 @@ func (s *OrderService) DeactivateOrder(ctx context.Context, orderID uint, status
 		return s.rebuildManagedRuntime(ctx)
 	}
 	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := bumpOrderVersionTx(tx, orderID); err != nil {
+			return err
+		}
 		if err := tx.Model(&model.Order{}).Where("id = ?", orderID).Updates(map[string]interface{}{
-			"status":     status,
-			"updated_at": time.Now(),
+			"status":       status,
+			"expiry_stage": "",
+			"updated_at":   time.Now(),
 		}).Error; err != nil {
 			return err
 		}
@@ -920,6 +1039,9 @@ func (s *OrderService) ActivateOrder(ctx context.Context, orderID uint) error {
 	if order.Status == model.OrderStatusActive {
 		return nil
 	}
+	if err := s.ensureCustomerNotSuspended(order.CustomerID); err != nil {
+		return err
+	}
 	if order.Status != model.OrderStatusDisabled {
 		return fmt.Errorf("only disabled order can be activated, current status: %s", order.Status)
 	}
@@ -937,11 +1059,12 @@ func (s *OrderService) ActivateOrder(ctx context.Context, orderID uint) error {
 			return errors.New("group contains expired child orders, please renew first")
 		}
 		if err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := bumpOrderVersionTx(tx, order.ID); err != nil {
+				return err
+			}
 			if err := tx.Model(&model.Order{}).Where("id = ? or parent_order_id = ?", order.ID, order.ID).Updates(map[string]interface{}{
-				"status":              model.OrderStatusActive,
-				"notify_one_day_sent": false,
-				"notify_expired_sent": false,
-				"updated_at":          now,
+				"status":     model.OrderStatusActive,
+				"updated_at": now,
 			}).Error; err != nil {
 				return err
 			}
@@ -956,11 +1079,12 @@ func (s *OrderService) ActivateOrder(ctx context.Context, orderID uint) error {
 	}
 
 	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := bumpOrderVersionTx(tx, order.ID); err != nil {
+			return err
+		}
 		if err := tx.Model(&model.Order{}).Where("id = ?", orderID).Updates(map[string]interface{}{
-			"status":              model.OrderStatusActive,
-			"notify_one_day_sent": false,
-			"notify_expired_sent": false,
-			"updated_at":          now,
+			"status":     model.OrderStatusActive,
+			"updated_at": now,
 		}).Error; err != nil {
 			return err
 		}
@@ -1009,37 +1133,62 @@ func (s *OrderService) RenewOrder(ctx context.Context, orderID uint, moreDays in
 }
 
 func (s *OrderService) RenewOrderWithExpiresAt(ctx context.Context, orderID uint, moreDays int, expiresAt time.Time) error {
+	return s.renewOrder(ctx, orderID, moreDays, expiresAt, LedgerSourceRenew)
+}
+
+func (s *OrderService) renewOrder(ctx context.Context, orderID uint, moreDays int, expiresAt time.Time, source string) error {
 	if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
 		return errors.New("expires_at must be in the future")
 	}
-	if moreDays <= 0 {
-		moreDays = 30
-	}
 	var order model.Order
 	if err := s.db.First(&order, orderID).Error; err != nil {
 		return err
 	}
+	if order.IsTrial {
+		return errors.New("trial orders are converted to paid, not renewed")
+	}
+	if err := s.ensureCustomerNotSuspended(order.CustomerID); err != nil {
+		return err
+	}
+	return s.renewLoadedOrder(ctx, order, moreDays, expiresAt, source)
+}
+
+// renewLoadedOrder renews an order its caller has already loaded and checked,
+// charging order.Price as given.
+func (s *OrderService) renewLoadedOrder(ctx context.Context, order model.Order, moreDays int, expiresAt time.Time, source string) error {
+	if moreDays <= 0 {
+		moreDays = 30
+	}
 	if order.IsGroupHead {
-		return s.renewOrderGroup(ctx, order, moreDays, expiresAt)
+		return s.renewOrderGroup(ctx, order, moreDays, expiresAt, source)
 	}
+	orderID := order.ID
 	newExpires := expiresAt
 	if newExpires.IsZero() {
-		base := order.ExpiresAt
-		if base.Before(time.Now()) {
-			base = time.Now()
-		}
-		newExpires = base.Add(time.Duration(moreDays) * 24 * time.Hour)
-	}
-	if err := s.db.Model(&model.Order{}).Where("id = ?", orderID).Updates(map[string]interface{}{
-		"status":              model.OrderStatusActive,
-		"expires_at":          newExpires,
-		"notify_one_day_sent": false,
-		"notify_expired_sent": false,
-		"updated_at":          time.Now(),
-	}).Error; err != nil {
-		return err
+		newExpires = renewBase(order, time.Now()).Add(time.Duration(moreDays) * 24 * time.Hour)
 	}
-	if err := s.db.Model(&model.OrderItem{}).Where("order_id = ?", orderID).Update("status", model.OrderItemStatusActive).Error; err != nil {
+	now := time.Now()
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := bumpOrderVersionTx(tx, orderID); err != nil {
+			return err
+		}
+		if err := tx.Model(&model.Order{}).Where("id = ?", orderID).Updates(map[string]interface{}{
+			"status":              model.OrderStatusActive,
+			"expires_at":          newExpires,
+			"expiry_stage":        "",
+			"notify_balance_sent": false,
+			"updated_at":          now,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&model.OrderItem{}).Where("order_id = ?", orderID).Update("status", model.OrderItemStatusActive).Error; err != nil {
+			return err
+		}
+		if err := recordOrderChargeTx(tx, order, order.Price, renewBase(order, now), newExpires, source); err != nil {
+			return err
+		}
+		return runRenewalTxHook(ctx, tx)
+	}); err != nil {
 		return err
 	}
 	return s.SyncOrderRuntime(ctx, orderID)
@@ -1142,7 +1291,7 @@ func (s *OrderService) CopyOrderLinkLines(orderID uint) (string, error) {
 
 func (s *OrderService) ExportOrderLinesWithMeta(orderID uint, opts ExportOrderOptions) (string, string, error) {
 	var order model.Order
-	if err := s.db.Preload("Customer").Preload("DedicatedEntry").Preload("DedicatedInbound").Preload("DedicatedIngress").First(&order, orderID).Error; err != nil {
+	if err := s.db.Preload("Customer").Preload("DedicatedEntry").Preload("DedicatedInbound").Preload("DedicatedIngress").Preload("Product").First(&order, orderID).Error; err != nil {
 		return "", "", err
 	}
 	ctx, err := s.loadDedicatedExportContext(order)
@@ -1293,10 +1442,9 @@ func (s *OrderService) TestOrderSampled(orderID uint, samplePercent int) (map[ui
 			out[item.ID] = "failed"
 			continue
 		}
-		body := make([]byte, 128)
-		n, _ := resp.Body.Read(body)
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 128))
 		_ = resp.Body.Close()
-		out[item.ID] = strings.TrimSpace(string(body[:n]))
+		out[item.ID] = strings.TrimSpace(string(body))
 	}
 	return out, nil
 }
@@ -1352,11 +1500,10 @@ func (s *OrderService) TestOrderStream(orderID uint, samplePercent int, emit fun
 			}
 			continue
 		}
-		body := make([]byte, 128)
-		n, _ := resp.Body.Read(body)
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 128))
 		_ = resp.Body.Close()
 		event.Status = "ok"
-		event.Detail = strings.TrimSpace(string(body[:n]))
+		event.Detail = strings.TrimSpace(string(body))
 		ok++
 		if err := emit(event); err != nil {
 			return err
@@ -1419,6 +1566,9 @@ func (s *OrderService) ImportOrder(ctx context.Context, customerID uint, orderNa
 	if customerID == 0 {
 		return nil, errors.New("customer_id required")
 	}
+	if err := s.ensureCustomerNotSuspended(customerID); err != nil {
+		return nil, err
+	}
 	rows, err := s.applyImportRowValidation(rows)
 	if err != nil {
 		return nil, err
@@ -1432,6 +1582,13 @@ func (s *OrderService) ImportOrder(ctx context.Context, customerID uint, orderNa
 	if len(validRows) == 0 {
 		return nil, errors.New("no valid rows, please fix preview errors")
 	}
+	itemsByIP := map[string]int{}
+	for _, row := range validRows {
+		itemsByIP[row.IP]++
+	}
+	if err := s.ensureHostIPCapacity(customerID, 0, itemsByIP); err != nil {
+		return nil, err
+	}
 	if orderName == "" {
 		orderName = fmt.Sprintf("Imported-%s", time.Now().Format("20060102150405"))
 	}
@@ -1506,6 +1663,10 @@ func (s *OrderService) ImportOrder(ctx context.Context, customerID uint, orderNa
 }
 
 func (s *OrderService) allocateIPs(customerID uint, quantity int, mode string, manualIDs []uint, excludeOrderID uint) ([]model.HostIP, error) {
+	return s.allocateIPsMatching(customerID, quantity, mode, manualIDs, excludeOrderID, nil)
+}
+
+func (s *OrderService) allocateIPsMatching(customerID uint, quantity int, mode string, manualIDs []uint, excludeOrderID uint, match func(model.HostIP) bool) ([]model.HostIP, error) {
 	if mode == model.OrderModeManual {
 		if len(manualIDs) < quantity {
 			return nil, errors.New("manual_ip_ids insufficient")
@@ -1522,10 +1683,29 @@ func (s *OrderService) allocateIPs(customerID uint, quantity int, mode string, m
 		if err != nil {
 			return nil, err
 		}
+		reserved, err := loadReservedResources(s.db, customerID, time.Now())
+		if err != nil {
+			return nil, err
+		}
 		for _, row := range rows {
 			if _, exists := usedByCustomer[row.IP]; exists {
 				return nil, fmt.Errorf("ip %s already used by current customer", row.IP)
 			}
+			if _, held := reserved.hostIPs[row.ID]; held {
+				return nil, fmt.Errorf("ip %s is reserved for another customer", row.IP)
+			}
+			if match != nil && !match(row) {
+				return nil, fmt.Errorf("ip %s is outside the allowed countries or ip tier", row.IP)
+			}
+		}
+		checker, err := s.loadHostIPCapacityChecker(excludeOrderID)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			if reason := checker.reason(row, customerID, 1); reason != "" {
+				return nil, fmt.Errorf("ip %s is at capacity (%s)", row.IP, reason)
+			}
 		}
 		return rows, nil
 	}
@@ -1537,6 +1717,18 @@ func (s *OrderService) allocateIPs(customerID uint, quantity int, mode string, m
 	if len(all) == 0 {
 		return nil, errors.New("no enabled public host ips")
 	}
+	if match != nil {
+		matched := make([]model.HostIP, 0, len(all))
+		for _, ip := range all {
+			if match(ip) {
+				matched = append(matched, ip)
+			}
+		}
+		if len(matched) == 0 {
+			return nil, errors.New("no host ips in the allowed countries or ip tier")
+		}
+		all = matched
+	}
 
 	usedByCustomer, err := s.customerUsedIPSet(customerID, excludeOrderID)
 	if err != nil {
@@ -1552,7 +1744,7 @@ func (s *OrderService) allocateIPs(customerID uint, quantity int, mode string, m
 	if err := s.db.Table("order_items oi").
 		Select("oi.ip as ip, count(1) as count").
 		Joins("join orders o on o.id = oi.order_id").
-		Where("o.status = ? and o.expires_at > ? and oi.status = ?", model.OrderStatusActive, time.Now(), model.OrderItemStatusActive).
+		Where("o.status = ? and (o.expires_at > ? or o.expiry_stage <> '') and oi.status = ?", model.OrderStatusActive, time.Now(), model.OrderItemStatusActive).
 		Group("oi.ip").Scan(&usageRows).Error; err != nil {
 		return nil, err
 	}
@@ -1560,16 +1752,16 @@ func (s *OrderService) allocateIPs(customerID uint, quantity int, mode string, m
 		usage[u.IP] = u.Count
 	}
 
-	candidates := make([]model.HostIP, 0, len(all))
-	for _, ip := range all {
-		if _, exists := usedByCustomer[ip.IP]; exists {
-			continue
-		}
-		candidates = append(candidates, ip)
+	pool, err := s.classifyHostIPPool(customerID, excludeOrderID, all, usedByCustomer, time.Now(), nil)
+	if err != nil {
+		return nil, err
 	}
-
-	if len(candidates) < quantity {
-		return nil, fmt.Errorf("available IPs (%d) less than quantity (%d)", len(candidates), quantity)
+	candidates, returned, reuse := pool.candidates, pool.returned, pool.reuse
+	if available := len(candidates) + len(returned); available < quantity {
+		if len(pool.full) > 0 {
+			return nil, fmt.Errorf("available IPs (%d) less than quantity (%d), %d ips at capacity", available, quantity, len(pool.full))
+		}
+		return nil, fmt.Errorf("available IPs (%d) less than quantity (%d)", available, quantity)
 	}
 
 	buckets := map[int64][]model.HostIP{}
@@ -1600,7 +1792,15 @@ func (s *OrderService) allocateIPs(customerID uint, quantity int, mode string, m
 		if take > len(bucket) {
 			take = len(bucket)
 		}
-		selected = append(selected, scatteredPick(bucket, take, seed+int(level)*11)...)
+		selected = append(selected, rankHostIPCandidates(bucket, reuse, take, seed+int(level)*11)...)
+	}
+	// IPs this customer handed back earlier are only a last resort.
+	sortByIdle(returned, reuse)
+	for _, ip := range returned {
+		if len(selected) >= quantity {
+			break
+		}
+		selected = append(selected, ip)
 	}
 	if len(selected) < quantity {
 		return nil, fmt.Errorf("available IPs (%d) less than quantity (%d)", len(selected), quantity)
@@ -1629,9 +1829,9 @@ func (s *OrderService) customerUsedIPSet(customerID uint, excludeOrderID uint) (
 	q := s.db.Table("order_items oi").
 		Select("oi.ip").
 		Joins("join orders o on o.id = oi.order_id").
-		Where("o.customer_id = ? and o.status = ? and o.expires_at > ? and oi.status = ?", customerID, model.OrderStatusActive, time.Now(), model.OrderItemStatusActive)
+		Where("o.customer_id = ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '') and oi.status = ?", customerID, model.OrderStatusActive, time.Now(), model.OrderItemStatusActive)
 	if excludeOrderID > 0 {
-		q = q.Where("o.id <> ?", excludeOrderID)
+		q = q.Where("o.id <> ? and (o.parent_order_id is null or o.parent_order_id <> ?)", excludeOrderID, excludeOrderID)
 	}
 	if err := q.Scan(&ips).Error; err != nil {
 		return nil, err
@@ -1686,12 +1886,24 @@ func buildOrderNo(ts time.Time, id uint) string {
 }
 
 func exportSKUForOrder(order model.Order) string {
+	if sku := productSKU(order); sku != "" {
+		return sku
+	}
 	if strings.EqualFold(strings.TrimSpace(order.Mode), model.OrderModeDedicated) {
 		return exportProtocolLabel(order.DedicatedProtocol)
 	}
 	return "Home"
 }
 
+// productSKU is the catalog label for orders created from a product; it
+// needs the Product association preloaded.
+func productSKU(order model.Order) string {
+	if order.Product == nil {
+		return ""
+	}
+	return strings.TrimSpace(order.Product.SKU)
+}
+
 func buildResidentialTXTLine(item model.OrderItem, layout string) string {
 	return buildSocks5TXTLine(strings.TrimSpace(item.IP), item.Port, strings.TrimSpace(item.Username), strings.TrimSpace(item.Password), layout)
 }
@@ -1887,7 +2099,7 @@ func (s *OrderService) ensurePortReadyForManaged(port int) error {
 	var count int64
 	if err := s.db.Table("order_items oi").
 		Joins("join orders o on o.id = oi.order_id").
-		Where("oi.port = ? and oi.managed = 1 and oi.status = ? and o.status = ? and o.expires_at > ?", port, model.OrderItemStatusActive, model.OrderStatusActive, time.Now()).
+		Where("oi.port = ? and oi.managed = 1 and oi.status = ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '')", port, model.OrderItemStatusActive, model.OrderStatusActive, time.Now()).
 		Count(&count).Error; err != nil {
 		return err
 	}
@@ -2007,7 +2219,7 @@ func (s *OrderService) loadForwardOutboundsByIDsTx(tx *gorm.DB, ids []uint, enab
 	return ordered, nil
 }
 
-func (s *OrderService) syncForwardOrderItemsTx(tx *gorm.DB, order model.Order, targetOutboundIDs []uint, targetPort int, targetExpiresAt time.Time, now time.Time) error {
+func (s *OrderService) syncForwardOrderItemsTx(ctx context.Context, tx *gorm.DB, order model.Order, targetOutboundIDs []uint, targetPort int, targetExpiresAt time.Time, now time.Time) error {
 	targetOutboundIDs = uniqueUintIDs(targetOutboundIDs)
 	outbounds, err := s.loadForwardOutboundsByIDsTx(tx, targetOutboundIDs, true)
 	if err != nil {
@@ -2023,7 +2235,7 @@ func (s *OrderService) syncForwardOrderItemsTx(tx *gorm.DB, order model.Order, t
 	keepByOutbound := map[uint]model.OrderItem{}
 	removeIDs := make([]uint, 0)
 	for _, item := range order.Items {
-		if item.SocksOutboundID == nil || *item.SocksOutboundID == 0 || !strings.EqualFold(strings.TrimSpace(item.OutboundType), model.OutboundTypeSocks5) {
+		if item.SocksOutboundID == nil || *item.SocksOutboundID == 0 || !isForwardOutboundType(item.OutboundType) {
 			removeIDs = append(removeIDs, item.ID)
 			continue
 		}
@@ -2060,6 +2272,20 @@ func (s *OrderService) syncForwardOrderItemsTx(tx *gorm.DB, order model.Order, t
 	}
 
 	if len(addOutboundIDs) > 0 {
+		reserved, err := loadReservedResources(tx, order.CustomerID, now)
+		if err != nil {
+			return err
+		}
+		adding := make([]model.SocksOutbound, 0, len(addOutboundIDs))
+		for _, outboundID := range addOutboundIDs {
+			if _, held := reserved.outbounds[outboundID]; held {
+				return fmt.Errorf("forward upstream %s is reserved for another customer", forwardOutboundLabel(outboundByID[outboundID]))
+			}
+			adding = append(adding, outboundByID[outboundID])
+		}
+		if err := s.ensureForwardCapacityTx(ctx, tx, order, adding); err != nil {
+			return err
+		}
 		ips, err := s.allocateIPs(order.CustomerID, len(addOutboundIDs), model.OrderModeAuto, nil, order.ID)
 		if err != nil {
 			return err
@@ -2078,7 +2304,7 @@ func (s *OrderService) syncForwardOrderItemsTx(tx *gorm.DB, order model.Order, t
 				Username:        user,
 				Password:        randomString(12),
 				SocksOutboundID: &outbound.ID,
-				OutboundType:    model.OutboundTypeSocks5,
+				OutboundType:    forwardOutboundTypeOf(outbound),
 				ForwardAddress:  outbound.Address,
 				ForwardPort:     outbound.Port,
 				ForwardUsername: outbound.Username,
@@ -2114,7 +2340,7 @@ func (s *OrderService) syncForwardOrderItemsTx(tx *gorm.DB, order model.Order, t
 			"port":              targetPort,
 			"username":          user,
 			"socks_outbound_id": outbound.ID,
-			"outbound_type":     model.OutboundTypeSocks5,
+			"outbound_type":     forwardOutboundTypeOf(outbound),
 			"forward_address":   outbound.Address,
 			"forward_port":      outbound.Port,
 			"forward_username":  outbound.Username,
@@ -2150,16 +2376,13 @@ func (s *OrderService) ForwardOutboundReuseWarnings(customerID uint, excludeOrde
 		Select("oi.socks_outbound_id as outbound_id, so.address as address, so.port as port, so.route_user as route_user, count(1) as count").
 		Joins("join orders o on o.id = oi.order_id").
 		Joins("join socks_outbounds so on so.id = oi.socks_outbound_id").
-		Where("o.customer_id = ? and o.status = ? and o.expires_at > ? and oi.status = ? and oi.socks_outbound_id in ?", customerID, model.OrderStatusActive, time.Now(), model.OrderItemStatusActive, outboundIDs)
+		Where("o.customer_id = ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '') and oi.status = ? and oi.socks_outbound_id in ?", customerID, model.OrderStatusActive, time.Now(), model.OrderItemStatusActive, outboundIDs)
 	if excludeOrderID > 0 {
 		q = q.Where("o.id <> ?", excludeOrderID)
 	}
 	if err := q.Group("oi.socks_outbound_id, so.address, so.port, so.route_user").Scan(&rows).Error; err != nil {
 		return nil, err
 	}
-	if len(rows) == 0 {
-		return []string{}, nil
-	}
 	warnings := make([]string, 0, len(rows))
 	for _, row := range rows {
 		user := strings.TrimSpace(row.RouteUser)
@@ -2168,16 +2391,30 @@ func (s *OrderService) ForwardOutboundReuseWarnings(customerID uint, excludeOrde
 		}
 		warnings = append(warnings, fmt.Sprintf("SOCKS5出口 %s:%d (%s) 已在该客户其他活动订单复用 %d 次", row.Address, row.Port, user, row.Count))
 	}
+	capacity, err := s.forwardCapacityWarnings(customerID, excludeOrderID, outboundIDs)
+	if err != nil {
+		return nil, err
+	}
+	warnings = append(warnings, capacity...)
 	sort.Strings(warnings)
 	return warnings, nil
 }
 
-func (s *OrderService) allocateForwardOutbounds(customerID uint, quantity int, excludeOrderID uint) ([]model.SocksOutbound, error) {
-	all := []model.SocksOutbound{}
-	if err := s.db.Where("enabled = 1").Order("id asc").Find(&all).Error; err != nil {
+func (s *OrderService) allocateForwardOutbounds(ctx context.Context, customerID uint, quantity int, excludeOrderID uint, match func(model.SocksOutbound) bool) ([]model.SocksOutbound, error) {
+	enabled := []model.SocksOutbound{}
+	if err := s.db.Where("enabled = 1").Order("id asc").Find(&enabled).Error; err != nil {
 		return nil, err
 	}
+	all := make([]model.SocksOutbound, 0, len(enabled))
+	for _, outbound := range enabled {
+		if match == nil || match(outbound) {
+			all = append(all, outbound)
+		}
+	}
 	if len(all) == 0 {
+		if match != nil && len(enabled) > 0 {
+			return nil, errors.New("no matching socks outbounds")
+		}
 		return nil, errors.New("no enabled socks outbounds")
 	}
 
@@ -2185,26 +2422,38 @@ func (s *OrderService) allocateForwardOutbounds(customerID uint, quantity int, e
 	if err != nil {
 		return nil, err
 	}
+	reserved, err := loadReservedResources(s.db, customerID, time.Now())
+	if err != nil {
+		return nil, err
+	}
 
-	usage := map[uint]int64{}
-	usageRows := []struct {
-		OutboundID uint
-		Count      int64
-	}{}
-	if err := s.db.Table("order_items oi").
-		Select("oi.socks_outbound_id as outbound_id, count(1) as count").
-		Joins("join orders o on o.id = oi.order_id").
-		Where("oi.socks_outbound_id is not null and oi.status = ? and o.status = ? and o.expires_at > ?", model.OrderItemStatusActive, model.OrderStatusActive, time.Now()).
-		Group("oi.socks_outbound_id").Scan(&usageRows).Error; err != nil {
+	loads, err := forwardOutboundLoadsTx(s.db, nil, 0)
+	if err != nil {
 		return nil, err
 	}
-	for _, row := range usageRows {
-		usage[row.OutboundID] = row.Count
+	usage := map[uint]int64{}
+	for outboundID, load := range loads {
+		usage[outboundID] = load.Items
+	}
+	// Usage excludes nothing so the order being re-homed still counts
+	// towards the spread, but capacity is judged without it.
+	if excludeOrderID > 0 {
+		if loads, err = forwardOutboundLoadsTx(s.db, nil, excludeOrderID); err != nil {
+			return nil, err
+		}
 	}
 
 	preferred := make([]model.SocksOutbound, 0, len(all))
 	fallback := make([]model.SocksOutbound, 0, len(all))
+	overflow := make([]model.SocksOutbound, 0)
 	for _, outbound := range all {
+		if _, held := reserved.outbounds[outbound.ID]; held {
+			continue
+		}
+		if forwardCapacityShortfall(outbound, loads[outbound.ID], customerID, 1) != "" {
+			overflow = append(overflow, outbound)
+			continue
+		}
 		if _, exists := usedByCustomer[outbound.ID]; exists {
 			fallback = append(fallback, outbound)
 			continue
@@ -2212,12 +2461,25 @@ func (s *OrderService) allocateForwardOutbounds(customerID uint, quantity int, e
 		preferred = append(preferred, outbound)
 	}
 
+	rankByBenchmark := benchmarkRankingEnabled(s.db)
 	selected := make([]model.SocksOutbound, 0, quantity)
 	seed := int(customerID*163 + excludeOrderID*13 + uint(quantity)*19)
-	selected = append(selected, selectDispersedOutbounds(preferred, usage, quantity, seed)...)
+	selected = append(selected, selectDispersedOutbounds(preferred, usage, quantity, seed, rankByBenchmark)...)
 	if len(selected) < quantity {
 		need := quantity - len(selected)
-		selected = append(selected, selectDispersedOutbounds(fallback, usage, need, seed+97)...)
+		selected = append(selected, selectDispersedOutbounds(fallback, usage, need, seed+97, rankByBenchmark)...)
+	}
+	if len(selected) < quantity && len(overflow) > 0 {
+		if forwardCapacityPolicy(s.db) != ForwardCapacityPolicyWarn {
+			return nil, fmt.Errorf("forward upstream pool exhausted: %d with free capacity, need %d", len(selected), quantity)
+		}
+		need := quantity - len(selected)
+		extra := selectDispersedOutbounds(overflow, usage, need, seed+193, rankByBenchmark)
+		for _, outbound := range extra {
+			s.log.Warn("forward upstream over capacity", zap.Uint("customer_id", customerID), zap.String("upstream", forwardOutboundLabel(outbound)))
+			noteCapacityWarning(ctx, outbound, forwardCapacityShortfall(outbound, loads[outbound.ID], customerID, 1))
+		}
+		selected = append(selected, extra...)
 	}
 	if len(selected) < quantity {
 		return nil, fmt.Errorf("available outbounds (%d) less than quantity (%d)", len(selected), quantity)
@@ -2225,7 +2487,10 @@ func (s *OrderService) allocateForwardOutbounds(customerID uint, quantity int, e
 	return selected[:quantity], nil
 }
 
-func selectDispersedOutbounds(candidates []model.SocksOutbound, usage map[uint]int64, quantity int, seed int) []model.SocksOutbound {
+// selectDispersedOutbounds spreads picks over the least used outbounds. With
+// rankByBenchmark the fastest benchmarked outbounds of each usage level win
+// instead of a scattered pick.
+func selectDispersedOutbounds(candidates []model.SocksOutbound, usage map[uint]int64, quantity int, seed int, rankByBenchmark bool) []model.SocksOutbound {
 	if quantity <= 0 || len(candidates) == 0 {
 		return []model.SocksOutbound{}
 	}
@@ -2245,6 +2510,11 @@ func selectDispersedOutbounds(candidates []model.SocksOutbound, usage map[uint]i
 	for _, level := range levels {
 		bucket := buckets[level]
 		sort.Slice(bucket, func(i, j int) bool {
+			if rankByBenchmark {
+				if less, decided := benchmarkRankLess(bucket[i], bucket[j]); decided {
+					return less
+				}
+			}
 			li := strings.TrimSpace(bucket[i].RouteUser)
 			lj := strings.TrimSpace(bucket[j].RouteUser)
 			if li == lj {
@@ -2260,6 +2530,10 @@ func selectDispersedOutbounds(candidates []model.SocksOutbound, usage map[uint]i
 		if take > len(bucket) {
 			take = len(bucket)
 		}
+		if rankByBenchmark {
+			out = append(out, bucket[:take]...)
+			continue
+		}
 		out = append(out, scatteredPick(bucket, take, seed+int(level)*7)...)
 	}
 	return out
@@ -2276,7 +2550,7 @@ func (s *OrderService) customerUsedOutboundSet(customerID uint, excludeOrderID u
 	q := s.db.Table("order_items oi").
 		Select("oi.socks_outbound_id as outbound_id").
 		Joins("join orders o on o.id = oi.order_id").
-		Where("o.customer_id = ? and o.status = ? and o.expires_at > ? and oi.status = ? and oi.socks_outbound_id is not null", customerID, model.OrderStatusActive, time.Now(), model.OrderItemStatusActive)
+		Where("o.customer_id = ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '') and oi.status = ? and oi.socks_outbound_id is not null", customerID, model.OrderStatusActive, time.Now(), model.OrderItemStatusActive)
 	if excludeOrderID > 0 {
 		q = q.Where("o.id <> ?", excludeOrderID)
 	}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+)
+
+const (
+	LedgerSourceCreate       = "create"
+	LedgerSourceRenew        = "renew"
+	LedgerSourceAutoRenew    = "auto_renew"
+	LedgerSourceManual       = "manual"
+	LedgerSourceWebhook      = "webhook"
+	LedgerSourceScheduled    = "scheduled"
+	LedgerSourceTrialConvert = "trial_convert"
+)
+
+type renewalTxHookKey struct{}
+
+// withRenewalTxHook makes the next renewal run fn as the last step of its own
+// transaction, so whatever fn books commits or rolls back with the new
+// expiry.
+func withRenewalTxHook(ctx context.Context, fn func(tx *gorm.DB) error) context.Context {
+	return context.WithValue(ctx, renewalTxHookKey{}, fn)
+}
+
+func runRenewalTxHook(ctx context.Context, tx *gorm.DB) error {
+	fn, ok := ctx.Value(renewalTxHookKey{}).(func(tx *gorm.DB) error)
+	if !ok || fn == nil {
+		return nil
+	}
+	return fn(tx)
+}
+
+// appendLedgerEntryTx moves the customer balance by entry.Amount and stores
+// the entry with the resulting balance.
+func appendLedgerEntryTx(tx *gorm.DB, entry *model.LedgerEntry) error {
+	entry.Amount = roundCurrency(entry.Amount)
+	if err := tx.Model(&model.Customer{}).Where("id = ?", entry.CustomerID).Updates(map[string]interface{}{
+		"balance":    gorm.Expr("balance + ?", entry.Amount),
+		"updated_at": time.Now(),
+	}).Error; err != nil {
+		return err
+	}
+	customer := model.Customer{}
+	if err := tx.Select("id", "balance").First(&customer, entry.CustomerID).Error; err != nil {
+		return err
+	}
+	entry.Balance = roundCurrency(customer.Balance)
+	return tx.Create(entry).Error
+}
+
+// recordOrderChargeTx snapshots the per-30-day price of an order for the
+// period it was just extended by. Free orders leave no ledger trace.
+func recordOrderChargeTx(tx *gorm.DB, order model.Order, price float64, from, to time.Time, source string) error {
+	if price <= 0 || !to.After(from) {
+		return nil
+	}
+	days := int(math.Ceil(to.Sub(from).Hours() / 24))
+	if days <= 0 {
+		return nil
+	}
+	orderID := order.ID
+	start, end := from, to
+	return appendLedgerEntryTx(tx, &model.LedgerEntry{
+		CustomerID:  order.CustomerID,
+		OrderID:     &orderID,
+		Type:        model.LedgerEntryCharge,
+		Amount:      -orderPeriodCost(price, days),
+		UnitPrice:   price,
+		Days:        days,
+		PeriodStart: &start,
+		PeriodEnd:   &end,
+		Source:      source,
+		Reference:   order.OrderNo,
+	})
+}
+
+func orderPeriodCost(price float64, days int) float64 {
+	return roundCurrency(price * float64(days) / pricePeriodDays)
+}
+
+// renewBase is where a renewal period starts: the current expiry while it is
+// ahead, or while the order is overdue but still held online by a grace
+// stage, otherwise now.
+func renewBase(order model.Order, now time.Time) time.Time {
+	if order.ExpiresAt.Before(now) && order.ExpiryStage == "" {
+		return now
+	}
+	return order.ExpiresAt
+}
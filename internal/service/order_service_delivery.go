@@ -83,12 +83,20 @@ func (s *OrderService) RefreshResidentialCredentials(ctx context.Context, orderI
 	if strings.EqualFold(strings.TrimSpace(order.Mode), model.OrderModeForward) {
 		return errors.New("forward mode is deprecated")
 	}
+	historyRoot := orderHistoryRoot(order)
+	if err := s.ensureOrderBaseline(historyRoot); err != nil {
+		return err
+	}
 	now := time.Now()
 	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := bumpOrderVersionTx(tx, order.ID); err != nil {
+			return err
+		}
 		return s.refreshResidentialCredentialsTx(tx, order, now)
 	}); err != nil {
 		return err
 	}
+	s.recordOrderVersion(historyRoot, OrderVersionSourceCredentials)
 	return s.rebuildManagedRuntime(ctx)
 }
 
@@ -138,44 +146,38 @@ func (s *OrderService) DeleteOrder(ctx context.Context, orderID uint) error {
 			if err := tx.Model(&model.Order{}).Where("id = ? or parent_order_id = ?", order.ID, order.ID).Pluck("id", &ids).Error; err != nil {
 				return err
 			}
+			if err := recycleOrdersTx(tx, order, ids, now); err != nil {
+				return err
+			}
 			return deleteOrdersByIDsTx(tx, ids)
 		}
 
 		if order.ParentOrderID != nil && *order.ParentOrderID > 0 {
 			parentID := *order.ParentOrderID
-			if err := deleteOrdersByIDsTx(tx, []uint{order.ID}); err != nil {
+			var siblings int64
+			if err := tx.Model(&model.Order{}).Where("parent_order_id = ? and id <> ?", parentID, order.ID).Count(&siblings).Error; err != nil {
 				return err
 			}
-			children := []model.Order{}
-			if err := tx.Select("id", "status", "expires_at").Where("parent_order_id = ?", parentID).Find(&children).Error; err != nil {
+			// The last child takes its head along, so the bin keeps both.
+			ids := []uint{order.ID}
+			if siblings == 0 {
+				ids = append(ids, parentID)
+			}
+			if err := recycleOrdersTx(tx, order, ids, now); err != nil {
 				return err
 			}
-			if len(children) == 0 {
-				return deleteOrdersByIDsTx(tx, []uint{parentID})
+			if err := deleteOrdersByIDsTx(tx, ids); err != nil {
+				return err
 			}
-			maxExpires := children[0].ExpiresAt
-			status := model.OrderStatusExpired
-			for _, child := range children {
-				if child.ExpiresAt.After(maxExpires) {
-					maxExpires = child.ExpiresAt
-				}
-				if child.Status == model.OrderStatusActive && child.ExpiresAt.After(now) {
-					status = model.OrderStatusActive
-				}
-				if status != model.OrderStatusActive && child.Status == model.OrderStatusDisabled {
-					status = model.OrderStatusDisabled
-				}
+			if siblings == 0 {
+				return nil
 			}
-			return tx.Model(&model.Order{}).Where("id = ?", parentID).Updates(map[string]interface{}{
-				"quantity":            len(children),
-				"status":              status,
-				"expires_at":          maxExpires,
-				"notify_one_day_sent": false,
-				"notify_expired_sent": false,
-				"updated_at":          now,
-			}).Error
+			return refreshGroupHeadTx(tx, parentID, now)
 		}
 
+		if err := recycleOrdersTx(tx, order, []uint{order.ID}, now); err != nil {
+			return err
+		}
 		return deleteOrdersByIDsTx(tx, []uint{order.ID})
 	}); err != nil {
 		return err
@@ -183,6 +185,41 @@ func (s *OrderService) DeleteOrder(ctx context.Context, orderID uint) error {
 	return s.rebuildManagedRuntime(ctx)
 }
 
+// refreshGroupHeadTx recomputes a head's quantity, status and expiry from
+// its remaining children.
+func refreshGroupHeadTx(tx *gorm.DB, parentID uint, now time.Time) error {
+	children := []model.Order{}
+	if err := tx.Select("id", "status", "expires_at", "expiry_stage").Where("parent_order_id = ?", parentID).Find(&children).Error; err != nil {
+		return err
+	}
+	if len(children) == 0 {
+		return nil
+	}
+	maxExpires := children[0].ExpiresAt
+	status := model.OrderStatusExpired
+	for _, child := range children {
+		if child.ExpiresAt.After(maxExpires) {
+			maxExpires = child.ExpiresAt
+		}
+		if orderLive(child, now) {
+			status = model.OrderStatusActive
+		}
+		if status != model.OrderStatusActive && child.Status == model.OrderStatusDisabled {
+			status = model.OrderStatusDisabled
+		}
+	}
+	updates := map[string]interface{}{
+		"quantity":   len(children),
+		"status":     status,
+		"expires_at": maxExpires,
+		"updated_at": now,
+	}
+	if maxExpires.After(now) {
+		updates["expiry_stage"] = ""
+	}
+	return tx.Model(&model.Order{}).Where("id = ?", parentID).Updates(updates).Error
+}
+
 func deleteOrdersByIDsTx(tx *gorm.DB, orderIDs []uint) error {
 	ids := uniqueUintIDs(orderIDs)
 	if len(ids) == 0 {
@@ -203,5 +240,12 @@ func deleteOrdersByIDsTx(tx *gorm.DB, orderIDs []uint) error {
 	if err := tx.Where("order_id in ?", ids).Delete(&model.OrderItem{}).Error; err != nil {
 		return err
 	}
+	if err := tx.Model(&model.ScheduledAction{}).Where("order_id in ? and status = ?", ids, model.ScheduledActionPending).Updates(map[string]interface{}{
+		"status":     model.ScheduledActionCancelled,
+		"last_error": "order deleted",
+		"updated_at": time.Now(),
+	}).Error; err != nil {
+		return err
+	}
 	return tx.Where("id in ?", ids).Delete(&model.Order{}).Error
 }
@@ -0,0 +1,255 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+)
+
+type EgressPoolMemberStatus struct {
+	SocksOutboundID uint   `json:"socks_outbound_id"`
+	Name            string `json:"name"`
+	Type            string `json:"type"`
+	Address         string `json:"address"`
+	Port            int    `json:"port"`
+	CountryCode     string `json:"country_code"`
+	Priority        int    `json:"priority"`
+	Tag             string `json:"tag"`
+	Alive           bool   `json:"alive"`
+	DelayMS         int64  `json:"delay_ms"`
+	LastError       string `json:"last_error,omitempty"`
+	ProbeStatus     string `json:"probe_status"`
+	Active          bool   `json:"active"`
+}
+
+type EgressPoolItemStatus struct {
+	OrderItemID      uint                     `json:"order_item_id"`
+	Username         string                   `json:"username"`
+	PoolID           uint                     `json:"pool_id"`
+	PoolName         string                   `json:"pool_name"`
+	Strategy         string                   `json:"strategy"`
+	Healthy          int                      `json:"healthy"`
+	Total            int                      `json:"total"`
+	ActiveOutboundID *uint                    `json:"active_outbound_id,omitempty"`
+	Members          []EgressPoolMemberStatus `json:"members"`
+	RuntimeError     string                   `json:"runtime_error,omitempty"`
+}
+
+func (s *OrderService) SetOrderEgressPool(ctx context.Context, orderID uint, poolID uint, itemIDs []uint) error {
+	order := model.Order{}
+	if err := s.db.Preload("Items").First(&order, orderID).Error; err != nil {
+		return err
+	}
+	selected := map[uint]struct{}{}
+	for _, id := range uniqueUintIDs(itemIDs) {
+		selected[id] = struct{}{}
+	}
+	targets := make([]model.OrderItem, 0, len(order.Items))
+	for _, item := range order.Items {
+		if len(selected) > 0 {
+			if _, ok := selected[item.ID]; !ok {
+				continue
+			}
+			delete(selected, item.ID)
+		}
+		if !isForwardOutboundType(item.OutboundType) {
+			if len(itemIDs) > 0 {
+				return fmt.Errorf("item %d is not a forward item", item.ID)
+			}
+			continue
+		}
+		targets = append(targets, item)
+	}
+	if len(selected) > 0 {
+		return fmt.Errorf("some items do not belong to order %d", orderID)
+	}
+	if len(targets) == 0 {
+		return errors.New("no forward items to update")
+	}
+
+	var pool *egressPoolRuntime
+	if poolID > 0 {
+		runtimes, err := loadEgressPoolRuntimes(s.db, []uint{poolID})
+		if err != nil {
+			return err
+		}
+		runtime, ok := runtimes[poolID]
+		if !ok {
+			return errors.New("egress pool is disabled or has no enabled members")
+		}
+		pool = &runtime
+	}
+	historyRoot := orderHistoryRoot(order)
+	if err := s.ensureOrderBaseline(historyRoot); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := bumpOrderVersionTx(tx, order.ID); err != nil {
+			return err
+		}
+		for _, item := range targets {
+			updates := map[string]interface{}{"updated_at": now}
+			if pool == nil {
+				updates["egress_pool_id"] = nil
+			} else {
+				updates["egress_pool_id"] = pool.pool.ID
+				if !egressPoolHasMember(*pool, item.SocksOutboundID) {
+					primary := pool.members[0]
+					updates["socks_outbound_id"] = primary.ID
+					updates["outbound_type"] = forwardOutboundTypeOf(primary)
+					updates["forward_address"] = primary.Address
+					updates["forward_port"] = primary.Port
+					updates["forward_username"] = primary.Username
+					updates["forward_password"] = primary.Password
+				}
+			}
+			if err := tx.Model(&model.OrderItem{}).Where("id = ?", item.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.recordOrderVersion(historyRoot, OrderVersionSourceEgressPool)
+	return s.rebuildManagedRuntime(ctx)
+}
+
+func (s *OrderService) EgressPoolStatus(ctx context.Context, orderID uint) ([]EgressPoolItemStatus, error) {
+	items := []model.OrderItem{}
+	if err := s.db.Where("order_id = ? and egress_pool_id is not null", orderID).Order("id asc").Find(&items).Error; err != nil {
+		return nil, err
+	}
+	out := make([]EgressPoolItemStatus, 0, len(items))
+	if len(items) == 0 {
+		return out, nil
+	}
+	poolIDs := make([]uint, 0, len(items))
+	for _, item := range items {
+		poolIDs = append(poolIDs, *item.EgressPoolID)
+	}
+	runtimes, err := loadEgressPoolRuntimes(s.db, poolIDs)
+	if err != nil {
+		return nil, err
+	}
+	pools := []model.EgressPool{}
+	if err := s.db.Where("id in ?", uniqueUintIDs(poolIDs)).Find(&pools).Error; err != nil {
+		return nil, err
+	}
+	poolsByID := make(map[uint]model.EgressPool, len(pools))
+	for _, pool := range pools {
+		poolsByID[pool.ID] = pool
+	}
+
+	runtimeErr := ""
+	observed, err := s.xray.GetObservatoryStatus(ctx)
+	if err != nil {
+		runtimeErr = err.Error()
+	}
+
+	for _, item := range items {
+		pool := poolsByID[*item.EgressPoolID]
+		row := EgressPoolItemStatus{
+			OrderItemID:  item.ID,
+			Username:     item.Username,
+			PoolID:       pool.ID,
+			PoolName:     pool.Name,
+			Strategy:     pool.Strategy,
+			Members:      []EgressPoolMemberStatus{},
+			RuntimeError: runtimeErr,
+		}
+		runtime, ok := runtimes[pool.ID]
+		if !ok {
+			row.RuntimeError = "egress pool is disabled or has no enabled members"
+			out = append(out, row)
+			continue
+		}
+		for idx, member := range runtime.members {
+			status := EgressPoolMemberStatus{
+				SocksOutboundID: member.ID,
+				Name:            member.Name,
+				Type:            forwardOutboundTypeOf(member),
+				Address:         member.Address,
+				Port:            member.Port,
+				CountryCode:     member.CountryCode,
+				Priority:        idx,
+				Tag:             EgressPoolMemberTag(pool.ID, idx),
+				ProbeStatus:     member.ProbeStatus,
+			}
+			if seen, ok := observed[status.Tag]; ok {
+				status.Alive = seen.Alive
+				status.DelayMS = seen.Delay
+				status.LastError = strings.TrimSpace(seen.LastErrorReason)
+			} else {
+				status.Alive = member.ProbeStatus == "ok"
+			}
+			if status.Alive {
+				row.Healthy++
+			}
+			row.Members = append(row.Members, status)
+		}
+		row.Total = len(row.Members)
+		markEgressPoolActiveMember(&row)
+		out = append(out, row)
+	}
+	return out, nil
+}
+
+func markEgressPoolActiveMember(row *EgressPoolItemStatus) {
+	active := -1
+	switch row.Strategy {
+	case model.EgressPoolStrategyRandom:
+		for idx := range row.Members {
+			if row.Members[idx].Alive {
+				row.Members[idx].Active = true
+			}
+		}
+		return
+	case model.EgressPoolStrategyLeastPing:
+		for idx, member := range row.Members {
+			if !member.Alive {
+				continue
+			}
+			if active < 0 || member.DelayMS < row.Members[active].DelayMS {
+				active = idx
+			}
+		}
+	default:
+		for idx, member := range row.Members {
+			if member.Alive {
+				active = idx
+				break
+			}
+		}
+	}
+	if active < 0 && len(row.Members) > 0 {
+		active = 0
+	}
+	if active < 0 {
+		return
+	}
+	row.Members[active].Active = true
+	id := row.Members[active].SocksOutboundID
+	row.ActiveOutboundID = &id
+}
+
+func egressPoolHasMember(pool egressPoolRuntime, outboundID *uint) bool {
+	if outboundID == nil {
+		return false
+	}
+	for _, member := range pool.members {
+		if member.ID == *outboundID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	ForwardCapacityPolicyRefuse = "refuse"
+	ForwardCapacityPolicyWarn   = "warn"
+)
+
+type capacityWarningsKey struct{}
+
+type capacityWarnings struct {
+	mu   sync.Mutex
+	rows []string
+}
+
+// WithCapacityWarnings attaches a collector to ctx. Writes run with it record
+// the upstream overflows the warn policy lets through, and the returned func
+// hands them back so the caller can show them next to the result.
+func WithCapacityWarnings(ctx context.Context) (context.Context, func() []string) {
+	sink := &capacityWarnings{}
+	collect := func() []string {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return append([]string{}, sink.rows...)
+	}
+	return context.WithValue(ctx, capacityWarningsKey{}, sink), collect
+}
+
+func noteCapacityWarning(ctx context.Context, outbound model.SocksOutbound, reason string) {
+	if ctx == nil {
+		return
+	}
+	sink, ok := ctx.Value(capacityWarningsKey{}).(*capacityWarnings)
+	if !ok {
+		return
+	}
+	sink.mu.Lock()
+	sink.rows = append(sink.rows, forwardCapacityWarning(outbound, reason))
+	sink.mu.Unlock()
+}
+
+func forwardCapacityWarning(outbound model.SocksOutbound, reason string) string {
+	return fmt.Sprintf("出口 %s:%d 容量已满 (%s)", outbound.Address, outbound.Port, reason)
+}
+
+type forwardOutboundLoad struct {
+	Items     int64
+	Customers map[uint]struct{}
+}
+
+// forwardOutboundLoadsTx counts active items and distinct customers per
+// upstream, leaving out excludeOrderID so an order being edited is not
+// counted against itself.
+func forwardOutboundLoadsTx(tx *gorm.DB, outboundIDs []uint, excludeOrderID uint) (map[uint]*forwardOutboundLoad, error) {
+	rows := []struct {
+		OutboundID uint
+		CustomerID uint
+		Count      int64
+	}{}
+	q := tx.Table("order_items oi").
+		Select("oi.socks_outbound_id as outbound_id, o.customer_id as customer_id, count(1) as count").
+		Joins("join orders o on o.id = oi.order_id").
+		Where("oi.socks_outbound_id is not null and oi.status = ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '')", model.OrderItemStatusActive, model.OrderStatusActive, time.Now())
+	if len(outboundIDs) > 0 {
+		q = q.Where("oi.socks_outbound_id in ?", outboundIDs)
+	}
+	if excludeOrderID > 0 {
+		q = q.Where("o.id <> ?", excludeOrderID)
+	}
+	if err := q.Group("oi.socks_outbound_id, o.customer_id").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	loads := map[uint]*forwardOutboundLoad{}
+	for _, row := range rows {
+		load := loads[row.OutboundID]
+		if load == nil {
+			load = &forwardOutboundLoad{Customers: map[uint]struct{}{}}
+			loads[row.OutboundID] = load
+		}
+		load.Items += row.Count
+		load.Customers[row.CustomerID] = struct{}{}
+	}
+	return loads, nil
+}
+
+// forwardCapacityShortfall reports why adding items for customerID would
+// exceed the upstream limits, or "" when it fits. A customer already on the
+// upstream does not take another customer slot.
+func forwardCapacityShortfall(outbound model.SocksOutbound, load *forwardOutboundLoad, customerID uint, addItems int64) string {
+	items := int64(0)
+	customers := 0
+	present := false
+	if load != nil {
+		items = load.Items
+		customers = len(load.Customers)
+		_, present = load.Customers[customerID]
+	}
+	if outbound.MaxItems > 0 && items+addItems > int64(outbound.MaxItems) {
+		return fmt.Sprintf("items %d/%d", items, outbound.MaxItems)
+	}
+	if outbound.MaxCustomers > 0 && !present && customers+1 > outbound.MaxCustomers {
+		return fmt.Sprintf("customers %d/%d", customers, outbound.MaxCustomers)
+	}
+	return ""
+}
+
+func forwardCapacityPolicy(db *gorm.DB) string {
+	row := model.Setting{}
+	if err := db.Where("key = ?", "forward_capacity_policy").Limit(1).Find(&row).Error; err != nil {
+		return ForwardCapacityPolicyRefuse
+	}
+	if strings.ToLower(strings.TrimSpace(row.Value)) == ForwardCapacityPolicyWarn {
+		return ForwardCapacityPolicyWarn
+	}
+	return ForwardCapacityPolicyRefuse
+}
+
+// ensureForwardCapacityTx checks the upstreams an order is about to gain.
+// Under the warn policy overflows are logged, noted on ctx for the caller and
+// allowed through.
+func (s *OrderService) ensureForwardCapacityTx(ctx context.Context, tx *gorm.DB, order model.Order, outbounds []model.SocksOutbound) error {
+	if len(outbounds) == 0 {
+		return nil
+	}
+	ids := make([]uint, 0, len(outbounds))
+	for _, outbound := range outbounds {
+		ids = append(ids, outbound.ID)
+	}
+	loads, err := forwardOutboundLoadsTx(tx, ids, order.ID)
+	if err != nil {
+		return err
+	}
+	full := make([]string, 0)
+	overflow := make([]model.SocksOutbound, 0)
+	reasons := make([]string, 0)
+	for _, outbound := range outbounds {
+		if reason := forwardCapacityShortfall(outbound, loads[outbound.ID], order.CustomerID, 1); reason != "" {
+			full = append(full, fmt.Sprintf("%s (%s)", forwardOutboundLabel(outbound), reason))
+			overflow = append(overflow, outbound)
+			reasons = append(reasons, reason)
+		}
+	}
+	if len(full) == 0 {
+		return nil
+	}
+	if forwardCapacityPolicy(tx) == ForwardCapacityPolicyWarn {
+		s.log.Warn("forward upstream over capacity", zap.Uint("order_id", order.ID), zap.Strings("upstreams", full))
+		for i, outbound := range overflow {
+			noteCapacityWarning(ctx, outbound, reasons[i])
+		}
+		return nil
+	}
+	return fmt.Errorf("forward upstream capacity exceeded: %s", strings.Join(full, ", "))
+}
+
+func (s *OrderService) forwardCapacityWarnings(customerID uint, excludeOrderID uint, outboundIDs []uint) ([]string, error) {
+	outbounds := []model.SocksOutbound{}
+	if err := s.db.Where("id in ?", outboundIDs).Order("id asc").Find(&outbounds).Error; err != nil {
+		return nil, err
+	}
+	loads, err := forwardOutboundLoadsTx(s.db, outboundIDs, excludeOrderID)
+	if err != nil {
+		return nil, err
+	}
+	warnings := make([]string, 0)
+	for _, outbound := range outbounds {
+		if reason := forwardCapacityShortfall(outbound, loads[outbound.ID], customerID, 1); reason != "" {
+			warnings = append(warnings, forwardCapacityWarning(outbound, reason))
+		}
+	}
+	return warnings, nil
+}
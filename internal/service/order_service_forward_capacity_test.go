@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+func seedForwardCapacityOrder(t *testing.T, db *gorm.DB, customerName string, price float64, outbounds ...model.SocksOutbound) model.Order {
+	t.Helper()
+	now := time.Now()
+	customer := model.Customer{}
+	if err := db.Where("name = ?", customerName).FirstOrCreate(&customer, model.Customer{Name: customerName, Code: customerName, Status: "active"}).Error; err != nil {
+		t.Fatalf("create customer failed: %v", err)
+	}
+	order := model.Order{
+		CustomerID: customer.ID,
+		Name:       customerName + "-order",
+		Mode:       model.OrderModeForward,
+		Status:     model.OrderStatusActive,
+		Quantity:   len(outbounds),
+		Port:       residentialTestPort,
+		StartsAt:   now,
+		ExpiresAt:  now.Add(24 * time.Hour),
+		Price:      price,
+	}
+	if err := db.Create(&order).Error; err != nil {
+		t.Fatalf("create order failed: %v", err)
+	}
+	for i := range outbounds {
+		outbound := outbounds[i]
+		item := model.OrderItem{
+			OrderID:         order.ID,
+			IP:              "203.0.113.90",
+			Port:            residentialTestPort,
+			Username:        randomString(10),
+			Password:        "pass",
+			SocksOutboundID: &outbound.ID,
+			OutboundType:    forwardOutboundTypeOf(outbound),
+			ForwardAddress:  outbound.Address,
+			ForwardPort:     outbound.Port,
+			Managed:         true,
+			Status:          model.OrderItemStatusActive,
+		}
+		if err := db.Create(&item).Error; err != nil {
+			t.Fatalf("create item failed: %v", err)
+		}
+	}
+	return order
+}
+
+func TestForwardCapacityRefusesOrWarnsWhenPoolExhausted(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+
+	byItems := model.SocksOutbound{Type: model.OutboundTypeSocks5, Address: "198.51.100.90", Port: 1080, Username: "a", Password: "a", MaxItems: 1, Enabled: true}
+	byCustomers := model.SocksOutbound{Type: model.OutboundTypeSocks5, Address: "198.51.100.91", Port: 1080, Username: "b", Password: "b", MaxCustomers: 1, Enabled: true}
+	for _, row := range []*model.SocksOutbound{&byItems, &byCustomers} {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatalf("create upstream failed: %v", err)
+		}
+	}
+	owner := seedForwardCapacityOrder(t, db, "owner", 0, byItems, byCustomers)
+
+	other := model.Customer{Name: "other", Code: "other", Status: "active"}
+	if err := db.Create(&other).Error; err != nil {
+		t.Fatalf("create customer failed: %v", err)
+	}
+	if _, err := svc.allocateForwardOutbounds(context.Background(), other.ID, 1, 0, nil); err == nil || !strings.Contains(err.Error(), "pool exhausted") {
+		t.Fatalf("expected exhausted pool to be refused, got %v", err)
+	}
+	// The owner already holds the customer slot and the item limit does
+	// not apply once its own order is left out.
+	picked, err := svc.allocateForwardOutbounds(context.Background(), owner.CustomerID, 2, owner.ID, nil)
+	if err != nil || len(picked) != 2 {
+		t.Fatalf("expected owner to keep both upstreams, got %v %v", picked, err)
+	}
+
+	order := model.Order{ID: 999, CustomerID: other.ID}
+	if err := svc.ensureForwardCapacityTx(context.Background(), db, order, []model.SocksOutbound{byCustomers}); err == nil || !strings.Contains(err.Error(), "customers 1/1") {
+		t.Fatalf("expected customer limit error, got %v", err)
+	}
+	warnings, err := svc.ForwardOutboundReuseWarnings(other.ID, 0, []uint{byItems.ID, byCustomers.ID})
+	if err != nil || len(warnings) != 2 {
+		t.Fatalf("expected two capacity warnings, got %v %v", warnings, err)
+	}
+
+	if err := store.New(db).SetSettings(map[string]string{"forward_capacity_policy": ForwardCapacityPolicyWarn}); err != nil {
+		t.Fatalf("save settings failed: %v", err)
+	}
+	ctx, collected := WithCapacityWarnings(context.Background())
+	if err := svc.ensureForwardCapacityTx(ctx, db, order, []model.SocksOutbound{byCustomers}); err != nil {
+		t.Fatalf("warn policy should allow overflow, got %v", err)
+	}
+	if noted := collected(); len(noted) != 1 || !strings.Contains(noted[0], byCustomers.Address) {
+		t.Fatalf("expected the overflow noted for the caller, got %v", noted)
+	}
+	picked, err = svc.allocateForwardOutbounds(ctx, other.ID, 1, 0, nil)
+	if err != nil || len(picked) != 1 {
+		t.Fatalf("warn policy should fall back to full upstreams, got %v %v", picked, err)
+	}
+	if noted := collected(); len(noted) != 2 {
+		t.Fatalf("expected the fallback pick noted too, got %v", noted)
+	}
+}
+
+func TestForwardMarginReportSplitsOrderPriceByItems(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	expires := time.Now().Add(3 * 24 * time.Hour)
+	costly := model.SocksOutbound{Type: model.OutboundTypeSocks5, Address: "198.51.100.95", Port: 1080, Username: "c", Password: "c", Supplier: "acme", Cost: 60, CostPeriodDays: 60, SupplierExpiresAt: &expires, Enabled: true}
+	cheap := model.SocksOutbound{Type: model.OutboundTypeSocks5, Address: "198.51.100.96", Port: 1080, Username: "d", Password: "d", Cost: 10, CostPeriodDays: 30, Enabled: true}
+	for _, row := range []*model.SocksOutbound{&costly, &cheap} {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatalf("create upstream failed: %v", err)
+		}
+	}
+	order := seedForwardCapacityOrder(t, db, "margin", 100, costly, cheap)
+
+	report, err := NewForwardOutboundService(db).MarginReport(time.Now())
+	if err != nil {
+		t.Fatalf("margin report failed: %v", err)
+	}
+	if len(report.Rows) != 2 {
+		t.Fatalf("expected two rows, got %d", len(report.Rows))
+	}
+	row := report.Rows[0]
+	if row.MonthlyCost != 30 || row.MonthlyRevenue != 50 || row.MonthlyMargin != 20 || row.ActiveItems != 1 || row.ActiveCustomers != 1 {
+		t.Fatalf("unexpected margin row: %#v", row)
+	}
+	if !row.SupplierExpiring || row.SupplierExpired || row.Supplier != "acme" {
+		t.Fatalf("expected supplier expiry warning, got %#v", row)
+	}
+	if len(row.Orders) != 1 || row.Orders[0].OrderID != order.ID || row.Orders[0].OrderItems != 2 {
+		t.Fatalf("unexpected margin orders: %#v", row.Orders)
+	}
+	if report.TotalMonthlyCost != 40 || report.TotalMonthlyRevenue != 100 || report.TotalMonthlyMargin != 60 {
+		t.Fatalf("unexpected totals: %#v", report)
+	}
+}
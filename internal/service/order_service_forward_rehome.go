@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+)
+
+type ForwardRehomeResult struct {
+	OrderID        uint     `json:"order_id"`
+	OrderItemID    uint     `json:"order_item_id"`
+	Username       string   `json:"username"`
+	FromOutboundID uint     `json:"from_outbound_id"`
+	ToOutboundID   uint     `json:"to_outbound_id,omitempty"`
+	Warnings       []string `json:"warnings,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+func (s *OrderService) RehomeForwardOutboundItems(ctx context.Context, outboundID uint) ([]ForwardRehomeResult, error) {
+	if outboundID == 0 {
+		return nil, errors.New("outbound id is required")
+	}
+	failing := model.SocksOutbound{}
+	if err := s.db.First(&failing, outboundID).Error; err != nil {
+		return nil, err
+	}
+	country := strings.ToLower(strings.TrimSpace(failing.CountryCode))
+	if len(country) != 2 || country == "xx" {
+		return nil, errors.New("outbound country is unknown, cannot pick a same-country spare")
+	}
+
+	type rehomeRow struct {
+		ItemID     uint
+		OrderID    uint
+		CustomerID uint
+		Username   string
+	}
+	rows := []rehomeRow{}
+	if err := s.db.Table("order_items oi").
+		Select("oi.id as item_id, oi.order_id, o.customer_id, oi.username").
+		Joins("join orders o on o.id = oi.order_id").
+		Where("oi.socks_outbound_id = ? and oi.egress_pool_id is null and oi.status = ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '')", outboundID, model.OrderItemStatusActive, model.OrderStatusActive, time.Now()).
+		Order("oi.id asc").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	spare := func(candidate model.SocksOutbound) bool {
+		return candidate.ID != outboundID &&
+			strings.EqualFold(strings.TrimSpace(candidate.CountryCode), country) &&
+			candidate.ProbeStatus == "ok" &&
+			candidate.FailStreak == 0
+	}
+
+	// Each order's moves commit together under one version bump, so a
+	// stale edit of the order conflicts and the move shows up in history.
+	orderIDs := make([]uint, 0)
+	rowsByOrder := map[uint][]rehomeRow{}
+	for _, row := range rows {
+		if _, ok := rowsByOrder[row.OrderID]; !ok {
+			orderIDs = append(orderIDs, row.OrderID)
+		}
+		rowsByOrder[row.OrderID] = append(rowsByOrder[row.OrderID], row)
+	}
+
+	results := make([]ForwardRehomeResult, 0, len(rows))
+	moved := 0
+	for _, orderID := range orderIDs {
+		type rehomeMove struct {
+			result int
+			itemID uint
+			target model.SocksOutbound
+		}
+		moves := make([]rehomeMove, 0)
+		picked := map[uint]struct{}{}
+		for _, row := range rowsByOrder[orderID] {
+			result := ForwardRehomeResult{
+				OrderID:        row.OrderID,
+				OrderItemID:    row.ItemID,
+				Username:       row.Username,
+				FromOutboundID: outboundID,
+			}
+			// Spread the order over spares not picked for it yet, falling
+			// back to a repeat when it has run out of them.
+			rowCtx, warnings := WithCapacityWarnings(ctx)
+			selected, err := s.allocateForwardOutbounds(rowCtx, row.CustomerID, 1, row.OrderID, func(candidate model.SocksOutbound) bool {
+				_, taken := picked[candidate.ID]
+				return !taken && spare(candidate)
+			})
+			if err != nil && len(picked) > 0 {
+				selected, err = s.allocateForwardOutbounds(rowCtx, row.CustomerID, 1, row.OrderID, spare)
+			}
+			if err != nil {
+				result.Error = err.Error()
+				results = append(results, result)
+				continue
+			}
+			target := selected[0]
+			picked[target.ID] = struct{}{}
+			result.ToOutboundID = target.ID
+			result.Warnings = warnings()
+			moves = append(moves, rehomeMove{result: len(results), itemID: row.ItemID, target: target})
+			results = append(results, result)
+		}
+		if len(moves) == 0 {
+			continue
+		}
+
+		historyRoot, err := s.orderHistoryRootID(orderID)
+		if err == nil {
+			err = s.ensureOrderBaseline(historyRoot)
+		}
+		if err == nil {
+			now := time.Now()
+			err = s.versionedTx(ctx, orderID, func(tx *gorm.DB) error {
+				for _, move := range moves {
+					if err := tx.Model(&model.OrderItem{}).Where("id = ?", move.itemID).Updates(map[string]interface{}{
+						"socks_outbound_id": move.target.ID,
+						"outbound_type":     forwardOutboundTypeOf(move.target),
+						"forward_address":   move.target.Address,
+						"forward_port":      move.target.Port,
+						"forward_username":  move.target.Username,
+						"forward_password":  move.target.Password,
+						"updated_at":        now,
+					}).Error; err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			for _, move := range moves {
+				results[move.result].ToOutboundID = 0
+				results[move.result].Warnings = nil
+				results[move.result].Error = err.Error()
+			}
+			continue
+		}
+		s.recordOrderVersion(historyRoot, OrderVersionSourceRehome)
+		moved += len(moves)
+	}
+	if moved > 0 {
+		if err := s.rebuildManagedRuntime(ctx); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+type expiryPolicy struct {
+	graceHours int
+	finalHours int
+}
+
+// ExpiryTransition is an overdue order that entered a new expiry stage.
+type ExpiryTransition struct {
+	Order    model.Order `json:"order"`
+	Stage    string      `json:"stage"`
+	CutoffAt time.Time   `json:"cutoff_at"`
+}
+
+type ExpiryStageResult struct {
+	Transitions []ExpiryTransition `json:"transitions"`
+	CutOff      []uint             `json:"cut_off"`
+}
+
+func loadExpiryPolicy(db *gorm.DB) expiryPolicy {
+	settings := map[string]string{}
+	rows := []model.Setting{}
+	if err := db.Where("key in ?", []string{"expiry_grace_hours", "expiry_final_hours"}).Find(&rows).Error; err == nil {
+		for _, row := range rows {
+			settings[row.Key] = row.Value
+		}
+	}
+	policy := expiryPolicy{
+		graceHours: parseSettingInt(settings["expiry_grace_hours"], 0),
+		finalHours: parseSettingInt(settings["expiry_final_hours"], 0),
+	}
+	if policy.graceHours < 0 {
+		policy.graceHours = 0
+	}
+	if policy.finalHours < 0 {
+		policy.finalHours = 0
+	}
+	return policy
+}
+
+// orderLive reports whether an order is still served: active and either
+// unexpired or held online by an expiry stage.
+func orderLive(order model.Order, now time.Time) bool {
+	return order.Status == model.OrderStatusActive && (order.ExpiresAt.After(now) || order.ExpiryStage != "")
+}
+
+// graceFor resolves an order's grace period: the customer override first,
+// then the product's, then expiry_grace_hours. Trials get none.
+func (p expiryPolicy) graceFor(order model.Order, customers map[uint]model.Customer, products map[uint]model.Product) time.Duration {
+	if order.IsTrial {
+		return 0
+	}
+	hours := p.graceHours
+	if order.ProductID != nil {
+		if product, ok := products[*order.ProductID]; ok && product.GraceHours != nil {
+			hours = *product.GraceHours
+		}
+	}
+	if customer, ok := customers[order.CustomerID]; ok && customer.GraceHours != nil {
+		hours = *customer.GraceHours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+func (p expiryPolicy) finalFor(order model.Order) time.Duration {
+	if order.IsTrial {
+		return 0
+	}
+	return time.Duration(p.finalHours) * time.Hour
+}
+
+// AdvanceExpiryStages walks active orders past expires_at through the grace
+// and final stages and deactivates them as expired once both are over. Both
+// stages keep the order online unchanged; the final stage only flags it and
+// sends its own notice before the cutoff.
+func (s *OrderService) AdvanceExpiryStages(ctx context.Context, now time.Time) (ExpiryStageResult, error) {
+	result := ExpiryStageResult{Transitions: []ExpiryTransition{}, CutOff: []uint{}}
+	orders := []model.Order{}
+	if err := s.db.Where("status = ? and expires_at <= ?", model.OrderStatusActive, now).
+		Order("is_group_head desc, id asc").Find(&orders).Error; err != nil {
+		return result, err
+	}
+	if len(orders) == 0 {
+		return result, nil
+	}
+	customerIDs := make([]uint, 0, len(orders))
+	productIDs := make([]uint, 0)
+	for _, order := range orders {
+		customerIDs = append(customerIDs, order.CustomerID)
+		if order.ProductID != nil {
+			productIDs = append(productIDs, *order.ProductID)
+		}
+	}
+	customers := map[uint]model.Customer{}
+	customerRows := []model.Customer{}
+	if err := s.db.Where("id in ?", uniqueUintIDs(customerIDs)).Find(&customerRows).Error; err != nil {
+		return result, err
+	}
+	for _, row := range customerRows {
+		customers[row.ID] = row
+	}
+	products := map[uint]model.Product{}
+	if len(productIDs) > 0 {
+		productRows := []model.Product{}
+		if err := s.db.Where("id in ?", uniqueUintIDs(productIDs)).Find(&productRows).Error; err != nil {
+			return result, err
+		}
+		for _, row := range productRows {
+			products[row.ID] = row
+		}
+	}
+
+	policy := loadExpiryPolicy(s.db)
+	cutHeads := map[uint]struct{}{}
+	for _, order := range orders {
+		if order.ParentOrderID != nil {
+			if _, ok := cutHeads[*order.ParentOrderID]; ok {
+				continue
+			}
+		}
+		grace := policy.graceFor(order, customers, products)
+		final := policy.finalFor(order)
+		cutoffAt := order.ExpiresAt.Add(grace + final)
+		if !cutoffAt.After(now) {
+			if err := s.DeactivateOrder(ctx, order.ID, model.OrderStatusExpired); err != nil {
+				s.log.Warn("expire order deactivate failed", zap.Error(err), zap.Uint("order_id", order.ID))
+				continue
+			}
+			result.CutOff = append(result.CutOff, order.ID)
+			if order.IsGroupHead {
+				cutHeads[order.ID] = struct{}{}
+			}
+			continue
+		}
+		stage := model.ExpiryStageGrace
+		if !order.ExpiresAt.Add(grace).After(now) {
+			stage = model.ExpiryStageFinal
+		}
+		if order.ExpiryStage == stage {
+			continue
+		}
+		if err := s.db.Model(&model.Order{}).Where("id = ? and status = ?", order.ID, model.OrderStatusActive).Updates(map[string]interface{}{
+			"expiry_stage": stage,
+			"updated_at":   now,
+		}).Error; err != nil {
+			return result, err
+		}
+		order.ExpiryStage = stage
+		result.Transitions = append(result.Transitions, ExpiryTransition{Order: order, Stage: stage, CutoffAt: cutoffAt})
+	}
+	if len(result.Transitions) > 0 {
+		if err := s.rebuildManagedRuntime(ctx); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+)
+
+func TestExpiryStagesGraceFinalAndCutoff(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	customer := seedBillingCustomer(t, db, "grace", "198.51.100.100")
+	if err := db.Create(&model.HostIP{IP: "198.51.100.101", IsPublic: true, IsLocal: true, Enabled: true}).Error; err != nil {
+		t.Fatalf("create host ip failed: %v", err)
+	}
+	if err := store.New(db).SetSettings(map[string]string{"expiry_grace_hours": "24", "expiry_final_hours": "12"}); err != nil {
+		t.Fatalf("set settings failed: %v", err)
+	}
+	ctx := context.Background()
+	now := time.Now()
+	overdue := func(orderID uint) time.Time {
+		t.Helper()
+		expiresAt := now.Add(-time.Hour)
+		if err := db.Model(&model.Order{}).Where("id = ?", orderID).Update("expires_at", expiresAt).Error; err != nil {
+			t.Fatalf("backdate order failed: %v", err)
+		}
+		return expiresAt
+	}
+	load := func(orderID uint) model.Order {
+		t.Helper()
+		row := model.Order{}
+		if err := db.First(&row, orderID).Error; err != nil {
+			t.Fatalf("load order failed: %v", err)
+		}
+		return row
+	}
+
+	order, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create order failed: %v", err)
+	}
+	expiredAt := overdue(order.ID)
+	result, err := svc.AdvanceExpiryStages(ctx, now)
+	if err != nil {
+		t.Fatalf("advance failed: %v", err)
+	}
+	if len(result.Transitions) != 1 || result.Transitions[0].Stage != model.ExpiryStageGrace || !result.Transitions[0].CutoffAt.Equal(expiredAt.Add(36*time.Hour)) {
+		t.Fatalf("unexpected grace transition: %+v", result)
+	}
+	if row := load(order.ID); row.Status != model.OrderStatusActive || row.ExpiryStage != model.ExpiryStageGrace {
+		t.Fatalf("expected order online in grace, got %s/%s", row.Status, row.ExpiryStage)
+	}
+	if result, err = svc.AdvanceExpiryStages(ctx, now); err != nil || len(result.Transitions) != 0 {
+		t.Fatalf("expected no repeated transition, got %+v %v", result, err)
+	}
+	listed, err := svc.ListOrders(ListOrdersInput{Status: model.ExpiryStageGrace})
+	if err != nil || listed.Total != 1 {
+		t.Fatalf("expected grace filter to list the order, got %d %v", listed.Total, err)
+	}
+	if _, err := svc.UpdateOrder(ctx, order.ID, UpdateOrderInput{Name: "renamed"}); err != nil {
+		t.Fatalf("update order failed: %v", err)
+	}
+	if row := load(order.ID); row.Status != model.OrderStatusActive || row.ExpiryStage != model.ExpiryStageGrace {
+		t.Fatalf("expected edit to keep grace, got %s/%s", row.Status, row.ExpiryStage)
+	}
+
+	zero := 0
+	if err := db.Model(&model.Customer{}).Where("id = ?", customer.ID).Update("grace_hours", &zero).Error; err != nil {
+		t.Fatalf("set customer grace failed: %v", err)
+	}
+	if result, err = svc.AdvanceExpiryStages(ctx, now); err != nil || len(result.Transitions) != 1 || result.Transitions[0].Stage != model.ExpiryStageFinal {
+		t.Fatalf("expected customer override to reach the final stage, got %+v %v", result, err)
+	}
+	if result, err = svc.AdvanceExpiryStages(ctx, now.Add(12*time.Hour)); err != nil || len(result.CutOff) != 1 {
+		t.Fatalf("expected cutoff, got %+v %v", result, err)
+	}
+	if row := load(order.ID); row.Status != model.OrderStatusExpired || row.ExpiryStage != "" {
+		t.Fatalf("expected order cut off, got %s/%s", row.Status, row.ExpiryStage)
+	}
+
+	if err := db.Model(&model.Customer{}).Where("id = ?", customer.ID).Update("grace_hours", nil).Error; err != nil {
+		t.Fatalf("clear customer grace failed: %v", err)
+	}
+	late, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create second order failed: %v", err)
+	}
+	lateExpired := overdue(late.ID)
+	if _, err := svc.AdvanceExpiryStages(ctx, now); err != nil {
+		t.Fatalf("advance failed: %v", err)
+	}
+	if err := svc.RenewOrder(ctx, late.ID, 30); err != nil {
+		t.Fatalf("renew in grace failed: %v", err)
+	}
+	renewed := load(late.ID)
+	if renewed.ExpiryStage != "" || !renewed.ExpiresAt.Equal(lateExpired.Add(30*24*time.Hour)) {
+		t.Fatalf("expected renewal to continue from the missed expiry, got %s stage=%q", renewed.ExpiresAt, renewed.ExpiryStage)
+	}
+}
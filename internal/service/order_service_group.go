@@ -27,6 +27,9 @@ func (s *OrderService) createDedicatedOrder(ctx context.Context, in CreateOrderI
 	if err != nil {
 		return nil, err
 	}
+	if len(in.countryCodes) > 0 && !containsCountryCode(in.countryCodes, ingress.CountryCode) {
+		return nil, fmt.Errorf("ingress country %s is outside the allowed countries %s", ingress.CountryCode, strings.Join(in.countryCodes, ","))
+	}
 	primaryPort := inbound.ListenPort
 	if primaryPort <= 0 {
 		return nil, fmt.Errorf("dedicated inbound has no usable port for protocol %s", protocol)
@@ -63,6 +66,10 @@ func (s *OrderService) createDedicatedOrder(ctx context.Context, in CreateOrderI
 		Port:               primaryPort,
 		StartsAt:           now,
 		ExpiresAt:          expiresAt,
+		Price:              in.Price,
+		ProductID:          uintPtrOrNil(in.ProductID),
+		IsTrial:            in.IsTrial,
+		TrialCapBytes:      in.TrialCapBytes,
 		IsGroupHead:        true,
 		DedicatedEntryID:   uintPtrOrNil(entry.ID),
 		DedicatedInboundID: uintPtrOrNil(inbound.ID),
@@ -85,6 +92,12 @@ func (s *OrderService) createDedicatedOrder(ctx context.Context, in CreateOrderI
 		if err := tx.Model(&model.Order{}).Where("id = ?", head.ID).Updates(headUpdates).Error; err != nil {
 			return err
 		}
+		if err := recordOrderChargeTx(tx, *head, head.Price, now, expiresAt, LedgerSourceCreate); err != nil {
+			return err
+		}
+		if err := countTrialTx(tx, *head); err != nil {
+			return err
+		}
 		if err := tx.Model(&model.Order{}).Where("id = ?", head.ID).Updates(map[string]interface{}{
 			"group_id":   head.ID,
 			"updated_at": now,
@@ -105,6 +118,8 @@ func (s *OrderService) createDedicatedOrder(ctx context.Context, in CreateOrderI
 				DedicatedInboundID: uintPtrOrNil(inbound.ID),
 				DedicatedIngressID: uintPtrOrNil(ingress.ID),
 				DedicatedProtocol:  protocol,
+				ProductID:          uintPtrOrNil(in.ProductID),
+				IsTrial:            in.IsTrial,
 				Name:               childName,
 				Mode:               model.OrderModeDedicated,
 				Status:             model.OrderStatusActive,
@@ -293,6 +308,9 @@ func (s *OrderService) resolveDedicatedBindingForUpdateTx(tx *gorm.DB, protocol
 }
 
 func (s *OrderService) rebuildManagedRuntime(ctx context.Context) error {
+	if err := s.SyncHostIPAssignments(time.Now()); err != nil {
+		s.log.Warn("sync host ip assignments failed", zap.Error(err))
+	}
 	return s.xray.RebuildAndRestartManaged(ctx)
 }
 
@@ -308,12 +326,15 @@ func (s *OrderService) updateOrderGroup(ctx context.Context, head model.Order, i
 	}
 	targetStatus := model.OrderStatusActive
 	itemStatus := model.OrderItemStatusActive
-	if !targetExpires.After(now) {
+	// An overdue group in its grace stage stays up until the scheduler cuts
+	// it off.
+	inGrace := head.ExpiryStage != "" && !targetExpires.After(now)
+	if !targetExpires.After(now) && !inGrace {
 		targetStatus = model.OrderStatusExpired
 		itemStatus = model.OrderItemStatusExpired
 	}
 
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
+	if err := s.versionedTx(ctx, head.ID, func(tx *gorm.DB) error {
 		children, err := s.loadGroupChildrenTx(tx, head.ID)
 		if err != nil {
 			return err
@@ -365,14 +386,18 @@ func (s *OrderService) updateOrderGroup(ctx context.Context, head model.Order, i
 		}
 
 		headUpdates := map[string]interface{}{
-			"name":                targetName,
-			"status":              targetStatus,
-			"expires_at":          targetExpires,
-			"notify_one_day_sent": false,
-			"notify_expired_sent": false,
-			"dedicated_protocol":  targetProtocol,
-			"port":                targetPort,
-			"updated_at":          now,
+			"name":               targetName,
+			"status":             targetStatus,
+			"expires_at":         targetExpires,
+			"dedicated_protocol": targetProtocol,
+			"port":               targetPort,
+			"updated_at":         now,
+		}
+		if in.Price != nil {
+			headUpdates["price"] = *in.Price
+		}
+		if !inGrace {
+			headUpdates["expiry_stage"] = ""
 		}
 		if targetEntryID != nil {
 			headUpdates["dedicated_entry_id"] = *targetEntryID
@@ -388,13 +413,14 @@ func (s *OrderService) updateOrderGroup(ctx context.Context, head model.Order, i
 		}
 		for _, child := range children {
 			childUpdates := map[string]interface{}{
-				"status":              targetStatus,
-				"expires_at":          targetExpires,
-				"notify_one_day_sent": false,
-				"notify_expired_sent": false,
-				"dedicated_protocol":  targetProtocol,
-				"port":                targetPort,
-				"updated_at":          now,
+				"status":             targetStatus,
+				"expires_at":         targetExpires,
+				"dedicated_protocol": targetProtocol,
+				"port":               targetPort,
+				"updated_at":         now,
+			}
+			if !inGrace {
+				childUpdates["expiry_stage"] = ""
 			}
 			if targetEntryID != nil {
 				childUpdates["dedicated_entry_id"] = *targetEntryID
@@ -426,13 +452,30 @@ func (s *OrderService) updateOrderGroup(ctx context.Context, head model.Order, i
 func (s *OrderService) deactivateOrderGroup(ctx context.Context, head model.Order, status string, itemStatus string) error {
 	now := time.Now()
 	if err := s.db.Transaction(func(tx *gorm.DB) error {
-		if err := tx.Model(&model.Order{}).Where("id = ? or parent_order_id = ?", head.ID, head.ID).Updates(map[string]interface{}{
-			"status":     status,
-			"updated_at": now,
+		if err := bumpOrderVersionTx(tx, head.ID); err != nil {
+			return err
+		}
+		ids := []uint{}
+		query := tx.Model(&model.Order{}).Where("id = ? or parent_order_id = ?", head.ID, head.ID)
+		// A suspension only takes down live lines so that resuming it does
+		// not revive children that were already off.
+		if status == model.OrderStatusSuspended {
+			query = query.Where("status = ?", model.OrderStatusActive)
+		}
+		if err := query.Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		if err := tx.Model(&model.Order{}).Where("id in ?", ids).Updates(map[string]interface{}{
+			"status":       status,
+			"expiry_stage": "",
+			"updated_at":   now,
 		}).Error; err != nil {
 			return err
 		}
-		return tx.Model(&model.OrderItem{}).Where("order_id in (?)", tx.Model(&model.Order{}).Select("id").Where("id = ? or parent_order_id = ?", head.ID, head.ID)).Updates(map[string]interface{}{
+		return tx.Model(&model.OrderItem{}).Where("order_id in ?", ids).Updates(map[string]interface{}{
 			"status":     itemStatus,
 			"updated_at": now,
 		}).Error
@@ -442,33 +485,38 @@ func (s *OrderService) deactivateOrderGroup(ctx context.Context, head model.Orde
 	return s.rebuildManagedRuntime(ctx)
 }
 
-func (s *OrderService) renewOrderGroup(ctx context.Context, head model.Order, moreDays int, expiresAt time.Time) error {
+func (s *OrderService) renewOrderGroup(ctx context.Context, head model.Order, moreDays int, expiresAt time.Time, source string) error {
 	newExpires := expiresAt
 	if newExpires.IsZero() {
 		if moreDays <= 0 {
 			moreDays = 30
 		}
-		base := head.ExpiresAt
-		if base.Before(time.Now()) {
-			base = time.Now()
-		}
-		newExpires = base.Add(time.Duration(moreDays) * 24 * time.Hour)
+		newExpires = renewBase(head, time.Now()).Add(time.Duration(moreDays) * 24 * time.Hour)
 	}
 	now := time.Now()
 	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := bumpOrderVersionTx(tx, head.ID); err != nil {
+			return err
+		}
 		if err := tx.Model(&model.Order{}).Where("id = ? or parent_order_id = ?", head.ID, head.ID).Updates(map[string]interface{}{
 			"status":              model.OrderStatusActive,
 			"expires_at":          newExpires,
-			"notify_one_day_sent": false,
-			"notify_expired_sent": false,
+			"expiry_stage":        "",
+			"notify_balance_sent": false,
 			"updated_at":          now,
 		}).Error; err != nil {
 			return err
 		}
-		return tx.Model(&model.OrderItem{}).Where("order_id in (?)", tx.Model(&model.Order{}).Select("id").Where("id = ? or parent_order_id = ?", head.ID, head.ID)).Updates(map[string]interface{}{
+		if err := recordOrderChargeTx(tx, head, head.Price, renewBase(head, now), newExpires, source); err != nil {
+			return err
+		}
+		if err := tx.Model(&model.OrderItem{}).Where("order_id in (?)", tx.Model(&model.Order{}).Select("id").Where("id = ? or parent_order_id = ?", head.ID, head.ID)).Updates(map[string]interface{}{
 			"status":     model.OrderItemStatusActive,
 			"updated_at": now,
-		}).Error
+		}).Error; err != nil {
+			return err
+		}
+		return runRenewalTxHook(ctx, tx)
 	}); err != nil {
 		return err
 	}
@@ -476,6 +524,10 @@ func (s *OrderService) renewOrderGroup(ctx context.Context, head model.Order, mo
 }
 
 func (s *OrderService) RenewOrderGroupSelected(ctx context.Context, headOrderID uint, childOrderIDs []uint, moreDays int, expiresAt time.Time) error {
+	return s.renewOrderGroupSelected(ctx, headOrderID, childOrderIDs, moreDays, expiresAt, LedgerSourceRenew)
+}
+
+func (s *OrderService) renewOrderGroupSelected(ctx context.Context, headOrderID uint, childOrderIDs []uint, moreDays int, expiresAt time.Time, source string) error {
 	if headOrderID == 0 {
 		return errors.New("order_id is required")
 	}
@@ -494,12 +546,18 @@ func (s *OrderService) RenewOrderGroupSelected(ctx context.Context, headOrderID
 	if !head.IsGroupHead {
 		return errors.New("only group head order supports selected renew")
 	}
+	if head.IsTrial {
+		return errors.New("trial orders are converted to paid, not renewed")
+	}
+	if err := s.ensureCustomerNotSuspended(head.CustomerID); err != nil {
+		return err
+	}
 	if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
 		return errors.New("expires_at must be in the future")
 	}
 
 	now := time.Now()
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
+	if err := s.versionedTx(ctx, head.ID, func(tx *gorm.DB) error {
 		children := []model.Order{}
 		if err := tx.Where("parent_order_id = ? and id in ?", head.ID, ids).Find(&children).Error; err != nil {
 			return err
@@ -510,25 +568,29 @@ func (s *OrderService) RenewOrderGroupSelected(ctx context.Context, headOrderID
 		if len(children) != len(ids) {
 			return fmt.Errorf("matched child orders %d not equal request %d", len(children), len(ids))
 		}
+		// Group prices live on the head; each renewed line pays its share.
+		childPrice := 0.0
+		if head.Quantity > 0 {
+			childPrice = head.Price / float64(head.Quantity)
+		}
 
 		for _, child := range children {
 			newExpires := expiresAt
 			if newExpires.IsZero() {
-				base := child.ExpiresAt
-				if base.Before(now) {
-					base = now
-				}
-				newExpires = base.Add(time.Duration(moreDays) * 24 * time.Hour)
+				newExpires = renewBase(child, now).Add(time.Duration(moreDays) * 24 * time.Hour)
 			}
 			if err := tx.Model(&model.Order{}).Where("id = ?", child.ID).Updates(map[string]interface{}{
 				"status":              model.OrderStatusActive,
 				"expires_at":          newExpires,
-				"notify_one_day_sent": false,
-				"notify_expired_sent": false,
+				"expiry_stage":        "",
+				"notify_balance_sent": false,
 				"updated_at":          now,
 			}).Error; err != nil {
 				return err
 			}
+			if err := recordOrderChargeTx(tx, child, childPrice, renewBase(child, now), newExpires, source); err != nil {
+				return err
+			}
 			if err := tx.Model(&model.OrderItem{}).Where("order_id = ?", child.ID).Updates(map[string]interface{}{
 				"status":     model.OrderItemStatusActive,
 				"updated_at": now,
@@ -538,7 +600,7 @@ func (s *OrderService) RenewOrderGroupSelected(ctx context.Context, headOrderID
 		}
 
 		allChildren := []model.Order{}
-		if err := tx.Select("id", "status", "expires_at").Where("parent_order_id = ?", head.ID).Find(&allChildren).Error; err != nil {
+		if err := tx.Select("id", "status", "expires_at", "expiry_stage").Where("parent_order_id = ?", head.ID).Find(&allChildren).Error; err != nil {
 			return err
 		}
 		headExpires := now
@@ -547,20 +609,22 @@ func (s *OrderService) RenewOrderGroupSelected(ctx context.Context, headOrderID
 			if child.ExpiresAt.After(headExpires) {
 				headExpires = child.ExpiresAt
 			}
-			if child.Status == model.OrderStatusActive && child.ExpiresAt.After(now) {
+			if orderLive(child, now) {
 				headStatus = model.OrderStatusActive
 			}
 		}
-		if err := tx.Model(&model.Order{}).Where("id = ?", head.ID).Updates(map[string]interface{}{
-			"status":              headStatus,
-			"expires_at":          headExpires,
-			"notify_one_day_sent": false,
-			"notify_expired_sent": false,
-			"updated_at":          now,
-		}).Error; err != nil {
+		headUpdates := map[string]interface{}{
+			"status":     headStatus,
+			"expires_at": headExpires,
+			"updated_at": now,
+		}
+		if headExpires.After(now) {
+			headUpdates["expiry_stage"] = ""
+		}
+		if err := tx.Model(&model.Order{}).Where("id = ?", head.ID).Updates(headUpdates).Error; err != nil {
 			return err
 		}
-		return nil
+		return runRenewalTxHook(ctx, tx)
 	}); err != nil {
 		return err
 	}
@@ -703,8 +767,11 @@ func (s *OrderService) UpdateGroupSocks5(ctx context.Context, orderID uint, line
 	if !head.IsGroupHead {
 		return errors.New("only group head order can batch update socks5")
 	}
+	if err := s.ensureOrderBaseline(head.ID); err != nil {
+		return err
+	}
 	now := time.Now()
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
+	if err := s.versionedTx(ctx, head.ID, func(tx *gorm.DB) error {
 		children, err := s.loadGroupChildrenTx(tx, head.ID)
 		if err != nil {
 			return err
@@ -713,6 +780,7 @@ func (s *OrderService) UpdateGroupSocks5(ctx context.Context, orderID uint, line
 	}); err != nil {
 		return err
 	}
+	s.recordOrderVersion(head.ID, OrderVersionSourceSocks5)
 	return s.rebuildManagedRuntime(ctx)
 }
 
@@ -724,8 +792,11 @@ func (s *OrderService) UpdateGroupCredentials(ctx context.Context, orderID uint,
 	if !head.IsGroupHead {
 		return errors.New("only group head order can batch update credentials")
 	}
+	if err := s.ensureOrderBaseline(head.ID); err != nil {
+		return err
+	}
 	now := time.Now()
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
+	if err := s.versionedTx(ctx, head.ID, func(tx *gorm.DB) error {
 		children, err := s.loadGroupChildrenTx(tx, head.ID)
 		if err != nil {
 			return err
@@ -738,6 +809,7 @@ func (s *OrderService) UpdateGroupCredentials(ctx context.Context, orderID uint,
 	}); err != nil {
 		return err
 	}
+	s.recordOrderVersion(head.ID, OrderVersionSourceCredentials)
 	return s.rebuildManagedRuntime(ctx)
 }
 
@@ -753,8 +825,11 @@ func (s *OrderService) UpdateGroupSocks5Selected(ctx context.Context, orderID ui
 	if !head.IsGroupHead {
 		return errors.New("only group head order can batch update socks5")
 	}
+	if err := s.ensureOrderBaseline(head.ID); err != nil {
+		return err
+	}
 	now := time.Now()
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
+	if err := s.versionedTx(ctx, head.ID, func(tx *gorm.DB) error {
 		children, err := s.loadGroupChildrenByIDsTx(tx, head.ID, ids)
 		if err != nil {
 			return err
@@ -763,6 +838,7 @@ func (s *OrderService) UpdateGroupSocks5Selected(ctx context.Context, orderID ui
 	}); err != nil {
 		return err
 	}
+	s.recordOrderVersion(head.ID, OrderVersionSourceSocks5)
 	return s.rebuildManagedRuntime(ctx)
 }
 
@@ -778,8 +854,11 @@ func (s *OrderService) UpdateGroupCredentialsSelected(ctx context.Context, order
 	if !head.IsGroupHead {
 		return errors.New("only group head order can batch update credentials")
 	}
+	if err := s.ensureOrderBaseline(head.ID); err != nil {
+		return err
+	}
 	now := time.Now()
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
+	if err := s.versionedTx(ctx, head.ID, func(tx *gorm.DB) error {
 		children, err := s.loadGroupChildrenByIDsTx(tx, head.ID, ids)
 		if err != nil {
 			return err
@@ -792,6 +871,7 @@ func (s *OrderService) UpdateGroupCredentialsSelected(ctx context.Context, order
 	}); err != nil {
 		return err
 	}
+	s.recordOrderVersion(head.ID, OrderVersionSourceCredentials)
 	return s.rebuildManagedRuntime(ctx)
 }
 
@@ -803,6 +883,9 @@ func (s *OrderService) UpdateGroupEgressGeo(ctx context.Context, orderID uint, c
 	if !head.IsGroupHead {
 		return errors.New("only group head order can batch update egress geo")
 	}
+	if err := s.ensureOrderBaseline(head.ID); err != nil {
+		return err
+	}
 	countryCode = strings.ToLower(strings.TrimSpace(countryCode))
 	if countryCode == "" {
 		return errors.New("country_code is required")
@@ -810,7 +893,7 @@ func (s *OrderService) UpdateGroupEgressGeo(ctx context.Context, orderID uint, c
 	region = strings.TrimSpace(region)
 	ids := uniqueUintIDs(childOrderIDs)
 	now := time.Now()
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
+	if err := s.versionedTx(ctx, head.ID, func(tx *gorm.DB) error {
 		children := []model.Order{}
 		var err error
 		if len(ids) > 0 {
@@ -853,6 +936,7 @@ func (s *OrderService) UpdateGroupEgressGeo(ctx context.Context, orderID uint, c
 	}); err != nil {
 		return err
 	}
+	s.recordOrderVersion(head.ID, OrderVersionSourceEgressGeo)
 	_ = ctx
 	return nil
 }
@@ -865,12 +949,15 @@ func (s *OrderService) UpdateGroupEgressGeoByMapping(ctx context.Context, orderI
 	if !head.IsGroupHead {
 		return errors.New("only group head order can batch update egress geo")
 	}
+	if err := s.ensureOrderBaseline(head.ID); err != nil {
+		return err
+	}
 	geoRows, err := parseDedicatedEgressGeoLines(lines, defaultCountryCode, defaultRegion)
 	if err != nil {
 		return err
 	}
 	now := time.Now()
-	if err := s.db.Transaction(func(tx *gorm.DB) error {
+	if err := s.versionedTx(ctx, head.ID, func(tx *gorm.DB) error {
 		children, err := s.loadGroupChildrenTx(tx, head.ID)
 		if err != nil {
 			return err
@@ -940,6 +1027,7 @@ func (s *OrderService) UpdateGroupEgressGeoByMapping(ctx context.Context, orderI
 	}); err != nil {
 		return err
 	}
+	s.recordOrderVersion(head.ID, OrderVersionSourceEgressGeo)
 	_ = ctx
 	return nil
 }
@@ -972,7 +1060,7 @@ func (s *OrderService) ensureCustomerDedicatedEgressUniqueTx(tx *gorm.DB, custom
 	q := tx.Table("dedicated_egresses de").
 		Select("de.address, de.port, de.username, de.password").
 		Joins("join orders o on o.id = de.order_id").
-		Where("o.customer_id = ? and o.mode = ? and o.status = ? and o.expires_at > ?", customerID, model.OrderModeDedicated, model.OrderStatusActive, time.Now())
+		Where("o.customer_id = ? and o.mode = ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '')", customerID, model.OrderModeDedicated, model.OrderStatusActive, time.Now())
 	if len(excludeOrderIDs) > 0 {
 		q = q.Where("o.id not in ?", uniqueUintIDs(excludeOrderIDs))
 	}
@@ -1220,7 +1308,7 @@ func (s *OrderService) ensureDedicatedMixedUsernamesAvailableTx(tx *gorm.DB, por
 	q := tx.Table("order_items oi").
 		Select("oi.username").
 		Joins("join orders o on o.id = oi.order_id").
-		Where("o.mode = ? and o.dedicated_protocol = ? and o.status = ? and o.expires_at > ? and oi.status = ? and oi.port = ? and oi.username in ?",
+		Where("o.mode = ? and o.dedicated_protocol = ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '') and oi.status = ? and oi.port = ? and oi.username in ?",
 			model.OrderModeDedicated,
 			model.DedicatedFeatureMixed,
 			model.OrderStatusActive,
@@ -1245,6 +1333,36 @@ func (s *OrderService) ensureDedicatedMixedUsernamesAvailableTx(tx *gorm.DB, por
 	return nil
 }
 
+// ensureDedicatedMixedOrdersUsernamesTx runs the shared-port username check
+// for dedicated mixed orders coming back with credentials they held before,
+// one port at a time.
+func (s *OrderService) ensureDedicatedMixedOrdersUsernamesTx(tx *gorm.DB, orders []model.Order) error {
+	byPort := map[int][]model.Order{}
+	ports := make([]int, 0)
+	for _, order := range orders {
+		if order.Mode != model.OrderModeDedicated || !strings.EqualFold(strings.TrimSpace(order.DedicatedProtocol), model.DedicatedFeatureMixed) || len(order.Items) == 0 {
+			continue
+		}
+		if _, ok := byPort[order.Port]; !ok {
+			ports = append(ports, order.Port)
+		}
+		byPort[order.Port] = append(byPort[order.Port], order)
+	}
+	for _, port := range ports {
+		group := byPort[port]
+		rows := make([]DedicatedCredentialLine, 0, len(group))
+		for _, order := range group {
+			for _, item := range order.Items {
+				rows = append(rows, DedicatedCredentialLine{Username: item.Username})
+			}
+		}
+		if err := s.ensureDedicatedMixedUsernamesAvailableTx(tx, port, group, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func generateDedicatedCredentialsByProtocol(protocol string) (string, string, string) {
 	protocol = strings.ToLower(strings.TrimSpace(protocol))
 	username := randomString(8)
@@ -156,7 +156,7 @@ func setupOrderServiceTestDB(t *testing.T) *gorm.DB {
 	if err != nil {
 		t.Fatalf("open sqlite failed: %v", err)
 	}
-	if err := db.AutoMigrate(&model.Customer{}, &model.HostIP{}, &model.DedicatedEntry{}, &model.DedicatedInbound{}, &model.DedicatedIngress{}, &model.Order{}, &model.OrderItem{}, &model.DedicatedEgress{}, &model.XrayResource{}, &model.Setting{}, &model.RuntimeTrafficSnapshot{}); err != nil {
+	if err := db.AutoMigrate(&model.Customer{}, &model.HostIP{}, &model.SocksOutbound{}, &model.SocksOutboundProbe{}, &model.UpstreamBenchmark{}, &model.EgressPool{}, &model.EgressPoolMember{}, &model.DedicatedEntry{}, &model.DedicatedInbound{}, &model.DedicatedIngress{}, &model.Product{}, &model.Order{}, &model.OrderItem{}, &model.DedicatedEgress{}, &model.LedgerEntry{}, &model.PaymentEvent{}, &model.ScheduledAction{}, &model.OrderTransfer{}, &model.OrderItemIPHistory{}, &model.HostIPAssignment{}, &model.Reservation{}, &model.ReservationItem{}, &model.RecycleBinEntry{}, &model.ReminderLog{}, &model.SavedFilter{}, &model.OrderVersion{}, &model.IntegrityRun{}, &model.XrayResource{}, &model.Setting{}, &model.TaskLog{}, &model.RuntimeTrafficSnapshot{}); err != nil {
 		t.Fatalf("automigrate failed: %v", err)
 	}
 	return db
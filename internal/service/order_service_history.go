@@ -0,0 +1,539 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	OrderVersionSourceBaseline    = "baseline"
+	OrderVersionSourceUpdate      = "update"
+	OrderVersionSourceCredentials = "credentials"
+	OrderVersionSourceSocks5      = "socks5"
+	OrderVersionSourceEgressGeo   = "egress_geo"
+	OrderVersionSourceEgressPool  = "egress_pool"
+	OrderVersionSourceRotateIP    = "rotate_ip"
+	OrderVersionSourceRehome      = "rehome"
+	OrderVersionSourceRevert      = "revert"
+	OrderVersionSourceIntegrity   = "integrity"
+)
+
+// orderVersionNoise are columns that move without anyone changing the order
+// (probe results, timestamps) and are left out of diffs.
+var orderVersionNoise = map[string]struct{}{
+	"updated_at":            {},
+	"last_probed_at":        {},
+	"probe_status":          {},
+	"probe_error":           {},
+	"bench_connect_ms":      {},
+	"bench_ttfb_ms":         {},
+	"bench_throughput_kbps": {},
+	"benched_at":            {},
+}
+
+type OrderVersionDetail struct {
+	model.OrderVersion
+	Orders   []model.Order           `json:"orders"`
+	Items    []model.OrderItem       `json:"items"`
+	Egresses []model.DedicatedEgress `json:"egresses"`
+}
+
+type OrderFieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+type OrderVersionChange struct {
+	Kind    string             `json:"kind"`
+	ID      uint               `json:"id"`
+	OrderID uint               `json:"order_id"`
+	Action  string             `json:"action"`
+	Fields  []OrderFieldChange `json:"fields,omitempty"`
+}
+
+type OrderVersionDiff struct {
+	OrderID uint                 `json:"order_id"`
+	From    int                  `json:"from"`
+	To      int                  `json:"to"`
+	Changes []OrderVersionChange `json:"changes"`
+}
+
+func orderHistoryKeep(db *gorm.DB) int {
+	row := model.Setting{}
+	if err := db.Where("key = ?", "order_history_keep").Limit(1).Find(&row).Error; err != nil {
+		return 50
+	}
+	keep := parseSettingInt(row.Value, 50)
+	if keep < 0 {
+		return 0
+	}
+	return keep
+}
+
+// orderHistoryRoot maps a group child to its head; history is kept per
+// group so a revert restores the whole group consistently.
+func orderHistoryRoot(order model.Order) uint {
+	if order.ParentOrderID != nil && *order.ParentOrderID > 0 {
+		return *order.ParentOrderID
+	}
+	return order.ID
+}
+
+func (s *OrderService) orderHistoryRootID(orderID uint) (uint, error) {
+	order := model.Order{}
+	if err := s.db.Select("id", "parent_order_id").First(&order, orderID).Error; err != nil {
+		return 0, err
+	}
+	return orderHistoryRoot(order), nil
+}
+
+func orderGroupIDsTx(tx *gorm.DB, rootID uint) ([]uint, error) {
+	ids := []uint{rootID}
+	children := []uint{}
+	if err := tx.Model(&model.Order{}).Where("parent_order_id = ?", rootID).Order("id asc").Pluck("id", &children).Error; err != nil {
+		return nil, err
+	}
+	return append(ids, children...), nil
+}
+
+func loadOrderVersionPayloadTx(tx *gorm.DB, rootID uint) (orderSnapshot, string, error) {
+	ids, err := orderGroupIDsTx(tx, rootID)
+	if err != nil {
+		return orderSnapshot{}, "", err
+	}
+	payload, err := loadOrderSnapshotTx(tx, ids)
+	if err != nil {
+		return payload, "", err
+	}
+	for i := range payload.Orders {
+		payload.Orders[i].UpdatedAt = time.Time{}
+		payload.Orders[i].Version = 0
+	}
+	for i := range payload.Items {
+		payload.Items[i].UpdatedAt = time.Time{}
+	}
+	for i := range payload.Egresses {
+		payload.Egresses[i].UpdatedAt = time.Time{}
+	}
+	for i := range payload.Resources {
+		payload.Resources[i].UpdatedAt = time.Time{}
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return payload, "", err
+	}
+	return payload, string(raw), nil
+}
+
+// recordOrderVersionTx stores the current state of rootID's group as the next
+// version, unless it is identical to the latest one.
+func recordOrderVersionTx(tx *gorm.DB, rootID uint, source string, now time.Time) error {
+	payload, raw, err := loadOrderVersionPayloadTx(tx, rootID)
+	if err != nil {
+		return err
+	}
+	if len(payload.Orders) == 0 {
+		return nil
+	}
+	latest := model.OrderVersion{}
+	if err := tx.Where("order_id = ?", rootID).Order("version desc").Limit(1).Find(&latest).Error; err != nil {
+		return err
+	}
+	if latest.ID > 0 && latest.Payload == raw {
+		return nil
+	}
+	if err := tx.Create(&model.OrderVersion{
+		OrderID:    rootID,
+		Version:    latest.Version + 1,
+		Source:     source,
+		OrderCount: len(payload.Orders),
+		ItemCount:  len(payload.Items),
+		Payload:    raw,
+		CreatedAt:  now,
+	}).Error; err != nil {
+		return err
+	}
+	if keep := orderHistoryKeep(tx); keep > 0 && latest.Version+1 > keep {
+		return tx.Where("order_id = ? and version <= ?", rootID, latest.Version+1-keep).Delete(&model.OrderVersion{}).Error
+	}
+	return nil
+}
+
+// ensureOrderBaseline keeps the state an order had before its first tracked
+// change, so even the first edit can be diffed and reverted.
+func (s *OrderService) ensureOrderBaseline(rootID uint) error {
+	var count int64
+	if err := s.db.Model(&model.OrderVersion{}).Where("order_id = ?", rootID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return recordOrderVersionTx(tx, rootID, OrderVersionSourceBaseline, time.Now())
+	})
+}
+
+// recordOrderVersion runs after a change has been committed; a failure only
+// loses the history entry, so it is logged rather than returned.
+func (s *OrderService) recordOrderVersion(rootID uint, source string) {
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		return recordOrderVersionTx(tx, rootID, source, time.Now())
+	}); err != nil {
+		s.log.Warn("record order version failed", zap.Error(err), zap.Uint("order_id", rootID), zap.String("source", source))
+	}
+}
+
+func (s *OrderService) ListOrderVersions(orderID uint) ([]model.OrderVersion, error) {
+	rootID, err := s.orderHistoryRootID(orderID)
+	if err != nil {
+		return nil, err
+	}
+	rows := []model.OrderVersion{}
+	if err := s.db.Omit("payload").Where("order_id = ?", rootID).Order("version desc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *OrderService) loadOrderVersion(rootID uint, version int) (model.OrderVersion, orderSnapshot, error) {
+	row := model.OrderVersion{}
+	payload := orderSnapshot{}
+	if err := s.db.Where("order_id = ? and version = ?", rootID, version).First(&row).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return row, payload, fmt.Errorf("order version %d not found", version)
+		}
+		return row, payload, err
+	}
+	if err := json.Unmarshal([]byte(row.Payload), &payload); err != nil {
+		return row, payload, err
+	}
+	return row, payload, nil
+}
+
+func (s *OrderService) GetOrderVersion(orderID uint, version int) (*OrderVersionDetail, error) {
+	rootID, err := s.orderHistoryRootID(orderID)
+	if err != nil {
+		return nil, err
+	}
+	row, payload, err := s.loadOrderVersion(rootID, version)
+	if err != nil {
+		return nil, err
+	}
+	return &OrderVersionDetail{OrderVersion: row, Orders: payload.Orders, Items: payload.Items, Egresses: payload.Egresses}, nil
+}
+
+// DiffOrderVersions compares two versions of an order; a version of 0 stands
+// for the order as it is now.
+func (s *OrderService) DiffOrderVersions(orderID uint, from int, to int) (OrderVersionDiff, error) {
+	diff := OrderVersionDiff{From: from, To: to, Changes: []OrderVersionChange{}}
+	rootID, err := s.orderHistoryRootID(orderID)
+	if err != nil {
+		return diff, err
+	}
+	diff.OrderID = rootID
+	load := func(version int) (orderSnapshot, error) {
+		if version == 0 {
+			payload, _, err := loadOrderVersionPayloadTx(s.db, rootID)
+			return payload, err
+		}
+		_, payload, err := s.loadOrderVersion(rootID, version)
+		return payload, err
+	}
+	before, err := load(from)
+	if err != nil {
+		return diff, err
+	}
+	after, err := load(to)
+	if err != nil {
+		return diff, err
+	}
+	diff.Changes = append(diff.Changes, diffOrderVersionRows("order", before.Orders, after.Orders, func(row model.Order) (uint, uint) { return row.ID, row.ID })...)
+	diff.Changes = append(diff.Changes, diffOrderVersionRows("item", before.Items, after.Items, func(row model.OrderItem) (uint, uint) { return row.ID, row.OrderID })...)
+	diff.Changes = append(diff.Changes, diffOrderVersionRows("egress", before.Egresses, after.Egresses, func(row model.DedicatedEgress) (uint, uint) { return row.ID, row.OrderID })...)
+	return diff, nil
+}
+
+func diffOrderVersionRows[T any](kind string, before []T, after []T, key func(T) (uint, uint)) []OrderVersionChange {
+	type entry struct {
+		orderID uint
+		fields  map[string]interface{}
+	}
+	index := func(rows []T) (map[uint]entry, []uint) {
+		out := make(map[uint]entry, len(rows))
+		ids := make([]uint, 0, len(rows))
+		for _, row := range rows {
+			id, orderID := key(row)
+			out[id] = entry{orderID: orderID, fields: orderVersionFields(row)}
+			ids = append(ids, id)
+		}
+		return out, ids
+	}
+	beforeRows, beforeIDs := index(before)
+	afterRows, afterIDs := index(after)
+	ids := uniqueUintIDs(append(beforeIDs, afterIDs...))
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	changes := make([]OrderVersionChange, 0)
+	for _, id := range ids {
+		old, hadOld := beforeRows[id]
+		cur, hasNew := afterRows[id]
+		switch {
+		case !hadOld:
+			changes = append(changes, OrderVersionChange{Kind: kind, ID: id, OrderID: cur.orderID, Action: "added"})
+		case !hasNew:
+			changes = append(changes, OrderVersionChange{Kind: kind, ID: id, OrderID: old.orderID, Action: "removed"})
+		default:
+			fields := make([]OrderFieldChange, 0)
+			for name, value := range cur.fields {
+				if prev := old.fields[name]; fmt.Sprint(prev) != fmt.Sprint(value) {
+					fields = append(fields, OrderFieldChange{Field: name, From: prev, To: value})
+				}
+			}
+			for name, prev := range old.fields {
+				if _, ok := cur.fields[name]; !ok {
+					fields = append(fields, OrderFieldChange{Field: name, From: prev, To: nil})
+				}
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			sort.Slice(fields, func(i, j int) bool { return fields[i].Field < fields[j].Field })
+			changes = append(changes, OrderVersionChange{Kind: kind, ID: id, OrderID: cur.orderID, Action: "changed", Fields: fields})
+		}
+	}
+	return changes
+}
+
+// orderVersionFields flattens a row to its scalar JSON fields; nested
+// associations are empty in snapshots and skipped.
+func orderVersionFields(row interface{}) map[string]interface{} {
+	raw, err := json.Marshal(row)
+	if err != nil {
+		return map[string]interface{}{}
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return map[string]interface{}{}
+	}
+	for name, value := range fields {
+		if _, noisy := orderVersionNoise[name]; noisy {
+			delete(fields, name)
+			continue
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			delete(fields, name)
+		}
+	}
+	return fields
+}
+
+// revertItemStatus keeps snapshot item states on live orders and parks the
+// items of offline orders the way DeactivateOrder does.
+func revertItemStatus(orderStatus string, itemStatus string) string {
+	switch orderStatus {
+	case model.OrderStatusActive:
+		return itemStatus
+	case model.OrderStatusExpired:
+		return model.OrderItemStatusExpired
+	default:
+		return model.OrderItemStatusDisabled
+	}
+}
+
+// RevertOrderVersion puts an order's items, credentials, dedicated egress and
+// settings back to a saved version and rebuilds the runtime. Lifecycle and
+// billing fields (status, expiry, price, customer, tags, notes) stay as they
+// are now, so a revert never renews, reactivates or moves an order. Versions
+// taken before a group gained or lost a child cannot be reverted to.
+func (s *OrderService) RevertOrderVersion(ctx context.Context, orderID uint, version int) (*model.OrderVersion, error) {
+	rootID, err := s.orderHistoryRootID(orderID)
+	if err != nil {
+		return nil, err
+	}
+	target, payload, err := s.loadOrderVersion(rootID, version)
+	if err != nil {
+		return nil, err
+	}
+	currentIDs, err := orderGroupIDsTx(s.db, rootID)
+	if err != nil {
+		return nil, err
+	}
+	currentRows := []model.Order{}
+	if err := s.db.Where("id in ?", currentIDs).Find(&currentRows).Error; err != nil {
+		return nil, err
+	}
+	current := map[uint]model.Order{}
+	for _, row := range currentRows {
+		current[row.ID] = row
+	}
+	root, ok := current[rootID]
+	if !ok {
+		return nil, errors.New("order not found")
+	}
+	if root.Status == model.OrderStatusSuspended {
+		return nil, errors.New("order is suspended with its customer, unsuspend first")
+	}
+
+	// Reverting across a membership change would have to drop or resurrect
+	// whole lines; that goes through delete and the recycle bin instead.
+	if len(payload.Orders) != len(currentRows) {
+		return nil, fmt.Errorf("group membership changed since version %d, restore or delete orders first", version)
+	}
+	for _, row := range payload.Orders {
+		if _, ok := current[row.ID]; !ok {
+			return nil, fmt.Errorf("group membership changed since version %d, restore or delete orders first", version)
+		}
+	}
+
+	now := time.Now()
+	snapshotIDs := make([]uint, 0, len(payload.Orders))
+	statusByOrder := map[uint]string{}
+	for i := range payload.Orders {
+		row := &payload.Orders[i]
+		live := current[row.ID]
+		row.CustomerID = root.CustomerID
+		row.Status = live.Status
+		row.StartsAt = live.StartsAt
+		row.ExpiresAt = live.ExpiresAt
+		row.ExpiryStage = live.ExpiryStage
+		row.Price = live.Price
+		row.IsTrial = live.IsTrial
+		row.TrialCapBytes = live.TrialCapBytes
+		row.Tags = live.Tags
+		row.Notes = live.Notes
+		row.NotifyBalanceSent = live.NotifyBalanceSent
+		row.Version = live.Version + 1
+		row.UpdatedAt = now
+		snapshotIDs = append(snapshotIDs, row.ID)
+		statusByOrder[row.ID] = row.Status
+	}
+	itemsByOrder := map[uint][]model.OrderItem{}
+	for i := range payload.Items {
+		item := &payload.Items[i]
+		item.Status = revertItemStatus(statusByOrder[item.OrderID], item.Status)
+		item.UpdatedAt = now
+		itemsByOrder[item.OrderID] = append(itemsByOrder[item.OrderID], *item)
+	}
+	for i := range payload.Egresses {
+		payload.Egresses[i].UpdatedAt = now
+	}
+	orders := make([]model.Order, 0, len(payload.Orders))
+	for _, row := range payload.Orders {
+		row.Items = itemsByOrder[row.ID]
+		orders = append(orders, row)
+	}
+	if err := s.ensureRevertedIPsFree(orders, root.CustomerID, rootID, now); err != nil {
+		return nil, err
+	}
+	if err := s.ensureRestoredHostIPsUsable(orders, root.CustomerID, rootID, now); err != nil {
+		return nil, err
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		itemIDs := []uint{}
+		if err := tx.Model(&model.OrderItem{}).Where("order_id in ?", currentIDs).Pluck("id", &itemIDs).Error; err != nil {
+			return err
+		}
+		if len(itemIDs) > 0 {
+			if err := tx.Where("order_item_id in ?", itemIDs).Delete(&model.XrayResource{}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("order_id in ?", currentIDs).Delete(&model.DedicatedEgress{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("order_id in ?", currentIDs).Delete(&model.OrderItem{}).Error; err != nil {
+			return err
+		}
+		for i := range payload.Orders {
+			row := payload.Orders[i]
+			if err := tx.Omit(clause.Associations).Save(&row).Error; err != nil {
+				return err
+			}
+		}
+		if len(payload.Items) > 0 {
+			if err := tx.Omit(clause.Associations).Create(&payload.Items).Error; err != nil {
+				return err
+			}
+		}
+		if len(payload.Egresses) > 0 {
+			if err := tx.Omit(clause.Associations).Create(&payload.Egresses).Error; err != nil {
+				return err
+			}
+		}
+		if len(payload.Resources) > 0 {
+			if err := tx.Omit(clause.Associations).Create(&payload.Resources).Error; err != nil {
+				return err
+			}
+		}
+		if err := s.ensureTransferDedicatedEgressUniqueTx(tx, root.CustomerID, snapshotIDs); err != nil {
+			return err
+		}
+		if err := s.ensureDedicatedMixedOrdersUsernamesTx(tx, orders); err != nil {
+			return err
+		}
+		for _, order := range orders {
+			if err := s.ensureTransferCredentialsTx(tx, order); err != nil {
+				return err
+			}
+			if err := s.ensureTransferForwardCapacityTx(ctx, tx, order, root.CustomerID); err != nil {
+				return err
+			}
+		}
+		if root.IsGroupHead {
+			if err := refreshGroupHeadTx(tx, rootID, now); err != nil {
+				return err
+			}
+		}
+		return recordOrderVersionTx(tx, rootID, fmt.Sprintf("%s:%d", OrderVersionSourceRevert, target.Version), now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rebuildManagedRuntime(ctx); err != nil {
+		return nil, err
+	}
+	latest := model.OrderVersion{}
+	if err := s.db.Omit("payload").Where("order_id = ?", rootID).Order("version desc").First(&latest).Error; err != nil {
+		return nil, err
+	}
+	return &latest, nil
+}
+
+// ensureRevertedIPsFree checks that live residential items going back to
+// old IPs do not collide with the customer's other orders.
+func (s *OrderService) ensureRevertedIPsFree(orders []model.Order, customerID uint, rootID uint, now time.Time) error {
+	used, err := s.customerUsedIPSet(customerID, rootID)
+	if err != nil {
+		return err
+	}
+	for _, order := range orders {
+		if order.Mode == model.OrderModeDedicated || !orderLive(order, now) {
+			continue
+		}
+		for _, item := range order.Items {
+			if item.Status != model.OrderItemStatusActive || strings.TrimSpace(item.IP) == "" {
+				continue
+			}
+			if _, exists := used[item.IP]; exists {
+				return fmt.Errorf("ip %s is now used by another order of this customer", item.IP)
+			}
+			used[item.IP] = struct{}{}
+		}
+	}
+	return nil
+}
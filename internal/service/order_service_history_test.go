@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+)
+
+func TestOrderHistoryDiffAndRevert(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	ctx := context.Background()
+
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	customer := seedBillingCustomer(t, db, "history", "198.51.100.91")
+	order, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: customer.ID, Name: "before", Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create order failed: %v", err)
+	}
+	original := order.Items[0]
+	price := 12.5
+	if _, err := svc.UpdateOrder(ctx, order.ID, UpdateOrderInput{Name: "after", Price: &price}); err != nil {
+		t.Fatalf("update order failed: %v", err)
+	}
+	if err := svc.RefreshResidentialCredentials(ctx, order.ID); err != nil {
+		t.Fatalf("refresh credentials failed: %v", err)
+	}
+	versions, err := svc.ListOrderVersions(order.ID)
+	if err != nil {
+		t.Fatalf("list versions failed: %v", err)
+	}
+	if len(versions) != 3 || versions[0].Source != OrderVersionSourceCredentials || versions[2].Source != OrderVersionSourceBaseline {
+		t.Fatalf("unexpected versions: %+v", versions)
+	}
+
+	diff, err := svc.DiffOrderVersions(order.ID, 1, 3)
+	if err != nil {
+		t.Fatalf("diff failed: %v", err)
+	}
+	changed := map[string]bool{}
+	for _, change := range diff.Changes {
+		for _, field := range change.Fields {
+			changed[change.Kind+"."+field.Field] = true
+		}
+	}
+	if !changed["order.name"] || !changed["order.price"] || !changed["item.username"] || !changed["item.password"] || changed["order.updated_at"] {
+		t.Fatalf("unexpected diff: %+v", diff.Changes)
+	}
+
+	reverted, err := svc.RevertOrderVersion(ctx, order.ID, 1)
+	if err != nil {
+		t.Fatalf("revert failed: %v", err)
+	}
+	if reverted.Version != 4 || reverted.Source != "revert:1" {
+		t.Fatalf("unexpected revert version: %+v", reverted)
+	}
+	current, err := svc.GetOrder(order.ID)
+	if err != nil {
+		t.Fatalf("load order failed: %v", err)
+	}
+	if current.Name != "before" || current.Price != price {
+		t.Fatalf("expected name reverted and price kept, got name=%s price=%v", current.Name, current.Price)
+	}
+	if len(current.Items) != 1 || current.Items[0].Username != original.Username || current.Items[0].Password != original.Password {
+		t.Fatalf("expected original credentials back, got %+v", current.Items)
+	}
+	now, err := svc.DiffOrderVersions(order.ID, 1, 0)
+	if err != nil {
+		t.Fatalf("diff against current failed: %v", err)
+	}
+	for _, change := range now.Changes {
+		for _, field := range change.Fields {
+			if field.Field != "price" {
+				t.Fatalf("unexpected change after revert: %+v", change)
+			}
+		}
+	}
+
+	headID, _ := seedDedicatedCopyLinksTestGroup(t, db)
+	if err := svc.UpdateGroupEgressGeo(ctx, headID, nil, "US", "ca"); err != nil {
+		t.Fatalf("update egress geo failed: %v", err)
+	}
+	var egresses int64
+	db.Model(&model.DedicatedEgress{}).Where("country_code = ?", "us").Count(&egresses)
+	if egresses == 0 {
+		t.Fatalf("expected egress geo rows")
+	}
+	if _, err := svc.RevertOrderVersion(ctx, headID, 1); err != nil {
+		t.Fatalf("group revert failed: %v", err)
+	}
+	db.Model(&model.DedicatedEgress{}).Where("country_code = ?", "us").Count(&egresses)
+	if egresses != 0 {
+		t.Fatalf("expected egress geo reverted, still %d rows", egresses)
+	}
+	if _, err := svc.RevertOrderVersion(ctx, headID, 9); err == nil {
+		t.Fatalf("expected unknown version to fail")
+	}
+
+	childIDs := []uint{}
+	db.Model(&model.Order{}).Where("parent_order_id = ?", headID).Order("id asc").Pluck("id", &childIDs)
+	if err := svc.DeleteOrder(ctx, childIDs[0]); err != nil {
+		t.Fatalf("delete child failed: %v", err)
+	}
+	if _, err := svc.RevertOrderVersion(ctx, headID, 1); err == nil || !strings.Contains(err.Error(), "membership changed") {
+		t.Fatalf("expected revert across a removed child to be refused, got %v", err)
+	}
+	var binned int64
+	db.Model(&model.RecycleBinEntry{}).Count(&binned)
+	if binned != 1 {
+		t.Fatalf("expected the deleted child to stay in the recycle bin, got %d entries", binned)
+	}
+}
+
+func TestOrderHistoryRevertChecksMixedUsernames(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	ctx := context.Background()
+
+	headID, children := seedDedicatedGroupForGeoTest(t, db)
+	if err := db.Model(&model.OrderItem{}).Where("id = ?", children[1].itemID).Update("username", "x2").Error; err != nil {
+		t.Fatalf("set username failed: %v", err)
+	}
+	if err := svc.ensureOrderBaseline(headID); err != nil {
+		t.Fatalf("baseline failed: %v", err)
+	}
+	if err := db.Model(&model.OrderItem{}).Where("id = ?", children[1].itemID).Update("username", "x3").Error; err != nil {
+		t.Fatalf("change username failed: %v", err)
+	}
+	now := time.Now()
+	other := model.Order{CustomerID: 1, Name: "other", Mode: model.OrderModeDedicated, DedicatedProtocol: model.DedicatedFeatureMixed, Status: model.OrderStatusActive, Quantity: 1, Port: 1080, StartsAt: now, ExpiresAt: now.Add(time.Hour)}
+	if err := db.Create(&other).Error; err != nil {
+		t.Fatalf("create other order failed: %v", err)
+	}
+	if err := db.Create(&model.OrderItem{OrderID: other.ID, IP: "127.0.0.1", Port: 1080, Username: "x2", Password: "p", Managed: true, Status: model.OrderItemStatusActive}).Error; err != nil {
+		t.Fatalf("create other item failed: %v", err)
+	}
+	if _, err := svc.RevertOrderVersion(ctx, headID, 1); err == nil || !strings.Contains(err.Error(), "already used on shared port") {
+		t.Fatalf("expected revert onto a taken mixed username to fail, got %v", err)
+	}
+}
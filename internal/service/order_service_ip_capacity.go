@@ -0,0 +1,299 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+)
+
+type HostIPCapacity struct {
+	HostIPID     uint   `json:"host_ip_id"`
+	IP           string `json:"ip"`
+	Tier         string `json:"tier"`
+	Customers    int    `json:"customers"`
+	MaxCustomers int    `json:"max_customers"`
+	Items        int    `json:"items"`
+	MaxItems     int    `json:"max_items"`
+	Full         bool   `json:"full"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// hostIPLoad is the live usage of one host IP.
+type hostIPLoad struct {
+	items     int
+	customers map[uint]struct{}
+}
+
+type hostIPCapacityChecker struct {
+	loads        map[string]*hostIPLoad
+	maxCustomers int
+	maxItems     int
+}
+
+func normalizeHostIPTier(raw string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "", model.HostIPTierShared:
+		return model.HostIPTierShared, nil
+	case model.HostIPTierExclusive:
+		return model.HostIPTierExclusive, nil
+	}
+	return "", errors.New("tier must be shared/exclusive")
+}
+
+// normalizeOrderIPTier keeps an empty tier, meaning the order takes any IP.
+func normalizeOrderIPTier(raw string) (string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return "", nil
+	}
+	return normalizeHostIPTier(raw)
+}
+
+func hostIPTier(host model.HostIP) string {
+	if strings.EqualFold(strings.TrimSpace(host.Tier), model.HostIPTierExclusive) {
+		return model.HostIPTierExclusive
+	}
+	return model.HostIPTierShared
+}
+
+func hostIPTierMatcher(tier string) func(model.HostIP) bool {
+	if tier == "" {
+		return nil
+	}
+	return func(host model.HostIP) bool {
+		return hostIPTier(host) == tier
+	}
+}
+
+func combineHostIPMatchers(matchers ...func(model.HostIP) bool) func(model.HostIP) bool {
+	active := make([]func(model.HostIP) bool, 0, len(matchers))
+	for _, match := range matchers {
+		if match != nil {
+			active = append(active, match)
+		}
+	}
+	if len(active) == 0 {
+		return nil
+	}
+	return func(host model.HostIP) bool {
+		for _, match := range active {
+			if !match(host) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (s *OrderService) loadHostIPCapacityChecker(excludeOrderID uint) (*hostIPCapacityChecker, error) {
+	settings := map[string]string{}
+	rows := []model.Setting{}
+	if err := s.db.Where("key in ?", []string{"host_ip_max_customers", "host_ip_max_items"}).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		settings[row.Key] = row.Value
+	}
+	checker := &hostIPCapacityChecker{
+		loads:        map[string]*hostIPLoad{},
+		maxCustomers: parseSettingInt(settings["host_ip_max_customers"], 0),
+		maxItems:     parseSettingInt(settings["host_ip_max_items"], 0),
+	}
+	type loadRow struct {
+		IP         string
+		CustomerID uint
+		Count      int
+	}
+	loadRows := []loadRow{}
+	query := s.db.Table("order_items oi").
+		Select("oi.ip as ip, o.customer_id as customer_id, count(1) as count").
+		Joins("join orders o on o.id = oi.order_id").
+		Where("o.mode <> ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '') and oi.status = ?", model.OrderModeDedicated, model.OrderStatusActive, time.Now(), model.OrderItemStatusActive)
+	if excludeOrderID > 0 {
+		query = query.Where("o.id <> ? and (o.parent_order_id is null or o.parent_order_id <> ?)", excludeOrderID, excludeOrderID)
+	}
+	if err := query.Group("oi.ip, o.customer_id").Scan(&loadRows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range loadRows {
+		load := checker.load(row.IP)
+		load.items += row.Count
+		load.customers[row.CustomerID] = struct{}{}
+	}
+	return checker, nil
+}
+
+func (c *hostIPCapacityChecker) load(ip string) *hostIPLoad {
+	load, ok := c.loads[ip]
+	if !ok {
+		load = &hostIPLoad{customers: map[uint]struct{}{}}
+		c.loads[ip] = load
+	}
+	return load
+}
+
+// claim books items of customerID on ip as if they were already active.
+func (c *hostIPCapacityChecker) claim(ip string, customerID uint, items int) {
+	load := c.load(ip)
+	load.items += items
+	load.customers[customerID] = struct{}{}
+}
+
+func (c *hostIPCapacityChecker) limits(host model.HostIP) (int, int) {
+	maxCustomers := c.maxCustomers
+	if host.MaxCustomers > 0 {
+		maxCustomers = host.MaxCustomers
+	}
+	if hostIPTier(host) == model.HostIPTierExclusive {
+		maxCustomers = 1
+	}
+	maxItems := c.maxItems
+	if host.MaxItems > 0 {
+		maxItems = host.MaxItems
+	}
+	return maxCustomers, maxItems
+}
+
+// reason explains why customerID cannot add addItems more items on host, or
+// returns "" when it fits. A customer already on the IP takes no new slot.
+func (c *hostIPCapacityChecker) reason(host model.HostIP, customerID uint, addItems int) string {
+	maxCustomers, maxItems := c.limits(host)
+	load := c.load(host.IP)
+	if maxCustomers > 0 {
+		_, present := load.customers[customerID]
+		if !present && len(load.customers)+1 > maxCustomers {
+			if hostIPTier(host) == model.HostIPTierExclusive {
+				return "exclusive ip already taken"
+			}
+			return fmt.Sprintf("customers %d/%d", len(load.customers), maxCustomers)
+		}
+	}
+	if maxItems > 0 && load.items+addItems > maxItems {
+		return fmt.Sprintf("items %d/%d", load.items, maxItems)
+	}
+	return ""
+}
+
+func (c *hostIPCapacityChecker) capacity(host model.HostIP) HostIPCapacity {
+	maxCustomers, maxItems := c.limits(host)
+	load := c.load(host.IP)
+	row := HostIPCapacity{
+		HostIPID:     host.ID,
+		IP:           host.IP,
+		Tier:         hostIPTier(host),
+		Customers:    len(load.customers),
+		MaxCustomers: maxCustomers,
+		Items:        load.items,
+		MaxItems:     maxItems,
+	}
+	if reason := c.reason(host, 0, 1); reason != "" {
+		row.Full = true
+		row.Reason = reason
+	}
+	return row
+}
+
+// ensureHostIPCapacity checks a batch of items a customer is about to put on
+// host IPs; IPs that are not local host addresses are not limited.
+func (s *OrderService) ensureHostIPCapacity(customerID uint, excludeOrderID uint, itemsByIP map[string]int) error {
+	if len(itemsByIP) == 0 {
+		return nil
+	}
+	ips := make([]string, 0, len(itemsByIP))
+	for ip := range itemsByIP {
+		ips = append(ips, ip)
+	}
+	hosts := []model.HostIP{}
+	if err := s.db.Where("ip in ?", ips).Find(&hosts).Error; err != nil {
+		return err
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+	checker, err := s.loadHostIPCapacityChecker(excludeOrderID)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		if reason := checker.reason(host, customerID, itemsByIP[host.IP]); reason != "" {
+			return fmt.Errorf("ip %s is at capacity (%s)", host.IP, reason)
+		}
+	}
+	return nil
+}
+
+// HostIPCapacityReport lists the usable pool with its current load and limits.
+func (s *OrderService) HostIPCapacityReport() ([]HostIPCapacity, error) {
+	pool, err := s.usableIPPool()
+	if err != nil {
+		return nil, err
+	}
+	checker, err := s.loadHostIPCapacityChecker(0)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]HostIPCapacity, 0, len(pool))
+	for _, host := range pool {
+		out = append(out, checker.capacity(host))
+	}
+	return out, nil
+}
+
+// hostIPPool splits the usable pool the way auto allocation sees it.
+type hostIPPool struct {
+	candidates []model.HostIP
+	returned   []model.HostIP
+	reuse      map[string]hostIPReuse
+	used       int
+	cooling    int
+	reserved   int
+	full       []HostIPCapacity
+}
+
+// classifyHostIPPool sorts all into the pool buckets. A nil checker loads the
+// current host IP load; callers planning several orders at once pass their own.
+func (s *OrderService) classifyHostIPPool(customerID uint, excludeOrderID uint, all []model.HostIP, usedByCustomer map[string]struct{}, now time.Time, checker *hostIPCapacityChecker) (hostIPPool, error) {
+	pool := hostIPPool{candidates: make([]model.HostIP, 0, len(all)), returned: []model.HostIP{}, full: []HostIPCapacity{}}
+	reuse, err := s.hostIPReuseState(customerID, now)
+	if err != nil {
+		return pool, err
+	}
+	pool.reuse = reuse
+	if checker == nil {
+		if checker, err = s.loadHostIPCapacityChecker(excludeOrderID); err != nil {
+			return pool, err
+		}
+	}
+	reserved, err := loadReservedResources(s.db, customerID, now)
+	if err != nil {
+		return pool, err
+	}
+	cooldown := hostIPCooldown(s.db)
+	for _, ip := range all {
+		if _, exists := usedByCustomer[ip.IP]; exists {
+			pool.used++
+			continue
+		}
+		if _, held := reserved.hostIPs[ip.ID]; held {
+			pool.reserved++
+			continue
+		}
+		state := reuse[ip.IP]
+		if cooldown > 0 && !state.lastReleased.IsZero() && now.Sub(state.lastReleased) < cooldown {
+			pool.cooling++
+			continue
+		}
+		if checker.reason(ip, customerID, 1) != "" {
+			pool.full = append(pool.full, checker.capacity(ip))
+			continue
+		}
+		if state.returned {
+			pool.returned = append(pool.returned, ip)
+			continue
+		}
+		pool.candidates = append(pool.candidates, ip)
+	}
+	return pool, nil
+}
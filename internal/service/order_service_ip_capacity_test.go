@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+)
+
+func TestHostIPCapacityEnforcedAcrossAllocationPreviewAndImport(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	hostIPs := NewHostIPService(db)
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	first := seedBillingCustomer(t, db, "cap-first", "198.51.100.60")
+	shared := model.HostIP{IP: "198.51.100.61", IsPublic: true, IsLocal: true, Enabled: true}
+	if err := db.Create(&shared).Error; err != nil {
+		t.Fatalf("create host ip failed: %v", err)
+	}
+	exclusive := model.HostIP{}
+	if err := db.Where("ip = ?", "198.51.100.60").First(&exclusive).Error; err != nil {
+		t.Fatalf("load host ip failed: %v", err)
+	}
+	if _, err := hostIPs.UpdatePolicy(exclusive.ID, model.HostIPTierExclusive, 0, 0); err != nil {
+		t.Fatalf("set exclusive tier failed: %v", err)
+	}
+	if _, err := hostIPs.UpdatePolicy(shared.ID, "", 0, 1); err != nil {
+		t.Fatalf("set item limit failed: %v", err)
+	}
+	if _, err := hostIPs.UpdatePolicy(shared.ID, "premium", 0, 1); err == nil {
+		t.Fatalf("expected unknown tier to be rejected")
+	}
+	second := model.Customer{Name: "cap-second", Code: "cap-second", Status: model.OrderStatusActive}
+	third := model.Customer{Name: "cap-third", Code: "cap-third", Status: model.OrderStatusActive}
+	for _, customer := range []*model.Customer{&second, &third} {
+		if err := db.Create(customer).Error; err != nil {
+			t.Fatalf("create customer failed: %v", err)
+		}
+	}
+	ctx := context.Background()
+
+	order, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: first.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort, IPTier: model.HostIPTierExclusive})
+	if err != nil {
+		t.Fatalf("create exclusive order failed: %v", err)
+	}
+	if order.IPTier != model.HostIPTierExclusive || len(order.Items) != 1 || order.Items[0].IP != exclusive.IP {
+		t.Fatalf("expected exclusive ip, got tier=%s items=%+v", order.IPTier, order.Items)
+	}
+	if _, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: second.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort, IPTier: model.HostIPTierExclusive}); err == nil || !strings.Contains(err.Error(), "at capacity") {
+		t.Fatalf("expected exclusive ip to be taken, got %v", err)
+	}
+
+	preview, err := svc.AllocationPreview(second.ID, 0, "")
+	if err != nil {
+		t.Fatalf("preview failed: %v", err)
+	}
+	if preview.PoolSize != 2 || preview.AtCapacity != 1 || preview.Available != 1 || len(preview.FullIPs) != 1 || preview.FullIPs[0].IP != exclusive.IP {
+		t.Fatalf("unexpected preview: %+v", preview)
+	}
+
+	secondOrder, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: second.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create shared order failed: %v", err)
+	}
+	if secondOrder.Items[0].IP != shared.IP {
+		t.Fatalf("expected shared ip, got %s", secondOrder.Items[0].IP)
+	}
+
+	rows := []ImportPreviewRow{{IP: shared.IP, Port: residentialTestPort, Username: "imp-user", Password: "imp-pass"}}
+	if _, err := svc.ImportOrder(ctx, third.ID, "imported", time.Now().Add(24*time.Hour), rows); err == nil || !strings.Contains(err.Error(), "items 1/1") {
+		t.Fatalf("expected import to hit item limit, got %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+)
+
+const (
+	HostIPReleaseExpired  = "expired"
+	HostIPReleaseRotated  = "rotated"
+	HostIPReleaseDeleted  = "deleted"
+	HostIPReleaseDisabled = "disabled"
+)
+
+type HostIPLineageEntry struct {
+	CustomerID    uint       `json:"customer_id"`
+	CustomerName  string     `json:"customer_name"`
+	CustomerCode  string     `json:"customer_code"`
+	OrderID       uint       `json:"order_id"`
+	OrderNo       string     `json:"order_no"`
+	OrderItemID   uint       `json:"order_item_id"`
+	AssignedAt    time.Time  `json:"assigned_at"`
+	ReleasedAt    *time.Time `json:"released_at,omitempty"`
+	ReleaseReason string     `json:"release_reason"`
+}
+
+type HostIPLineage struct {
+	HostIPID       uint                 `json:"host_ip_id"`
+	IP             string               `json:"ip"`
+	Enabled        bool                 `json:"enabled"`
+	ActiveItems    int                  `json:"active_items"`
+	LastReleasedAt *time.Time           `json:"last_released_at,omitempty"`
+	CooldownUntil  *time.Time           `json:"cooldown_until,omitempty"`
+	Entries        []HostIPLineageEntry `json:"entries"`
+}
+
+// hostIPReuse summarises the released history of one IP for allocation.
+type hostIPReuse struct {
+	lastReleased time.Time
+	returned     bool
+}
+
+func hostIPCooldown(db *gorm.DB) time.Duration {
+	row := model.Setting{}
+	if err := db.Where("key = ?", "host_ip_cooldown_hours").Limit(1).Find(&row).Error; err != nil {
+		return 0
+	}
+	hours, err := strconv.Atoi(strings.TrimSpace(row.Value))
+	if err != nil || hours <= 0 {
+		return 0
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// SyncHostIPAssignments reconciles the assignment history with the items that
+// currently hold host IPs: new holders open a row, vanished holders close
+// theirs. Release times are therefore as precise as the sync cadence.
+func (s *OrderService) SyncHostIPAssignments(now time.Time) error {
+	s.assignMu.Lock()
+	defer s.assignMu.Unlock()
+
+	held, err := loadHostIPHolders(s.db, now)
+	if err != nil {
+		return err
+	}
+	open := []model.HostIPAssignment{}
+	if err := s.db.Where("released_at is null").Find(&open).Error; err != nil {
+		return err
+	}
+	opened := make(map[string]struct{}, len(open))
+	closing := make([]model.HostIPAssignment, 0)
+	for _, row := range open {
+		k := hostIPHolderKey(row.OrderItemID, row.IP)
+		if _, ok := held[k]; ok {
+			opened[k] = struct{}{}
+			continue
+		}
+		closing = append(closing, row)
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, row := range closing {
+			reason, err := hostIPReleaseReasonTx(tx, row, now)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&model.HostIPAssignment{}).Where("id = ?", row.ID).Updates(map[string]interface{}{
+				"released_at":    now,
+				"release_reason": reason,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		for k, row := range held {
+			if _, ok := opened[k]; ok {
+				continue
+			}
+			if err := tx.Create(&model.HostIPAssignment{
+				HostIPID:    row.HostIPID,
+				IP:          row.IP,
+				CustomerID:  row.CustomerID,
+				OrderID:     row.OrderID,
+				OrderNo:     row.OrderNo,
+				OrderItemID: row.ItemID,
+				AssignedAt:  now,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type hostIPHolder struct {
+	ItemID     uint
+	OrderID    uint
+	OrderNo    string
+	CustomerID uint
+	HostIPID   uint
+	IP         string
+}
+
+func hostIPHolderKey(itemID uint, ip string) string {
+	return fmt.Sprintf("%d|%s", itemID, ip)
+}
+
+// loadHostIPHolders returns the live non-dedicated items sitting on a host IP.
+func loadHostIPHolders(db *gorm.DB, now time.Time) (map[string]hostIPHolder, error) {
+	rows := []hostIPHolder{}
+	if err := db.Table("order_items oi").
+		Select("oi.id as item_id, oi.order_id as order_id, o.order_no as order_no, o.customer_id as customer_id, h.id as host_ip_id, oi.ip as ip").
+		Joins("join orders o on o.id = oi.order_id").
+		Joins("join host_ips h on h.ip = oi.ip").
+		Where("o.mode <> ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '') and oi.status = ?", model.OrderModeDedicated, model.OrderStatusActive, now, model.OrderItemStatusActive).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make(map[string]hostIPHolder, len(rows))
+	for _, row := range rows {
+		out[hostIPHolderKey(row.ItemID, row.IP)] = row
+	}
+	return out, nil
+}
+
+func hostIPReleaseReasonTx(tx *gorm.DB, row model.HostIPAssignment, now time.Time) (string, error) {
+	item := model.OrderItem{}
+	if err := tx.Where("id = ?", row.OrderItemID).Limit(1).Find(&item).Error; err != nil {
+		return "", err
+	}
+	if item.ID == 0 {
+		return HostIPReleaseDeleted, nil
+	}
+	if item.IP != row.IP {
+		return HostIPReleaseRotated, nil
+	}
+	order := model.Order{}
+	if err := tx.Where("id = ?", item.OrderID).Limit(1).Find(&order).Error; err != nil {
+		return "", err
+	}
+	if order.Status == model.OrderStatusExpired || (order.Status == model.OrderStatusActive && !orderLive(order, now)) {
+		return HostIPReleaseExpired, nil
+	}
+	return HostIPReleaseDisabled, nil
+}
+
+// hostIPReuseState summarises the released history per IP in SQL, flagging
+// the ones this customer has given back before. It only reads, since
+// allocation may run inside another transaction: open rows whose holder is
+// gone count as released now until the next sync closes them.
+func (s *OrderService) hostIPReuseState(customerID uint, now time.Time) (map[string]hostIPReuse, error) {
+	// Selecting the row that holds the max keeps released_at typed; sqlite
+	// hands max() back as bare text.
+	released := []struct {
+		IP         string
+		ReleasedAt time.Time
+	}{}
+	if err := s.db.Table("host_ip_assignments a").
+		Select("a.ip as ip, a.released_at as released_at").
+		Where("a.released_at is not null and a.released_at = (select max(b.released_at) from host_ip_assignments b where b.ip = a.ip)").
+		Scan(&released).Error; err != nil {
+		return nil, err
+	}
+
+	holder := s.db.Table("order_items oi").
+		Select("1").
+		Joins("join orders o on o.id = oi.order_id").
+		Joins("join host_ips h on h.ip = oi.ip").
+		Where("oi.id = a.order_item_id and oi.ip = a.ip").
+		Where("o.mode <> ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '') and oi.status = ?", model.OrderModeDedicated, model.OrderStatusActive, now, model.OrderItemStatusActive)
+	flags := []struct {
+		IP       string
+		Pending  bool
+		Returned bool
+	}{}
+	if err := s.db.Table("host_ip_assignments a").
+		Select("a.ip as ip, max(case when a.released_at is null then 1 else 0 end) as pending, max(case when a.customer_id = ? then 1 else 0 end) as returned", customerID).
+		Where("(a.released_at is null and not exists (?)) or (a.released_at is not null and a.customer_id = ?)", holder, customerID).
+		Group("a.ip").
+		Scan(&flags).Error; err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]hostIPReuse, len(released)+len(flags))
+	for _, row := range released {
+		out[row.IP] = hostIPReuse{lastReleased: row.ReleasedAt}
+	}
+	for _, row := range flags {
+		state := out[row.IP]
+		if row.Pending {
+			state.lastReleased = now
+		}
+		if customerID > 0 && row.Returned {
+			state.returned = true
+		}
+		out[row.IP] = state
+	}
+	return out, nil
+}
+
+// rankHostIPCandidates orders one usage bucket: IPs never released keep the
+// scattered pick, released IPs follow with the longest idle first.
+func rankHostIPCandidates(bucket []model.HostIP, reuse map[string]hostIPReuse, take int, seed int) []model.HostIP {
+	fresh := make([]model.HostIP, 0, len(bucket))
+	idle := make([]model.HostIP, 0)
+	for _, ip := range bucket {
+		if reuse[ip.IP].lastReleased.IsZero() {
+			fresh = append(fresh, ip)
+			continue
+		}
+		idle = append(idle, ip)
+	}
+	sortByIdle(idle, reuse)
+	picked := scatteredPick(fresh, take, seed)
+	for _, ip := range idle {
+		if len(picked) >= take {
+			break
+		}
+		picked = append(picked, ip)
+	}
+	return picked
+}
+
+func sortByIdle(rows []model.HostIP, reuse map[string]hostIPReuse) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return reuse[rows[i].IP].lastReleased.Before(reuse[rows[j].IP].lastReleased)
+	})
+}
+
+// HostIPLineage lists every host IP (or just ip) with the customers that have
+// held it, newest first.
+func (s *OrderService) HostIPLineage(ip string, now time.Time) ([]HostIPLineage, error) {
+	if err := s.SyncHostIPAssignments(now); err != nil {
+		return nil, err
+	}
+	hosts := []model.HostIP{}
+	query := s.db.Model(&model.HostIP{})
+	if ip = strings.TrimSpace(ip); ip != "" {
+		query = query.Where("ip = ?", ip)
+	}
+	if err := query.Find(&hosts).Error; err != nil {
+		return nil, err
+	}
+	sort.Slice(hosts, func(i, j int) bool { return lessIPString(hosts[i].IP, hosts[j].IP) })
+
+	type entryRow struct {
+		model.HostIPAssignment
+		CustomerName string
+		CustomerCode string
+	}
+	rows := []entryRow{}
+	entries := s.db.Table("host_ip_assignments a").
+		Select("a.*, c.name as customer_name, c.code as customer_code").
+		Joins("left join customers c on c.id = a.customer_id")
+	if ip != "" {
+		entries = entries.Where("a.ip = ?", ip)
+	}
+	if err := entries.Order("a.assigned_at desc, a.id desc").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	byIP := map[string][]entryRow{}
+	for _, row := range rows {
+		byIP[row.IP] = append(byIP[row.IP], row)
+	}
+
+	cooldown := hostIPCooldown(s.db)
+	out := make([]HostIPLineage, 0, len(hosts))
+	for _, host := range hosts {
+		lineage := HostIPLineage{HostIPID: host.ID, IP: host.IP, Enabled: host.Enabled, Entries: []HostIPLineageEntry{}}
+		for _, row := range byIP[host.IP] {
+			if row.ReleasedAt == nil {
+				lineage.ActiveItems++
+			} else if lineage.LastReleasedAt == nil || row.ReleasedAt.After(*lineage.LastReleasedAt) {
+				released := *row.ReleasedAt
+				lineage.LastReleasedAt = &released
+			}
+			lineage.Entries = append(lineage.Entries, HostIPLineageEntry{
+				CustomerID:    row.CustomerID,
+				CustomerName:  row.CustomerName,
+				CustomerCode:  row.CustomerCode,
+				OrderID:       row.OrderID,
+				OrderNo:       row.OrderNo,
+				OrderItemID:   row.OrderItemID,
+				AssignedAt:    row.AssignedAt,
+				ReleasedAt:    row.ReleasedAt,
+				ReleaseReason: row.ReleaseReason,
+			})
+		}
+		if lineage.LastReleasedAt != nil && cooldown > 0 {
+			until := lineage.LastReleasedAt.Add(cooldown)
+			if until.After(now) {
+				lineage.CooldownUntil = &until
+			}
+		}
+		out = append(out, lineage)
+	}
+	return out, nil
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+)
+
+func TestAllocateIPsHonoursCooldownAndReturnedIPs(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	first := seedBillingCustomer(t, db, "first", "198.51.100.50")
+	if err := db.Create(&model.HostIP{IP: "198.51.100.51", IsPublic: true, IsLocal: true, Enabled: true}).Error; err != nil {
+		t.Fatalf("create host ip failed: %v", err)
+	}
+	second := model.Customer{Name: "second", Code: "second", Status: model.OrderStatusActive}
+	third := model.Customer{Name: "third", Code: "third", Status: model.OrderStatusActive}
+	for _, customer := range []*model.Customer{&second, &third} {
+		if err := db.Create(customer).Error; err != nil {
+			t.Fatalf("create customer failed: %v", err)
+		}
+	}
+	if err := store.New(db).SetSettings(map[string]string{"host_ip_cooldown_hours": "24"}); err != nil {
+		t.Fatalf("set cooldown failed: %v", err)
+	}
+	ctx := context.Background()
+	itemIP := func(orderID uint) string {
+		t.Helper()
+		item := model.OrderItem{}
+		if err := db.Where("order_id = ?", orderID).First(&item).Error; err != nil {
+			t.Fatalf("load item failed: %v", err)
+		}
+		return item.IP
+	}
+
+	firstOrder, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: first.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create first order failed: %v", err)
+	}
+	returnedIP := itemIP(firstOrder.ID)
+	if err := svc.DeleteOrder(ctx, firstOrder.ID); err != nil {
+		t.Fatalf("delete first order failed: %v", err)
+	}
+
+	secondOrder, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: second.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create second order failed: %v", err)
+	}
+	otherIP := itemIP(secondOrder.ID)
+	if otherIP == returnedIP {
+		t.Fatalf("ip %s handed out during cooldown", returnedIP)
+	}
+	if _, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: third.ID, Quantity: 2, DurationDay: 30, Port: residentialTestPort}); err == nil || !strings.Contains(err.Error(), "less than quantity") {
+		t.Fatalf("expected cooling ip to be unavailable, got %v", err)
+	}
+
+	if err := store.New(db).SetSettings(map[string]string{"host_ip_cooldown_hours": "0"}); err != nil {
+		t.Fatalf("clear cooldown failed: %v", err)
+	}
+	if _, err := svc.RotateOrderIPs(ctx, secondOrder.ID, RotateOrderIPInput{}); err != nil {
+		t.Fatalf("rotate failed: %v", err)
+	}
+	if got := itemIP(secondOrder.ID); got != returnedIP {
+		t.Fatalf("expected rotation onto %s, got %s", returnedIP, got)
+	}
+	// Both IPs are free of the first customer now, but it gave back returnedIP.
+	again, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: first.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create repeat order failed: %v", err)
+	}
+	if got := itemIP(again.ID); got != otherIP {
+		t.Fatalf("expected %s for returning customer, got %s", otherIP, got)
+	}
+
+	lineage, err := svc.HostIPLineage(returnedIP, time.Now())
+	if err != nil {
+		t.Fatalf("lineage failed: %v", err)
+	}
+	if len(lineage) != 1 || len(lineage[0].Entries) != 2 || lineage[0].ActiveItems != 1 {
+		t.Fatalf("unexpected lineage: %+v", lineage)
+	}
+	oldest := lineage[0].Entries[1]
+	if oldest.CustomerID != first.ID || oldest.ReleaseReason != HostIPReleaseDeleted || oldest.ReleasedAt == nil {
+		t.Fatalf("unexpected first holder: %+v", oldest)
+	}
+}
+
+func TestHostIPReuseStateAggregatesHistory(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	holder := seedBillingCustomer(t, db, "holder", "198.51.100.50")
+	order, err := svc.CreateOrder(context.Background(), CreateOrderInput{CustomerID: holder.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create order failed: %v", err)
+	}
+	now := time.Now()
+	if err := svc.SyncHostIPAssignments(now); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	var open int64
+	if err := db.Model(&model.HostIPAssignment{}).Where("ip = ? and released_at is null", "198.51.100.50").Count(&open).Error; err != nil || open != 1 {
+		t.Fatalf("expected an open row for the live holder, got %d %v", open, err)
+	}
+
+	older := now.Add(-48 * time.Hour)
+	newer := now.Add(-2 * time.Hour)
+	for _, row := range []model.HostIPAssignment{
+		{IP: "198.51.100.60", CustomerID: 7, OrderItemID: 900, AssignedAt: older.Add(-time.Hour), ReleasedAt: &older},
+		{IP: "198.51.100.60", CustomerID: 8, OrderItemID: 901, AssignedAt: older, ReleasedAt: &newer},
+		{IP: "198.51.100.61", CustomerID: 8, OrderItemID: 902, AssignedAt: older},
+	} {
+		if err := db.Create(&row).Error; err != nil {
+			t.Fatalf("create assignment failed: %v", err)
+		}
+	}
+
+	reuse, err := svc.hostIPReuseState(7, now)
+	if err != nil {
+		t.Fatalf("reuse state failed: %v", err)
+	}
+	if state := reuse["198.51.100.60"]; !state.lastReleased.Equal(newer) || !state.returned {
+		t.Fatalf("expected latest release and returned flag, got %+v", state)
+	}
+	if state := reuse["198.51.100.61"]; !state.lastReleased.Equal(now) || state.returned {
+		t.Fatalf("expected orphaned open row released now, got %+v", state)
+	}
+	if _, ok := reuse["198.51.100.50"]; ok {
+		t.Fatalf("live holder of order %d should not count as released", order.ID)
+	}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+)
+
+// applyProductToCreateInput fills blank order fields from the catalog entry
+// and rejects explicit values that contradict it.
+func (s *OrderService) applyProductToCreateInput(in CreateOrderInput) (CreateOrderInput, error) {
+	product := model.Product{}
+	if err := s.db.First(&product, in.ProductID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return in, errors.New("product not found")
+		}
+		return in, err
+	}
+	if !product.Enabled {
+		return in, fmt.Errorf("product %s is disabled", product.SKU)
+	}
+
+	mode := strings.ToLower(strings.TrimSpace(in.Mode))
+	if mode == "" {
+		in.Mode = product.Mode
+	} else if mode != product.Mode {
+		return in, fmt.Errorf("mode %s conflicts with product mode %s", mode, product.Mode)
+	}
+	if in.Quantity <= 0 {
+		in.Quantity = product.Quantity
+	}
+	if in.DurationDay <= 0 && in.ExpiresAt.IsZero() {
+		in.DurationDay = product.DurationDay
+	}
+	if !in.HasPrice {
+		in.Price = product.Price
+	}
+
+	if product.Mode == model.OrderModeDedicated {
+		protocol := strings.TrimSpace(in.DedicatedProtocol)
+		if protocol == "" {
+			in.DedicatedProtocol = product.DedicatedProtocol
+		} else if normalized, err := normalizeDedicatedProtocol(protocol); err != nil {
+			return in, err
+		} else if product.DedicatedProtocol != "" && normalized != product.DedicatedProtocol {
+			return in, fmt.Errorf("protocol %s conflicts with product protocol %s", normalized, product.DedicatedProtocol)
+		}
+		if product.DedicatedInboundID != nil {
+			if in.DedicatedInboundID == 0 {
+				in.DedicatedInboundID = *product.DedicatedInboundID
+			} else if in.DedicatedInboundID != *product.DedicatedInboundID {
+				return in, errors.New("dedicated inbound conflicts with product")
+			}
+		}
+		if product.DedicatedIngressID != nil {
+			if in.DedicatedIngressID == 0 {
+				in.DedicatedIngressID = *product.DedicatedIngressID
+			} else if in.DedicatedIngressID != *product.DedicatedIngressID {
+				return in, errors.New("dedicated ingress conflicts with product")
+			}
+		}
+	}
+
+	countries, err := parseProductCountryCodes(product.CountryCodes)
+	if err != nil {
+		return in, err
+	}
+	in.countryCodes = countries
+	return in, nil
+}
+
+// hostIPCountryMatcher resolves host IPs against the local GeoIP databases
+// only; an IP the databases cannot place never satisfies a constraint.
+func hostIPCountryMatcher(countries []string) func(model.HostIP) bool {
+	if len(countries) == 0 {
+		return nil
+	}
+	return func(host model.HostIP) bool {
+		info, ok := lookupLocalIPGeo(host.IP)
+		return ok && containsCountryCode(countries, info.CountryCode)
+	}
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"xraytool/internal/config"
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"go.uber.org/zap"
+)
+
+func TestProductServiceValidatesCatalogEntries(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	products := NewProductService(db)
+
+	if _, err := products.Create(ProductInput{Name: "Home", SKU: "HOME-30", Mode: model.OrderModeAuto, DedicatedProtocol: "vmess"}); err == nil {
+		t.Fatalf("expected dedicated fields to be rejected for residential products")
+	}
+	if _, err := products.Create(ProductInput{Name: "Home", SKU: "HOME-30", CountryCodes: "japan"}); err == nil {
+		t.Fatalf("expected invalid country code to be rejected")
+	}
+	row, err := products.Create(ProductInput{Name: "Home", SKU: "HOME-30", Quantity: 1, CountryCodes: "ID; id,JP"})
+	if err != nil {
+		t.Fatalf("create product failed: %v", err)
+	}
+	if row.Mode != model.OrderModeAuto || row.DurationDay != 30 || row.CountryCodes != "id,jp" || !row.Enabled {
+		t.Fatalf("unexpected normalized product: %#v", row)
+	}
+	if _, err := products.Create(ProductInput{Name: "Home 2", SKU: "HOME-30"}); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("expected duplicate sku to be rejected, got %v", err)
+	}
+
+	inbound := model.DedicatedInbound{Name: "vmess", Protocol: model.DedicatedFeatureVmess, ListenPort: 24001, Enabled: true}
+	if err := db.Create(&inbound).Error; err != nil {
+		t.Fatalf("create inbound failed: %v", err)
+	}
+	ingress := model.DedicatedIngress{DedicatedInboundID: inbound.ID, Domain: "jp.example.com", IngressPort: 24001, CountryCode: "jp", Enabled: true}
+	if err := db.Create(&ingress).Error; err != nil {
+		t.Fatalf("create ingress failed: %v", err)
+	}
+	if _, err := products.Create(ProductInput{Name: "VMess ID", SKU: "VM-ID", Mode: model.OrderModeDedicated, DedicatedProtocol: "vmess", DedicatedInboundID: inbound.ID, DedicatedIngressID: ingress.ID, CountryCodes: "id"}); err == nil {
+		t.Fatalf("expected ingress outside product countries to be rejected")
+	}
+	if _, err := products.Create(ProductInput{Name: "Mixed JP", SKU: "MX-JP", Mode: model.OrderModeDedicated, DedicatedInboundID: inbound.ID}); err == nil {
+		t.Fatalf("expected inbound protocol mismatch to be rejected")
+	}
+
+	seedForwardCapacityOrder(t, db, "product-owner", 0)
+	if err := db.Model(&model.Order{}).Where("1 = 1").Update("product_id", row.ID).Error; err != nil {
+		t.Fatalf("bind product failed: %v", err)
+	}
+	if err := products.Delete(row.ID); err == nil {
+		t.Fatalf("expected delete of a product in use to fail")
+	}
+}
+
+func TestCreateOrderFromProductAppliesCatalog(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, NewXrayManager(config.Config{}, db, zap.NewNop()), zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+
+	st := store.New(db)
+	if err := st.SetSettings(map[string]string{
+		"geoip_db_path":         filepath.Join(t.TempDir(), "country.mmdb"),
+		"geoip_online_fallback": "false",
+	}); err != nil {
+		t.Fatalf("save settings failed: %v", err)
+	}
+	geo := NewGeoIPService(st)
+	countryDB := buildTestMMDB(t, "GeoLite2-Country", "203.0.113.0/24", mmdbtype.Map{
+		"country": mmdbtype.Map{"iso_code": mmdbtype.String("ID")},
+	})
+	if _, err := geo.Install(GeoIPKindCountry, bytes.NewReader(countryDB)); err != nil {
+		t.Fatalf("install geoip database failed: %v", err)
+	}
+	SetDefaultGeoIP(geo)
+	t.Cleanup(func() { SetDefaultGeoIP(nil) })
+
+	customer := model.Customer{Name: "catalog", Code: "cat", Status: model.OrderStatusActive}
+	if err := db.Create(&customer).Error; err != nil {
+		t.Fatalf("create customer failed: %v", err)
+	}
+	for _, host := range []model.HostIP{
+		{IP: "198.51.100.10", IsPublic: true, IsLocal: true, Enabled: true},
+		{IP: "203.0.113.10", IsPublic: true, IsLocal: true, Enabled: true},
+	} {
+		if err := db.Create(&host).Error; err != nil {
+			t.Fatalf("create host ip failed: %v", err)
+		}
+	}
+
+	products := NewProductService(db)
+	product, err := products.Create(ProductInput{Name: "Home ID 7d", SKU: "HOME-ID-7", Quantity: 1, DurationDay: 7, Price: 20, CountryCodes: "id"})
+	if err != nil {
+		t.Fatalf("create product failed: %v", err)
+	}
+	if _, err := svc.CreateOrder(context.Background(), CreateOrderInput{CustomerID: customer.ID, ProductID: product.ID, Mode: model.OrderModeDedicated}); err == nil || !strings.Contains(err.Error(), "conflicts with product mode") {
+		t.Fatalf("expected mode conflict, got %v", err)
+	}
+
+	order, err := svc.CreateOrder(context.Background(), CreateOrderInput{CustomerID: customer.ID, ProductID: product.ID, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create order from product failed: %v", err)
+	}
+	if order.Mode != model.OrderModeAuto || order.Price != 20 || order.ProductID == nil || *order.ProductID != product.ID {
+		t.Fatalf("unexpected order from product: %#v", order)
+	}
+	if len(order.Items) != 1 || order.Items[0].IP != "203.0.113.10" {
+		t.Fatalf("expected item on the allowed country ip, got %#v", order.Items)
+	}
+	if days := order.ExpiresAt.Sub(order.StartsAt); days < 7*24*time.Hour-time.Minute || days > 7*24*time.Hour+time.Minute {
+		t.Fatalf("expected product duration, got %s", days)
+	}
+
+	_, filename, err := svc.ExportOrderLinesWithMeta(order.ID, ExportOrderOptions{})
+	if err != nil {
+		t.Fatalf("export order failed: %v", err)
+	}
+	if !strings.Contains(filename, "HOME-ID-7") {
+		t.Fatalf("expected catalog sku in export filename, got %s", filename)
+	}
+
+	free, err := svc.applyProductToCreateInput(CreateOrderInput{CustomerID: customer.ID, ProductID: product.ID, HasPrice: true})
+	if err != nil || free.Price != 0 {
+		t.Fatalf("expected an explicit zero price to stay, got %v (%v)", free.Price, err)
+	}
+
+	if _, err := svc.CreateOrder(context.Background(), CreateOrderInput{CustomerID: customer.ID, ProductID: product.ID, Port: residentialTestPort}); err == nil || !strings.Contains(err.Error(), "less than quantity") {
+		t.Fatalf("expected allowed-country pool to be exhausted, got %v", err)
+	}
+	disabled := false
+	if _, err := products.Update(product.ID, ProductInput{Name: product.Name, SKU: product.SKU, Quantity: 1, CountryCodes: "id", Enabled: &disabled}); err != nil {
+		t.Fatalf("disable product failed: %v", err)
+	}
+	if _, err := svc.CreateOrder(context.Background(), CreateOrderInput{CustomerID: customer.ID, ProductID: product.ID}); err == nil || !strings.Contains(err.Error(), "disabled") {
+		t.Fatalf("expected disabled product to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,365 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// orderSnapshot holds the rows of one order or group, as kept by the recycle
+// bin and the order history.
+type orderSnapshot struct {
+	Orders    []model.Order           `json:"orders"`
+	Items     []model.OrderItem       `json:"items"`
+	Egresses  []model.DedicatedEgress `json:"egresses"`
+	Resources []model.XrayResource    `json:"resources"`
+}
+
+// defaultRecycleBinRetentionDays bounds how long snapshots, credentials
+// included, outlive their orders when the setting is unset or not positive.
+const defaultRecycleBinRetentionDays = 30
+
+func recycleBinRetention(db *gorm.DB) time.Duration {
+	row := model.Setting{}
+	days := defaultRecycleBinRetentionDays
+	if err := db.Where("key = ?", "recycle_bin_retention_days").Limit(1).Find(&row).Error; err == nil {
+		if parsed, err := strconv.Atoi(strings.TrimSpace(row.Value)); err == nil && parsed > 0 {
+			days = parsed
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func loadOrderSnapshotTx(tx *gorm.DB, orderIDs []uint) (orderSnapshot, error) {
+	ids := uniqueUintIDs(orderIDs)
+	payload := orderSnapshot{}
+	if err := tx.Where("id in ?", ids).Order("id asc").Find(&payload.Orders).Error; err != nil {
+		return payload, err
+	}
+	if err := tx.Where("order_id in ?", ids).Order("id asc").Find(&payload.Items).Error; err != nil {
+		return payload, err
+	}
+	if err := tx.Where("order_id in ?", ids).Order("id asc").Find(&payload.Egresses).Error; err != nil {
+		return payload, err
+	}
+	if len(payload.Items) > 0 {
+		itemIDs := make([]uint, 0, len(payload.Items))
+		for _, item := range payload.Items {
+			itemIDs = append(itemIDs, item.ID)
+		}
+		if err := tx.Where("order_item_id in ?", itemIDs).Order("id asc").Find(&payload.Resources).Error; err != nil {
+			return payload, err
+		}
+	}
+	return payload, nil
+}
+
+// recycleOrdersTx snapshots the rows deleteOrdersByIDsTx is about to remove.
+func recycleOrdersTx(tx *gorm.DB, order model.Order, orderIDs []uint, now time.Time) error {
+	payload, err := loadOrderSnapshotTx(tx, orderIDs)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	label := order.OrderNo
+	if strings.TrimSpace(order.Name) != "" {
+		label = fmt.Sprintf("%s %s", order.OrderNo, order.Name)
+	}
+	return tx.Create(&model.RecycleBinEntry{
+		Kind:       model.RecycleKindOrder,
+		EntityID:   order.ID,
+		CustomerID: order.CustomerID,
+		Label:      strings.TrimSpace(label),
+		OrderCount: len(payload.Orders),
+		ItemCount:  len(payload.Items),
+		Payload:    string(raw),
+		DeletedAt:  now,
+	}).Error
+}
+
+// DeleteCustomer moves a customer without orders into the recycle bin.
+func (s *OrderService) DeleteCustomer(customerID uint) error {
+	customer := model.Customer{}
+	if err := s.db.First(&customer, customerID).Error; err != nil {
+		return err
+	}
+	var orderCount int64
+	if err := s.db.Model(&model.Order{}).Where("customer_id = ?", customerID).Count(&orderCount).Error; err != nil {
+		return err
+	}
+	if orderCount > 0 {
+		return errors.New("customer has orders, cannot delete")
+	}
+	raw, err := json.Marshal(customer)
+	if err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&model.RecycleBinEntry{
+			Kind:       model.RecycleKindCustomer,
+			EntityID:   customer.ID,
+			CustomerID: customer.ID,
+			Label:      customer.Name,
+			Payload:    string(raw),
+			DeletedAt:  time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&model.Customer{}, customer.ID).Error
+	})
+}
+
+func (s *OrderService) ListRecycleBin(kind string) ([]model.RecycleBinEntry, error) {
+	query := s.db.Model(&model.RecycleBinEntry{})
+	if kind = strings.TrimSpace(kind); kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	rows := []model.RecycleBinEntry{}
+	if err := query.Order("id desc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// RestoreRecycleEntry puts a deleted customer or order back under its
+// original IDs. Orders are checked again for IP, credential, dedicated egress
+// and capacity conflicts that may have appeared since they were deleted.
+func (s *OrderService) RestoreRecycleEntry(ctx context.Context, entryID uint) (model.RecycleBinEntry, error) {
+	entry := model.RecycleBinEntry{}
+	if err := s.db.First(&entry, entryID).Error; err != nil {
+		return entry, err
+	}
+	switch entry.Kind {
+	case model.RecycleKindCustomer:
+		return entry, s.restoreCustomer(entry)
+	case model.RecycleKindOrder:
+		if err := s.restoreOrders(ctx, entry); err != nil {
+			return entry, err
+		}
+		return entry, s.rebuildManagedRuntime(ctx)
+	}
+	return entry, fmt.Errorf("unknown recycle bin kind %s", entry.Kind)
+}
+
+func (s *OrderService) restoreCustomer(entry model.RecycleBinEntry) error {
+	customer := model.Customer{}
+	if err := json.Unmarshal([]byte(entry.Payload), &customer); err != nil {
+		return err
+	}
+	var conflicts int64
+	query := s.db.Model(&model.Customer{}).Where("id = ? or name = ?", customer.ID, customer.Name)
+	if code := strings.TrimSpace(customer.Code); code != "" {
+		query = query.Or("code = ?", code)
+	}
+	if err := query.Count(&conflicts).Error; err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		return errors.New("a customer with the same id, name or code already exists")
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Create(&customer).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&model.RecycleBinEntry{}, entry.ID).Error
+	})
+}
+
+func (s *OrderService) restoreOrders(ctx context.Context, entry model.RecycleBinEntry) error {
+	payload := orderSnapshot{}
+	if err := json.Unmarshal([]byte(entry.Payload), &payload); err != nil {
+		return err
+	}
+	if len(payload.Orders) == 0 {
+		return errors.New("recycle bin entry holds no orders")
+	}
+	customer := model.Customer{}
+	if err := s.db.First(&customer, entry.CustomerID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errors.New("customer no longer exists, restore the customer first")
+		}
+		return err
+	}
+
+	ids := make([]uint, 0, len(payload.Orders))
+	restored := make(map[uint]struct{}, len(payload.Orders))
+	for _, order := range payload.Orders {
+		ids = append(ids, order.ID)
+		restored[order.ID] = struct{}{}
+	}
+	var taken int64
+	if err := s.db.Model(&model.Order{}).Where("id in ?", ids).Count(&taken).Error; err != nil {
+		return err
+	}
+	if taken > 0 {
+		return errors.New("order ids are already in use")
+	}
+	parentIDs := []uint{}
+	for _, order := range payload.Orders {
+		if order.ParentOrderID == nil {
+			continue
+		}
+		if _, ok := restored[*order.ParentOrderID]; ok {
+			continue
+		}
+		var heads int64
+		if err := s.db.Model(&model.Order{}).Where("id = ? and is_group_head = ?", *order.ParentOrderID, true).Count(&heads).Error; err != nil {
+			return err
+		}
+		if heads == 0 {
+			return fmt.Errorf("group head %d no longer exists", *order.ParentOrderID)
+		}
+		parentIDs = append(parentIDs, *order.ParentOrderID)
+	}
+
+	itemsByOrder := map[uint][]model.OrderItem{}
+	for _, item := range payload.Items {
+		itemsByOrder[item.OrderID] = append(itemsByOrder[item.OrderID], item)
+	}
+	orders := make([]model.Order, 0, len(payload.Orders))
+	for _, order := range payload.Orders {
+		order.Items = itemsByOrder[order.ID]
+		orders = append(orders, order)
+	}
+	now := time.Now()
+	if err := s.ensureTransferTargetIPsFree(orders, customer.ID, now); err != nil {
+		return err
+	}
+	if err := s.ensureRestoredHostIPsUsable(orders, customer.ID, 0, now); err != nil {
+		return err
+	}
+	// Something else may have bound a residential port while it sat in the bin.
+	checkedPorts := map[int]struct{}{}
+	for _, order := range orders {
+		if order.Mode == model.OrderModeDedicated || order.IsGroupHead || !orderLive(order, now) {
+			continue
+		}
+		if _, ok := checkedPorts[order.Port]; ok {
+			continue
+		}
+		checkedPorts[order.Port] = struct{}{}
+		if err := s.ensurePortReadyForManaged(order.Port); err != nil {
+			return err
+		}
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Create(&payload.Orders).Error; err != nil {
+			return err
+		}
+		if len(payload.Items) > 0 {
+			if err := tx.Omit(clause.Associations).Create(&payload.Items).Error; err != nil {
+				return err
+			}
+		}
+		if len(payload.Egresses) > 0 {
+			if err := tx.Omit(clause.Associations).Create(&payload.Egresses).Error; err != nil {
+				return err
+			}
+		}
+		if len(payload.Resources) > 0 {
+			if err := tx.Omit(clause.Associations).Create(&payload.Resources).Error; err != nil {
+				return err
+			}
+		}
+		if err := s.ensureTransferDedicatedEgressUniqueTx(tx, customer.ID, ids); err != nil {
+			return err
+		}
+		if err := s.ensureDedicatedMixedOrdersUsernamesTx(tx, orders); err != nil {
+			return err
+		}
+		for _, order := range orders {
+			if err := s.ensureTransferCredentialsTx(tx, order); err != nil {
+				return err
+			}
+			if err := s.ensureTransferForwardCapacityTx(ctx, tx, order, customer.ID); err != nil {
+				return err
+			}
+		}
+		for _, parentID := range uniqueUintIDs(parentIDs) {
+			if err := refreshGroupHeadTx(tx, parentID, now); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&model.RecycleBinEntry{}, entry.ID).Error
+	})
+}
+
+// ensureRestoredHostIPsUsable checks that live residential items still point
+// at enabled host IPs with room for the customer and not held for someone
+// else.
+func (s *OrderService) ensureRestoredHostIPsUsable(orders []model.Order, customerID uint, excludeOrderID uint, now time.Time) error {
+	itemsByIP := map[string]int{}
+	hostIPIDs := []uint{}
+	for _, order := range orders {
+		if order.Mode == model.OrderModeDedicated || !orderLive(order, now) {
+			continue
+		}
+		for _, item := range order.Items {
+			if item.Status != model.OrderItemStatusActive || item.HostIPID == nil {
+				continue
+			}
+			itemsByIP[item.IP]++
+			hostIPIDs = append(hostIPIDs, *item.HostIPID)
+		}
+	}
+	if len(hostIPIDs) == 0 {
+		return nil
+	}
+	hosts := []model.HostIP{}
+	if err := s.db.Where("id in ?", uniqueUintIDs(hostIPIDs)).Find(&hosts).Error; err != nil {
+		return err
+	}
+	byID := make(map[uint]model.HostIP, len(hosts))
+	for _, host := range hosts {
+		byID[host.ID] = host
+	}
+	reserved, err := loadReservedResources(s.db, customerID, now)
+	if err != nil {
+		return err
+	}
+	for _, id := range uniqueUintIDs(hostIPIDs) {
+		host, ok := byID[id]
+		if !ok {
+			return fmt.Errorf("host ip %d no longer exists", id)
+		}
+		if !host.Enabled {
+			return fmt.Errorf("host ip %s is disabled", host.IP)
+		}
+		if _, held := reserved.hostIPs[host.ID]; held {
+			return fmt.Errorf("ip %s is reserved for another customer", host.IP)
+		}
+	}
+	return s.ensureHostIPCapacity(customerID, excludeOrderID, itemsByIP)
+}
+
+// PurgeRecycleEntry drops one entry for good.
+func (s *OrderService) PurgeRecycleEntry(entryID uint) error {
+	res := s.db.Delete(&model.RecycleBinEntry{}, entryID)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// PurgeRecycleBin drops entries older than recycle_bin_retention_days.
+func (s *OrderService) PurgeRecycleBin(now time.Time) (int64, error) {
+	retention := recycleBinRetention(s.db)
+	res := s.db.Where("deleted_at <= ?", now.Add(-retention)).Delete(&model.RecycleBinEntry{})
+	return res.RowsAffected, res.Error
+}
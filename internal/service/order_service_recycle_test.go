@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+)
+
+func TestRecycleBinRestoresOrdersAndCustomers(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	ctx := context.Background()
+	binEntry := func(kind string, entityID uint) model.RecycleBinEntry {
+		t.Helper()
+		entry := model.RecycleBinEntry{}
+		if err := db.Where("kind = ? and entity_id = ?", kind, entityID).First(&entry).Error; err != nil {
+			t.Fatalf("load recycle bin entry failed: %v", err)
+		}
+		return entry
+	}
+
+	headID, childIDs := seedDedicatedCopyLinksTestGroup(t, db)
+	if err := svc.DeleteOrder(ctx, childIDs[0]); err != nil {
+		t.Fatalf("delete child failed: %v", err)
+	}
+	if err := svc.DeleteOrder(ctx, headID); err != nil {
+		t.Fatalf("delete head failed: %v", err)
+	}
+	childEntry := binEntry(model.RecycleKindOrder, childIDs[0])
+	headEntry := binEntry(model.RecycleKindOrder, headID)
+	if headEntry.OrderCount != 2 || headEntry.ItemCount != 1 {
+		t.Fatalf("unexpected head entry: %+v", headEntry)
+	}
+	if _, err := svc.RestoreRecycleEntry(ctx, childEntry.ID); err == nil || !strings.Contains(err.Error(), "group head") {
+		t.Fatalf("expected child restore to need its head, got %v", err)
+	}
+	if _, err := svc.RestoreRecycleEntry(ctx, headEntry.ID); err != nil {
+		t.Fatalf("restore head failed: %v", err)
+	}
+	if _, err := svc.RestoreRecycleEntry(ctx, childEntry.ID); err != nil {
+		t.Fatalf("restore child failed: %v", err)
+	}
+	head := model.Order{}
+	if err := db.First(&head, headID).Error; err != nil {
+		t.Fatalf("load restored head failed: %v", err)
+	}
+	if head.Quantity != 2 {
+		t.Fatalf("expected head quantity 2 after restore, got %d", head.Quantity)
+	}
+
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	customer := seedBillingCustomer(t, db, "recycle", "198.51.100.90")
+	first, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create order failed: %v", err)
+	}
+	if err := svc.DeleteOrder(ctx, first.ID); err != nil {
+		t.Fatalf("delete order failed: %v", err)
+	}
+	blocker, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create blocking order failed: %v", err)
+	}
+	firstEntry := binEntry(model.RecycleKindOrder, first.ID)
+	if _, err := svc.RestoreRecycleEntry(ctx, firstEntry.ID); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Fatalf("expected ip conflict on restore, got %v", err)
+	}
+	if err := svc.DeleteOrder(ctx, blocker.ID); err != nil {
+		t.Fatalf("delete blocking order failed: %v", err)
+	}
+	if _, err := svc.RestoreRecycleEntry(ctx, firstEntry.ID); err != nil {
+		t.Fatalf("restore order failed: %v", err)
+	}
+	restored, err := svc.GetOrder(first.ID)
+	if err != nil {
+		t.Fatalf("load restored order failed: %v", err)
+	}
+	if len(restored.Items) != 1 || restored.Items[0].Username != first.Items[0].Username || restored.Items[0].Password != first.Items[0].Password {
+		t.Fatalf("expected original credentials back, got %+v", restored.Items)
+	}
+
+	idle := model.Customer{Name: "recycle-idle", Code: "recycle-idle", Status: model.OrderStatusActive}
+	if err := db.Create(&idle).Error; err != nil {
+		t.Fatalf("create customer failed: %v", err)
+	}
+	if err := svc.DeleteCustomer(customer.ID); err == nil {
+		t.Fatalf("expected customer with orders to stay")
+	}
+	if err := svc.DeleteCustomer(idle.ID); err != nil {
+		t.Fatalf("delete customer failed: %v", err)
+	}
+	if _, err := svc.RestoreRecycleEntry(ctx, binEntry(model.RecycleKindCustomer, idle.ID).ID); err != nil {
+		t.Fatalf("restore customer failed: %v", err)
+	}
+	if err := db.First(&model.Customer{}, idle.ID).Error; err != nil {
+		t.Fatalf("expected customer back, got %v", err)
+	}
+
+	if err := store.New(db).SetSettings(map[string]string{"recycle_bin_retention_days": "0"}); err != nil {
+		t.Fatalf("set retention failed: %v", err)
+	}
+	if purged, err := svc.PurgeRecycleBin(time.Now().Add(8 * 24 * time.Hour)); err != nil || purged != 0 {
+		t.Fatalf("expected a zero retention to fall back to 30 days, got %d %v", purged, err)
+	}
+	if err := store.New(db).SetSettings(map[string]string{"recycle_bin_retention_days": "7"}); err != nil {
+		t.Fatalf("set retention failed: %v", err)
+	}
+	if purged, err := svc.PurgeRecycleBin(time.Now()); err != nil || purged != 0 {
+		t.Fatalf("expected nothing purged inside retention, got %d %v", purged, err)
+	}
+	if purged, err := svc.PurgeRecycleBin(time.Now().Add(8 * 24 * time.Hour)); err != nil || purged != 1 {
+		t.Fatalf("expected blocker entry purged, got %d %v", purged, err)
+	}
+}
+
+func TestRecycleBinRestoreChecksMixedUsernames(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	ctx := context.Background()
+
+	_, children := seedDedicatedGroupForGeoTest(t, db)
+	if err := db.Model(&model.OrderItem{}).Where("id = ?", children[1].itemID).Update("username", "x2").Error; err != nil {
+		t.Fatalf("set username failed: %v", err)
+	}
+	if err := svc.DeleteOrder(ctx, children[1].orderID); err != nil {
+		t.Fatalf("delete child failed: %v", err)
+	}
+	now := time.Now()
+	other := model.Order{CustomerID: 1, Name: "other", Mode: model.OrderModeDedicated, DedicatedProtocol: model.DedicatedFeatureMixed, Status: model.OrderStatusActive, Quantity: 1, Port: 1080, StartsAt: now, ExpiresAt: now.Add(time.Hour)}
+	if err := db.Create(&other).Error; err != nil {
+		t.Fatalf("create other order failed: %v", err)
+	}
+	if err := db.Create(&model.OrderItem{OrderID: other.ID, IP: "127.0.0.1", Port: 1080, Username: "x2", Password: "p", Managed: true, Status: model.OrderItemStatusActive}).Error; err != nil {
+		t.Fatalf("create other item failed: %v", err)
+	}
+	entry := model.RecycleBinEntry{}
+	if err := db.Where("kind = ? and entity_id = ?", model.RecycleKindOrder, children[1].orderID).First(&entry).Error; err != nil {
+		t.Fatalf("load recycle bin entry failed: %v", err)
+	}
+	if _, err := svc.RestoreRecycleEntry(ctx, entry.ID); err == nil || !strings.Contains(err.Error(), "already used on shared port") {
+		t.Fatalf("expected restore onto a taken mixed username to fail, got %v", err)
+	}
+}
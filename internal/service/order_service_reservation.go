@@ -0,0 +1,293 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+)
+
+const (
+	reservationDefaultHours = 24
+	reservationMaxHours     = 7 * 24
+)
+
+type CreateReservationInput struct {
+	CustomerID         uint      `json:"customer_id"`
+	HostIPIDs          []uint    `json:"host_ip_ids"`
+	ForwardOutboundIDs []uint    `json:"forward_outbound_ids"`
+	Hours              int       `json:"hours"`
+	ExpiresAt          time.Time `json:"-"`
+	Note               string    `json:"note"`
+	Operator           string    `json:"-"`
+}
+
+type ConvertReservationInput struct {
+	Name        string    `json:"name"`
+	DurationDay int       `json:"duration_day"`
+	ExpiresAt   time.Time `json:"-"`
+	Port        int       `json:"port"`
+	Price       float64   `json:"price"`
+	// OrderID is the forward order a reservation of upstreams is added to.
+	OrderID uint `json:"order_id"`
+}
+
+type reservedResourceSet struct {
+	hostIPs   map[uint]uint
+	outbounds map[uint]uint
+}
+
+// loadReservedResources returns what active reservations of customers other
+// than customerID hold, keyed by resource id; customerID 0 includes everyone.
+func loadReservedResources(db *gorm.DB, customerID uint, now time.Time) (reservedResourceSet, error) {
+	set := reservedResourceSet{hostIPs: map[uint]uint{}, outbounds: map[uint]uint{}}
+	type reservedRow struct {
+		ReservationID   uint
+		HostIPID        *uint
+		SocksOutboundID *uint
+	}
+	rows := []reservedRow{}
+	query := db.Table("reservation_items ri").
+		Select("ri.reservation_id as reservation_id, ri.host_ip_id as host_ip_id, ri.socks_outbound_id as socks_outbound_id").
+		Joins("join reservations r on r.id = ri.reservation_id").
+		Where("r.status = ? and r.expires_at > ?", model.ReservationStatusActive, now)
+	if customerID > 0 {
+		query = query.Where("r.customer_id <> ?", customerID)
+	}
+	if err := query.Scan(&rows).Error; err != nil {
+		return set, err
+	}
+	for _, row := range rows {
+		if row.HostIPID != nil {
+			set.hostIPs[*row.HostIPID] = row.ReservationID
+		}
+		if row.SocksOutboundID != nil {
+			set.outbounds[*row.SocksOutboundID] = row.ReservationID
+		}
+	}
+	return set, nil
+}
+
+func (s *OrderService) CreateReservation(in CreateReservationInput) (*model.Reservation, error) {
+	if in.CustomerID == 0 {
+		return nil, errors.New("customer_id is required")
+	}
+	customer := model.Customer{}
+	if err := s.db.First(&customer, in.CustomerID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("customer not found")
+		}
+		return nil, err
+	}
+	if customer.Status == model.CustomerStatusSuspended {
+		return nil, errors.New("customer is suspended")
+	}
+	hostIPIDs := uniqueUintIDs(in.HostIPIDs)
+	outboundIDs := uniqueUintIDs(in.ForwardOutboundIDs)
+	if (len(hostIPIDs) == 0) == (len(outboundIDs) == 0) {
+		return nil, errors.New("reservation holds either host_ip_ids or forward_outbound_ids")
+	}
+	now := time.Now()
+	expiresAt := in.ExpiresAt
+	if expiresAt.IsZero() {
+		hours := in.Hours
+		if hours == 0 {
+			hours = reservationDefaultHours
+		}
+		if hours < 1 || hours > reservationMaxHours {
+			return nil, fmt.Errorf("hours must be between 1 and %d", reservationMaxHours)
+		}
+		expiresAt = now.Add(time.Duration(hours) * time.Hour)
+	}
+	if !expiresAt.After(now) || expiresAt.Sub(now) > reservationMaxHours*time.Hour {
+		return nil, fmt.Errorf("expires_at must be within %d hours from now", reservationMaxHours)
+	}
+
+	reserved, err := loadReservedResources(s.db, 0, now)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]model.ReservationItem, 0, len(hostIPIDs)+len(outboundIDs))
+	if len(hostIPIDs) > 0 {
+		hosts := []model.HostIP{}
+		if err := s.db.Where("id in ? and enabled = 1", hostIPIDs).Find(&hosts).Error; err != nil {
+			return nil, err
+		}
+		hosts = filterUsableIPs(hosts)
+		if len(hosts) != len(hostIPIDs) {
+			return nil, errors.New("some host ips are invalid, disabled, or not usable public local addresses")
+		}
+		usedByCustomer, err := s.customerUsedIPSet(customer.ID, 0)
+		if err != nil {
+			return nil, err
+		}
+		checker, err := s.loadHostIPCapacityChecker(0)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			if _, held := reserved.hostIPs[host.ID]; held {
+				return nil, fmt.Errorf("ip %s is already reserved", host.IP)
+			}
+			if _, used := usedByCustomer[host.IP]; used {
+				return nil, fmt.Errorf("ip %s already used by current customer", host.IP)
+			}
+			if reason := checker.reason(host, customer.ID, 1); reason != "" {
+				return nil, fmt.Errorf("ip %s is at capacity (%s)", host.IP, reason)
+			}
+			items = append(items, model.ReservationItem{HostIPID: uintPtrOrNil(host.ID), Label: host.IP})
+		}
+	}
+	if len(outboundIDs) > 0 {
+		outbounds, err := s.loadForwardOutboundsByIDs(outboundIDs, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, outbound := range outbounds {
+			if _, held := reserved.outbounds[outbound.ID]; held {
+				return nil, fmt.Errorf("forward upstream %s is already reserved", forwardOutboundLabel(outbound))
+			}
+			items = append(items, model.ReservationItem{SocksOutboundID: uintPtrOrNil(outbound.ID), Label: forwardOutboundLabel(outbound)})
+		}
+	}
+
+	row := model.Reservation{
+		CustomerID: customer.ID,
+		Status:     model.ReservationStatusActive,
+		ExpiresAt:  expiresAt,
+		Operator:   strings.TrimSpace(in.Operator),
+		Note:       strings.TrimSpace(in.Note),
+		Items:      items,
+	}
+	if err := s.db.Create(&row).Error; err != nil {
+		return nil, err
+	}
+	return s.GetReservation(row.ID)
+}
+
+func (s *OrderService) GetReservation(id uint) (*model.Reservation, error) {
+	row := model.Reservation{}
+	if err := s.db.Preload("Customer").Preload("Items").First(&row, id).Error; err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
+
+func (s *OrderService) ListReservations(customerID uint, status string) ([]model.Reservation, error) {
+	query := s.db.Preload("Customer").Preload("Items")
+	if customerID > 0 {
+		query = query.Where("customer_id = ?", customerID)
+	}
+	if status = strings.TrimSpace(status); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	rows := []model.Reservation{}
+	if err := query.Order("id desc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *OrderService) ReleaseReservation(id uint) error {
+	now := time.Now()
+	res := s.db.Model(&model.Reservation{}).Where("id = ? and status = ?", id, model.ReservationStatusActive).Updates(map[string]interface{}{
+		"status":      model.ReservationStatusReleased,
+		"released_at": now,
+		"updated_at":  now,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.New("only active reservations can be released")
+	}
+	return nil
+}
+
+// ExpireReservations releases every active reservation past its expiry.
+// Allocation already ignores them, this only settles their status.
+func (s *OrderService) ExpireReservations(now time.Time) (int64, error) {
+	res := s.db.Model(&model.Reservation{}).Where("status = ? and expires_at <= ?", model.ReservationStatusActive, now).Updates(map[string]interface{}{
+		"status":      model.ReservationStatusExpired,
+		"released_at": now,
+		"updated_at":  now,
+	})
+	return res.RowsAffected, res.Error
+}
+
+// ConvertReservation turns held host IPs into a new manual order, or adds
+// held upstreams to an existing forward order of the same customer.
+func (s *OrderService) ConvertReservation(ctx context.Context, id uint, in ConvertReservationInput) (*model.Order, error) {
+	reservation, err := s.GetReservation(id)
+	if err != nil {
+		return nil, err
+	}
+	if reservation.Status != model.ReservationStatusActive {
+		return nil, fmt.Errorf("reservation is %s", reservation.Status)
+	}
+	if !reservation.ExpiresAt.After(time.Now()) {
+		return nil, errors.New("reservation has expired")
+	}
+	hostIPIDs := make([]uint, 0, len(reservation.Items))
+	outboundIDs := make([]uint, 0, len(reservation.Items))
+	for _, item := range reservation.Items {
+		if item.HostIPID != nil {
+			hostIPIDs = append(hostIPIDs, *item.HostIPID)
+		}
+		if item.SocksOutboundID != nil {
+			outboundIDs = append(outboundIDs, *item.SocksOutboundID)
+		}
+	}
+
+	var order *model.Order
+	switch {
+	case len(hostIPIDs) > 0:
+		order, err = s.CreateOrder(ctx, CreateOrderInput{
+			CustomerID:  reservation.CustomerID,
+			Name:        in.Name,
+			Quantity:    len(hostIPIDs),
+			DurationDay: in.DurationDay,
+			ExpiresAt:   in.ExpiresAt,
+			Mode:        model.OrderModeManual,
+			Port:        in.Port,
+			ManualIPIDs: hostIPIDs,
+			Price:       in.Price,
+		})
+	case len(outboundIDs) > 0:
+		if in.OrderID == 0 {
+			return nil, errors.New("order_id of a forward order is required to convert upstream reservations")
+		}
+		target := model.Order{}
+		if err := s.db.Preload("Items").First(&target, in.OrderID).Error; err != nil {
+			return nil, err
+		}
+		if target.Mode != model.OrderModeForward || target.CustomerID != reservation.CustomerID {
+			return nil, errors.New("order_id must be a forward order of the reserving customer")
+		}
+		for _, item := range target.Items {
+			if item.SocksOutboundID != nil {
+				outboundIDs = append(outboundIDs, *item.SocksOutboundID)
+			}
+		}
+		order, err = s.UpdateOrder(ctx, target.ID, UpdateOrderInput{ForwardOutboundIDs: outboundIDs, ExpiresAt: in.ExpiresAt})
+	default:
+		return nil, errors.New("reservation holds nothing")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&model.Reservation{}).Where("id = ?", reservation.ID).Updates(map[string]interface{}{
+		"status":      model.ReservationStatusConverted,
+		"order_id":    order.ID,
+		"released_at": time.Now(),
+		"updated_at":  time.Now(),
+	}).Error; err != nil {
+		return nil, err
+	}
+	return order, nil
+}
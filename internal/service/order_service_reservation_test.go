@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+)
+
+func TestReservationHoldsIPUntilConvertedOrExpired(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	holder := seedBillingCustomer(t, db, "hold-owner", "198.51.100.70")
+	other := model.Customer{Name: "hold-other", Code: "hold-other", Status: model.OrderStatusActive}
+	if err := db.Create(&other).Error; err != nil {
+		t.Fatalf("create customer failed: %v", err)
+	}
+	host := model.HostIP{}
+	if err := db.Where("ip = ?", "198.51.100.70").First(&host).Error; err != nil {
+		t.Fatalf("load host ip failed: %v", err)
+	}
+	ctx := context.Background()
+
+	reservation, err := svc.CreateReservation(CreateReservationInput{CustomerID: holder.ID, HostIPIDs: []uint{host.ID}})
+	if err != nil {
+		t.Fatalf("create reservation failed: %v", err)
+	}
+	if len(reservation.Items) != 1 || reservation.Items[0].Label != host.IP {
+		t.Fatalf("unexpected reservation items: %+v", reservation.Items)
+	}
+	if _, err := svc.CreateReservation(CreateReservationInput{CustomerID: other.ID, HostIPIDs: []uint{host.ID}}); err == nil || !strings.Contains(err.Error(), "already reserved") {
+		t.Fatalf("expected double reservation to fail, got %v", err)
+	}
+	if _, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: other.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort}); err == nil || !strings.Contains(err.Error(), "less than quantity") {
+		t.Fatalf("expected reserved ip to be excluded, got %v", err)
+	}
+	if _, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: other.ID, Quantity: 1, DurationDay: 30, Mode: model.OrderModeManual, ManualIPIDs: []uint{host.ID}, Port: residentialTestPort}); err == nil || !strings.Contains(err.Error(), "reserved for another customer") {
+		t.Fatalf("expected manual pick of reserved ip to fail, got %v", err)
+	}
+	preview, err := svc.AllocationPreview(other.ID, 0, "")
+	if err != nil {
+		t.Fatalf("preview failed: %v", err)
+	}
+	if preview.Reserved != 1 || preview.Available != 0 {
+		t.Fatalf("unexpected preview: %+v", preview)
+	}
+
+	order, err := svc.ConvertReservation(ctx, reservation.ID, ConvertReservationInput{DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("convert reservation failed: %v", err)
+	}
+	if len(order.Items) != 1 || order.Items[0].IP != host.IP || order.CustomerID != holder.ID {
+		t.Fatalf("unexpected converted order: %+v", order)
+	}
+	converted, err := svc.GetReservation(reservation.ID)
+	if err != nil {
+		t.Fatalf("load reservation failed: %v", err)
+	}
+	if converted.Status != model.ReservationStatusConverted || converted.OrderID == nil || *converted.OrderID != order.ID {
+		t.Fatalf("unexpected converted reservation: %+v", converted)
+	}
+
+	second := model.HostIP{IP: "198.51.100.71", IsPublic: true, IsLocal: true, Enabled: true}
+	if err := db.Create(&second).Error; err != nil {
+		t.Fatalf("create host ip failed: %v", err)
+	}
+	held, err := svc.CreateReservation(CreateReservationInput{CustomerID: holder.ID, HostIPIDs: []uint{second.ID}, Hours: 1})
+	if err != nil {
+		t.Fatalf("create second reservation failed: %v", err)
+	}
+	expired, err := svc.ExpireReservations(time.Now().Add(2 * time.Hour))
+	if err != nil || expired != 1 {
+		t.Fatalf("expected one reservation to expire, got %d %v", expired, err)
+	}
+	if _, err := svc.ConvertReservation(ctx, held.ID, ConvertReservationInput{DurationDay: 30, Port: residentialTestPort}); err == nil {
+		t.Fatalf("expected expired reservation to refuse conversion")
+	}
+	freed, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: other.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create order after expiry failed: %v", err)
+	}
+	if len(freed.Items) != 1 || freed.Items[0].IP != second.IP {
+		t.Fatalf("expected released ip %s, got %+v", second.IP, freed.Items)
+	}
+}
@@ -61,7 +61,7 @@ func (s *OrderService) ListResidentialUsernameConflicts() ([]ResidentialUsername
 		`).
 		Joins("join orders o on o.id = oi.order_id").
 		Joins("join customers c on c.id = o.customer_id").
-		Where("o.status = ? and o.expires_at > ? and oi.status = ?", model.OrderStatusActive, time.Now(), model.OrderItemStatusActive).
+		Where("o.status = ? and (o.expires_at > ? or o.expiry_stage <> '') and oi.status = ?", model.OrderStatusActive, time.Now(), model.OrderItemStatusActive).
 		Where("o.mode in ?", []string{model.OrderModeAuto, model.OrderModeManual, model.OrderModeImport}).
 		Where("oi.username <> ''").
 		Order("oi.username asc, o.id asc, oi.id asc").
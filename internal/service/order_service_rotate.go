@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+)
+
+type RotateOrderIPInput struct {
+	ItemIDs               []uint `json:"item_ids"`
+	RegenerateCredentials bool   `json:"regenerate_credentials"`
+	Reason                string `json:"reason"`
+	Operator              string `json:"-"`
+}
+
+// RotateOrderIPs moves active residential items to fresh host IPs. Without
+// item_ids every active item of the order (or of a group's children) is
+// rotated. Replacements come from the same pool and ordering allocateIPs
+// uses, so a customer never ends up with an IP it already holds.
+func (s *OrderService) RotateOrderIPs(ctx context.Context, orderID uint, in RotateOrderIPInput) ([]model.OrderItemIPHistory, error) {
+	order := model.Order{}
+	if err := s.db.First(&order, orderID).Error; err != nil {
+		return nil, err
+	}
+	mode := strings.ToLower(strings.TrimSpace(order.Mode))
+	if mode == model.OrderModeDedicated || mode == model.OrderModeForward {
+		return nil, errors.New("ip rotation only applies to residential orders")
+	}
+	targetOrderIDs := []uint{order.ID}
+	if order.IsGroupHead {
+		childIDs := []uint{}
+		if err := s.db.Model(&model.Order{}).Where("parent_order_id = ?", order.ID).Pluck("id", &childIDs).Error; err != nil {
+			return nil, err
+		}
+		if len(childIDs) > 0 {
+			targetOrderIDs = childIDs
+		}
+	}
+	candidates := []model.OrderItem{}
+	if err := s.db.Where("order_id in ? and status = ? and outbound_type = ?", targetOrderIDs, model.OrderItemStatusActive, model.OutboundTypeDirect).Order("id asc").Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+	items := candidates
+	if len(in.ItemIDs) > 0 {
+		byID := make(map[uint]model.OrderItem, len(candidates))
+		for _, item := range candidates {
+			byID[item.ID] = item
+		}
+		items = make([]model.OrderItem, 0, len(in.ItemIDs))
+		for _, id := range uniqueUintIDs(in.ItemIDs) {
+			item, ok := byID[id]
+			if !ok {
+				return nil, fmt.Errorf("item %d is not an active residential item of this order", id)
+			}
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		return nil, errors.New("no active items to rotate")
+	}
+
+	match, err := s.orderHostIPMatcher(order)
+	if err != nil {
+		return nil, err
+	}
+	replacements, err := s.allocateIPsMatching(order.CustomerID, len(items), model.OrderModeAuto, nil, 0, match)
+	if err != nil {
+		return nil, err
+	}
+
+	historyRoot := orderHistoryRoot(order)
+	if err := s.ensureOrderBaseline(historyRoot); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	reason := strings.TrimSpace(in.Reason)
+	operator := strings.TrimSpace(in.Operator)
+	history := make([]model.OrderItemIPHistory, 0, len(items))
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := bumpOrderVersionTx(tx, order.ID); err != nil {
+			return err
+		}
+		for idx, item := range items {
+			next := replacements[idx]
+			updates := map[string]interface{}{
+				"host_ip_id": next.ID,
+				"ip":         next.IP,
+				"updated_at": now,
+			}
+			if in.RegenerateCredentials {
+				username, err := s.nextAvailableResidentialUsernameTx(tx, next.IP, item.OrderID)
+				if err != nil {
+					return err
+				}
+				updates["username"] = username
+				updates["password"] = randomString(12)
+				updates["vmess_uuid"] = ""
+			}
+			if err := tx.Model(&model.OrderItem{}).Where("id = ?", item.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+			row := model.OrderItemIPHistory{
+				OrderItemID: item.ID,
+				OrderID:     item.OrderID,
+				CustomerID:  order.CustomerID,
+				OldHostIPID: item.HostIPID,
+				OldIP:       item.IP,
+				NewHostIPID: uintPtrOrNil(next.ID),
+				NewIP:       next.IP,
+				Reason:      reason,
+				Operator:    operator,
+			}
+			if err := tx.Create(&row).Error; err != nil {
+				return err
+			}
+			history = append(history, row)
+		}
+		return tx.Model(&model.Order{}).Where("id in ? or id = ?", targetOrderIDs, order.ID).Updates(map[string]interface{}{
+			"updated_at": now,
+		}).Error
+	}); err != nil {
+		return nil, err
+	}
+	s.recordOrderVersion(historyRoot, OrderVersionSourceRotateIP)
+	if err := s.rebuildManagedRuntime(ctx); err != nil {
+		return history, err
+	}
+	return history, nil
+}
+
+func (s *OrderService) ListOrderIPHistory(orderID uint) ([]model.OrderItemIPHistory, error) {
+	ids := []uint{}
+	if err := s.db.Model(&model.Order{}).Where("id = ? or parent_order_id = ?", orderID, orderID).Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	rows := []model.OrderItemIPHistory{}
+	if len(ids) == 0 {
+		return rows, nil
+	}
+	if err := s.db.Where("order_id in ?", ids).Order("id desc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// orderHostIPMatcher rebuilds the host IP constraints an order was created
+// with: its ip tier and the country codes of its product.
+func (s *OrderService) orderHostIPMatcher(order model.Order) (func(model.HostIP) bool, error) {
+	tierMatch := hostIPTierMatcher(strings.TrimSpace(order.IPTier))
+	if order.ProductID == nil || *order.ProductID == 0 {
+		return tierMatch, nil
+	}
+	product := model.Product{}
+	if err := s.db.First(&product, *order.ProductID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tierMatch, nil
+		}
+		return nil, err
+	}
+	countries, err := parseProductCountryCodes(product.CountryCodes)
+	if err != nil {
+		return nil, err
+	}
+	return combineHostIPMatchers(hostIPCountryMatcher(countries), tierMatch), nil
+}
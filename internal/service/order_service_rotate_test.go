@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"xraytool/internal/config"
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+)
+
+func TestRotateOrderIPsPicksFreeIPAndKeepsHistory(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, NewXrayManager(config.Config{}, db, zap.NewNop()), zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	customer := seedBillingCustomer(t, db, "rotate", "198.51.100.40")
+	if err := db.Create(&model.HostIP{IP: "198.51.100.41", IsPublic: true, IsLocal: true, Enabled: true}).Error; err != nil {
+		t.Fatalf("create host ip failed: %v", err)
+	}
+
+	order, err := svc.CreateOrder(context.Background(), CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create order failed: %v", err)
+	}
+	before := model.OrderItem{}
+	if err := db.Where("order_id = ?", order.ID).First(&before).Error; err != nil {
+		t.Fatalf("load item failed: %v", err)
+	}
+
+	rows, err := svc.RotateOrderIPs(context.Background(), order.ID, RotateOrderIPInput{ItemIDs: []uint{before.ID}, Reason: "blocked", Operator: "admin"})
+	if err != nil {
+		t.Fatalf("rotate failed: %v", err)
+	}
+	after := model.OrderItem{}
+	if err := db.First(&after, before.ID).Error; err != nil {
+		t.Fatalf("reload item failed: %v", err)
+	}
+	if after.IP == before.IP || after.HostIPID == nil || *after.HostIPID == *before.HostIPID {
+		t.Fatalf("expected a new ip, got %s", after.IP)
+	}
+	if after.Username != before.Username || after.Password != before.Password {
+		t.Fatalf("credentials should be kept")
+	}
+	if len(rows) != 1 || rows[0].OldIP != before.IP || rows[0].NewIP != after.IP || rows[0].Reason != "blocked" {
+		t.Fatalf("unexpected history: %+v", rows)
+	}
+
+	if _, err := svc.RotateOrderIPs(context.Background(), order.ID, RotateOrderIPInput{RegenerateCredentials: true}); err != nil {
+		t.Fatalf("rotate with new credentials failed: %v", err)
+	}
+	regenerated := model.OrderItem{}
+	if err := db.First(&regenerated, before.ID).Error; err != nil {
+		t.Fatalf("reload item failed: %v", err)
+	}
+	if regenerated.IP == after.IP || regenerated.Username == after.Username {
+		t.Fatalf("expected new ip and credentials, got %s %s", regenerated.IP, regenerated.Username)
+	}
+	history, err := svc.ListOrderIPHistory(order.ID)
+	if err != nil {
+		t.Fatalf("list history failed: %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected 2 history rows, got %d", len(history))
+	}
+
+	if _, err := svc.RotateOrderIPs(context.Background(), order.ID, RotateOrderIPInput{ItemIDs: []uint{before.ID + 100}}); err == nil {
+		t.Fatalf("expected unknown item to be rejected")
+	}
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// ErrCustomerSuspended is returned when a suspended customer's orders would be
+// created or renewed.
+var ErrCustomerSuspended = errors.New("customer is suspended")
+
+func (s *OrderService) ensureCustomerNotSuspended(customerID uint) error {
+	var suspended int64
+	if err := s.db.Model(&model.Customer{}).Where("id = ? and status = ?", customerID, model.CustomerStatusSuspended).Count(&suspended).Error; err != nil {
+		return err
+	}
+	if suspended > 0 {
+		return ErrCustomerSuspended
+	}
+	return nil
+}
+
+// SuspendCustomer blocks new orders for a customer and takes every active
+// order offline through DeactivateOrder with the suspended status, which is
+// what UnsuspendCustomer later looks for.
+func (s *OrderService) SuspendCustomer(ctx context.Context, customerID uint) ([]BatchActionResult, error) {
+	customer := model.Customer{}
+	if err := s.db.First(&customer, customerID).Error; err != nil {
+		return nil, err
+	}
+	if customer.Status == model.CustomerStatusSuspended {
+		return nil, errors.New("customer is already suspended")
+	}
+	if err := s.db.Model(&model.Customer{}).Where("id = ?", customer.ID).Updates(map[string]interface{}{
+		"status":     model.CustomerStatusSuspended,
+		"version":    gorm.Expr("version + 1"),
+		"updated_at": time.Now(),
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	orders := []model.Order{}
+	if err := s.db.Where("customer_id = ? and status = ?", customer.ID, model.OrderStatusActive).
+		Order("is_group_head desc, id asc").Find(&orders).Error; err != nil {
+		return nil, err
+	}
+	out := make([]BatchActionResult, 0, len(orders))
+	covered := map[uint]struct{}{}
+	for _, order := range orders {
+		if order.ParentOrderID != nil {
+			if _, ok := covered[*order.ParentOrderID]; ok {
+				continue
+			}
+		}
+		err := s.DeactivateOrder(ctx, order.ID, model.OrderStatusSuspended)
+		entry := BatchActionResult{ID: order.ID, Success: err == nil}
+		if err != nil {
+			entry.Error = err.Error()
+			s.log.Warn("suspend order failed", zap.Error(err), zap.Uint("order_id", order.ID))
+		} else if order.IsGroupHead {
+			covered[order.ID] = struct{}{}
+		}
+		out = append(out, entry)
+	}
+	return out, nil
+}
+
+// UnsuspendCustomer lifts the suspension and brings back the orders it took
+// offline. Orders that ran out meanwhile come back as expired rather than
+// active, the same state the scheduler would have left them in.
+func (s *OrderService) UnsuspendCustomer(ctx context.Context, customerID uint) ([]BatchActionResult, error) {
+	customer := model.Customer{}
+	if err := s.db.First(&customer, customerID).Error; err != nil {
+		return nil, err
+	}
+	if customer.Status != model.CustomerStatusSuspended {
+		return nil, errors.New("customer is not suspended")
+	}
+	orders := []model.Order{}
+	if err := s.db.Select("id", "expires_at").Where("customer_id = ? and status = ?", customer.ID, model.OrderStatusSuspended).Order("id asc").Find(&orders).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	liveIDs := make([]uint, 0, len(orders))
+	expiredIDs := make([]uint, 0)
+	for _, order := range orders {
+		if order.ExpiresAt.After(now) {
+			liveIDs = append(liveIDs, order.ID)
+		} else {
+			expiredIDs = append(expiredIDs, order.ID)
+		}
+	}
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&model.Customer{}).Where("id = ?", customer.ID).Updates(map[string]interface{}{
+			"status":     model.CustomerStatusActive,
+			"version":    gorm.Expr("version + 1"),
+			"updated_at": now,
+		}).Error; err != nil {
+			return err
+		}
+		if err := restoreSuspendedOrdersTx(tx, liveIDs, model.OrderStatusActive, model.OrderItemStatusActive, now); err != nil {
+			return err
+		}
+		return restoreSuspendedOrdersTx(tx, expiredIDs, model.OrderStatusExpired, model.OrderItemStatusExpired, now)
+	}); err != nil {
+		return nil, err
+	}
+	out := make([]BatchActionResult, 0, len(orders))
+	for _, order := range orders {
+		out = append(out, BatchActionResult{ID: order.ID, Success: true})
+	}
+	if len(liveIDs) == 0 {
+		return out, nil
+	}
+	return out, s.rebuildManagedRuntime(ctx)
+}
+
+func restoreSuspendedOrdersTx(tx *gorm.DB, ids []uint, status, itemStatus string, now time.Time) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := tx.Model(&model.Order{}).Where("id in ?", ids).Updates(map[string]interface{}{
+		"status":     status,
+		"version":    gorm.Expr("version + 1"),
+		"updated_at": now,
+	}).Error; err != nil {
+		return err
+	}
+	return tx.Model(&model.OrderItem{}).Where("order_id in ?", ids).Updates(map[string]interface{}{
+		"status":     itemStatus,
+		"updated_at": now,
+	}).Error
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+)
+
+func TestSuspendCustomerRestoresOnlyPreviouslyActiveOrders(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	customer := seedBillingCustomer(t, db, "suspend", "198.51.100.95")
+	for _, ip := range []string{"198.51.100.96", "198.51.100.97"} {
+		if err := db.Create(&model.HostIP{IP: ip, IsPublic: true, IsLocal: true, Enabled: true}).Error; err != nil {
+			t.Fatalf("create host ip failed: %v", err)
+		}
+	}
+	ctx := context.Background()
+
+	active, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create active order failed: %v", err)
+	}
+	disabled, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create second order failed: %v", err)
+	}
+	if err := svc.DeactivateOrder(ctx, disabled.ID, model.OrderStatusDisabled); err != nil {
+		t.Fatalf("disable order failed: %v", err)
+	}
+	lapsing, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create third order failed: %v", err)
+	}
+
+	results, err := svc.SuspendCustomer(ctx, customer.ID)
+	if err != nil {
+		t.Fatalf("suspend failed: %v", err)
+	}
+	if len(results) != 2 || results[0].ID != active.ID || !results[0].Success || !results[1].Success {
+		t.Fatalf("unexpected suspend results: %+v", results)
+	}
+	suspended, err := svc.GetOrder(active.ID)
+	if err != nil {
+		t.Fatalf("load order failed: %v", err)
+	}
+	if suspended.Status != model.OrderStatusSuspended || suspended.Items[0].Status != model.OrderItemStatusDisabled {
+		t.Fatalf("expected order and items suspended, got %s/%s", suspended.Status, suspended.Items[0].Status)
+	}
+	if _, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort}); err == nil || !strings.Contains(err.Error(), "suspended") {
+		t.Fatalf("expected new orders blocked, got %v", err)
+	}
+	if err := svc.ActivateOrder(ctx, disabled.ID); err == nil {
+		t.Fatalf("expected activation blocked while suspended")
+	}
+	if _, err := svc.SuspendCustomer(ctx, customer.ID); err == nil {
+		t.Fatalf("expected double suspend to fail")
+	}
+
+	if err := db.Model(&model.Order{}).Where("id = ?", lapsing.ID).Update("expires_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatalf("lapse order failed: %v", err)
+	}
+
+	results, err = svc.UnsuspendCustomer(ctx, customer.ID)
+	if err != nil {
+		t.Fatalf("unsuspend failed: %v", err)
+	}
+	if len(results) != 2 || results[0].ID != active.ID || results[1].ID != lapsing.ID {
+		t.Fatalf("unexpected unsuspend results: %+v", results)
+	}
+	restored, err := svc.GetOrder(active.ID)
+	if err != nil {
+		t.Fatalf("load order failed: %v", err)
+	}
+	if restored.Status != model.OrderStatusActive || restored.Items[0].Status != model.OrderItemStatusActive {
+		t.Fatalf("expected order restored, got %s/%s", restored.Status, restored.Items[0].Status)
+	}
+	lapsed, err := svc.GetOrder(lapsing.ID)
+	if err != nil {
+		t.Fatalf("load lapsed order failed: %v", err)
+	}
+	if lapsed.Status != model.OrderStatusExpired || lapsed.Items[0].Status != model.OrderItemStatusExpired {
+		t.Fatalf("expected lapsed order expired, got %s/%s", lapsed.Status, lapsed.Items[0].Status)
+	}
+	still := model.Order{}
+	if err := db.First(&still, disabled.ID).Error; err != nil {
+		t.Fatalf("load disabled order failed: %v", err)
+	}
+	if still.Status != model.OrderStatusDisabled {
+		t.Fatalf("expected disabled order untouched, got %s", still.Status)
+	}
+	reloaded := model.Customer{}
+	if err := db.First(&reloaded, customer.ID).Error; err != nil || reloaded.Status != model.CustomerStatusActive {
+		t.Fatalf("expected customer active again, got %s %v", reloaded.Status, err)
+	}
+}
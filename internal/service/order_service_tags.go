@@ -0,0 +1,266 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+)
+
+const (
+	maxTagLength  = 32
+	maxTagsPerRow = 16
+)
+
+type SavedFilterInput struct {
+	Name        string     `json:"name"`
+	Keyword     string     `json:"keyword"`
+	Mode        string     `json:"mode"`
+	Status      string     `json:"status"`
+	CustomerID  uint       `json:"customer_id"`
+	Tags        string     `json:"tags"`
+	ExpiresFrom *time.Time `json:"expires_from"`
+	ExpiresTo   *time.Time `json:"expires_to"`
+}
+
+type OrderLabelsInput struct {
+	Tags  *string `json:"tags"`
+	Notes *string `json:"notes"`
+}
+
+// NormalizeTags turns a comma-separated tag list into its stored form:
+// trimmed, de-duplicated case-insensitively and joined with commas.
+func NormalizeTags(raw string) (string, error) {
+	tags := SplitTags(raw)
+	if len(tags) > maxTagsPerRow {
+		return "", fmt.Errorf("at most %d tags", maxTagsPerRow)
+	}
+	for _, tag := range tags {
+		if len([]rune(tag)) > maxTagLength {
+			return "", fmt.Errorf("tag %s is longer than %d characters", tag, maxTagLength)
+		}
+	}
+	return strings.Join(tags, ","), nil
+}
+
+func SplitTags(raw string) []string {
+	out := make([]string, 0)
+	seen := map[string]struct{}{}
+	for _, part := range strings.Split(raw, ",") {
+		tag := strings.TrimSpace(part)
+		if tag == "" {
+			continue
+		}
+		key := strings.ToLower(tag)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		out = append(out, tag)
+	}
+	return out
+}
+
+// tagFilterSQL matches a stored tag list containing tag. sqlite LIKE is case
+// insensitive for ASCII, which is what tags are compared with.
+func tagFilterSQL(column string) string {
+	return fmt.Sprintf("(',' || %s || ',') LIKE ? ESCAPE '\\'", column)
+}
+
+func tagFilterArg(tag string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%," + replacer.Replace(tag) + ",%"
+}
+
+// applyListOrdersTagFilter keeps orders carrying every tag, either on the
+// order itself or on its customer.
+func applyListOrdersTagFilter(db *gorm.DB, tags []string) *gorm.DB {
+	for _, tag := range tags {
+		arg := tagFilterArg(tag)
+		db = db.Where("("+tagFilterSQL("orders.tags")+" OR EXISTS (SELECT 1 FROM customers tc WHERE tc.id = orders.customer_id AND "+tagFilterSQL("tc.tags")+"))", arg, arg)
+	}
+	return db
+}
+
+// ApplyCustomerTagFilter keeps customers carrying every tag.
+func ApplyCustomerTagFilter(db *gorm.DB, tags []string) *gorm.DB {
+	for _, tag := range tags {
+		db = db.Where(tagFilterSQL("customers.tags"), tagFilterArg(tag))
+	}
+	return db
+}
+
+// SetOrderLabels updates the tags and notes of an order. Group heads pass
+// their tags on to the children so group members filter alike.
+func (s *OrderService) SetOrderLabels(ctx context.Context, orderID uint, in OrderLabelsInput) (*model.Order, error) {
+	order := model.Order{}
+	if err := s.db.First(&order, orderID).Error; err != nil {
+		return nil, err
+	}
+	updates := map[string]interface{}{"updated_at": time.Now()}
+	if in.Tags != nil {
+		tags, err := NormalizeTags(*in.Tags)
+		if err != nil {
+			return nil, err
+		}
+		updates["tags"] = tags
+	}
+	if in.Notes != nil {
+		notes := strings.TrimSpace(*in.Notes)
+		if len(notes) > 1024 {
+			return nil, errors.New("notes must be at most 1024 bytes")
+		}
+		updates["notes"] = notes
+	}
+	err := s.versionedTx(ctx, order.ID, func(tx *gorm.DB) error {
+		if err := tx.Model(&model.Order{}).Where("id = ?", order.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+		if tags, ok := updates["tags"]; ok && order.IsGroupHead {
+			return tx.Model(&model.Order{}).Where("parent_order_id = ?", order.ID).Updates(map[string]interface{}{"tags": tags, "updated_at": updates["updated_at"]}).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetOrder(order.ID)
+}
+
+// BatchTagOrders adds and removes tags on many orders at once.
+func (s *OrderService) BatchTagOrders(ctx context.Context, orderIDs []uint, add string, remove string) []BatchActionResult {
+	addTags := SplitTags(add)
+	removeTags := map[string]struct{}{}
+	for _, tag := range SplitTags(remove) {
+		removeTags[strings.ToLower(tag)] = struct{}{}
+	}
+	results := make([]BatchActionResult, 0, len(orderIDs))
+	for _, id := range orderIDs {
+		order := model.Order{}
+		if err := s.db.Select("id", "tags").First(&order, id).Error; err != nil {
+			results = append(results, BatchActionResult{ID: id, Success: false, Error: err.Error()})
+			continue
+		}
+		kept := make([]string, 0)
+		for _, tag := range SplitTags(order.Tags + "," + strings.Join(addTags, ",")) {
+			if _, drop := removeTags[strings.ToLower(tag)]; !drop {
+				kept = append(kept, tag)
+			}
+		}
+		tags := strings.Join(kept, ",")
+		if _, err := s.SetOrderLabels(ctx, id, OrderLabelsInput{Tags: &tags}); err != nil {
+			results = append(results, BatchActionResult{ID: id, Success: false, Error: err.Error()})
+			continue
+		}
+		results = append(results, BatchActionResult{ID: id, Success: true})
+	}
+	return results
+}
+
+func (s *OrderService) ListSavedFilters(owner string) ([]model.SavedFilter, error) {
+	rows := []model.SavedFilter{}
+	err := s.db.Where("owner = ?", owner).Order("name asc").Find(&rows).Error
+	return rows, err
+}
+
+func (s *OrderService) GetSavedFilter(owner string, id uint) (*model.SavedFilter, error) {
+	row := model.SavedFilter{}
+	if err := s.db.Where("id = ? and owner = ?", id, owner).First(&row).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("saved filter not found")
+		}
+		return nil, err
+	}
+	return &row, nil
+}
+
+// SaveFilter creates a filter when id is 0 and replaces the owner's filter
+// otherwise.
+func (s *OrderService) SaveFilter(owner string, id uint, in SavedFilterInput) (*model.SavedFilter, error) {
+	if strings.TrimSpace(owner) == "" {
+		return nil, errors.New("owner is required")
+	}
+	row := model.SavedFilter{Owner: owner}
+	if id > 0 {
+		current, err := s.GetSavedFilter(owner, id)
+		if err != nil {
+			return nil, err
+		}
+		row = *current
+	}
+	row.Name = strings.TrimSpace(in.Name)
+	if row.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	tags, err := NormalizeTags(in.Tags)
+	if err != nil {
+		return nil, err
+	}
+	if in.ExpiresFrom != nil && in.ExpiresTo != nil && in.ExpiresTo.Before(*in.ExpiresFrom) {
+		return nil, errors.New("expires_to must not be before expires_from")
+	}
+	var count int64
+	if err := s.db.Model(&model.SavedFilter{}).Where("owner = ? and name = ? and id <> ?", owner, row.Name, row.ID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, errors.New("saved filter name already exists")
+	}
+	row.Keyword = strings.TrimSpace(in.Keyword)
+	row.Mode = strings.ToLower(strings.TrimSpace(in.Mode))
+	row.Status = strings.ToLower(strings.TrimSpace(in.Status))
+	row.CustomerID = in.CustomerID
+	row.Tags = tags
+	row.ExpiresFrom = in.ExpiresFrom
+	row.ExpiresTo = in.ExpiresTo
+	if err := s.db.Save(&row).Error; err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
+
+func (s *OrderService) DeleteSavedFilter(owner string, id uint) error {
+	res := s.db.Where("id = ? and owner = ?", id, owner).Delete(&model.SavedFilter{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.New("saved filter not found")
+	}
+	return nil
+}
+
+// ApplySavedFilter fills the filter fields of in from a saved filter.
+func ApplySavedFilter(in ListOrdersInput, row model.SavedFilter) ListOrdersInput {
+	in.Keyword = row.Keyword
+	in.Mode = row.Mode
+	in.Status = row.Status
+	in.CustomerID = row.CustomerID
+	in.Tags = SplitTags(row.Tags)
+	in.ExpiresFrom = time.Time{}
+	in.ExpiresTo = time.Time{}
+	if row.ExpiresFrom != nil {
+		in.ExpiresFrom = *row.ExpiresFrom
+	}
+	if row.ExpiresTo != nil {
+		in.ExpiresTo = *row.ExpiresTo
+	}
+	return in
+}
+
+// MatchingOrderIDs returns every top-level order (single orders and group
+// heads) the filter lists, ignoring paging. Batch actions on a head cover its
+// whole group.
+func (s *OrderService) MatchingOrderIDs(in ListOrdersInput) ([]uint, error) {
+	in = normalizeListOrdersInput(in)
+	ids := make([]uint, 0)
+	err := s.applyListOrdersFilters(s.db.Model(&model.Order{}).Where("orders.parent_order_id IS NULL"), in).
+		Order("orders.id asc").
+		Pluck("orders.id", &ids).Error
+	return ids, err
+}
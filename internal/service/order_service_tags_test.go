@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+)
+
+func TestOrderTagsExpiryRangeAndSavedFilters(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	ctx := context.Background()
+	vip := model.Customer{Name: "tag-vip", Code: "tag-vip", Status: model.OrderStatusActive, Tags: "VIP"}
+	plain := model.Customer{Name: "tag-plain", Code: "tag-plain", Status: model.OrderStatusActive}
+	for _, row := range []*model.Customer{&vip, &plain} {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatalf("create customer failed: %v", err)
+		}
+	}
+	now := time.Now()
+	seed := func(customerID uint, name string, expiresAt time.Time) model.Order {
+		t.Helper()
+		row := model.Order{CustomerID: customerID, Name: name, Mode: model.OrderModeAuto, Status: model.OrderStatusActive, Quantity: 1, Port: residentialTestPort, StartsAt: now, ExpiresAt: expiresAt}
+		if err := db.Create(&row).Error; err != nil {
+			t.Fatalf("create order failed: %v", err)
+		}
+		return row
+	}
+	vipOrder := seed(vip.ID, "vip-order", now.Add(5*24*time.Hour))
+	resold := seed(plain.ID, "resold", now.Add(10*24*time.Hour))
+	other := seed(plain.ID, "other", now.Add(40*24*time.Hour))
+
+	tags := " reseller-A, migrating ,RESELLER-a,"
+	notes := "moving to new pool"
+	labeled, err := svc.SetOrderLabels(ctx, resold.ID, OrderLabelsInput{Tags: &tags, Notes: &notes})
+	if err != nil {
+		t.Fatalf("set labels failed: %v", err)
+	}
+	if labeled.Tags != "reseller-A,migrating" || labeled.Notes != notes {
+		t.Fatalf("unexpected labels: tags=%q notes=%q", labeled.Tags, labeled.Notes)
+	}
+
+	listNames := func(in ListOrdersInput) []string {
+		t.Helper()
+		result, err := svc.ListOrders(in)
+		if err != nil {
+			t.Fatalf("list orders failed: %v", err)
+		}
+		names := []string{}
+		for _, row := range result.Rows {
+			names = append(names, row.Name)
+		}
+		return names
+	}
+	if names := listNames(ListOrdersInput{Tags: []string{"vip"}}); len(names) != 1 || names[0] != vipOrder.Name {
+		t.Fatalf("expected customer tag to match vip order, got %v", names)
+	}
+	if names := listNames(ListOrdersInput{Tags: []string{"reseller-a", "migrating"}}); len(names) != 1 || names[0] != resold.Name {
+		t.Fatalf("expected both tags to match resold, got %v", names)
+	}
+	if names := listNames(ListOrdersInput{Tags: []string{"reseller"}}); len(names) != 0 {
+		t.Fatalf("expected partial tag not to match, got %v", names)
+	}
+	if names := listNames(ListOrdersInput{ExpiresFrom: now.Add(7 * 24 * time.Hour), ExpiresTo: now.Add(30 * 24 * time.Hour)}); len(names) != 1 || names[0] != resold.Name {
+		t.Fatalf("expected expiry range to match resold, got %v", names)
+	}
+
+	to := now.Add(30 * 24 * time.Hour)
+	filter, err := svc.SaveFilter("alice", 0, SavedFilterInput{Name: "due this month", ExpiresTo: &to})
+	if err != nil {
+		t.Fatalf("save filter failed: %v", err)
+	}
+	if _, err := svc.SaveFilter("alice", 0, SavedFilterInput{Name: "due this month"}); err == nil {
+		t.Fatalf("expected duplicate filter name to be rejected")
+	}
+	if _, err := svc.GetSavedFilter("bob", filter.ID); err == nil {
+		t.Fatalf("expected filters to be private to their owner")
+	}
+	ids, err := svc.MatchingOrderIDs(ApplySavedFilter(ListOrdersInput{}, *filter))
+	if err != nil || len(ids) != 2 || ids[0] != vipOrder.ID || ids[1] != resold.ID {
+		t.Fatalf("expected filter to match vip and resold orders, got %v %v", ids, err)
+	}
+
+	results := svc.BatchTagOrders(ctx, ids, "renew-due", "migrating")
+	for _, result := range results {
+		if !result.Success {
+			t.Fatalf("batch tag failed: %+v", result)
+		}
+	}
+	if names := listNames(ListOrdersInput{Tags: []string{"renew-due"}}); len(names) != 2 {
+		t.Fatalf("expected batch tag on both orders, got %v", names)
+	}
+	if names := listNames(ListOrdersInput{Tags: []string{"migrating"}}); len(names) != 0 {
+		t.Fatalf("expected migrating tag removed, got %v", names)
+	}
+	current := model.Order{}
+	if err := db.First(&current, other.ID).Error; err != nil || current.Tags != "" {
+		t.Fatalf("expected unmatched order untouched, got %q %v", current.Tags, err)
+	}
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+)
+
+type TransferOrderInput struct {
+	CustomerID uint   `json:"customer_id"`
+	Operator   string `json:"-"`
+	Note       string `json:"note"`
+}
+
+// TransferOrder moves an order, or a group head with all of its children, to
+// another customer. Items, credentials and runtime resources are untouched;
+// only the customer-level invariants are checked again for the target.
+func (s *OrderService) TransferOrder(ctx context.Context, orderID uint, in TransferOrderInput) (*model.Order, error) {
+	order := model.Order{}
+	if err := s.db.First(&order, orderID).Error; err != nil {
+		return nil, err
+	}
+	if order.ParentOrderID != nil && *order.ParentOrderID > 0 {
+		return nil, errors.New("child order cannot be transferred alone, transfer the group head")
+	}
+	if in.CustomerID == 0 {
+		return nil, errors.New("customer_id is required")
+	}
+	if in.CustomerID == order.CustomerID {
+		return nil, errors.New("order already belongs to this customer")
+	}
+	if order.Status == model.OrderStatusSuspended {
+		return nil, errors.New("order is suspended with its customer, unsuspend first")
+	}
+	target := model.Customer{}
+	if err := s.db.First(&target, in.CustomerID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("target customer not found")
+		}
+		return nil, err
+	}
+	if target.Status == model.CustomerStatusSuspended {
+		return nil, errors.New("target customer is suspended")
+	}
+
+	ids := []uint{order.ID}
+	if order.IsGroupHead {
+		if err := s.db.Model(&model.Order{}).Where("id = ? or parent_order_id = ?", order.ID, order.ID).Pluck("id", &ids).Error; err != nil {
+			return nil, err
+		}
+	}
+	orders := []model.Order{}
+	if err := s.db.Preload("Items").Where("id in ?", ids).Find(&orders).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.ensureTransferTargetIPsFree(orders, target.ID, now); err != nil {
+			return err
+		}
+		if err := s.ensureTransferDedicatedEgressUniqueTx(tx, target.ID, ids); err != nil {
+			return err
+		}
+		for _, row := range orders {
+			if err := s.ensureTransferCredentialsTx(tx, row); err != nil {
+				return err
+			}
+			if err := s.ensureTransferForwardCapacityTx(ctx, tx, row, target.ID); err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&model.Order{}).Where("id in ?", ids).Updates(map[string]interface{}{
+			"customer_id": target.ID,
+			"version":     gorm.Expr("version + 1"),
+			"updated_at":  now,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&model.OrderTransfer{
+			OrderID:        order.ID,
+			OrderNo:        order.OrderNo,
+			OrderCount:     len(ids),
+			FromCustomerID: order.CustomerID,
+			ToCustomerID:   target.ID,
+			Operator:       strings.TrimSpace(in.Operator),
+			Note:           strings.TrimSpace(in.Note),
+		}).Error
+	}); err != nil {
+		return nil, err
+	}
+	return s.GetOrder(order.ID)
+}
+
+func (s *OrderService) ListOrderTransfers(orderID uint) ([]model.OrderTransfer, error) {
+	rows := []model.OrderTransfer{}
+	if err := s.db.Where("order_id = ?", orderID).Order("id desc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// ensureTransferTargetIPsFree keeps the one-IP-per-customer rule for live
+// residential items; dedicated items share ingress addresses by design.
+func (s *OrderService) ensureTransferTargetIPsFree(orders []model.Order, customerID uint, now time.Time) error {
+	used, err := s.customerUsedIPSet(customerID, 0)
+	if err != nil {
+		return err
+	}
+	for _, order := range orders {
+		if order.Mode == model.OrderModeDedicated || !orderLive(order, now) {
+			continue
+		}
+		for _, item := range order.Items {
+			if item.Status != model.OrderItemStatusActive {
+				continue
+			}
+			if _, exists := used[item.IP]; exists {
+				return fmt.Errorf("ip %s already used by target customer", item.IP)
+			}
+			used[item.IP] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (s *OrderService) ensureTransferDedicatedEgressUniqueTx(tx *gorm.DB, customerID uint, orderIDs []uint) error {
+	egresses := []model.DedicatedEgress{}
+	if err := tx.Table("dedicated_egresses de").
+		Select("de.*").
+		Joins("join orders o on o.id = de.order_id").
+		Where("de.order_id in ? and o.mode = ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '')", orderIDs, model.OrderModeDedicated, model.OrderStatusActive, time.Now()).
+		Scan(&egresses).Error; err != nil {
+		return err
+	}
+	lines := make([]DedicatedEgressLine, 0, len(egresses))
+	for _, egress := range egresses {
+		lines = append(lines, DedicatedEgressLine{Address: egress.Address, Port: egress.Port, Username: egress.Username, Password: egress.Password})
+	}
+	return s.ensureCustomerDedicatedEgressUniqueTx(tx, customerID, lines, orderIDs)
+}
+
+func (s *OrderService) ensureTransferCredentialsTx(tx *gorm.DB, order model.Order) error {
+	if order.Mode == model.OrderModeDedicated || order.Mode == model.OrderModeForward {
+		return nil
+	}
+	assignments := make([]residentialCredentialAssignment, 0, len(order.Items))
+	for _, item := range order.Items {
+		if strings.TrimSpace(item.Username) == "" {
+			continue
+		}
+		assignments = append(assignments, residentialCredentialAssignment{IP: item.IP, Username: item.Username, Password: item.Password})
+	}
+	return s.ensureResidentialCredentialAssignmentsAvailableTx(tx, assignments, order.ID)
+}
+
+func (s *OrderService) ensureTransferForwardCapacityTx(ctx context.Context, tx *gorm.DB, order model.Order, customerID uint) error {
+	outboundIDs := make([]uint, 0)
+	for _, item := range order.Items {
+		if item.SocksOutboundID != nil && item.Status == model.OrderItemStatusActive {
+			outboundIDs = append(outboundIDs, *item.SocksOutboundID)
+		}
+	}
+	if len(outboundIDs) == 0 {
+		return nil
+	}
+	outbounds := []model.SocksOutbound{}
+	if err := tx.Where("id in ?", uniqueUintIDs(outboundIDs)).Find(&outbounds).Error; err != nil {
+		return err
+	}
+	order.CustomerID = customerID
+	return s.ensureForwardCapacityTx(ctx, tx, order, outbounds)
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+)
+
+func TestTransferOrderRejectsTargetIPConflict(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	from := seedBillingCustomer(t, db, "from", "198.51.100.30")
+	to := model.Customer{Name: "to", Code: "to", Status: model.OrderStatusActive}
+	if err := db.Create(&to).Error; err != nil {
+		t.Fatalf("create customer failed: %v", err)
+	}
+
+	order, err := svc.CreateOrder(context.Background(), CreateOrderInput{CustomerID: from.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create order failed: %v", err)
+	}
+	if _, err := svc.CreateOrder(context.Background(), CreateOrderInput{CustomerID: to.ID, Quantity: 1, DurationDay: 30, Port: residentialTestPort}); err != nil {
+		t.Fatalf("create target order failed: %v", err)
+	}
+
+	if _, err := svc.TransferOrder(context.Background(), order.ID, TransferOrderInput{CustomerID: to.ID}); err == nil || !strings.Contains(err.Error(), "already used by target customer") {
+		t.Fatalf("expected ip conflict, got %v", err)
+	}
+	reloaded := model.Order{}
+	if err := db.First(&reloaded, order.ID).Error; err != nil {
+		t.Fatalf("reload order failed: %v", err)
+	}
+	if reloaded.CustomerID != from.ID {
+		t.Fatalf("order should stay with original customer, got %d", reloaded.CustomerID)
+	}
+	var count int64
+	db.Model(&model.OrderTransfer{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected no transfer record, got %d", count)
+	}
+}
+
+func TestTransferOrderGroupMovesChildrenAndRecordsAudit(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	headID, childIDs := seedDedicatedCopyLinksTestGroup(t, db)
+	target := model.Customer{Name: "target", Code: "tg", Status: model.OrderStatusActive}
+	if err := db.Create(&target).Error; err != nil {
+		t.Fatalf("create customer failed: %v", err)
+	}
+
+	if _, err := svc.TransferOrder(context.Background(), childIDs[0], TransferOrderInput{CustomerID: target.ID}); err == nil {
+		t.Fatalf("expected child transfer to be rejected")
+	}
+	if _, err := svc.TransferOrder(context.Background(), headID, TransferOrderInput{CustomerID: target.ID, Operator: "admin", Note: "account merge"}); err != nil {
+		t.Fatalf("transfer group failed: %v", err)
+	}
+
+	orders := []model.Order{}
+	if err := db.Where("id = ? or parent_order_id = ?", headID, headID).Find(&orders).Error; err != nil {
+		t.Fatalf("load group failed: %v", err)
+	}
+	if len(orders) != 3 {
+		t.Fatalf("expected 3 orders in group, got %d", len(orders))
+	}
+	for _, row := range orders {
+		if row.CustomerID != target.ID {
+			t.Fatalf("order %d not moved: customer=%d", row.ID, row.CustomerID)
+		}
+	}
+	item := model.OrderItem{}
+	if err := db.Where("order_id = ?", childIDs[0]).First(&item).Error; err != nil {
+		t.Fatalf("load item failed: %v", err)
+	}
+	if item.Username != "user01" || item.Password != "pass01" {
+		t.Fatalf("credentials should be unchanged, got %s/%s", item.Username, item.Password)
+	}
+
+	transfers, err := svc.ListOrderTransfers(headID)
+	if err != nil {
+		t.Fatalf("list transfers failed: %v", err)
+	}
+	if len(transfers) != 1 || transfers[0].OrderCount != 3 || transfers[0].ToCustomerID != target.ID || transfers[0].Operator != "admin" {
+		t.Fatalf("unexpected transfer audit: %+v", transfers)
+	}
+}
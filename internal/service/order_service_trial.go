@@ -0,0 +1,201 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+type trialPolicy struct {
+	maxDays        int
+	maxPerCustomer int
+	grace          time.Duration
+}
+
+type ConvertTrialInput struct {
+	DurationDay int       `json:"duration_day"`
+	ExpiresAt   time.Time `json:"-"`
+	Price       *float64  `json:"price"`
+}
+
+type TrialSweepResult struct {
+	Capped  []uint `json:"capped"`
+	Deleted []uint `json:"deleted"`
+}
+
+func loadTrialPolicy(db *gorm.DB) trialPolicy {
+	settings := map[string]string{}
+	rows := []model.Setting{}
+	if err := db.Where("key in ?", []string{"trial_max_days", "trial_max_per_customer", "trial_grace_hours"}).Find(&rows).Error; err == nil {
+		for _, row := range rows {
+			settings[row.Key] = row.Value
+		}
+	}
+	graceHours := parseSettingInt(settings["trial_grace_hours"], 24)
+	if graceHours < 0 {
+		graceHours = 0
+	}
+	return trialPolicy{
+		maxDays:        parseSettingInt(settings["trial_max_days"], 3),
+		maxPerCustomer: parseSettingInt(settings["trial_max_per_customer"], 1),
+		grace:          time.Duration(graceHours) * time.Hour,
+	}
+}
+
+// ensureTrialAllowed checks a trial against trial_max_days and the customer's
+// allowance: Customer.TrialLimit when set, otherwise trial_max_per_customer.
+// Trials are counted when created, so deleting one gives nothing back.
+func (s *OrderService) ensureTrialAllowed(customerID uint, now time.Time, expiresAt time.Time) error {
+	policy := loadTrialPolicy(s.db)
+	if policy.maxDays > 0 && expiresAt.Sub(now) > time.Duration(policy.maxDays)*24*time.Hour {
+		return fmt.Errorf("trial orders last at most %d days", policy.maxDays)
+	}
+	customer := model.Customer{}
+	if err := s.db.First(&customer, customerID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errors.New("customer not found")
+		}
+		return err
+	}
+	limit := customer.TrialLimit
+	if limit <= 0 {
+		limit = policy.maxPerCustomer
+	}
+	if limit > 0 && customer.TrialsUsed >= limit {
+		return fmt.Errorf("customer has used %d/%d trials", customer.TrialsUsed, limit)
+	}
+	return nil
+}
+
+func countTrialTx(tx *gorm.DB, order model.Order) error {
+	if !order.IsTrial {
+		return nil
+	}
+	return tx.Model(&model.Customer{}).Where("id = ?", order.CustomerID).UpdateColumn("trials_used", gorm.Expr("trials_used + ?", 1)).Error
+}
+
+// ConvertTrialOrder turns a trial (or a trial group) into a paid order in
+// place: items, IPs and credentials stay and the order is renewed like any
+// other, so the paid period follows on from the trial.
+func (s *OrderService) ConvertTrialOrder(ctx context.Context, orderID uint, in ConvertTrialInput) (*model.Order, error) {
+	order := model.Order{}
+	if err := s.db.First(&order, orderID).Error; err != nil {
+		return nil, err
+	}
+	if order.ParentOrderID != nil {
+		return nil, errors.New("convert the group head instead of a child order")
+	}
+	if !order.IsTrial {
+		return nil, errors.New("order is not a trial")
+	}
+	if in.Price != nil && *in.Price < 0 {
+		return nil, errors.New("price must be >= 0")
+	}
+	if !in.ExpiresAt.IsZero() && !in.ExpiresAt.After(time.Now()) {
+		return nil, errors.New("expires_at must be in the future")
+	}
+	if err := s.ensureCustomerNotSuspended(order.CustomerID); err != nil {
+		return nil, err
+	}
+	updates := map[string]interface{}{
+		"is_trial":        false,
+		"trial_cap_bytes": 0,
+	}
+	if in.Price != nil {
+		updates["price"] = *in.Price
+		order.Price = *in.Price
+	}
+	order.IsTrial = false
+	order.TrialCapBytes = 0
+	// The trial flag flips inside the renewal transaction, so a renewal that
+	// fails leaves the order a trial the sweep still cleans up.
+	convertCtx := withRenewalTxHook(ctx, func(tx *gorm.DB) error {
+		if err := tx.Model(&model.Order{}).Where("id = ? or parent_order_id = ?", order.ID, order.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+		return runRenewalTxHook(ctx, tx)
+	})
+	if err := s.renewLoadedOrder(convertCtx, order, in.DurationDay, in.ExpiresAt, LedgerSourceTrialConvert); err != nil {
+		return nil, err
+	}
+	if err := s.db.Preload("Customer").Preload("Items").First(&order, order.ID).Error; err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// SweepTrials expires trials that used up their traffic cap and hard-deletes
+// trials that have been expired for longer than trial_grace_hours.
+func (s *OrderService) SweepTrials(ctx context.Context, now time.Time) (TrialSweepResult, error) {
+	result := TrialSweepResult{Capped: []uint{}, Deleted: []uint{}}
+	capped := []model.Order{}
+	if err := s.db.Where("is_trial = ? and parent_order_id is null and status = ? and trial_cap_bytes > 0", true, model.OrderStatusActive).Find(&capped).Error; err != nil {
+		return result, err
+	}
+	for _, order := range capped {
+		used, err := s.trialTrafficUsed(order)
+		if err != nil {
+			return result, err
+		}
+		if used < order.TrialCapBytes {
+			continue
+		}
+		if err := s.DeactivateOrder(ctx, order.ID, model.OrderStatusExpired); err != nil {
+			s.log.Warn("expire capped trial failed", zap.Error(err), zap.Uint("order_id", order.ID))
+			continue
+		}
+		if err := s.db.Model(&model.Order{}).Where("id = ? or parent_order_id = ?", order.ID, order.ID).Updates(map[string]interface{}{
+			"expires_at": now,
+			"updated_at": now,
+		}).Error; err != nil {
+			return result, err
+		}
+		result.Capped = append(result.Capped, order.ID)
+	}
+
+	policy := loadTrialPolicy(s.db)
+	stale := []model.Order{}
+	if err := s.db.Where("is_trial = ? and parent_order_id is null and status = ? and expires_at <= ?", true, model.OrderStatusExpired, now.Add(-policy.grace)).Find(&stale).Error; err != nil {
+		return result, err
+	}
+	for _, order := range stale {
+		if err := s.DeleteOrder(ctx, order.ID); err != nil {
+			s.log.Warn("delete expired trial failed", zap.Error(err), zap.Uint("order_id", order.ID))
+			continue
+		}
+		result.Deleted = append(result.Deleted, order.ID)
+	}
+	return result, nil
+}
+
+// trialTrafficUsed adds up the runtime snapshots of an order since it was
+// created. A counter that drops means xray restarted, so the new value counts
+// in full.
+func (s *OrderService) trialTrafficUsed(order model.Order) (int64, error) {
+	scope, key := runtimeScopeOrder, uintKey(order.ID)
+	if order.IsGroupHead {
+		scope, key = runtimeScopeGroup, uintKey(order.GroupID)
+	}
+	totals := []int64{}
+	if err := s.db.Model(&model.RuntimeTrafficSnapshot{}).
+		Where("scope = ? and entity_key = ? and sampled_at >= ?", scope, key, order.CreatedAt).
+		Order("sampled_at asc").Pluck("total_bytes", &totals).Error; err != nil {
+		return 0, err
+	}
+	var used, prev int64
+	for _, total := range totals {
+		if total >= prev {
+			used += total - prev
+		} else {
+			used += total
+		}
+		prev = total
+	}
+	return used, nil
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+func TestTrialOrderLimitsCapsConversionAndCleanup(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	customer := seedBillingCustomer(t, db, "trial", "198.51.100.80")
+	if err := db.Create(&model.HostIP{IP: "198.51.100.81", IsPublic: true, IsLocal: true, Enabled: true}).Error; err != nil {
+		t.Fatalf("create host ip failed: %v", err)
+	}
+	ctx := context.Background()
+
+	if _, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 10, Port: residentialTestPort, IsTrial: true}); err == nil || !strings.Contains(err.Error(), "at most 3 days") {
+		t.Fatalf("expected long trial to be rejected, got %v", err)
+	}
+	trial, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: customer.ID, Quantity: 1, Port: residentialTestPort, Price: 30, IsTrial: true, TrialCapBytes: 1000})
+	if err != nil {
+		t.Fatalf("create trial failed: %v", err)
+	}
+	if !trial.IsTrial || trial.Price != 0 || trial.ExpiresAt.Sub(trial.StartsAt) > 3*24*time.Hour {
+		t.Fatalf("unexpected trial: trial=%v price=%v expires=%s", trial.IsTrial, trial.Price, trial.ExpiresAt)
+	}
+	if _, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: customer.ID, Quantity: 1, Port: residentialTestPort, IsTrial: true}); err == nil || !strings.Contains(err.Error(), "1/1 trials") {
+		t.Fatalf("expected trial limit, got %v", err)
+	}
+	if err := svc.RenewOrder(ctx, trial.ID, 30); err == nil {
+		t.Fatalf("expected trial renew to be refused")
+	}
+
+	now := time.Now()
+	for i, total := range []int64{600, 1200} {
+		row := model.RuntimeTrafficSnapshot{Scope: runtimeScopeOrder, EntityKey: uintKey(trial.ID), BucketAt: now.Add(time.Duration(i) * time.Minute), SampledAt: now.Add(time.Duration(i) * time.Minute), TotalBytes: total}
+		if err := db.Create(&row).Error; err != nil {
+			t.Fatalf("create snapshot failed: %v", err)
+		}
+	}
+	sweep, err := svc.SweepTrials(ctx, now.Add(2*time.Minute))
+	if err != nil {
+		t.Fatalf("sweep failed: %v", err)
+	}
+	if len(sweep.Capped) != 1 || sweep.Capped[0] != trial.ID || len(sweep.Deleted) != 0 {
+		t.Fatalf("unexpected sweep: %+v", sweep)
+	}
+	capped := model.Order{}
+	if err := db.First(&capped, trial.ID).Error; err != nil {
+		t.Fatalf("load trial failed: %v", err)
+	}
+	if capped.Status != model.OrderStatusExpired {
+		t.Fatalf("expected capped trial to expire, got %s", capped.Status)
+	}
+
+	price := 30.0
+	failing := withRenewalTxHook(ctx, func(tx *gorm.DB) error { return errors.New("renewal failed") })
+	if _, err := svc.ConvertTrialOrder(failing, trial.ID, ConvertTrialInput{DurationDay: 30, Price: &price}); err == nil {
+		t.Fatalf("expected failing renewal to abort the conversion")
+	}
+	if err := db.First(&capped, trial.ID).Error; err != nil {
+		t.Fatalf("load trial failed: %v", err)
+	}
+	if !capped.IsTrial || capped.Price != 0 || capped.Status != model.OrderStatusExpired {
+		t.Fatalf("expected failed conversion to leave the trial untouched, got %+v", capped)
+	}
+
+	paid, err := svc.ConvertTrialOrder(ctx, trial.ID, ConvertTrialInput{DurationDay: 30, Price: &price})
+	if err != nil {
+		t.Fatalf("convert trial failed: %v", err)
+	}
+	if paid.IsTrial || paid.Status != model.OrderStatusActive || paid.Price != price || paid.ExpiresAt.Before(now.Add(29*24*time.Hour)) {
+		t.Fatalf("unexpected converted order: %+v", paid)
+	}
+	if len(paid.Items) != 1 || paid.Items[0].IP != trial.Items[0].IP || paid.Items[0].Username != trial.Items[0].Username || paid.Items[0].Status != model.OrderItemStatusActive {
+		t.Fatalf("expected items kept in place, got %+v", paid.Items)
+	}
+	var charges int64
+	if err := db.Model(&model.LedgerEntry{}).Where("order_id = ? and source = ?", trial.ID, LedgerSourceTrialConvert).Count(&charges).Error; err != nil || charges != 1 {
+		t.Fatalf("expected one conversion charge, got %d %v", charges, err)
+	}
+
+	if err := db.Model(&model.Customer{}).Where("id = ?", customer.ID).Update("trial_limit", 2).Error; err != nil {
+		t.Fatalf("raise trial limit failed: %v", err)
+	}
+	second, err := svc.CreateOrder(ctx, CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 1, Port: residentialTestPort, IsTrial: true})
+	if err != nil {
+		t.Fatalf("create second trial failed: %v", err)
+	}
+	if err := svc.DeactivateOrder(ctx, second.ID, model.OrderStatusExpired); err != nil {
+		t.Fatalf("expire second trial failed: %v", err)
+	}
+	if sweep, err = svc.SweepTrials(ctx, second.ExpiresAt.Add(time.Hour)); err != nil || len(sweep.Deleted) != 0 {
+		t.Fatalf("expected trial kept within grace, got %+v %v", sweep, err)
+	}
+	if sweep, err = svc.SweepTrials(ctx, second.ExpiresAt.Add(25*time.Hour)); err != nil || len(sweep.Deleted) != 1 {
+		t.Fatalf("expected trial deleted after grace, got %+v %v", sweep, err)
+	}
+	if err := db.First(&model.Order{}, second.ID).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("expected trial hard-deleted, got %v", err)
+	}
+	reloaded := model.Customer{}
+	if err := db.First(&reloaded, customer.ID).Error; err != nil || reloaded.TrialsUsed != 2 {
+		t.Fatalf("expected 2 trials used, got %d %v", reloaded.TrialsUsed, err)
+	}
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+)
+
+// ErrVersionConflict is returned when a write was based on an order or
+// customer version that has changed since it was read.
+var ErrVersionConflict = errors.New("version conflict, reload and retry")
+
+type expectedVersionKey struct{}
+
+// WithExpectedVersion attaches the version a caller last read to ctx.
+// Guarded order mutations then only go ahead while the order is still at
+// that version.
+func WithExpectedVersion(ctx context.Context, version int) context.Context {
+	return context.WithValue(ctx, expectedVersionKey{}, version)
+}
+
+func expectedVersionFrom(ctx context.Context) (int, bool) {
+	if ctx == nil {
+		return 0, false
+	}
+	version, ok := ctx.Value(expectedVersionKey{}).(int)
+	return version, ok
+}
+
+// versionedTx runs fn in a transaction that only commits if orderID is still
+// at the version ctx expects. The claim is the last statement, so fn keeps
+// the lock order it had before versions existed.
+func (s *OrderService) versionedTx(ctx context.Context, orderID uint, fn func(tx *gorm.DB) error) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return claimOrderVersionTx(ctx, tx, orderID)
+	})
+}
+
+// claimOrderVersionTx bumps the version of orderID, failing with
+// ErrVersionConflict when ctx expects a version the order has moved past.
+// The compare and the bump are one statement so two writers holding the same
+// version cannot both pass.
+func claimOrderVersionTx(ctx context.Context, tx *gorm.DB, orderID uint) error {
+	expected, guarded := expectedVersionFrom(ctx)
+	if !guarded {
+		return bumpOrderVersionTx(tx, orderID)
+	}
+	res := tx.Model(&model.Order{}).Where("id = ? and version = ?", orderID, expected).UpdateColumn("version", gorm.Expr("version + 1"))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrVersionConflict
+	}
+	return bumpOrderGroupVersionTx(tx, orderID)
+}
+
+// bumpOrderVersionTx moves an order and the rest of its group to the next
+// version without checking what the caller read.
+func bumpOrderVersionTx(tx *gorm.DB, orderID uint) error {
+	if err := tx.Model(&model.Order{}).Where("id = ?", orderID).UpdateColumn("version", gorm.Expr("version + 1")).Error; err != nil {
+		return err
+	}
+	return bumpOrderGroupVersionTx(tx, orderID)
+}
+
+// bumpOrderGroupVersionTx bumps every other member of orderID's group, so a
+// change made through the head invalidates edits based on a child and the
+// other way round.
+func bumpOrderGroupVersionTx(tx *gorm.DB, orderID uint) error {
+	order := model.Order{}
+	if err := tx.Select("id", "parent_order_id").First(&order, orderID).Error; err != nil {
+		return err
+	}
+	rootID := orderHistoryRoot(order)
+	return tx.Model(&model.Order{}).
+		Where("id <> ? and (id = ? or parent_order_id = ?)", orderID, rootID, rootID).
+		UpdateColumn("version", gorm.Expr("version + 1")).Error
+}
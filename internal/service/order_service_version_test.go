@@ -0,0 +1,66 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+)
+
+func TestOrderVersionRejectsStaleGroupWrites(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	ctx := context.Background()
+	headID, children := seedDedicatedGroupForGeoTest(t, db)
+	versionOf := func(id uint) int {
+		t.Helper()
+		row := model.Order{}
+		if err := db.Select("id", "version").First(&row, id).Error; err != nil {
+			t.Fatalf("load order failed: %v", err)
+		}
+		return row.Version
+	}
+	if v := versionOf(headID); v != 1 {
+		t.Fatalf("expected new orders at version 1, got %d", v)
+	}
+
+	if err := svc.UpdateGroupEgressGeo(WithExpectedVersion(ctx, 1), headID, nil, "US", "Virginia"); err != nil {
+		t.Fatalf("first write failed: %v", err)
+	}
+	if versionOf(headID) != 2 || versionOf(children[0].orderID) != 2 {
+		t.Fatalf("expected head and children bumped to 2, got %d/%d", versionOf(headID), versionOf(children[0].orderID))
+	}
+
+	err := svc.UpdateGroupEgressGeo(WithExpectedVersion(ctx, 1), headID, nil, "MX", "Jalisco")
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("expected version conflict, got %v", err)
+	}
+	egress := model.DedicatedEgress{}
+	if err := db.Where("order_item_id = ?", children[0].itemID).First(&egress).Error; err != nil {
+		t.Fatalf("load egress failed: %v", err)
+	}
+	if egress.CountryCode != "us" || versionOf(headID) != 2 {
+		t.Fatalf("stale write must not apply, got %s at version %d", egress.CountryCode, versionOf(headID))
+	}
+
+	// A child edit moves the whole group, so a head write based on the old
+	// version is stale too.
+	tags := "vip"
+	if _, err := svc.SetOrderLabels(WithExpectedVersion(ctx, 2), children[1].orderID, OrderLabelsInput{Tags: &tags}); err != nil {
+		t.Fatalf("child label write failed: %v", err)
+	}
+	if err := svc.UpdateGroupEgressGeo(WithExpectedVersion(ctx, 2), headID, nil, "MX", "Jalisco"); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("expected conflict after child edit, got %v", err)
+	}
+
+	// Writers without an expectation, like the scheduler, still bump.
+	if err := svc.UpdateGroupEgressGeo(ctx, headID, nil, "MX", "Jalisco"); err != nil {
+		t.Fatalf("unguarded write failed: %v", err)
+	}
+	if v := versionOf(headID); v != 4 {
+		t.Fatalf("expected version 4, got %d", v)
+	}
+}
@@ -0,0 +1,314 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const PaymentSignatureHeader = "X-Xraytool-Signature"
+
+// paymentEventStaleAfter is how long a delivery may sit in processing before
+// a retry takes it over. Booking commits with the renewal, so a stale event
+// never has a half-applied payment behind it.
+const paymentEventStaleAfter = 10 * time.Minute
+
+var (
+	ErrPaymentWebhookDisabled = errors.New("payment webhook secret is not configured")
+	ErrPaymentSignature       = errors.New("invalid payment signature")
+	ErrPaymentInProgress      = errors.New("payment is already being processed")
+)
+
+type PaymentWebhookEvent struct {
+	PaymentID     string    `json:"payment_id"`
+	OrderNo       string    `json:"order_no"`
+	CustomerCode  string    `json:"customer_code"`
+	Amount        float64   `json:"amount"`
+	Days          int       `json:"days"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	ChildOrderIDs []uint    `json:"child_order_ids"`
+	Note          string    `json:"note"`
+}
+
+// SignPaymentWebhook returns the signature header value for a raw body.
+func SignPaymentWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *BillingService) VerifyPaymentSignature(body []byte, signature string) error {
+	secret, err := s.store.GetSetting("payment_webhook_secret")
+	if err != nil {
+		return err
+	}
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return ErrPaymentWebhookDisabled
+	}
+	expected := SignPaymentWebhook(secret, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.TrimSpace(signature))) {
+		return ErrPaymentSignature
+	}
+	return nil
+}
+
+func (s *BillingService) ListPaymentEvents(limit int) ([]model.PaymentEvent, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	rows := []model.PaymentEvent{}
+	if err := s.db.Order("id desc").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// ApplyPayment renews the paid order and books the payment. Deliveries are
+// idempotent on PaymentID: an applied event is returned with duplicate=true,
+// a failed one is retried, as is one left processing for longer than
+// paymentEventStaleAfter. Without a resolvable order, or when the customer is
+// suspended, the amount is only credited to the customer balance.
+func (s *BillingService) ApplyPayment(ctx context.Context, in PaymentWebhookEvent, payload []byte) (*model.PaymentEvent, bool, error) {
+	in.PaymentID = strings.TrimSpace(in.PaymentID)
+	in.OrderNo = strings.TrimSpace(in.OrderNo)
+	in.CustomerCode = strings.TrimSpace(in.CustomerCode)
+	if in.PaymentID == "" || len(in.PaymentID) > 128 {
+		return nil, false, errors.New("payment_id is required and at most 128 chars")
+	}
+	if in.OrderNo == "" && in.CustomerCode == "" {
+		return nil, false, errors.New("order_no or customer_code is required")
+	}
+	if in.Amount <= 0 {
+		return nil, false, errors.New("amount must be > 0")
+	}
+	if in.Days < 0 {
+		return nil, false, errors.New("days must be >= 0")
+	}
+	if in.Days == 0 && in.ExpiresAt.IsZero() {
+		return nil, false, errors.New("days or expires_at is required")
+	}
+
+	event, duplicate, err := s.claimPaymentEvent(in, payload)
+	if err != nil || duplicate {
+		return event, duplicate, err
+	}
+
+	customer, order, err := s.resolvePaymentTarget(in)
+	if err == nil && order != nil {
+		// The payment is booked inside the renewal transaction, so an order
+		// is never renewed without its payment on record.
+		renewed := *order
+		err = s.renewPaidOrder(withRenewalTxHook(ctx, func(tx *gorm.DB) error {
+			return bookPaymentEventTx(tx, event.ID, customer, &renewed, in)
+		}), renewed, in)
+		if errors.Is(err, ErrCustomerSuspended) {
+			s.store.AddTaskLog("warn", "payment webhook renewal refused", fmt.Sprintf("%s: customer %s is suspended, amount credited to balance", in.PaymentID, customer.Name))
+			order = nil
+			err = nil
+		} else if err != nil && s.paymentEventBooked(event.ID) {
+			// Only the runtime sync after the committed renewal failed.
+			s.logger.Warn("payment renewal runtime sync failed", zap.Error(err), zap.String("payment_id", in.PaymentID))
+			err = nil
+		}
+		if err == nil && order != nil {
+			return s.finishPaymentEvent(event, customer, order, in)
+		}
+	}
+	if err == nil {
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			return bookPaymentEventTx(tx, event.ID, customer, nil, in)
+		})
+	}
+	if err != nil {
+		s.store.AddTaskLog("warn", "payment webhook failed", fmt.Sprintf("%s: %v", in.PaymentID, err))
+		_ = s.db.Model(&model.PaymentEvent{}).Where("id = ?", event.ID).Updates(map[string]interface{}{
+			"status":     model.PaymentEventFailed,
+			"error":      err.Error(),
+			"updated_at": time.Now(),
+		}).Error
+		event.Status = model.PaymentEventFailed
+		event.Error = err.Error()
+		return event, false, err
+	}
+	return s.finishPaymentEvent(event, customer, nil, in)
+}
+
+// bookPaymentEventTx adds the payment to the ledger and closes the event:
+// applied when it paid for order, credited when it only tops up the balance.
+func bookPaymentEventTx(tx *gorm.DB, eventID uint, customer model.Customer, order *model.Order, in PaymentWebhookEvent) error {
+	entry := &model.LedgerEntry{
+		CustomerID: customer.ID,
+		Type:       model.LedgerEntryPayment,
+		Amount:     in.Amount,
+		Source:     LedgerSourceWebhook,
+		Reference:  in.PaymentID,
+		Note:       strings.TrimSpace(in.Note),
+	}
+	status := model.PaymentEventCredited
+	if order != nil {
+		entry.OrderID = &order.ID
+		status = model.PaymentEventApplied
+	}
+	if err := appendLedgerEntryTx(tx, entry); err != nil {
+		return err
+	}
+	updates := map[string]interface{}{
+		"status":          status,
+		"error":           "",
+		"customer_id":     customer.ID,
+		"ledger_entry_id": entry.ID,
+		"updated_at":      time.Now(),
+	}
+	if order != nil {
+		updates["order_id"] = order.ID
+	}
+	return tx.Model(&model.PaymentEvent{}).Where("id = ?", eventID).Updates(updates).Error
+}
+
+func (s *BillingService) paymentEventBooked(eventID uint) bool {
+	row := model.PaymentEvent{}
+	if err := s.db.Select("id", "status").First(&row, eventID).Error; err != nil {
+		return false
+	}
+	return row.Status == model.PaymentEventApplied
+}
+
+func (s *BillingService) finishPaymentEvent(event *model.PaymentEvent, customer model.Customer, order *model.Order, in PaymentWebhookEvent) (*model.PaymentEvent, bool, error) {
+	if err := s.db.First(event, event.ID).Error; err != nil {
+		return nil, false, err
+	}
+	target := "balance of " + customer.Name
+	if order != nil {
+		target = "order " + order.OrderNo
+	}
+	s.store.AddTaskLog("info", "payment webhook applied", fmt.Sprintf("%s: %.2f to %s", in.PaymentID, in.Amount, target))
+	return event, false, nil
+}
+
+func (s *BillingService) claimPaymentEvent(in PaymentWebhookEvent, payload []byte) (*model.PaymentEvent, bool, error) {
+	childIDs := make([]string, 0, len(in.ChildOrderIDs))
+	for _, id := range uniqueUintIDs(in.ChildOrderIDs) {
+		childIDs = append(childIDs, strconv.FormatUint(uint64(id), 10))
+	}
+	fields := model.PaymentEvent{
+		PaymentID:     in.PaymentID,
+		OrderNo:       in.OrderNo,
+		CustomerCode:  in.CustomerCode,
+		ChildOrderIDs: strings.Join(childIDs, ","),
+		Amount:        in.Amount,
+		Days:          in.Days,
+		Status:        model.PaymentEventProcessing,
+		Payload:       string(payload),
+	}
+	event := &model.PaymentEvent{}
+	duplicate := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		rows := []model.PaymentEvent{}
+		if err := tx.Where("payment_id = ?", in.PaymentID).Limit(1).Find(&rows).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			*event = fields
+			return tx.Create(event).Error
+		}
+		*event = rows[0]
+		switch event.Status {
+		case model.PaymentEventApplied, model.PaymentEventCredited:
+			duplicate = true
+			return nil
+		case model.PaymentEventProcessing:
+			if event.UpdatedAt.After(time.Now().Add(-paymentEventStaleAfter)) {
+				return ErrPaymentInProgress
+			}
+		}
+		if err := tx.Model(&model.PaymentEvent{}).Where("id = ?", event.ID).Updates(map[string]interface{}{
+			"order_no":        fields.OrderNo,
+			"customer_code":   fields.CustomerCode,
+			"child_order_ids": fields.ChildOrderIDs,
+			"amount":          fields.Amount,
+			"days":            fields.Days,
+			"status":          model.PaymentEventProcessing,
+			"error":           "",
+			"payload":         fields.Payload,
+			"updated_at":      time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		return tx.First(event, event.ID).Error
+	})
+	if err != nil {
+		if event.ID == 0 && !errors.Is(err, ErrPaymentInProgress) {
+			// A concurrent delivery may have won the unique payment_id insert.
+			var count int64
+			if s.db.Model(&model.PaymentEvent{}).Where("payment_id = ?", in.PaymentID).Count(&count).Error == nil && count > 0 {
+				return nil, false, ErrPaymentInProgress
+			}
+		}
+		return event, false, err
+	}
+	return event, duplicate, nil
+}
+
+func (s *BillingService) resolvePaymentTarget(in PaymentWebhookEvent) (model.Customer, *model.Order, error) {
+	customer := model.Customer{}
+	if in.CustomerCode != "" {
+		rows := []model.Customer{}
+		if err := s.db.Where("code = ?", in.CustomerCode).Limit(1).Find(&rows).Error; err != nil {
+			return customer, nil, err
+		}
+		if len(rows) == 0 {
+			return customer, nil, fmt.Errorf("customer %s not found", in.CustomerCode)
+		}
+		customer = rows[0]
+	}
+	if in.OrderNo != "" {
+		rows := []model.Order{}
+		if err := s.db.Where("order_no = ?", in.OrderNo).Limit(1).Find(&rows).Error; err != nil {
+			return customer, nil, err
+		}
+		if len(rows) == 0 {
+			return customer, nil, fmt.Errorf("order %s not found", in.OrderNo)
+		}
+		order := rows[0]
+		if customer.ID > 0 && customer.ID != order.CustomerID {
+			return customer, nil, fmt.Errorf("order %s does not belong to customer %s", in.OrderNo, in.CustomerCode)
+		}
+		if customer.ID == 0 {
+			if err := s.db.First(&customer, order.CustomerID).Error; err != nil {
+				return customer, nil, err
+			}
+		}
+		return customer, &order, nil
+	}
+	orders := []model.Order{}
+	if err := s.db.Where("customer_id = ? and parent_order_id is null and status in ?", customer.ID, []string{model.OrderStatusActive, model.OrderStatusExpired}).
+		Limit(2).Find(&orders).Error; err != nil {
+		return customer, nil, err
+	}
+	if len(orders) == 1 {
+		return customer, &orders[0], nil
+	}
+	return customer, nil, nil
+}
+
+func (s *BillingService) renewPaidOrder(ctx context.Context, order model.Order, in PaymentWebhookEvent) error {
+	if order.ParentOrderID != nil {
+		return s.orders.renewOrderGroupSelected(ctx, *order.ParentOrderID, []uint{order.ID}, in.Days, in.ExpiresAt, LedgerSourceWebhook)
+	}
+	if order.IsGroupHead && len(in.ChildOrderIDs) > 0 {
+		return s.orders.renewOrderGroupSelected(ctx, order.ID, in.ChildOrderIDs, in.Days, in.ExpiresAt, LedgerSourceWebhook)
+	}
+	return s.orders.renewOrder(ctx, order.ID, in.Days, in.ExpiresAt, LedgerSourceWebhook)
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"xraytool/internal/config"
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+)
+
+func TestApplyPaymentRenewsOnceAndBooksLedger(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, NewXrayManager(config.Config{}, db, zap.NewNop()), zap.NewNop())
+	st := store.New(db)
+	billing := NewBillingService(db, st, svc, nil, zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	customer := seedBillingCustomer(t, db, "payer", "198.51.100.30")
+
+	if err := billing.VerifyPaymentSignature([]byte(`{}`), ""); !errors.Is(err, ErrPaymentWebhookDisabled) {
+		t.Fatalf("expected webhook to be disabled without secret, got %v", err)
+	}
+	if err := st.SetSettings(map[string]string{"payment_webhook_secret": "s3cret"}); err != nil {
+		t.Fatalf("save settings failed: %v", err)
+	}
+	body := []byte(`{"payment_id":"p1"}`)
+	if err := billing.VerifyPaymentSignature(body, SignPaymentWebhook("other", body)); !errors.Is(err, ErrPaymentSignature) {
+		t.Fatalf("expected signature mismatch, got %v", err)
+	}
+	if err := billing.VerifyPaymentSignature(body, SignPaymentWebhook("s3cret", body)); err != nil {
+		t.Fatalf("expected valid signature, got %v", err)
+	}
+
+	order, err := svc.CreateOrder(context.Background(), CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 10, Port: residentialTestPort, Price: 30})
+	if err != nil {
+		t.Fatalf("create order failed: %v", err)
+	}
+	event, duplicate, err := billing.ApplyPayment(context.Background(), PaymentWebhookEvent{PaymentID: "p1", OrderNo: order.OrderNo, Amount: 30, Days: 30}, body)
+	if err != nil || duplicate || event.Status != model.PaymentEventApplied || event.OrderID == nil || *event.OrderID != order.ID {
+		t.Fatalf("unexpected first delivery: %#v duplicate=%v err=%v", event, duplicate, err)
+	}
+	renewed := model.Order{}
+	if err := db.First(&renewed, order.ID).Error; err != nil {
+		t.Fatalf("load order failed: %v", err)
+	}
+	if _, duplicate, err := billing.ApplyPayment(context.Background(), PaymentWebhookEvent{PaymentID: "p1", OrderNo: order.OrderNo, Amount: 30, Days: 30}, body); err != nil || !duplicate {
+		t.Fatalf("expected duplicate delivery to be acknowledged, got duplicate=%v err=%v", duplicate, err)
+	}
+	again := model.Order{}
+	if err := db.First(&again, order.ID).Error; err != nil {
+		t.Fatalf("load order failed: %v", err)
+	}
+	if !again.ExpiresAt.Equal(renewed.ExpiresAt) || !renewed.ExpiresAt.After(order.ExpiresAt.Add(29*24*time.Hour)) {
+		t.Fatalf("expected a single 30 day renewal, got %s -> %s -> %s", order.ExpiresAt, renewed.ExpiresAt, again.ExpiresAt)
+	}
+
+	if _, _, err := billing.ApplyPayment(context.Background(), PaymentWebhookEvent{PaymentID: "p2", OrderNo: "missing", Amount: 30, Days: 30}, nil); err == nil {
+		t.Fatalf("expected unknown order to fail")
+	}
+	event, _, err = billing.ApplyPayment(context.Background(), PaymentWebhookEvent{PaymentID: "p2", CustomerCode: customer.Code, Amount: 30, Days: 30}, nil)
+	if err != nil || event.Status != model.PaymentEventApplied || event.Error != "" {
+		t.Fatalf("expected failed delivery to be retried against the only order, got %#v err=%v", event, err)
+	}
+
+	current := model.Customer{}
+	if err := db.First(&current, customer.ID).Error; err != nil {
+		t.Fatalf("load customer failed: %v", err)
+	}
+	if current.Balance != -10 {
+		t.Fatalf("expected balance -10-30-30+30+30=-10, got %.2f", current.Balance)
+	}
+	var payments int64
+	if err := db.Model(&model.LedgerEntry{}).Where("customer_id = ? and type = ? and source = ?", customer.ID, model.LedgerEntryPayment, LedgerSourceWebhook).Count(&payments).Error; err != nil {
+		t.Fatalf("count payments failed: %v", err)
+	}
+	if payments != 2 {
+		t.Fatalf("expected two booked payments, got %d", payments)
+	}
+
+	// A delivery stuck in processing is taken over once stale, and a
+	// suspended customer's payment is credited instead of dropped.
+	before := model.Order{}
+	if err := db.First(&before, order.ID).Error; err != nil {
+		t.Fatalf("load order failed: %v", err)
+	}
+	stale := model.PaymentEvent{PaymentID: "p3", OrderNo: order.OrderNo, Amount: 30, Days: 30, Status: model.PaymentEventProcessing, UpdatedAt: time.Now().Add(-time.Hour)}
+	if err := db.Create(&stale).Error; err != nil {
+		t.Fatalf("seed stale event failed: %v", err)
+	}
+	if err := db.Model(&model.Customer{}).Where("id = ?", customer.ID).Update("status", model.CustomerStatusSuspended).Error; err != nil {
+		t.Fatalf("suspend customer failed: %v", err)
+	}
+	event, _, err = billing.ApplyPayment(context.Background(), PaymentWebhookEvent{PaymentID: "p3", OrderNo: order.OrderNo, Amount: 30, Days: 30}, nil)
+	if err != nil || event.Status != model.PaymentEventCredited || event.OrderID != nil {
+		t.Fatalf("expected stale delivery credited to balance, got %#v err=%v", event, err)
+	}
+	if err := db.First(&current, customer.ID).Error; err != nil {
+		t.Fatalf("load customer failed: %v", err)
+	}
+	if current.Balance != 20 {
+		t.Fatalf("expected balance 20 after credit, got %.2f", current.Balance)
+	}
+	if err := db.First(&again, order.ID).Error; err != nil {
+		t.Fatalf("load order failed: %v", err)
+	}
+	if !again.ExpiresAt.Equal(before.ExpiresAt) {
+		t.Fatalf("suspended customer's order must not be renewed again, got %s", again.ExpiresAt)
+	}
+}
+
+func TestApplyPaymentRenewsSelectedGroupChildren(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	billing := NewBillingService(db, store.New(db), svc, nil, zap.NewNop())
+	headID, childIDs := seedDedicatedCopyLinksTestGroup(t, db)
+	if err := db.Model(&model.Order{}).Where("id = ?", headID).Updates(map[string]interface{}{"order_no": "GRP-1", "price": 30}).Error; err != nil {
+		t.Fatalf("set order no failed: %v", err)
+	}
+	before := []model.Order{}
+	if err := db.Where("id in ?", childIDs).Order("id asc").Find(&before).Error; err != nil {
+		t.Fatalf("load children failed: %v", err)
+	}
+
+	event, _, err := billing.ApplyPayment(context.Background(), PaymentWebhookEvent{PaymentID: "g1", OrderNo: "GRP-1", Amount: 15, Days: 30, ChildOrderIDs: childIDs[:1]}, nil)
+	if err != nil || event.Status != model.PaymentEventApplied {
+		t.Fatalf("apply group payment failed: %#v %v", event, err)
+	}
+	after := []model.Order{}
+	if err := db.Where("id in ?", childIDs).Order("id asc").Find(&after).Error; err != nil {
+		t.Fatalf("load children failed: %v", err)
+	}
+	if !after[0].ExpiresAt.After(before[0].ExpiresAt.Add(29*24*time.Hour)) || !after[1].ExpiresAt.Equal(before[1].ExpiresAt) {
+		t.Fatalf("expected only the selected child to be renewed, got %s / %s", after[0].ExpiresAt, after[1].ExpiresAt)
+	}
+	charges := []model.LedgerEntry{}
+	if err := db.Where("order_id = ? and type = ?", childIDs[0], model.LedgerEntryCharge).Find(&charges).Error; err != nil {
+		t.Fatalf("load charges failed: %v", err)
+	}
+	if len(charges) != 1 || charges[0].Source != LedgerSourceWebhook {
+		t.Fatalf("expected the child renewal charged as a webhook renewal, got %+v", charges)
+	}
+}
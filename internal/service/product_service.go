@@ -0,0 +1,255 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"xraytool/internal/model"
+
+	"gorm.io/gorm"
+)
+
+type ProductService struct {
+	db *gorm.DB
+}
+
+type ProductInput struct {
+	Name               string  `json:"name"`
+	SKU                string  `json:"sku"`
+	Mode               string  `json:"mode"`
+	Quantity           int     `json:"quantity"`
+	DurationDay        int     `json:"duration_day"`
+	DedicatedProtocol  string  `json:"dedicated_protocol"`
+	DedicatedInboundID uint    `json:"dedicated_inbound_id"`
+	DedicatedIngressID uint    `json:"dedicated_ingress_id"`
+	Price              float64 `json:"price"`
+	CountryCodes       string  `json:"country_codes"`
+	GraceHours         *int    `json:"grace_hours"`
+	Enabled            *bool   `json:"enabled"`
+	Notes              string  `json:"notes"`
+}
+
+func NewProductService(db *gorm.DB) *ProductService {
+	return &ProductService{db: db}
+}
+
+func (s *ProductService) List() ([]model.Product, error) {
+	rows := []model.Product{}
+	if err := s.db.Order("enabled desc, id asc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *ProductService) Create(in ProductInput) (*model.Product, error) {
+	row, err := s.normalizeProductInput(in)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureProductUnique(row, 0); err != nil {
+		return nil, err
+	}
+	if err := s.db.Create(&row).Error; err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
+
+func (s *ProductService) Update(id uint, in ProductInput) (*model.Product, error) {
+	if id == 0 {
+		return nil, errors.New("id is required")
+	}
+	base := model.Product{}
+	if err := s.db.First(&base, id).Error; err != nil {
+		return nil, err
+	}
+	row, err := s.normalizeProductInput(in)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureProductUnique(row, id); err != nil {
+		return nil, err
+	}
+	updates := map[string]interface{}{
+		"name":                 row.Name,
+		"sku":                  row.SKU,
+		"mode":                 row.Mode,
+		"quantity":             row.Quantity,
+		"duration_day":         row.DurationDay,
+		"dedicated_protocol":   row.DedicatedProtocol,
+		"dedicated_inbound_id": row.DedicatedInboundID,
+		"dedicated_ingress_id": row.DedicatedIngressID,
+		"price":                row.Price,
+		"country_codes":        row.CountryCodes,
+		"grace_hours":          row.GraceHours,
+		"enabled":              row.Enabled,
+		"notes":                row.Notes,
+		"updated_at":           time.Now(),
+	}
+	if err := s.db.Model(&model.Product{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.First(&base, id).Error; err != nil {
+		return nil, err
+	}
+	return &base, nil
+}
+
+func (s *ProductService) Delete(id uint) error {
+	if id == 0 {
+		return errors.New("id is required")
+	}
+	var count int64
+	if err := s.db.Model(&model.Order{}).Where("product_id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("product is used by %d orders, disable it instead", count)
+	}
+	return s.db.Delete(&model.Product{}, id).Error
+}
+
+func (s *ProductService) ensureProductUnique(row model.Product, excludeID uint) error {
+	var count int64
+	q := s.db.Model(&model.Product{}).Where("sku = ?", row.SKU)
+	if excludeID > 0 {
+		q = q.Where("id <> ?", excludeID)
+	}
+	if err := q.Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("sku %s already exists", row.SKU)
+	}
+	q = s.db.Model(&model.Product{}).Where("name = ?", row.Name)
+	if excludeID > 0 {
+		q = q.Where("id <> ?", excludeID)
+	}
+	if err := q.Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("product name %s already exists", row.Name)
+	}
+	return nil
+}
+
+func (s *ProductService) normalizeProductInput(in ProductInput) (model.Product, error) {
+	enabled := true
+	if in.Enabled != nil {
+		enabled = *in.Enabled
+	}
+	row := model.Product{
+		Name:        strings.TrimSpace(in.Name),
+		SKU:         strings.TrimSpace(in.SKU),
+		Mode:        strings.ToLower(strings.TrimSpace(in.Mode)),
+		Quantity:    in.Quantity,
+		DurationDay: in.DurationDay,
+		Price:       in.Price,
+		GraceHours:  in.GraceHours,
+		Enabled:     enabled,
+		Notes:       strings.TrimSpace(in.Notes),
+	}
+	if row.Name == "" {
+		return model.Product{}, errors.New("name is required")
+	}
+	if row.SKU == "" {
+		return model.Product{}, errors.New("sku is required")
+	}
+	if row.Mode == "" {
+		row.Mode = model.OrderModeAuto
+	}
+	if row.Mode != model.OrderModeAuto && row.Mode != model.OrderModeManual && row.Mode != model.OrderModeDedicated {
+		return model.Product{}, errors.New("mode must be auto/manual/dedicated")
+	}
+	if row.Quantity < 0 {
+		return model.Product{}, errors.New("quantity must be >= 0")
+	}
+	if row.DurationDay < 0 {
+		return model.Product{}, errors.New("duration_day must be >= 0")
+	}
+	if row.DurationDay == 0 {
+		row.DurationDay = 30
+	}
+	if row.Price < 0 {
+		return model.Product{}, errors.New("price must be >= 0")
+	}
+	if row.GraceHours != nil && *row.GraceHours < 0 {
+		return model.Product{}, errors.New("grace_hours must be >= 0")
+	}
+	countries, err := parseProductCountryCodes(in.CountryCodes)
+	if err != nil {
+		return model.Product{}, err
+	}
+	row.CountryCodes = strings.Join(countries, ",")
+
+	if row.Mode != model.OrderModeDedicated {
+		if strings.TrimSpace(in.DedicatedProtocol) != "" || in.DedicatedInboundID > 0 || in.DedicatedIngressID > 0 {
+			return model.Product{}, errors.New("dedicated protocol, inbound and ingress require dedicated mode")
+		}
+		return row, nil
+	}
+	protocol := strings.TrimSpace(in.DedicatedProtocol)
+	if protocol == "" {
+		protocol = model.DedicatedFeatureMixed
+	}
+	row.DedicatedProtocol, err = normalizeDedicatedProtocol(protocol)
+	if err != nil {
+		return model.Product{}, err
+	}
+	if in.DedicatedIngressID > 0 && in.DedicatedInboundID == 0 {
+		return model.Product{}, errors.New("dedicated_ingress_id requires dedicated_inbound_id")
+	}
+	if in.DedicatedInboundID > 0 {
+		inbound := model.DedicatedInbound{}
+		if err := s.db.First(&inbound, in.DedicatedInboundID).Error; err != nil {
+			return model.Product{}, fmt.Errorf("dedicated inbound invalid: %w", err)
+		}
+		if !strings.EqualFold(strings.TrimSpace(inbound.Protocol), row.DedicatedProtocol) {
+			return model.Product{}, fmt.Errorf("inbound protocol mismatch, expect %s got %s", row.DedicatedProtocol, inbound.Protocol)
+		}
+		row.DedicatedInboundID = uintPtrOrNil(inbound.ID)
+	}
+	if in.DedicatedIngressID > 0 {
+		ingress := model.DedicatedIngress{}
+		if err := s.db.Where("id = ? and dedicated_inbound_id = ?", in.DedicatedIngressID, in.DedicatedInboundID).First(&ingress).Error; err != nil {
+			return model.Product{}, fmt.Errorf("dedicated ingress invalid: %w", err)
+		}
+		if len(countries) > 0 && !containsCountryCode(countries, ingress.CountryCode) {
+			return model.Product{}, fmt.Errorf("ingress country %s is outside product countries %s", ingress.CountryCode, row.CountryCodes)
+		}
+		row.DedicatedIngressID = uintPtrOrNil(ingress.ID)
+	}
+	return row, nil
+}
+
+func parseProductCountryCodes(raw string) ([]string, error) {
+	fields := strings.FieldsFunc(strings.ToLower(raw), func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\n' || r == '\t'
+	})
+	result := make([]string, 0, len(fields))
+	seen := map[string]struct{}{}
+	for _, code := range fields {
+		if len(code) != 2 || code[0] < 'a' || code[0] > 'z' || code[1] < 'a' || code[1] > 'z' {
+			return nil, fmt.Errorf("invalid country code %s", code)
+		}
+		if _, ok := seen[code]; ok {
+			continue
+		}
+		seen[code] = struct{}{}
+		result = append(result, code)
+	}
+	return result, nil
+}
+
+func containsCountryCode(countries []string, code string) bool {
+	code = strings.ToLower(strings.TrimSpace(code))
+	for _, country := range countries {
+		if country == code {
+			return true
+		}
+	}
+	return false
+}
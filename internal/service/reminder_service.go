@@ -0,0 +1,439 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"xraytool/internal/model"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	reminderOffsetExpired   = "expired"
+	reminderMaxAttempts     = 3
+	reminderExpiredLookback = 72 * time.Hour
+	defaultReminderOffsets  = "7d,3d,1d,expired"
+	defaultReminderSubject  = "XrayTool 订单到期提醒"
+	defaultReminderTemplate = `{{.Customer}}，您好：
+{{if .Upcoming}}以下订单即将到期：
+{{range .Upcoming}}- {{.Name}}（{{.OrderNo}}）将于 {{.ExpiresAt}} 到期
+{{end}}{{end}}{{if .Expired}}以下订单已到期：
+{{range .Expired}}- {{.Name}}（{{.OrderNo}}）已于 {{.ExpiresAt}} 到期
+{{end}}{{end}}如需继续使用请及时续费。`
+)
+
+type ReminderService struct {
+	db     *gorm.DB
+	bark   *BarkService
+	logger *zap.Logger
+	client *http.Client
+	// deliver sends one rendered message; tests replace it.
+	deliver func(settings map[string]string, channel, target, subject, body string) error
+}
+
+type reminderOffset struct {
+	label  string
+	before time.Duration
+}
+
+type ReminderLine struct {
+	OrderID   uint   `json:"order_id"`
+	OrderNo   string `json:"order_no"`
+	Name      string `json:"name"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// ReminderMessage is what a template renders for one customer.
+type ReminderMessage struct {
+	Customer string
+	Upcoming []ReminderLine
+	Expired  []ReminderLine
+}
+
+type ReminderRunResult struct {
+	Messages int `json:"messages"`
+	Orders   int `json:"orders"`
+	Failed   int `json:"failed"`
+}
+
+type ReminderQuery struct {
+	CustomerID uint
+	OrderID    uint
+	Status     string
+	Limit      int
+}
+
+type reminderCandidate struct {
+	order  model.Order
+	offset string
+}
+
+func NewReminderService(db *gorm.DB, bark *BarkService, logger *zap.Logger) *ReminderService {
+	s := &ReminderService{db: db, bark: bark, logger: logger, client: &http.Client{Timeout: 10 * time.Second}}
+	s.deliver = s.send
+	return s
+}
+
+// parseReminderOffsets reads a schedule such as "7d,3d,12h,expired" into
+// upcoming offsets sorted nearest first; expired reports whether overdue
+// orders are reminded too.
+func parseReminderOffsets(raw string) ([]reminderOffset, bool, error) {
+	offsets := []reminderOffset{}
+	expired := false
+	seen := map[time.Duration]struct{}{}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+		if part == reminderOffsetExpired {
+			expired = true
+			continue
+		}
+		unit := time.Hour
+		switch {
+		case strings.HasSuffix(part, "d"):
+			unit = 24 * time.Hour
+		case strings.HasSuffix(part, "h"):
+		default:
+			return nil, false, fmt.Errorf("invalid reminder offset %q, expect like 7d, 12h or expired", part)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(part, "d"), "h"))
+		if err != nil || n <= 0 {
+			return nil, false, fmt.Errorf("invalid reminder offset %q, expect like 7d, 12h or expired", part)
+		}
+		before := time.Duration(n) * unit
+		if _, ok := seen[before]; ok {
+			continue
+		}
+		seen[before] = struct{}{}
+		offsets = append(offsets, reminderOffset{label: part, before: before})
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i].before < offsets[j].before })
+	return offsets, expired, nil
+}
+
+func (s *ReminderService) loadSettings() (map[string]string, error) {
+	rows := []model.Setting{}
+	if err := s.db.Where("key like ? or key like ? or key like ? or key = ?", "reminder_%", "smtp_%", "telegram_%", "bark_enabled").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := map[string]string{}
+	for _, row := range rows {
+		out[row.Key] = strings.TrimSpace(row.Value)
+	}
+	return out, nil
+}
+
+// customerChannels lists where a customer's reminders go: their own email
+// and Telegram chat when configured, plus the admin Bark device.
+func customerChannels(settings map[string]string, customer model.Customer) map[string]string {
+	out := map[string]string{}
+	if email := strings.TrimSpace(customer.Email); email != "" && settings["smtp_host"] != "" {
+		out[model.ReminderChannelEmail] = email
+	}
+	if chatID := strings.TrimSpace(customer.TgChatID); chatID != "" && settings["telegram_bot_token"] != "" {
+		out[model.ReminderChannelTelegram] = chatID
+	}
+	adminBark := settings["reminder_admin_bark"] == "" || parseBool(settings["reminder_admin_bark"])
+	if adminBark && parseBool(settings["bark_enabled"]) {
+		out[model.ReminderChannelBark] = "admin"
+	}
+	return out
+}
+
+func reminderLogKey(orderID uint, offset string, expiresAt time.Time, channel string) string {
+	return fmt.Sprintf("%d/%s/%d/%s", orderID, offset, expiresAt.Unix(), channel)
+}
+
+// RunDue sends every reminder that is due, one message per customer and
+// channel. Group children are covered by their head.
+func (s *ReminderService) RunDue(ctx context.Context, now time.Time) (ReminderRunResult, error) {
+	result := ReminderRunResult{}
+	settings, err := s.loadSettings()
+	if err != nil {
+		return result, err
+	}
+	raw := settings["reminder_offsets"]
+	if raw == "" {
+		raw = defaultReminderOffsets
+	}
+	offsets, withExpired, err := parseReminderOffsets(raw)
+	if err != nil {
+		return result, err
+	}
+
+	candidates := []reminderCandidate{}
+	if len(offsets) > 0 {
+		upcoming := []model.Order{}
+		if err := s.db.Where("parent_order_id is null and status = ? and expires_at > ? and expires_at <= ?", model.OrderStatusActive, now, now.Add(offsets[len(offsets)-1].before)).
+			Order("expires_at asc, id asc").Find(&upcoming).Error; err != nil {
+			return result, err
+		}
+		for _, order := range upcoming {
+			remaining := order.ExpiresAt.Sub(now)
+			for _, offset := range offsets {
+				if remaining <= offset.before {
+					candidates = append(candidates, reminderCandidate{order: order, offset: offset.label})
+					break
+				}
+			}
+		}
+	}
+	if withExpired {
+		overdue := []model.Order{}
+		if err := s.db.Where("parent_order_id is null and expires_at <= ? and expires_at > ?", now, now.Add(-reminderExpiredLookback)).
+			Where("status = ? or (status = ? and expiry_stage <> '')", model.OrderStatusExpired, model.OrderStatusActive).
+			Order("expires_at asc, id asc").Find(&overdue).Error; err != nil {
+			return result, err
+		}
+		for _, order := range overdue {
+			candidates = append(candidates, reminderCandidate{order: order, offset: reminderOffsetExpired})
+		}
+	}
+	if len(candidates) == 0 {
+		return result, nil
+	}
+
+	orderIDs := make([]uint, 0, len(candidates))
+	customerIDs := make([]uint, 0, len(candidates))
+	for _, candidate := range candidates {
+		orderIDs = append(orderIDs, candidate.order.ID)
+		customerIDs = append(customerIDs, candidate.order.CustomerID)
+	}
+	customers := map[uint]model.Customer{}
+	customerRows := []model.Customer{}
+	if err := s.db.Where("id in ?", uniqueUintIDs(customerIDs)).Find(&customerRows).Error; err != nil {
+		return result, err
+	}
+	for _, row := range customerRows {
+		customers[row.ID] = row
+	}
+	logs := map[string]model.ReminderLog{}
+	logRows := []model.ReminderLog{}
+	if err := s.db.Where("order_id in ?", uniqueUintIDs(orderIDs)).Find(&logRows).Error; err != nil {
+		return result, err
+	}
+	for _, row := range logRows {
+		logs[reminderLogKey(row.OrderID, row.Offset, row.ExpiresAt, row.Channel)] = row
+	}
+
+	type batchKey struct {
+		customerID uint
+		channel    string
+	}
+	batches := map[batchKey][]reminderCandidate{}
+	keys := []batchKey{}
+	for _, candidate := range candidates {
+		customer, ok := customers[candidate.order.CustomerID]
+		if !ok {
+			continue
+		}
+		for channel := range customerChannels(settings, customer) {
+			if row, ok := logs[reminderLogKey(candidate.order.ID, candidate.offset, candidate.order.ExpiresAt, channel)]; ok {
+				if row.Status == model.ReminderStatusSent || row.Attempts >= reminderMaxAttempts {
+					continue
+				}
+			}
+			key := batchKey{customerID: customer.ID, channel: channel}
+			if _, ok := batches[key]; !ok {
+				keys = append(keys, key)
+			}
+			batches[key] = append(batches[key], candidate)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].customerID != keys[j].customerID {
+			return keys[i].customerID < keys[j].customerID
+		}
+		return keys[i].channel < keys[j].channel
+	})
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		customer := customers[key.customerID]
+		target := customerChannels(settings, customer)[key.channel]
+		batch := batches[key]
+		subject, body, err := renderReminder(settings, customer, batch)
+		if err == nil {
+			err = s.deliver(settings, key.channel, target, subject, body)
+		}
+		result.Messages++
+		result.Orders += len(batch)
+		if err != nil {
+			result.Failed++
+			s.logger.Warn("reminder delivery failed", zap.Error(err), zap.Uint("customer_id", customer.ID), zap.String("channel", key.channel))
+		}
+		for _, candidate := range batch {
+			if logErr := s.recordReminder(logs, candidate, customer.ID, key.channel, target, err, now); logErr != nil {
+				return result, logErr
+			}
+		}
+	}
+	return result, nil
+}
+
+func renderReminder(settings map[string]string, customer model.Customer, batch []reminderCandidate) (string, string, error) {
+	msg := ReminderMessage{Customer: customer.Name}
+	for _, candidate := range batch {
+		line := ReminderLine{
+			OrderID:   candidate.order.ID,
+			OrderNo:   candidate.order.OrderNo,
+			Name:      candidate.order.Name,
+			ExpiresAt: candidate.order.ExpiresAt.Format("2006-01-02 15:04"),
+		}
+		if candidate.offset == reminderOffsetExpired {
+			msg.Expired = append(msg.Expired, line)
+		} else {
+			msg.Upcoming = append(msg.Upcoming, line)
+		}
+	}
+	subject := settings["reminder_subject"]
+	if subject == "" {
+		subject = defaultReminderSubject
+	}
+	text := settings["reminder_template"]
+	if text == "" {
+		text = defaultReminderTemplate
+	}
+	tmpl, err := template.New("reminder").Parse(text)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid reminder_template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, msg); err != nil {
+		return "", "", fmt.Errorf("render reminder_template: %w", err)
+	}
+	return subject, strings.TrimSpace(buf.String()), nil
+}
+
+func (s *ReminderService) recordReminder(logs map[string]model.ReminderLog, candidate reminderCandidate, customerID uint, channel, target string, sendErr error, now time.Time) error {
+	status := model.ReminderStatusSent
+	lastError := ""
+	if sendErr != nil {
+		status = model.ReminderStatusFailed
+		lastError = sendErr.Error()
+	}
+	key := reminderLogKey(candidate.order.ID, candidate.offset, candidate.order.ExpiresAt, channel)
+	if row, ok := logs[key]; ok {
+		return s.db.Model(&model.ReminderLog{}).Where("id = ?", row.ID).Updates(map[string]interface{}{
+			"status":     status,
+			"attempts":   row.Attempts + 1,
+			"last_error": lastError,
+			"target":     target,
+			"updated_at": now,
+		}).Error
+	}
+	return s.db.Create(&model.ReminderLog{
+		OrderID:    candidate.order.ID,
+		Offset:     candidate.offset,
+		ExpiresAt:  candidate.order.ExpiresAt,
+		Channel:    channel,
+		CustomerID: customerID,
+		Target:     target,
+		Status:     status,
+		Attempts:   1,
+		LastError:  lastError,
+	}).Error
+}
+
+func (s *ReminderService) send(settings map[string]string, channel, target, subject, body string) error {
+	switch channel {
+	case model.ReminderChannelBark:
+		return s.bark.Notify(subject, body)
+	case model.ReminderChannelEmail:
+		return sendReminderEmail(settings, target, subject, body)
+	case model.ReminderChannelTelegram:
+		return s.sendTelegram(settings, target, subject, body)
+	}
+	return fmt.Errorf("unknown reminder channel %s", channel)
+}
+
+func sendReminderEmail(settings map[string]string, to, subject, body string) error {
+	host := settings["smtp_host"]
+	from := settings["smtp_from"]
+	if host == "" || from == "" {
+		return errors.New("smtp_host and smtp_from are required for email reminders")
+	}
+	port := settings["smtp_port"]
+	if port == "" {
+		port = "587"
+	}
+	var auth smtp.Auth
+	if user := settings["smtp_username"]; user != "" {
+		auth = smtp.PlainAuth("", user, settings["smtp_password"], host)
+	}
+	msg := strings.Join([]string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+	return smtp.SendMail(host+":"+port, auth, from, []string{to}, []byte(msg))
+}
+
+func (s *ReminderService) sendTelegram(settings map[string]string, chatID, subject, body string) error {
+	token := settings["telegram_bot_token"]
+	if token == "" {
+		return errors.New("telegram_bot_token is required for telegram reminders")
+	}
+	payload, err := json.Marshal(map[string]string{"chat_id": chatID, "text": subject + "\n\n" + body})
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", token), "application/json", bytes.NewReader(payload))
+	if err != nil {
+		// The request URL carries the bot token; keep it out of logs and
+		// the stored last_error.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("telegram request failed: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("telegram request failed: %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *ReminderService) List(q ReminderQuery) ([]model.ReminderLog, error) {
+	limit := q.Limit
+	if limit <= 0 || limit > 500 {
+		limit = 200
+	}
+	query := s.db.Model(&model.ReminderLog{})
+	if q.CustomerID > 0 {
+		query = query.Where("customer_id = ?", q.CustomerID)
+	}
+	if q.OrderID > 0 {
+		query = query.Where("order_id = ?", q.OrderID)
+	}
+	if status := strings.TrimSpace(q.Status); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	rows := []model.ReminderLog{}
+	if err := query.Order("id desc").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+)
+
+func TestReminderServiceAggregatesPerCustomerAndChannel(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	if err := store.New(db).SetSettings(map[string]string{
+		"bark_enabled":       "true",
+		"smtp_host":          "smtp.example.com",
+		"telegram_bot_token": "token",
+	}); err != nil {
+		t.Fatalf("set settings failed: %v", err)
+	}
+	customer := model.Customer{Name: "remind", Code: "remind", Status: model.OrderStatusActive, Email: "ops@example.com", TgChatID: "42"}
+	quiet := model.Customer{Name: "remind-quiet", Code: "remind-quiet", Status: model.OrderStatusActive}
+	for _, row := range []*model.Customer{&customer, &quiet} {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatalf("create customer failed: %v", err)
+		}
+	}
+	now := time.Now()
+	seedOrder := func(customerID uint, name, status string, expiresAt time.Time) model.Order {
+		t.Helper()
+		row := model.Order{CustomerID: customerID, Name: name, Mode: model.OrderModeAuto, Status: status, Quantity: 1, Port: residentialTestPort, StartsAt: now.Add(-30 * 24 * time.Hour), ExpiresAt: expiresAt}
+		if err := db.Create(&row).Error; err != nil {
+			t.Fatalf("create order failed: %v", err)
+		}
+		return row
+	}
+	seedOrder(customer.ID, "soon-a", model.OrderStatusActive, now.Add(2*24*time.Hour))
+	seedOrder(customer.ID, "soon-b", model.OrderStatusActive, now.Add(2*24*time.Hour))
+	seedOrder(customer.ID, "week", model.OrderStatusActive, now.Add(6*24*time.Hour))
+	seedOrder(customer.ID, "gone", model.OrderStatusExpired, now.Add(-time.Hour))
+	seedOrder(customer.ID, "later", model.OrderStatusActive, now.Add(20*24*time.Hour))
+	seedOrder(quiet.ID, "quiet", model.OrderStatusActive, now.Add(12*time.Hour))
+
+	type sent struct {
+		channel string
+		target  string
+		body    string
+	}
+	deliveries := []sent{}
+	failTelegram := true
+	svc := NewReminderService(db, nil, zap.NewNop())
+	svc.deliver = func(_ map[string]string, channel, target, _ string, body string) error {
+		deliveries = append(deliveries, sent{channel: channel, target: target, body: body})
+		if channel == model.ReminderChannelTelegram && failTelegram {
+			return errors.New("telegram down")
+		}
+		return nil
+	}
+
+	result, err := svc.RunDue(context.Background(), now)
+	if err != nil {
+		t.Fatalf("run reminders failed: %v", err)
+	}
+	if result.Messages != 4 || result.Failed != 1 {
+		t.Fatalf("expected 3 channels for the customer and bark for the quiet one, got %+v", result)
+	}
+	for _, d := range deliveries {
+		if d.target == "admin" && strings.Contains(d.body, "quiet") {
+			continue
+		}
+		for _, name := range []string{"soon-a", "soon-b", "week", "gone"} {
+			if !strings.Contains(d.body, name) {
+				t.Fatalf("expected %s message to list %s, got %q", d.channel, name, d.body)
+			}
+		}
+		if strings.Contains(d.body, "later") {
+			t.Fatalf("order outside the schedule was reminded: %q", d.body)
+		}
+	}
+	var logged int64
+	if err := db.Model(&model.ReminderLog{}).Where("customer_id = ? and offset = ?", customer.ID, "3d").Count(&logged).Error; err != nil || logged != 6 {
+		t.Fatalf("expected 3d reminders for 2 orders on 3 channels, got %d %v", logged, err)
+	}
+
+	failTelegram = false
+	deliveries = deliveries[:0]
+	if result, err = svc.RunDue(context.Background(), now.Add(time.Minute)); err != nil {
+		t.Fatalf("rerun reminders failed: %v", err)
+	}
+	if result.Messages != 1 || len(deliveries) != 1 || deliveries[0].channel != model.ReminderChannelTelegram || deliveries[0].target != "42" {
+		t.Fatalf("expected only the failed telegram reminder retried, got %+v %+v", result, deliveries)
+	}
+
+	if _, _, err := parseReminderOffsets("7d,soon"); err == nil {
+		t.Fatalf("expected invalid offset to be rejected")
+	}
+}
+
+type failingRoundTripper struct{}
+
+func (failingRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestReminderTelegramErrorHidesBotToken(t *testing.T) {
+	svc := &ReminderService{client: &http.Client{Transport: failingRoundTripper{}}}
+	err := svc.sendTelegram(map[string]string{"telegram_bot_token": "123:secret"}, "42", "subject", "body")
+	if err == nil || strings.Contains(err.Error(), "secret") || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("expected a token-free telegram error, got %v", err)
+	}
+}
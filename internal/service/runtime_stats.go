@@ -627,7 +627,7 @@ func (s *RuntimeStatsService) collectRuntimeDataset(ctx context.Context) (runtim
 		Joins("join orders o on o.id = oi.order_id").
 		Joins("join customers c on c.id = o.customer_id").
 		Joins("left join orders p on p.id = o.parent_order_id").
-		Where("o.status = ? and o.expires_at > ? and oi.status = ?", model.OrderStatusActive, s.nowFn(), model.OrderItemStatusActive).
+		Where("o.status = ? and (o.expires_at > ? or o.expiry_stage <> '') and oi.status = ?", model.OrderStatusActive, s.nowFn(), model.OrderItemStatusActive).
 		Where("oi.username <> ''").
 		Find(&rows).Error; err != nil {
 		return runtimeDataset{}, err
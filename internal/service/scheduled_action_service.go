@@ -0,0 +1,271 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	scheduledActionRetryDelay  = 5 * time.Minute
+	scheduledActionStaleAfter  = 30 * time.Minute
+	scheduledActionMaxAttempts = 3
+)
+
+type ScheduledActionService struct {
+	db     *gorm.DB
+	store  *store.Store
+	orders *OrderService
+	logger *zap.Logger
+
+	mu sync.Mutex
+}
+
+type ScheduledActionParams struct {
+	Days                  int       `json:"days,omitempty"`
+	ExpiresAt             time.Time `json:"expires_at"`
+	ChildOrderIDs         []uint    `json:"child_order_ids,omitempty"`
+	Protocol              string    `json:"protocol,omitempty"`
+	DedicatedInboundID    uint      `json:"dedicated_inbound_id,omitempty"`
+	DedicatedIngressID    uint      `json:"dedicated_ingress_id,omitempty"`
+	RegenerateCredentials bool      `json:"regenerate_credentials,omitempty"`
+}
+
+type ScheduledActionInput struct {
+	OrderID     uint                  `json:"order_id"`
+	Action      string                `json:"action"`
+	RunAt       time.Time             `json:"run_at"`
+	Params      ScheduledActionParams `json:"params"`
+	MaxAttempts int                   `json:"max_attempts"`
+	Note        string                `json:"note"`
+}
+
+type ScheduledActionQuery struct {
+	OrderID uint
+	Status  string
+	Limit   int
+}
+
+func NewScheduledActionService(db *gorm.DB, st *store.Store, orders *OrderService, logger *zap.Logger) *ScheduledActionService {
+	return &ScheduledActionService{db: db, store: st, orders: orders, logger: logger}
+}
+
+func (s *ScheduledActionService) Create(in ScheduledActionInput) (*model.ScheduledAction, error) {
+	action := strings.ToLower(strings.TrimSpace(in.Action))
+	if in.OrderID == 0 {
+		return nil, errors.New("order_id is required")
+	}
+	if in.RunAt.IsZero() {
+		return nil, errors.New("run_at is required")
+	}
+	if !in.RunAt.After(time.Now()) {
+		return nil, errors.New("run_at must be in the future")
+	}
+	order := model.Order{}
+	if err := s.db.First(&order, in.OrderID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("order not found")
+		}
+		return nil, err
+	}
+	params := in.Params
+	switch action {
+	case model.ScheduledActionActivate, model.ScheduledActionDeactivate, model.ScheduledActionDelete:
+	case model.ScheduledActionRenew:
+		if params.Days < 0 {
+			return nil, errors.New("days must be >= 0")
+		}
+		if params.Days == 0 && params.ExpiresAt.IsZero() {
+			params.Days = 30
+		}
+		if !params.ExpiresAt.IsZero() && !params.ExpiresAt.After(in.RunAt) {
+			return nil, errors.New("expires_at must be after run_at")
+		}
+		if len(params.ChildOrderIDs) > 0 && !order.IsGroupHead {
+			return nil, errors.New("child_order_ids requires a group head order")
+		}
+	case model.ScheduledActionSwitchProtocol:
+		if order.Mode != model.OrderModeDedicated {
+			return nil, errors.New("switch_protocol requires a dedicated order")
+		}
+		protocol, err := normalizeDedicatedProtocol(params.Protocol)
+		if err != nil {
+			return nil, err
+		}
+		params.Protocol = protocol
+	case model.ScheduledActionRotateCredentials:
+		if order.Mode == model.OrderModeForward {
+			return nil, errors.New("forward mode is deprecated")
+		}
+	default:
+		return nil, errors.New("action must be activate/deactivate/renew/switch_protocol/rotate_credentials/delete")
+	}
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	maxAttempts := in.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = scheduledActionMaxAttempts
+	}
+	row := model.ScheduledAction{
+		OrderID:     order.ID,
+		Action:      action,
+		Params:      string(raw),
+		RunAt:       in.RunAt,
+		NextRunAt:   in.RunAt,
+		Status:      model.ScheduledActionPending,
+		MaxAttempts: maxAttempts,
+		Note:        strings.TrimSpace(in.Note),
+	}
+	if err := s.db.Create(&row).Error; err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
+
+func (s *ScheduledActionService) List(q ScheduledActionQuery) ([]model.ScheduledAction, error) {
+	limit := q.Limit
+	if limit <= 0 || limit > 500 {
+		limit = 200
+	}
+	query := s.db.Model(&model.ScheduledAction{})
+	if q.OrderID > 0 {
+		query = query.Where("order_id = ?", q.OrderID)
+	}
+	if status := strings.TrimSpace(q.Status); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	rows := []model.ScheduledAction{}
+	if err := query.Order("run_at asc, id asc").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *ScheduledActionService) Cancel(id uint) error {
+	res := s.db.Model(&model.ScheduledAction{}).Where("id = ? and status = ?", id, model.ScheduledActionPending).Updates(map[string]interface{}{
+		"status":     model.ScheduledActionCancelled,
+		"updated_at": time.Now(),
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errors.New("only pending actions can be cancelled")
+	}
+	return nil
+}
+
+// RunDue executes every pending action whose next run time has passed, in
+// run order. Actions left running by a crashed process are picked up again
+// once they are stale.
+func (s *ScheduledActionService) RunDue(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.db.Model(&model.ScheduledAction{}).Where("status = ? and updated_at < ?", model.ScheduledActionRunning, now.Add(-scheduledActionStaleAfter)).Updates(map[string]interface{}{
+		"status":     model.ScheduledActionPending,
+		"updated_at": now,
+	}).Error; err != nil {
+		s.logger.Warn("reset stale scheduled actions failed", zap.Error(err))
+	}
+
+	rows := []model.ScheduledAction{}
+	if err := s.db.Where("status = ? and next_run_at <= ?", model.ScheduledActionPending, now).Order("next_run_at asc, id asc").Find(&rows).Error; err != nil {
+		s.logger.Warn("load due scheduled actions failed", zap.Error(err))
+		return
+	}
+	for _, row := range rows {
+		if ctx.Err() != nil {
+			return
+		}
+		claim := s.db.Model(&model.ScheduledAction{}).Where("id = ? and status = ?", row.ID, model.ScheduledActionPending).Updates(map[string]interface{}{
+			"status":     model.ScheduledActionRunning,
+			"attempts":   gorm.Expr("attempts + 1"),
+			"updated_at": time.Now(),
+		})
+		if claim.Error != nil || claim.RowsAffected == 0 {
+			continue
+		}
+		row.Attempts++
+		s.finish(row, now, s.execute(ctx, row))
+	}
+}
+
+func (s *ScheduledActionService) finish(row model.ScheduledAction, due time.Time, runErr error) {
+	now := time.Now()
+	updates := map[string]interface{}{"updated_at": now}
+	label := fmt.Sprintf("action %d %s on order %d", row.ID, row.Action, row.OrderID)
+	switch {
+	case runErr == nil:
+		updates["status"] = model.ScheduledActionDone
+		updates["last_error"] = ""
+		updates["finished_at"] = now
+		s.store.AddTaskLog("info", "scheduled action done", label)
+	case errors.Is(runErr, gorm.ErrRecordNotFound) || row.Attempts >= row.MaxAttempts:
+		updates["status"] = model.ScheduledActionFailed
+		updates["last_error"] = runErr.Error()
+		updates["finished_at"] = now
+		s.store.AddTaskLog("error", "scheduled action failed", fmt.Sprintf("%s after %d attempts: %v", label, row.Attempts, runErr))
+	default:
+		updates["status"] = model.ScheduledActionPending
+		updates["last_error"] = runErr.Error()
+		updates["next_run_at"] = due.Add(time.Duration(row.Attempts) * scheduledActionRetryDelay)
+		s.logger.Warn("scheduled action failed, will retry", zap.Error(runErr), zap.Uint("action_id", row.ID), zap.Int("attempts", row.Attempts))
+	}
+	if err := s.db.Model(&model.ScheduledAction{}).Where("id = ?", row.ID).Updates(updates).Error; err != nil {
+		s.logger.Warn("save scheduled action result failed", zap.Error(err), zap.Uint("action_id", row.ID))
+	}
+}
+
+func (s *ScheduledActionService) execute(ctx context.Context, row model.ScheduledAction) error {
+	params := ScheduledActionParams{}
+	if strings.TrimSpace(row.Params) != "" {
+		if err := json.Unmarshal([]byte(row.Params), &params); err != nil {
+			return fmt.Errorf("decode params failed: %w", err)
+		}
+	}
+	order := model.Order{}
+	if err := s.db.First(&order, row.OrderID).Error; err != nil {
+		return err
+	}
+	switch row.Action {
+	case model.ScheduledActionActivate:
+		return s.orders.ActivateOrder(ctx, order.ID)
+	case model.ScheduledActionDeactivate:
+		return s.orders.DeactivateOrder(ctx, order.ID, model.OrderStatusDisabled)
+	case model.ScheduledActionRenew:
+		if len(params.ChildOrderIDs) > 0 {
+			return s.orders.renewOrderGroupSelected(ctx, order.ID, params.ChildOrderIDs, params.Days, params.ExpiresAt, LedgerSourceScheduled)
+		}
+		return s.orders.renewOrder(ctx, order.ID, params.Days, params.ExpiresAt, LedgerSourceScheduled)
+	case model.ScheduledActionSwitchProtocol:
+		_, err := s.orders.UpdateOrder(ctx, order.ID, UpdateOrderInput{
+			DedicatedProtocol:              params.Protocol,
+			DedicatedInboundID:             params.DedicatedInboundID,
+			DedicatedIngressID:             params.DedicatedIngressID,
+			RegenerateDedicatedCredentials: params.RegenerateCredentials,
+		})
+		return err
+	case model.ScheduledActionRotateCredentials:
+		if order.Mode == model.OrderModeDedicated {
+			_, err := s.orders.UpdateOrder(ctx, order.ID, UpdateOrderInput{RegenerateDedicatedCredentials: true})
+			return err
+		}
+		return s.orders.RefreshResidentialCredentials(ctx, order.ID)
+	case model.ScheduledActionDelete:
+		return s.orders.DeleteOrder(ctx, order.ID)
+	}
+	return fmt.Errorf("unsupported action %s", row.Action)
+}
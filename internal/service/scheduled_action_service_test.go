@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"xraytool/internal/config"
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+)
+
+func TestScheduledActionsRunWhenDueAndRetry(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, NewXrayManager(config.Config{}, db, zap.NewNop()), zap.NewNop())
+	actions := NewScheduledActionService(db, store.New(db), svc, zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	customer := seedBillingCustomer(t, db, "scheduled", "198.51.100.40")
+
+	order, err := svc.CreateOrder(context.Background(), CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 10, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create order failed: %v", err)
+	}
+	now := time.Now()
+	if _, err := actions.Create(ScheduledActionInput{OrderID: order.ID, Action: "reboot", RunAt: now.Add(time.Hour)}); err == nil {
+		t.Fatalf("expected unknown action to be rejected")
+	}
+	if _, err := actions.Create(ScheduledActionInput{OrderID: order.ID, Action: model.ScheduledActionSwitchProtocol, RunAt: now.Add(time.Hour), Params: ScheduledActionParams{Protocol: "vless"}}); err == nil {
+		t.Fatalf("expected protocol switch on a residential order to be rejected")
+	}
+	deactivate, err := actions.Create(ScheduledActionInput{OrderID: order.ID, Action: model.ScheduledActionDeactivate, RunAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("create deactivate action failed: %v", err)
+	}
+	renew, err := actions.Create(ScheduledActionInput{OrderID: order.ID, Action: model.ScheduledActionRenew, RunAt: now.Add(2 * time.Hour), Params: ScheduledActionParams{Days: 5}})
+	if err != nil {
+		t.Fatalf("create renew action failed: %v", err)
+	}
+	cancelled, err := actions.Create(ScheduledActionInput{OrderID: order.ID, Action: model.ScheduledActionDelete, RunAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("create delete action failed: %v", err)
+	}
+	if err := actions.Cancel(cancelled.ID); err != nil {
+		t.Fatalf("cancel action failed: %v", err)
+	}
+	if err := actions.Cancel(cancelled.ID); err == nil {
+		t.Fatalf("expected second cancel to fail")
+	}
+
+	actions.RunDue(context.Background(), now)
+	current := model.Order{}
+	if err := db.First(&current, order.ID).Error; err != nil {
+		t.Fatalf("load order failed: %v", err)
+	}
+	if current.Status != model.OrderStatusActive {
+		t.Fatalf("expected nothing to run before run_at, got %s", current.Status)
+	}
+
+	actions.RunDue(context.Background(), now.Add(90*time.Minute))
+	if err := db.First(&current, order.ID).Error; err != nil {
+		t.Fatalf("load order failed: %v", err)
+	}
+	if current.Status != model.OrderStatusDisabled {
+		t.Fatalf("expected scheduled deactivate, got %s", current.Status)
+	}
+
+	actions.RunDue(context.Background(), now.Add(3*time.Hour))
+	if err := db.First(&current, order.ID).Error; err != nil {
+		t.Fatalf("load order failed: %v", err)
+	}
+	if !current.ExpiresAt.After(order.ExpiresAt.Add(5*24*time.Hour - time.Minute)) {
+		t.Fatalf("expected scheduled renew by 5 days, got %s -> %s", order.ExpiresAt, current.ExpiresAt)
+	}
+
+	rows, err := actions.List(ScheduledActionQuery{OrderID: order.ID})
+	if err != nil {
+		t.Fatalf("list actions failed: %v", err)
+	}
+	statuses := map[uint]string{}
+	for _, row := range rows {
+		statuses[row.ID] = row.Status
+	}
+	if statuses[deactivate.ID] != model.ScheduledActionDone || statuses[renew.ID] != model.ScheduledActionDone || statuses[cancelled.ID] != model.ScheduledActionCancelled {
+		t.Fatalf("unexpected action statuses: %#v", statuses)
+	}
+
+	// Activating an expired order keeps failing until attempts run out.
+	if err := db.Model(&model.Order{}).Where("id = ?", order.ID).Updates(map[string]interface{}{"status": model.OrderStatusDisabled, "expires_at": now.Add(-time.Minute)}).Error; err != nil {
+		t.Fatalf("shorten order failed: %v", err)
+	}
+	activate, err := actions.Create(ScheduledActionInput{OrderID: order.ID, Action: model.ScheduledActionActivate, RunAt: now.Add(time.Hour), MaxAttempts: 2})
+	if err != nil {
+		t.Fatalf("create activate action failed: %v", err)
+	}
+	actions.RunDue(context.Background(), now.Add(time.Hour))
+	retry := model.ScheduledAction{}
+	if err := db.First(&retry, activate.ID).Error; err != nil {
+		t.Fatalf("load action failed: %v", err)
+	}
+	if retry.Status != model.ScheduledActionPending || retry.Attempts != 1 || retry.LastError == "" || !retry.NextRunAt.After(retry.RunAt) {
+		t.Fatalf("expected action to be queued for retry, got %#v", retry)
+	}
+	actions.RunDue(context.Background(), retry.NextRunAt.Add(time.Second))
+	if err := db.First(&retry, activate.ID).Error; err != nil {
+		t.Fatalf("load action failed: %v", err)
+	}
+	if retry.Status != model.ScheduledActionFailed || retry.Attempts != 2 || retry.FinishedAt == nil {
+		t.Fatalf("expected action to fail after max attempts, got %#v", retry)
+	}
+}
+
+func TestScheduledDeleteCancelsRemainingActions(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, NewXrayManager(config.Config{}, db, zap.NewNop()), zap.NewNop())
+	actions := NewScheduledActionService(db, store.New(db), svc, zap.NewNop())
+	seedManagedAccountForPort(t, db, residentialTestPort)
+	customer := seedBillingCustomer(t, db, "scheduled-delete", "198.51.100.41")
+
+	order, err := svc.CreateOrder(context.Background(), CreateOrderInput{CustomerID: customer.ID, Quantity: 1, DurationDay: 10, Port: residentialTestPort})
+	if err != nil {
+		t.Fatalf("create order failed: %v", err)
+	}
+	now := time.Now()
+	if _, err := actions.Create(ScheduledActionInput{OrderID: order.ID, Action: model.ScheduledActionDelete, RunAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("create delete action failed: %v", err)
+	}
+	later, err := actions.Create(ScheduledActionInput{OrderID: order.ID, Action: model.ScheduledActionRenew, RunAt: now.Add(48 * time.Hour)})
+	if err != nil {
+		t.Fatalf("create renew action failed: %v", err)
+	}
+
+	actions.RunDue(context.Background(), now.Add(2*time.Hour))
+	var count int64
+	if err := db.Model(&model.Order{}).Where("id = ?", order.ID).Count(&count).Error; err != nil {
+		t.Fatalf("count orders failed: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("expected scheduled delete to remove the order")
+	}
+	row := model.ScheduledAction{}
+	if err := db.First(&row, later.ID).Error; err != nil {
+		t.Fatalf("load action failed: %v", err)
+	}
+	if row.Status != model.ScheduledActionCancelled || row.LastError != "order deleted" {
+		t.Fatalf("expected pending action to be cancelled with the order, got %#v", row)
+	}
+}
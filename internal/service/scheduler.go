@@ -17,12 +17,18 @@ type Scheduler struct {
 	bark      *BarkService
 	runtime   *RuntimeStatsService
 	telemetry *GoSeaLightTelemetryService
+	health    *ForwardHealthService
+	benchmark *UpstreamBenchmarkService
+	billing   *BillingService
+	actions   *ScheduledActionService
+	reminders *ReminderService
+	integrity *IntegrityService
 	logger    *zap.Logger
 	interval  time.Duration
 }
 
-func NewScheduler(db *gorm.DB, orders *OrderService, bark *BarkService, runtime *RuntimeStatsService, telemetry *GoSeaLightTelemetryService, logger *zap.Logger, interval time.Duration) *Scheduler {
-	return &Scheduler{db: db, orders: orders, bark: bark, runtime: runtime, telemetry: telemetry, logger: logger, interval: interval}
+func NewScheduler(db *gorm.DB, orders *OrderService, bark *BarkService, runtime *RuntimeStatsService, telemetry *GoSeaLightTelemetryService, health *ForwardHealthService, benchmark *UpstreamBenchmarkService, billing *BillingService, actions *ScheduledActionService, reminders *ReminderService, integrity *IntegrityService, logger *zap.Logger, interval time.Duration) *Scheduler {
+	return &Scheduler{db: db, orders: orders, bark: bark, runtime: runtime, telemetry: telemetry, health: health, benchmark: benchmark, billing: billing, actions: actions, reminders: reminders, integrity: integrity, logger: logger, interval: interval}
 }
 
 func (s *Scheduler) Start(ctx context.Context) {
@@ -42,42 +48,50 @@ func (s *Scheduler) Start(ctx context.Context) {
 
 func (s *Scheduler) runOnce(ctx context.Context) {
 	now := time.Now()
-	oneDayLater := now.Add(24 * time.Hour)
 
-	var remindOrders []model.Order
-	if err := s.db.Where("status = ? and expires_at > ? and expires_at <= ? and notify_one_day_sent = 0", model.OrderStatusActive, now, oneDayLater).
-		Find(&remindOrders).Error; err == nil {
-		for _, order := range remindOrders {
-			title := "XrayTool 订单将到期"
-			body := fmt.Sprintf("订单[%s] 将于 %s 到期", order.Name, order.ExpiresAt.Format("2006-01-02 15:04:05"))
+	if _, err := s.orders.ExpireReservations(now); err != nil {
+		s.logger.Warn("expire reservations failed", zap.Error(err))
+	}
+	if s.actions != nil {
+		s.actions.RunDue(ctx, now)
+	}
+	if s.billing != nil {
+		s.billing.AutoRenewDue(ctx, now)
+	}
+
+	if stages, err := s.orders.AdvanceExpiryStages(ctx, now); err != nil {
+		s.logger.Warn("advance expiry stages failed", zap.Error(err))
+	} else {
+		for _, change := range stages.Transitions {
+			title := "XrayTool 订单进入宽限期"
+			body := fmt.Sprintf("订单[%s] 已于 %s 到期，宽限期内保持在线，将于 %s 停用", change.Order.Name, change.Order.ExpiresAt.Format("2006-01-02 15:04:05"), change.CutoffAt.Format("2006-01-02 15:04:05"))
+			if change.Stage == model.ExpiryStageFinal {
+				title = "XrayTool 订单即将停用"
+				body = fmt.Sprintf("订单[%s] 宽限期已结束，将于 %s 停用，请尽快续费", change.Order.Name, change.CutoffAt.Format("2006-01-02 15:04:05"))
+			}
 			if err := s.bark.Notify(title, body); err != nil {
-				s.logger.Warn("bark one-day notify failed", zap.Error(err), zap.Uint("order_id", order.ID))
-				continue
+				s.logger.Warn("bark expiry stage notify failed", zap.Error(err), zap.Uint("order_id", change.Order.ID), zap.String("stage", change.Stage))
 			}
-			_ = s.db.Model(&model.Order{}).Where("id = ?", order.ID).Update("notify_one_day_sent", true).Error
 		}
 	}
 
-	var expired []model.Order
-	if err := s.db.Where("status = ? and expires_at <= ?", model.OrderStatusActive, now).Find(&expired).Error; err == nil {
-		for _, order := range expired {
-			if err := s.orders.DeactivateOrder(ctx, order.ID, model.OrderStatusExpired); err != nil {
-				s.logger.Warn("expire order deactivate failed", zap.Error(err), zap.Uint("order_id", order.ID))
-				continue
-			}
-		}
+	if sweep, err := s.orders.SweepTrials(ctx, now); err != nil {
+		s.logger.Warn("trial sweep failed", zap.Error(err))
+	} else if len(sweep.Capped) > 0 || len(sweep.Deleted) > 0 {
+		s.logger.Info("trial sweep", zap.Uints("capped", sweep.Capped), zap.Uints("deleted", sweep.Deleted))
 	}
 
-	var expiredNotified []model.Order
-	if err := s.db.Where("status = ? and notify_expired_sent = 0", model.OrderStatusExpired).Find(&expiredNotified).Error; err == nil {
-		for _, order := range expiredNotified {
-			title := "XrayTool 订单已到期"
-			body := fmt.Sprintf("订单[%s] 已到期并自动下线", order.Name)
-			if err := s.bark.Notify(title, body); err != nil {
-				s.logger.Warn("bark expired notify failed", zap.Error(err), zap.Uint("order_id", order.ID))
-				continue
-			}
-			_ = s.db.Model(&model.Order{}).Where("id = ?", order.ID).Update("notify_expired_sent", true).Error
+	if purged, err := s.orders.PurgeRecycleBin(now); err != nil {
+		s.logger.Warn("recycle bin purge failed", zap.Error(err))
+	} else if purged > 0 {
+		s.logger.Info("recycle bin purged", zap.Int64("entries", purged))
+	}
+
+	if s.reminders != nil {
+		if sent, err := s.reminders.RunDue(ctx, now); err != nil {
+			s.logger.Warn("renewal reminders failed", zap.Error(err))
+		} else if sent.Messages > 0 {
+			s.logger.Info("renewal reminders", zap.Int("messages", sent.Messages), zap.Int("orders", sent.Orders), zap.Int("failed", sent.Failed))
 		}
 	}
 
@@ -89,4 +103,13 @@ func (s *Scheduler) runOnce(ctx context.Context) {
 	if s.telemetry != nil {
 		s.telemetry.RunDue(ctx)
 	}
+	if s.health != nil && !s.health.Running() {
+		go s.health.RunDue(ctx)
+	}
+	if s.integrity != nil && !s.integrity.Running() {
+		go s.integrity.RunDue(ctx)
+	}
+	if s.benchmark != nil && !s.benchmark.Running() {
+		go s.benchmark.RunDue(ctx)
+	}
 }
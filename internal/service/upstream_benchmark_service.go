@@ -0,0 +1,392 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
+	"gorm.io/gorm"
+)
+
+const defaultBenchmarkTargetURL = "https://speed.cloudflare.com/__down?bytes=10000000"
+
+var errBenchmarkRunning = errors.New("benchmark is already running")
+
+type UpstreamBenchmarkService struct {
+	db     *gorm.DB
+	store  *store.Store
+	logger *zap.Logger
+
+	running       atomic.Bool
+	mu            sync.Mutex
+	lastAttemptAt time.Time
+}
+
+type upstreamBenchmarkSettings struct {
+	Enabled     bool
+	Interval    time.Duration
+	TargetURL   string
+	MaxBytes    int64
+	Timeout     time.Duration
+	HistoryDays int
+}
+
+type benchmarkMeasurement struct {
+	ConnectMS      int64
+	TTFBMS         int64
+	Bytes          int64
+	ThroughputKbps int64
+}
+
+func NewUpstreamBenchmarkService(db *gorm.DB, st *store.Store, logger *zap.Logger) *UpstreamBenchmarkService {
+	return &UpstreamBenchmarkService{db: db, store: st, logger: logger}
+}
+
+func (s *UpstreamBenchmarkService) RunDue(ctx context.Context) {
+	settings, err := s.loadSettings()
+	if err != nil {
+		s.logger.Warn("load benchmark settings failed", zap.Error(err))
+		return
+	}
+	if !settings.Enabled {
+		return
+	}
+
+	s.mu.Lock()
+	if !s.lastAttemptAt.IsZero() && time.Since(s.lastAttemptAt) < settings.Interval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastAttemptAt = time.Now()
+	s.mu.Unlock()
+
+	if err := s.runAll(ctx, settings); err != nil && !errors.Is(err, errBenchmarkRunning) {
+		s.logger.Warn("upstream benchmark run failed", zap.Error(err))
+	}
+}
+
+// RunAll benchmarks every enabled forward upstream and every dedicated
+// egress of an active order, one at a time.
+func (s *UpstreamBenchmarkService) RunAll(ctx context.Context) error {
+	settings, err := s.loadSettings()
+	if err != nil {
+		return err
+	}
+	return s.runAll(ctx, settings)
+}
+
+func (s *UpstreamBenchmarkService) Running() bool {
+	return s.running.Load()
+}
+
+func (s *UpstreamBenchmarkService) runAll(ctx context.Context, settings upstreamBenchmarkSettings) error {
+	if !s.running.CompareAndSwap(false, true) {
+		return errBenchmarkRunning
+	}
+	defer s.running.Store(false)
+
+	outbounds := []model.SocksOutbound{}
+	if err := s.db.Where("enabled = 1").Order("id asc").Find(&outbounds).Error; err != nil {
+		return err
+	}
+	egresses := []model.DedicatedEgress{}
+	if err := s.db.Table("dedicated_egresses de").
+		Select("de.*").
+		Joins("join orders o on o.id = de.order_id").
+		Where("o.status = ? and (o.expires_at > ? or o.expiry_stage <> '')", model.OrderStatusActive, time.Now()).
+		Order("de.id asc").
+		Find(&egresses).Error; err != nil {
+		return err
+	}
+
+	ok, failed := 0, 0
+	for _, row := range outbounds {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		result, err := s.benchmarkOutbound(ctx, settings, row)
+		if err != nil || result.Status != "ok" {
+			failed++
+			continue
+		}
+		ok++
+	}
+	for _, row := range egresses {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		result, err := s.benchmarkEgress(ctx, settings, row)
+		if err != nil || result.Status != "ok" {
+			failed++
+			continue
+		}
+		ok++
+	}
+	if settings.HistoryDays > 0 {
+		if err := s.db.Where("created_at < ?", time.Now().AddDate(0, 0, -settings.HistoryDays)).Delete(&model.UpstreamBenchmark{}).Error; err != nil {
+			s.logger.Warn("prune benchmark history failed", zap.Error(err))
+		}
+	}
+	s.store.AddTaskLog("info", "upstream benchmark finished", fmt.Sprintf("ok=%d failed=%d", ok, failed))
+	return nil
+}
+
+func (s *UpstreamBenchmarkService) BenchmarkOutbound(ctx context.Context, id uint) (*model.UpstreamBenchmark, error) {
+	settings, err := s.loadSettings()
+	if err != nil {
+		return nil, err
+	}
+	row := model.SocksOutbound{}
+	if err := s.db.First(&row, id).Error; err != nil {
+		return nil, err
+	}
+	return s.benchmarkOutbound(ctx, settings, row)
+}
+
+func (s *UpstreamBenchmarkService) BenchmarkDedicatedEgress(ctx context.Context, id uint) (*model.UpstreamBenchmark, error) {
+	settings, err := s.loadSettings()
+	if err != nil {
+		return nil, err
+	}
+	row := model.DedicatedEgress{}
+	if err := s.db.First(&row, id).Error; err != nil {
+		return nil, err
+	}
+	return s.benchmarkEgress(ctx, settings, row)
+}
+
+func (s *UpstreamBenchmarkService) History(targetType string, targetID uint, limit int) ([]model.UpstreamBenchmark, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	q := s.db.Model(&model.UpstreamBenchmark{})
+	if targetType = strings.TrimSpace(targetType); targetType != "" {
+		q = q.Where("target_type = ?", targetType)
+	}
+	if targetID > 0 {
+		q = q.Where("target_id = ?", targetID)
+	}
+	rows := []model.UpstreamBenchmark{}
+	if err := q.Order("created_at desc, id desc").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (s *UpstreamBenchmarkService) benchmarkOutbound(ctx context.Context, settings upstreamBenchmarkSettings, row model.SocksOutbound) (*model.UpstreamBenchmark, error) {
+	m, err := benchmarkForwardOutbound(ctx, row, settings.TargetURL, settings.MaxBytes, settings.Timeout)
+	result := newUpstreamBenchmark(model.BenchmarkTargetSocksOutbound, row.ID, settings.TargetURL, m, err)
+	if err := s.saveResult(&result, &model.SocksOutbound{}, row.ID); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (s *UpstreamBenchmarkService) benchmarkEgress(ctx context.Context, settings upstreamBenchmarkSettings, row model.DedicatedEgress) (*model.UpstreamBenchmark, error) {
+	m, err := benchmarkSocksUpstream(ctx, row.Address, row.Port, row.Username, row.Password, settings.TargetURL, settings.MaxBytes, settings.Timeout)
+	result := newUpstreamBenchmark(model.BenchmarkTargetDedicatedEgress, row.ID, settings.TargetURL, m, err)
+	if err := s.saveResult(&result, &model.DedicatedEgress{}, row.ID); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (s *UpstreamBenchmarkService) saveResult(result *model.UpstreamBenchmark, target interface{}, targetID uint) error {
+	now := result.CreatedAt
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(result).Error; err != nil {
+			return err
+		}
+		return tx.Model(target).Where("id = ?", targetID).Updates(map[string]interface{}{
+			"bench_connect_ms":      result.ConnectMS,
+			"bench_ttfb_ms":         result.TTFBMS,
+			"bench_throughput_kbps": result.ThroughputKbps,
+			"benched_at":            &now,
+			"updated_at":            now,
+		}).Error
+	})
+}
+
+func newUpstreamBenchmark(targetType string, targetID uint, targetURL string, m benchmarkMeasurement, err error) model.UpstreamBenchmark {
+	result := model.UpstreamBenchmark{
+		TargetType:     targetType,
+		TargetID:       targetID,
+		Status:         "ok",
+		TargetURL:      targetURL,
+		ConnectMS:      m.ConnectMS,
+		TTFBMS:         m.TTFBMS,
+		Bytes:          m.Bytes,
+		ThroughputKbps: m.ThroughputKbps,
+		CreatedAt:      time.Now(),
+	}
+	if err != nil {
+		result.Status = "failed"
+		result.Error = truncateProbeError(err.Error())
+		result.ThroughputKbps = 0
+	}
+	return result
+}
+
+func (s *UpstreamBenchmarkService) loadSettings() (upstreamBenchmarkSettings, error) {
+	values, err := s.store.GetSettings()
+	if err != nil {
+		return upstreamBenchmarkSettings{}, err
+	}
+	intervalMinutes := parseSettingInt(values["benchmark_interval_minutes"], 1440)
+	if intervalMinutes < 10 {
+		intervalMinutes = 10
+	}
+	timeoutSeconds := parseSettingInt(values["benchmark_timeout_seconds"], 30)
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = 30
+	}
+	maxBytes, err := strconv.ParseInt(strings.TrimSpace(values["benchmark_max_bytes"]), 10, 64)
+	if err != nil || maxBytes <= 0 {
+		maxBytes = 10 << 20
+	}
+	targetURL := strings.TrimSpace(values["benchmark_target_url"])
+	if targetURL == "" {
+		targetURL = defaultBenchmarkTargetURL
+	}
+	return upstreamBenchmarkSettings{
+		Enabled:     parseSettingBool(values["benchmark_enabled"], false),
+		Interval:    time.Duration(intervalMinutes) * time.Minute,
+		TargetURL:   targetURL,
+		MaxBytes:    maxBytes,
+		Timeout:     time.Duration(timeoutSeconds) * time.Second,
+		HistoryDays: parseSettingInt(values["benchmark_history_days"], 30),
+	}, nil
+}
+
+func benchmarkForwardOutbound(ctx context.Context, row model.SocksOutbound, targetURL string, maxBytes int64, timeout time.Duration) (benchmarkMeasurement, error) {
+	switch forwardOutboundTypeOf(row) {
+	case model.OutboundTypeHTTP:
+		transport := &http.Transport{Proxy: http.ProxyURL(forwardHTTPProxyURL(row))}
+		defer transport.CloseIdleConnections()
+		return measureDownload(ctx, transport, targetURL, maxBytes, timeout)
+	case model.OutboundTypeShadowsocks, model.OutboundTypeVmess:
+		if err := validateForwardOutbound(row); err != nil {
+			return benchmarkMeasurement{}, err
+		}
+		localPort, err := reserveLocalTCPPort()
+		if err != nil {
+			return benchmarkMeasurement{}, fmt.Errorf("reserve local benchmark port failed: %w", err)
+		}
+		instance, err := startProbeCore(ctx, localPort, forwardUpstreamOutbound("probe-out", row))
+		if err != nil {
+			return benchmarkMeasurement{}, fmt.Errorf("start benchmark runtime failed: %w", err)
+		}
+		defer instance.Close()
+		return benchmarkSocksUpstream(ctx, "127.0.0.1", localPort, "", "", targetURL, maxBytes, timeout)
+	default:
+		return benchmarkSocksUpstream(ctx, row.Address, row.Port, row.Username, row.Password, targetURL, maxBytes, timeout)
+	}
+}
+
+func benchmarkSocksUpstream(ctx context.Context, address string, port int, username, password, targetURL string, maxBytes int64, timeout time.Duration) (benchmarkMeasurement, error) {
+	var auth *proxy.Auth
+	if strings.TrimSpace(username) != "" || strings.TrimSpace(password) != "" {
+		auth = &proxy.Auth{User: strings.TrimSpace(username), Password: strings.TrimSpace(password)}
+	}
+	dialer, err := proxy.SOCKS5("tcp", net.JoinHostPort(strings.TrimSpace(address), strconv.Itoa(port)), auth, proxy.Direct)
+	if err != nil {
+		return benchmarkMeasurement{}, err
+	}
+	transport := &http.Transport{}
+	if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+		transport.DialContext = contextDialer.DialContext
+	} else {
+		transport.Dial = dialer.Dial
+	}
+	defer transport.CloseIdleConnections()
+	return measureDownload(ctx, transport, targetURL, maxBytes, timeout)
+}
+
+// measureDownload reports connect time (until a usable connection, including
+// the proxy handshake), time to first byte and the download rate after it.
+func measureDownload(ctx context.Context, transport *http.Transport, targetURL string, maxBytes int64, timeout time.Duration) (benchmarkMeasurement, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var gotConnAt, firstByteAt time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn:              func(httptrace.GotConnInfo) { gotConnAt = time.Now() },
+		GotFirstResponseByte: func() { firstByteAt = time.Now() },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, targetURL, nil)
+	if err != nil {
+		return benchmarkMeasurement{}, err
+	}
+	started := time.Now()
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return benchmarkMeasurement{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return benchmarkMeasurement{}, fmt.Errorf("benchmark target status %d", resp.StatusCode)
+	}
+	n, copyErr := io.Copy(io.Discard, io.LimitReader(resp.Body, maxBytes))
+	finished := time.Now()
+	if copyErr != nil && n == 0 {
+		return benchmarkMeasurement{}, copyErr
+	}
+	if gotConnAt.IsZero() {
+		gotConnAt = started
+	}
+	if firstByteAt.IsZero() {
+		firstByteAt = gotConnAt
+	}
+	elapsed := finished.Sub(firstByteAt)
+	if elapsed <= 0 {
+		elapsed = time.Millisecond
+	}
+	return benchmarkMeasurement{
+		ConnectMS:      gotConnAt.Sub(started).Milliseconds(),
+		TTFBMS:         firstByteAt.Sub(started).Milliseconds(),
+		Bytes:          n,
+		ThroughputKbps: int64(float64(n*8) / elapsed.Seconds() / 1000),
+	}, nil
+}
+
+func benchmarkRankingEnabled(db *gorm.DB) bool {
+	row := model.Setting{}
+	if err := db.Where("key = ?", "benchmark_ranking_enabled").Limit(1).Find(&row).Error; err != nil {
+		return false
+	}
+	return parseSettingBool(row.Value, false)
+}
+
+// benchmarkRankLess orders outbounds by their latest benchmark: measured
+// before unmeasured, then higher throughput, then lower time to first byte.
+func benchmarkRankLess(a, b model.SocksOutbound) (bool, bool) {
+	aMeasured := a.BenchedAt != nil && a.BenchThroughputKbps > 0
+	bMeasured := b.BenchedAt != nil && b.BenchThroughputKbps > 0
+	if aMeasured != bMeasured {
+		return aMeasured, true
+	}
+	if !aMeasured {
+		return false, false
+	}
+	if a.BenchThroughputKbps != b.BenchThroughputKbps {
+		return a.BenchThroughputKbps > b.BenchThroughputKbps, true
+	}
+	if a.BenchTTFBMS != b.BenchTTFBMS {
+		return a.BenchTTFBMS < b.BenchTTFBMS, true
+	}
+	return false, false
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"xraytool/internal/model"
+	"xraytool/internal/store"
+
+	"go.uber.org/zap"
+)
+
+func startTestSocksUpstream(t *testing.T, username, password string) int {
+	t.Helper()
+	port, err := reserveLocalTCPPort()
+	if err != nil {
+		t.Fatalf("reserve port failed: %v", err)
+	}
+	payload := map[string]any{
+		"log": map[string]any{"loglevel": "warning"},
+		"inbounds": []map[string]any{{
+			"tag":      "test-in",
+			"listen":   "127.0.0.1",
+			"port":     port,
+			"protocol": "socks",
+			"settings": map[string]any{
+				"auth":     "password",
+				"accounts": []map[string]any{{"user": username, "pass": password}},
+			},
+		}},
+		"outbounds": []map[string]any{{"tag": "direct", "protocol": "freedom"}},
+	}
+	instance, err := startLocalXrayCore(context.Background(), payload, port)
+	if err != nil {
+		t.Fatalf("start socks upstream failed: %v", err)
+	}
+	t.Cleanup(func() { _ = instance.Close() })
+	return port
+}
+
+func TestUpstreamBenchmarkMeasuresThroughSocksUpstream(t *testing.T) {
+	db := setupOrderServiceTestDB(t)
+	st := store.New(db)
+
+	payload := bytes.Repeat([]byte("x"), 256<<10)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(payload)
+	}))
+	defer target.Close()
+	if err := st.SetSettings(map[string]string{
+		"benchmark_target_url":      target.URL + "/blob",
+		"benchmark_timeout_seconds": "10",
+	}); err != nil {
+		t.Fatalf("save settings failed: %v", err)
+	}
+
+	port := startTestSocksUpstream(t, "bench", "bench-pass")
+	outbound := model.SocksOutbound{Type: model.OutboundTypeSocks5, Address: "127.0.0.1", Port: port, Username: "bench", Password: "bench-pass", Enabled: true}
+	if err := db.Create(&outbound).Error; err != nil {
+		t.Fatalf("create upstream failed: %v", err)
+	}
+	egress := model.DedicatedEgress{OrderID: 1, OrderItemID: 1, Address: "127.0.0.1", Port: port, Username: "bench", Password: "bench-pass"}
+	if err := db.Create(&egress).Error; err != nil {
+		t.Fatalf("create egress failed: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	closedPort := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+	broken := model.SocksOutbound{Type: model.OutboundTypeSocks5, Address: "127.0.0.1", Port: closedPort, Username: "x", Password: "y", Enabled: true}
+	if err := db.Create(&broken).Error; err != nil {
+		t.Fatalf("create broken upstream failed: %v", err)
+	}
+
+	svc := NewUpstreamBenchmarkService(db, st, zap.NewNop())
+	result, err := svc.BenchmarkOutbound(context.Background(), outbound.ID)
+	if err != nil {
+		t.Fatalf("benchmark outbound failed: %v", err)
+	}
+	if result.Status != "ok" || result.Bytes != int64(len(payload)) || result.ThroughputKbps <= 0 || result.TTFBMS < result.ConnectMS {
+		t.Fatalf("unexpected benchmark result: %#v", result)
+	}
+	latest := model.SocksOutbound{}
+	if err := db.First(&latest, outbound.ID).Error; err != nil {
+		t.Fatalf("load upstream failed: %v", err)
+	}
+	if latest.BenchedAt == nil || latest.BenchThroughputKbps != result.ThroughputKbps {
+		t.Fatalf("expected latest benchmark on upstream, got %#v", latest)
+	}
+
+	egressResult, err := svc.BenchmarkDedicatedEgress(context.Background(), egress.ID)
+	if err != nil || egressResult.Status != "ok" || egressResult.TargetType != model.BenchmarkTargetDedicatedEgress {
+		t.Fatalf("unexpected egress benchmark: %#v %v", egressResult, err)
+	}
+
+	failed, err := svc.BenchmarkOutbound(context.Background(), broken.ID)
+	if err != nil {
+		t.Fatalf("benchmark broken outbound failed: %v", err)
+	}
+	if failed.Status != "failed" || failed.Error == "" || failed.ThroughputKbps != 0 {
+		t.Fatalf("expected failed benchmark, got %#v", failed)
+	}
+
+	history, err := svc.History(model.BenchmarkTargetSocksOutbound, 0, 0)
+	if err != nil {
+		t.Fatalf("load history failed: %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected two socks outbound benchmark rows, got %d", len(history))
+	}
+}
+
+func TestSelectDispersedOutboundsRanksByBenchmark(t *testing.T) {
+	now := time.Now()
+	candidates := []model.SocksOutbound{
+		{ID: 1, RouteUser: "a", BenchThroughputKbps: 2000, BenchTTFBMS: 300, BenchedAt: &now},
+		{ID: 2, RouteUser: "b"},
+		{ID: 3, RouteUser: "c", BenchThroughputKbps: 9000, BenchTTFBMS: 500, BenchedAt: &now},
+		{ID: 4, RouteUser: "d", BenchThroughputKbps: 2000, BenchTTFBMS: 100, BenchedAt: &now},
+		{ID: 5, RouteUser: "e", BenchThroughputKbps: 50000, BenchedAt: &now},
+	}
+	usage := map[uint]int64{5: 3}
+
+	picked := selectDispersedOutbounds(candidates, usage, 3, 7, true)
+	got := []uint{picked[0].ID, picked[1].ID, picked[2].ID}
+	want := []uint{3, 4, 1}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected ranked pick %v, got %v", want, got)
+		}
+	}
+
+	db := setupOrderServiceTestDB(t)
+	svc := NewOrderService(db, &XrayManager{}, zap.NewNop())
+	for i := range candidates {
+		row := candidates[i]
+		row.ID = 0
+		row.Type = model.OutboundTypeSocks5
+		row.Address = "198.51.100.80"
+		row.Port = 1080 + i
+		row.Username = "u"
+		row.Password = "p"
+		row.Enabled = true
+		if err := db.Create(&row).Error; err != nil {
+			t.Fatalf("create upstream failed: %v", err)
+		}
+	}
+	if err := store.New(db).SetSettings(map[string]string{"benchmark_ranking_enabled": "true"}); err != nil {
+		t.Fatalf("save settings failed: %v", err)
+	}
+	selected, err := svc.allocateForwardOutbounds(context.Background(), 0, 1, 0, nil)
+	if err != nil {
+		t.Fatalf("allocate failed: %v", err)
+	}
+	if selected[0].RouteUser != "e" {
+		t.Fatalf("expected fastest unused upstream, got %s", selected[0].RouteUser)
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"xraytool/internal/config"
 	"xraytool/internal/model"
 
+	"github.com/xtls/xray-core/app/observatory"
+	observatorycmd "github.com/xtls/xray-core/app/observatory/command"
 	handlercmd "github.com/xtls/xray-core/app/proxyman/command"
 	routercmd "github.com/xtls/xray-core/app/router/command"
 	statscmd "github.com/xtls/xray-core/app/stats/command"
@@ -318,6 +320,31 @@ func (m *XrayManager) GetOnlineCounts(ctx context.Context, onlineStatNames []str
 	return out, nil
 }
 
+func (m *XrayManager) GetObservatoryStatus(ctx context.Context) (map[string]*observatory.OutboundStatus, error) {
+	conn, err := m.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := observatorycmd.NewObservatoryServiceClient(conn)
+	resp, err := client.GetOutboundStatus(ctx, &observatorycmd.GetOutboundStatusRequest{})
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]*observatory.OutboundStatus{}
+	if resp.Status == nil {
+		return out, nil
+	}
+	for _, row := range resp.Status.Status {
+		if row == nil {
+			continue
+		}
+		out[row.OutboundTag] = row
+	}
+	return out, nil
+}
+
 func (m *XrayManager) ApplyOrderItem(ctx context.Context, item model.OrderItem, inboundTag string) (model.XrayResource, error) {
 	resource := model.XrayResource{
 		OrderItemID: item.ID,
@@ -383,24 +410,14 @@ func (m *XrayManager) RebuildInboundForPort(ctx context.Context, port int, accou
 }
 
 func (m *XrayManager) addOutbound(ctx context.Context, client handlercmd.HandlerServiceClient, tag string, item model.OrderItem) error {
+	upstream, forward, err := forwardUpstreamForItem(m.db.WithContext(ctx), item)
+	if err != nil {
+		return err
+	}
 	obj := map[string]interface{}{}
-	if strings.EqualFold(strings.TrimSpace(item.OutboundType), model.OutboundTypeSocks5) && strings.TrimSpace(item.ForwardAddress) != "" && item.ForwardPort > 0 {
-		server := map[string]interface{}{
-			"address": item.ForwardAddress,
-			"port":    item.ForwardPort,
-		}
-		if strings.TrimSpace(item.ForwardUsername) != "" || strings.TrimSpace(item.ForwardPassword) != "" {
-			server["users"] = []map[string]string{{
-				"user": item.ForwardUsername,
-				"pass": item.ForwardPassword,
-			}}
-		}
+	if forward {
 		obj = map[string]interface{}{
-			"outbounds": []map[string]interface{}{{
-				"tag":      tag,
-				"protocol": "socks",
-				"settings": map[string]interface{}{"servers": []map[string]interface{}{server}},
-			}},
+			"outbounds": []map[string]interface{}{forwardUpstreamOutbound(tag, upstream)},
 		}
 	} else {
 		obj = map[string]interface{}{
@@ -553,23 +570,48 @@ func (m *XrayManager) RebuildConfigFile(ctx context.Context) error {
 		ForwardPort        int
 		ForwardUsername    string
 		ForwardPassword    string
+		SocksOutboundID    uint
+		EgressPoolID       uint
 	}
 
 	var rows []activeRow
 	err := m.db.WithContext(ctx).
 		Table("order_items oi").
-		Select("oi.id as item_id, o.dedicated_inbound_id as dedicated_inbound_id, oi.ip, oi.port, oi.username, oi.password, oi.vmess_uuid, oi.managed, o.mode as order_mode, o.dedicated_protocol as order_protocol, oi.outbound_type, oi.forward_address, oi.forward_port, oi.forward_username, oi.forward_password").
+		Select("oi.id as item_id, o.dedicated_inbound_id as dedicated_inbound_id, oi.ip, oi.port, oi.username, oi.password, oi.vmess_uuid, oi.managed, o.mode as order_mode, o.dedicated_protocol as order_protocol, oi.outbound_type, oi.forward_address, oi.forward_port, oi.forward_username, oi.forward_password, oi.socks_outbound_id, oi.egress_pool_id").
 		Joins("join orders o on o.id = oi.order_id").
-		Where("oi.status = ? and o.status = ? and o.expires_at > ?", model.OrderItemStatusActive, model.OrderStatusActive, time.Now()).
+		Where("oi.status = ? and o.status = ? and (o.expires_at > ? or o.expiry_stage <> '')", model.OrderItemStatusActive, model.OrderStatusActive, time.Now()).
 		Scan(&rows).Error
 	if err != nil {
 		return err
 	}
 	inboundIDs := make([]uint, 0)
+	upstreamIDs := make([]uint, 0)
+	poolIDs := make([]uint, 0)
 	for _, row := range rows {
+		if row.EgressPoolID > 0 {
+			poolIDs = append(poolIDs, row.EgressPoolID)
+		}
 		if row.DedicatedInboundID > 0 {
 			inboundIDs = append(inboundIDs, row.DedicatedInboundID)
 		}
+		if row.SocksOutboundID > 0 && isForwardOutboundType(row.OutboundType) && !strings.EqualFold(strings.TrimSpace(row.OutboundType), model.OutboundTypeSocks5) {
+			upstreamIDs = append(upstreamIDs, row.SocksOutboundID)
+		}
+	}
+	upstreamIDs = uniqueUintIDs(upstreamIDs)
+	upstreamsByID := map[uint]model.SocksOutbound{}
+	if len(upstreamIDs) > 0 {
+		upstreamRows := []model.SocksOutbound{}
+		if err := m.db.WithContext(ctx).Where("id in ?", upstreamIDs).Find(&upstreamRows).Error; err != nil {
+			return err
+		}
+		for _, row := range upstreamRows {
+			upstreamsByID[row.ID] = row
+		}
+	}
+	poolsByID, err := loadEgressPoolRuntimes(m.db.WithContext(ctx), poolIDs)
+	if err != nil {
+		return err
 	}
 	inboundIDs = uniqueUintIDs(inboundIDs)
 	dedicatedInboundsByID := map[uint]model.DedicatedInbound{}
@@ -594,17 +636,15 @@ func (m *XrayManager) RebuildConfigFile(ctx context.Context) error {
 	vlessInboundByPort := map[int]model.DedicatedInbound{}
 	ssClientsByPort := map[int]map[string]string{}
 	type managedItem struct {
-		itemID          uint
-		ip              string
-		user            string
-		password        string
-		vmessUUID       string
-		inboundTags     []string
-		outboundType    string
-		forwardAddress  string
-		forwardPort     int
-		forwardUsername string
-		forwardPassword string
+		itemID      uint
+		ip          string
+		user        string
+		password    string
+		vmessUUID   string
+		inboundTags []string
+		forward     bool
+		upstream    model.SocksOutbound
+		pool        *egressPoolRuntime
 	}
 	items := make([]managedItem, 0)
 
@@ -670,19 +710,26 @@ func (m *XrayManager) RebuildConfigFile(ctx context.Context) error {
 			legacyMixedAccountsByListen[key][row.Username] = row.Password
 			inboundTags = append(inboundTags, managedMixedInboundTag(listenIP, row.Port))
 		}
-		items = append(items, managedItem{
-			itemID:          row.ItemID,
-			ip:              row.IP,
-			user:            row.Username,
-			password:        row.Password,
-			vmessUUID:       row.VmessUUID,
-			inboundTags:     inboundTags,
-			outboundType:    row.OutboundType,
-			forwardAddress:  row.ForwardAddress,
-			forwardPort:     row.ForwardPort,
-			forwardUsername: row.ForwardUsername,
-			forwardPassword: row.ForwardPassword,
-		})
+		upstream := upstreamsByID[row.SocksOutboundID]
+		upstream.Type = strings.ToLower(strings.TrimSpace(row.OutboundType))
+		upstream.Address = row.ForwardAddress
+		upstream.Port = row.ForwardPort
+		upstream.Username = row.ForwardUsername
+		upstream.Password = row.ForwardPassword
+		item := managedItem{
+			itemID:      row.ItemID,
+			ip:          row.IP,
+			user:        row.Username,
+			password:    row.Password,
+			vmessUUID:   row.VmessUUID,
+			inboundTags: inboundTags,
+			forward:     isForwardOutboundType(row.OutboundType) && strings.TrimSpace(row.ForwardAddress) != "" && row.ForwardPort > 0,
+			upstream:    upstream,
+		}
+		if pool, ok := poolsByID[row.EgressPoolID]; ok && item.forward {
+			item.pool = &pool
+		}
+		items = append(items, item)
 	}
 
 	inbounds := []map[string]interface{}{
@@ -871,23 +918,20 @@ func (m *XrayManager) RebuildConfigFile(ctx context.Context) error {
 	rules := []map[string]interface{}{
 		{"type": "field", "inboundTag": []string{"api-in"}, "outboundTag": "api"},
 	}
+	balancers := make([]map[string]interface{}, 0)
+	renderedPools := map[uint]struct{}{}
 	for _, item := range items {
-		if strings.EqualFold(strings.TrimSpace(item.outboundType), model.OutboundTypeSocks5) && strings.TrimSpace(item.forwardAddress) != "" && item.forwardPort > 0 {
-			server := map[string]interface{}{
-				"address": item.forwardAddress,
-				"port":    item.forwardPort,
-			}
-			if strings.TrimSpace(item.forwardUsername) != "" || strings.TrimSpace(item.forwardPassword) != "" {
-				server["users"] = []map[string]string{{
-					"user": item.forwardUsername,
-					"pass": item.forwardPassword,
-				}}
+		if item.pool != nil {
+			poolID := item.pool.pool.ID
+			if _, ok := renderedPools[poolID]; !ok {
+				renderedPools[poolID] = struct{}{}
+				for idx, member := range item.pool.members {
+					outbounds = append(outbounds, forwardUpstreamOutbound(EgressPoolMemberTag(poolID, idx), member))
+				}
+				balancers = append(balancers, egressPoolBalancer(poolID, item.pool.pool.Strategy, len(item.pool.members)))
 			}
-			outbounds = append(outbounds, map[string]interface{}{
-				"tag":      OutboundTag(item.itemID),
-				"protocol": "socks",
-				"settings": map[string]interface{}{"servers": []map[string]interface{}{server}},
-			})
+		} else if item.forward {
+			outbounds = append(outbounds, forwardUpstreamOutbound(OutboundTag(item.itemID), item.upstream))
 		} else {
 			outbounds = append(outbounds, map[string]interface{}{
 				"tag":         OutboundTag(item.itemID),
@@ -901,23 +945,38 @@ func (m *XrayManager) RebuildConfigFile(ctx context.Context) error {
 			if idx > 0 {
 				ruleTag = fmt.Sprintf("%s-%d", RuleTag(item.itemID), idx+1)
 			}
-			rules = append(rules, map[string]interface{}{
+			rule := map[string]interface{}{
 				"type":        "field",
 				"ruleTag":     ruleTag,
 				"inboundTag":  []string{inTag},
 				"user":        []string{item.user},
 				"outboundTag": OutboundTag(item.itemID),
-			})
+			}
+			if item.pool != nil {
+				delete(rule, "outboundTag")
+				rule["balancerTag"] = EgressPoolBalancerTag(item.pool.pool.ID)
+			}
+			rules = append(rules, rule)
 		}
 	}
 
+	routing := map[string]interface{}{
+		"domainStrategy": "AsIs",
+		"rules":          rules,
+	}
+	apiServices := []string{"HandlerService", "RoutingService", "StatsService"}
+	if len(balancers) > 0 {
+		routing["balancers"] = balancers
+		apiServices = append(apiServices, "ObservatoryService")
+	}
+
 	payload := map[string]interface{}{
 		"log": map[string]interface{}{
 			"loglevel": "warning",
 		},
 		"api": map[string]interface{}{
 			"tag":      "api",
-			"services": []string{"HandlerService", "RoutingService", "StatsService"},
+			"services": apiServices,
 		},
 		"stats": map[string]interface{}{},
 		"policy": map[string]interface{}{
@@ -937,10 +996,16 @@ func (m *XrayManager) RebuildConfigFile(ctx context.Context) error {
 		},
 		"inbounds":  inbounds,
 		"outbounds": outbounds,
-		"routing": map[string]interface{}{
-			"domainStrategy": "AsIs",
-			"rules":          rules,
-		},
+		"routing":   routing,
+	}
+	if len(balancers) > 0 {
+		probeURL, probeInterval := loadEgressPoolObservatorySettings(m.db.WithContext(ctx))
+		payload["observatory"] = map[string]interface{}{
+			"subjectSelector":   []string{"xtool-pool-"},
+			"probeURL":          probeURL,
+			"probeInterval":     probeInterval,
+			"enableConcurrency": true,
+		}
 	}
 
 	body, err := json.MarshalIndent(payload, "", "  ")
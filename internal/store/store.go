@@ -25,19 +25,64 @@ func (s *Store) DB() *gorm.DB {
 
 func (s *Store) EnsureDefaultSettings(defaultPort int, barkBase string, extraDefaults map[string]string) error {
 	defaults := map[string]string{
-		"default_inbound_port":     strconv.Itoa(defaultPort),
-		"default_inbound_listen":   "0.0.0.0",
-		"bark_enabled":             "false",
-		"bark_base_url":            barkBase,
-		"bark_device_key":          "",
-		"bark_group":               "xraytool",
-		"xray_api_server":          "127.0.0.1:10085",
-		"dedicated_vless_security": "tls",
-		"dedicated_vless_sni":      "",
-		"dedicated_vless_type":     "tcp",
-		"dedicated_vless_path":     "",
-		"dedicated_vless_host":     "",
-		"residential_name_prefix":  "家宽-Socks5",
+		"default_inbound_port":            strconv.Itoa(defaultPort),
+		"default_inbound_listen":          "0.0.0.0",
+		"bark_enabled":                    "false",
+		"bark_base_url":                   barkBase,
+		"bark_device_key":                 "",
+		"bark_group":                      "xraytool",
+		"xray_api_server":                 "127.0.0.1:10085",
+		"dedicated_vless_security":        "tls",
+		"dedicated_vless_sni":             "",
+		"dedicated_vless_type":            "tcp",
+		"dedicated_vless_path":            "",
+		"dedicated_vless_host":            "",
+		"residential_name_prefix":         "家宽-Socks5",
+		"egress_pool_probe_url":           "https://www.gstatic.com/generate_204",
+		"egress_pool_probe_interval":      "30s",
+		"forward_probe_enabled":           "false",
+		"forward_probe_interval_seconds":  "300",
+		"forward_probe_failure_threshold": "3",
+		"forward_probe_auto_rehome":       "false",
+		"forward_probe_history_days":      "7",
+		"geoip_online_fallback":           "false",
+		"benchmark_enabled":               "false",
+		"benchmark_interval_minutes":      "1440",
+		"benchmark_target_url":            "https://speed.cloudflare.com/__down?bytes=10000000",
+		"benchmark_max_bytes":             "10485760",
+		"benchmark_timeout_seconds":       "30",
+		"benchmark_history_days":          "30",
+		"benchmark_ranking_enabled":       "false",
+		"forward_capacity_policy":         "refuse",
+		"billing_auto_renew_enabled":      "false",
+		"billing_auto_renew_lead_hours":   "24",
+		"billing_currency":                "",
+		"invoice_pdf_font_path":           "",
+		"payment_webhook_secret":          "",
+		"host_ip_cooldown_hours":          "24",
+		"host_ip_max_customers":           "0",
+		"host_ip_max_items":               "0",
+		"trial_max_days":                  "3",
+		"trial_max_per_customer":          "1",
+		"trial_grace_hours":               "24",
+		"recycle_bin_retention_days":      "30",
+		"order_history_keep":              "50",
+		"integrity_enabled":               "false",
+		"integrity_interval_minutes":      "360",
+		"integrity_auto_repair":           "false",
+		"integrity_history_days":          "30",
+		"expiry_grace_hours":              "0",
+		"expiry_final_hours":              "0",
+		"reminder_offsets":                "7d,3d,1d,expired",
+		"reminder_subject":                "",
+		"reminder_template":               "",
+		"reminder_admin_bark":             "true",
+		"smtp_host":                       "",
+		"smtp_port":                       "587",
+		"smtp_username":                   "",
+		"smtp_password":                   "",
+		"smtp_from":                       "",
+		"telegram_bot_token":              "",
 	}
 	for k, v := range extraDefaults {
 		defaults[k] = v